@@ -0,0 +1,205 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/leonardinius/smtpd-proxy/app/metrics"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+// HealthCheckTimeout upper bound for a single upstream health check.
+var HealthCheckTimeout = 30 * time.Second
+
+var (
+	errMissingToken  = errors.New("admin token is required")
+	errInvalidToken  = errors.New("invalid or missing bearer token")
+	errMissingWeight = errors.New("weight is required")
+)
+
+// Registry runtime inspection and control of upstream entries.
+type Registry interface {
+	Entries() []upstream.EntryStatus
+	Entry(id string) (upstream.EntryStatus, error)
+	SetState(ctx context.Context, id string, state upstream.State) (upstream.EntryStatus, error)
+	SetWeight(ctx context.Context, id string, weight int) (upstream.EntryStatus, error)
+	HealthCheck(ctx context.Context, id string) (upstream.EntryStatus, error)
+}
+
+var _ Registry = (*upstream.RegistryMap)(nil)
+
+type handler struct {
+	registry func() Registry
+	logger   *slog.Logger
+}
+
+// NewHandler admin API, every request must carry "Authorization: Bearer <token>".
+// registry returns the current registry, which is replaced on configuration reload.
+//
+//	GET  /upstreams                       list entries
+//	GET  /upstreams/{id}                  single entry, by UID or name
+//	POST /upstreams/{id}/drain            stop routing new messages, let in-flight finish
+//	POST /upstreams/{id}/disable          stop routing new messages
+//	POST /upstreams/{id}/enable           resume routing
+//	PUT  /upstreams/{id}/weight           {"weight": 10}
+//	POST /upstreams/{id}/health-check     probe the upstream without sending
+func NewHandler(logger *slog.Logger, token string, registry func() Registry) (http.Handler, error) {
+	if token == "" {
+		return nil, errMissingToken
+	}
+
+	h := &handler{registry: registry, logger: logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /upstreams", h.list)
+	mux.HandleFunc("GET /upstreams/{id}", h.get)
+	mux.HandleFunc("POST /upstreams/{id}/drain", h.setState(upstream.StateDraining))
+	mux.HandleFunc("POST /upstreams/{id}/disable", h.setState(upstream.StateDisabled))
+	mux.HandleFunc("POST /upstreams/{id}/enable", h.setState(upstream.StateActive))
+	mux.HandleFunc("PUT /upstreams/{id}/weight", h.setWeight)
+	mux.HandleFunc("POST /upstreams/{id}/health-check", h.healthCheck)
+	return requireToken(token, mux), nil
+}
+
+// requireToken rejects requests without matching bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	expected := []byte(token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="smtpd-proxy"`)
+			writeError(w, http.StatusUnauthorized, errInvalidToken)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	statuses := h.registry().Entries()
+	entries := make([]entry, 0, len(statuses))
+	for _, s := range statuses {
+		entries = append(entries, newEntry(s))
+	}
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request) {
+	status, err := h.registry().Entry(r.PathValue("id"))
+	h.reply(w, r, status, err)
+}
+
+func (h *handler) setState(state upstream.State) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status, err := h.registry().SetState(r.Context(), r.PathValue("id"), state)
+		h.reply(w, r, status, err)
+	}
+}
+
+func (h *handler) setWeight(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Weight *int `json:"weight"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if body.Weight == nil {
+		writeError(w, http.StatusBadRequest, errMissingWeight)
+		return
+	}
+
+	status, err := h.registry().SetWeight(r.Context(), r.PathValue("id"), *body.Weight)
+	h.reply(w, r, status, err)
+}
+
+func (h *handler) healthCheck(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), HealthCheckTimeout)
+	defer cancel()
+
+	status, err := h.registry().HealthCheck(ctx, r.PathValue("id"))
+	h.reply(w, r, status, err)
+}
+
+func (h *handler) reply(w http.ResponseWriter, r *http.Request, status upstream.EntryStatus, err error) {
+	switch {
+	case err == nil:
+		writeJSON(w, http.StatusOK, newEntry(status))
+	case errors.Is(err, upstream.ErrEntryNotFound):
+		writeError(w, http.StatusNotFound, err)
+	case errors.Is(err, upstream.ErrNotWeighted):
+		writeError(w, http.StatusConflict, err)
+	case errors.Is(err, upstream.ErrInvalidWeight), errors.Is(err, upstream.ErrInvalidState):
+		writeError(w, http.StatusBadRequest, err)
+	default:
+		h.logger.ErrorContext(r.Context(), "admin request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+		writeError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// entry JSON representation of upstream.EntryStatus.
+type entry struct {
+	UID              string `json:"uid"`
+	Name             string `json:"name,omitempty"`
+	Type             string `json:"type"`
+	Role             string `json:"role"`
+	State            string `json:"state"`
+	Weight           int    `json:"weight"`
+	ConfiguredWeight int    `json:"configured_weight"`
+	InFlight         int64  `json:"in_flight"`
+	Forwarded        int64  `json:"forwarded"`
+	Failed           int64  `json:"failed"`
+	Health           health `json:"health"`
+}
+
+type health struct {
+	Status    string     `json:"status"`
+	Error     string     `json:"error,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+	LatencyMs int64      `json:"latency_ms,omitempty"`
+}
+
+func newEntry(s upstream.EntryStatus) entry {
+	e := entry{
+		UID:              s.UID,
+		Name:             s.Name,
+		Type:             s.Type,
+		Role:             metrics.RolePrimary,
+		State:            string(s.State),
+		Weight:           s.Weight,
+		ConfiguredWeight: s.ConfiguredWeight,
+		InFlight:         s.InFlight,
+		Forwarded:        s.Forwarded,
+		Failed:           s.Failed,
+		Health: health{
+			Status:    string(s.Health.Status),
+			Error:     s.Health.Error,
+			LatencyMs: s.Health.Latency.Milliseconds(),
+		},
+	}
+	switch {
+	case s.Mirror:
+		e.Role = metrics.RoleMirror
+	case s.Shadow:
+		e.Role = metrics.RoleShadow
+	}
+	if !s.Health.CheckedAt.IsZero() {
+		e.Health.CheckedAt = &s.Health.CheckedAt
+	}
+	return e
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
@@ -0,0 +1,118 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const token = "s3cret"
+
+type noopForwarder struct{}
+
+func (noopForwarder) Forward(context.Context, *upstream.Email) error {
+	return nil
+}
+
+func (noopForwarder) HealthCheck(context.Context) error {
+	return nil
+}
+
+func newTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	reg := upstream.NewEmptyRegistry(logger)
+	reg.AddForwarder(noopForwarder{}, 10, upstream.WithName("primary"), upstream.WithType("smtp"))
+	reg.AddForwarder(noopForwarder{}, 0, upstream.WithName("archive"), upstream.WithType("s3"), upstream.AsMirror())
+
+	handler, err := NewHandler(logger, token, func() Registry { return reg })
+	require.NoError(t, err)
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func do(t *testing.T, srv *httptest.Server, method, path, body string) (int, []byte) {
+	t.Helper()
+	req, err := http.NewRequestWithContext(context.Background(), method, srv.URL+path, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, data
+}
+
+func TestRequiresBearerToken(t *testing.T) {
+	_, err := NewHandler(slog.Default(), "", nil)
+	require.ErrorIs(t, err, errMissingToken)
+
+	srv := newTestServer(t)
+	for _, header := range []string{"", "Bearer wrong", token} {
+		req, err := http.NewRequestWithContext(context.Background(), http.MethodGet, srv.URL+"/upstreams", http.NoBody)
+		require.NoError(t, err)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode, header)
+	}
+}
+
+func TestListAndControlUpstreams(t *testing.T) {
+	srv := newTestServer(t)
+
+	code, body := do(t, srv, http.MethodGet, "/upstreams", "")
+	require.Equal(t, http.StatusOK, code)
+	var entries []entry
+	require.NoError(t, json.Unmarshal(body, &entries))
+	require.Len(t, entries, 2)
+	assert.Equal(t, "primary", entries[0].Name)
+	assert.Equal(t, "active", entries[0].State)
+	assert.Equal(t, 10, entries[0].Weight)
+	assert.Equal(t, "unknown", entries[0].Health.Status)
+	assert.Equal(t, "mirror", entries[1].Role)
+
+	var e entry
+	code, body = do(t, srv, http.MethodPost, "/upstreams/primary/drain", "")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(body, &e))
+	assert.Equal(t, "drained", e.State)
+
+	code, body = do(t, srv, http.MethodPost, "/upstreams/"+entries[0].UID+"/enable", "")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(body, &e))
+	assert.Equal(t, "active", e.State)
+
+	code, body = do(t, srv, http.MethodPut, "/upstreams/primary/weight", `{"weight": 3}`)
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(body, &e))
+	assert.Equal(t, 3, e.Weight)
+	assert.Equal(t, 10, e.ConfiguredWeight)
+
+	code, body = do(t, srv, http.MethodPost, "/upstreams/archive/health-check", "")
+	require.Equal(t, http.StatusOK, code)
+	require.NoError(t, json.Unmarshal(body, &e))
+	assert.Equal(t, "ok", e.Health.Status)
+	assert.NotNil(t, e.Health.CheckedAt)
+
+	code, _ = do(t, srv, http.MethodPut, "/upstreams/archive/weight", `{"weight": 3}`)
+	assert.Equal(t, http.StatusConflict, code)
+	code, _ = do(t, srv, http.MethodPut, "/upstreams/primary/weight", `{}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(t, srv, http.MethodPost, "/upstreams/missing/disable", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
@@ -0,0 +1,160 @@
+package audit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message outcomes.
+const (
+	StatusDelivered = "delivered"
+	// StatusPartial some recipients were delivered, the others failed.
+	StatusPartial  = "partial"
+	StatusFailed   = "failed"
+	StatusRejected = "rejected"
+	// StatusQuarantined failed verification, delivered through the quarantine upstream.
+	StatusQuarantined = "quarantined"
+	// StatusDropped all recipients were dropped by the staging allowlist, nothing was delivered.
+	StatusDropped = "dropped"
+	// StatusBounced permanent upstream failure, the sender got a delivery status notification and the client a positive reply.
+	StatusBounced = "bounced"
+)
+
+// Record single message audit entry, one JSON line.
+type Record struct {
+	Time      time.Time `json:"time"`
+	SessionID string    `json:"session_id"`
+	// MessageID proxy assigned message ID, see logging.NewMessageID.
+	MessageID string `json:"message_id"`
+	// HeaderMessageID Message-Id header.
+	HeaderMessageID string   `json:"header_message_id,omitempty"`
+	ClientIP        string   `json:"client_ip"`
+	User            string   `json:"user,omitempty"`
+	From            string   `json:"from"`
+	To              []string `json:"to"`
+	// SubjectHash SHA-256 of the subject, the subject itself is not recorded.
+	SubjectHash string    `json:"subject_hash,omitempty"`
+	Size        int       `json:"size"`
+	Upstream    *Upstream `json:"upstream,omitempty"`
+	// ProviderMessageIDs IDs assigned by the upstream, e.g. SES MessageId or SMTP queue ID.
+	ProviderMessageIDs []string `json:"provider_message_ids,omitempty"`
+	Status             string   `json:"status"`
+	// Failed recipients of a partial delivery.
+	Failed []string `json:"failed,omitempty"`
+	Error  string   `json:"error,omitempty"`
+	// ReceivedAt MAIL FROM time.
+	ReceivedAt time.Time `json:"received_at"`
+	// DurationMS from MAIL FROM until the reply to DATA, ForwardMS upstream forward only.
+	DurationMS int64 `json:"duration_ms"`
+	ForwardMS  int64 `json:"forward_ms"`
+}
+
+// Upstream the entry chosen for the message.
+type Upstream struct {
+	UID  string `json:"uid"`
+	Name string `json:"name,omitempty"`
+	Type string `json:"type"`
+}
+
+// HashSubject SHA-256 hex digest of the subject.
+func HashSubject(subject string) string {
+	if subject == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(subject))
+	return hex.EncodeToString(sum[:])
+}
+
+// Recorder appends audit records.
+type Recorder interface {
+	Record(ctx context.Context, r *Record) error
+}
+
+// Log append-only JSON lines audit file.
+type Log struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+var _ Recorder = (*Log)(nil)
+
+// Open opens or creates the audit file for appending.
+func Open(path string) (*Log, error) {
+	file, err := os.OpenFile(filepath.Clean(path), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Log{file: file}, nil
+}
+
+// Record appends r as a single line.
+func (l *Log) Record(_ context.Context, r *Record) error {
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err = l.file.Write(line)
+	return err
+}
+
+// Close closes the audit file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.file.Close()
+}
+
+// Filter query criteria, all non-empty criteria must match.
+type Filter struct {
+	// Recipient envelope recipient, case insensitive.
+	Recipient string
+	// MessageID Message-Id header, with or without angle brackets, or the proxy assigned message ID.
+	MessageID string
+}
+
+// Match reports whether r matches the filter.
+func (f *Filter) Match(r *Record) bool {
+	if f.Recipient != "" && !slices.ContainsFunc(r.To, func(to string) bool { return strings.EqualFold(to, f.Recipient) }) {
+		return false
+	}
+	if f.MessageID != "" {
+		id := strings.Trim(f.MessageID, "<>")
+		if id != strings.Trim(r.HeaderMessageID, "<>") && id != r.MessageID {
+			return false
+		}
+	}
+	return true
+}
+
+// Query calls fn for every record of the audit log matching the filter, in order.
+func Query(r io.Reader, f Filter, fn func(*Record) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var record Record
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return err
+		}
+		if !f.Match(&record) {
+			continue
+		}
+		if err := fn(&record); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
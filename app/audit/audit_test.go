@@ -0,0 +1,54 @@
+package audit
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLogAppendAndQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	records := []*Record{
+		{MessageID: "a1-1", HeaderMessageID: "<one@example.com>", To: []string{"Alice@example.com"}, Status: StatusDelivered},
+		{MessageID: "a1-2", HeaderMessageID: "<two@example.com>", To: []string{"bob@example.com"}, Status: StatusFailed},
+		{MessageID: "b2-1", HeaderMessageID: "<three@example.com>", To: []string{"bob@example.com", "alice@example.com"}},
+	}
+
+	// appended across reopen
+	for _, batch := range [][]*Record{records[:2], records[2:]} {
+		log, err := Open(path)
+		require.NoError(t, err)
+		for _, r := range batch {
+			require.NoError(t, log.Record(context.Background(), r))
+		}
+		require.NoError(t, log.Close())
+	}
+
+	query := func(f Filter) []string {
+		file, err := os.Open(path)
+		require.NoError(t, err)
+		defer file.Close()
+		var ids []string
+		require.NoError(t, Query(file, f, func(r *Record) error {
+			ids = append(ids, r.MessageID)
+			return nil
+		}))
+		return ids
+	}
+
+	assert.Equal(t, []string{"a1-1", "a1-2", "b2-1"}, query(Filter{}))
+	assert.Equal(t, []string{"a1-1", "b2-1"}, query(Filter{Recipient: "alice@EXAMPLE.com"}))
+	assert.Equal(t, []string{"a1-2"}, query(Filter{MessageID: "two@example.com"}))
+	assert.Equal(t, []string{"b2-1"}, query(Filter{MessageID: "b2-1", Recipient: "bob@example.com"}))
+	assert.Empty(t, query(Filter{MessageID: "<one@example.com>", Recipient: "bob@example.com"}))
+}
+
+func TestHashSubject(t *testing.T) {
+	assert.Empty(t, HashSubject(""))
+	assert.Len(t, HashSubject("Invoice #42"), 64)
+	assert.NotEqual(t, HashSubject("Invoice #42"), HashSubject("Invoice #43"))
+}
@@ -0,0 +1,165 @@
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const multipart = "From: app@example.com\r\n" +
+	"To: user@example.net\r\n" +
+	"Subject: Welcome\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=b1\r\n" +
+	"\r\n" +
+	"--b1\r\n" +
+	"Content-Type: multipart/alternative; boundary=b2\r\n" +
+	"\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/plain; charset=utf-8\r\n" +
+	"\r\n" +
+	"Hello text\r\n" +
+	"--b2\r\n" +
+	"Content-Type: text/html; charset=utf-8\r\n" +
+	"\r\n" +
+	"<p>Hello html</p>\r\n" +
+	"--b2--\r\n" +
+	"--b1\r\n" +
+	"Content-Type: text/csv\r\n" +
+	"Content-Disposition: attachment; filename=\"report.csv\"\r\n" +
+	"\r\n" +
+	"a,b\r\n" +
+	"--b1--\r\n"
+
+func TestStoreEvictsOldest(t *testing.T) {
+	for name, dir := range map[string]string{"memory": "", "dir": t.TempDir()} {
+		t.Run(name, func(t *testing.T) {
+			store, err := Open(dir, 2)
+			require.NoError(t, err)
+			first, err := store.Add(Message{From: "a@example.com", Subject: "first"}, []byte("Subject: first\r\n\r\n"))
+			require.NoError(t, err)
+			_, err = store.Add(Message{From: "b@example.com", To: []string{"x@example.net"}, Subject: "second"}, []byte("Subject: second\r\n\r\n"))
+			require.NoError(t, err)
+			third, err := store.Add(Message{From: "c@example.com", Subject: "third"}, []byte("Subject: third\r\n\r\n"))
+			require.NoError(t, err)
+
+			list := store.List("")
+			require.Len(t, list, 2)
+			assert.Equal(t, "third", list[0].Subject, "newest first")
+			assert.Equal(t, "second", list[1].Subject)
+			_, _, err = store.Get(first.ID)
+			require.ErrorIs(t, err, ErrNotFound)
+
+			msg, raw, err := store.Get(third.ID)
+			require.NoError(t, err)
+			assert.Equal(t, "Subject: third\r\n\r\n", string(raw))
+			assert.Equal(t, len(raw), msg.Size)
+
+			assert.Len(t, store.List("X@EXAMPLE"), 1)
+			assert.Empty(t, store.List("nothing"))
+
+			require.NoError(t, store.Delete(third.ID))
+			require.ErrorIs(t, store.Delete(third.ID), ErrNotFound)
+			assert.Len(t, store.List(""), 1)
+		})
+	}
+}
+
+func TestStoreReopensDir(t *testing.T) {
+	dir := t.TempDir()
+	store, err := Open(dir, 10)
+	require.NoError(t, err)
+	msg, err := store.Add(Message{From: "a@example.com", Subject: "kept"}, []byte(multipart))
+	require.NoError(t, err)
+
+	reopened, err := Open(dir, 10)
+	require.NoError(t, err)
+	list := reopened.List("")
+	require.Len(t, list, 1)
+	assert.Equal(t, msg, list[0])
+
+	require.NoError(t, reopened.DeleteAll())
+	files, err := filepath.Glob(filepath.Join(dir, "*"))
+	require.NoError(t, err)
+	assert.Empty(t, files)
+
+	_, err = os.Stat(dir)
+	require.NoError(t, err)
+}
+
+func TestHandler(t *testing.T) {
+	store, err := Open("", 0)
+	require.NoError(t, err)
+	msg, err := store.Add(Message{From: "app@example.com", To: []string{"user@example.net"}, Subject: "Welcome"}, []byte(multipart))
+	require.NoError(t, err)
+	_, err = store.Add(Message{From: "other@example.com", Subject: "Other"}, []byte("Subject: Other\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(NewHandler(slog.New(slog.NewTextHandler(io.Discard, nil)), store))
+	t.Cleanup(srv.Close)
+	do := func(method, path string) (*http.Response, string) {
+		t.Helper()
+		req, err := http.NewRequestWithContext(context.Background(), method, srv.URL+path, http.NoBody)
+		require.NoError(t, err)
+		resp, err := srv.Client().Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp, string(body)
+	}
+
+	resp, body := do(http.MethodGet, "/")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, body, "smtpd-proxy capture")
+
+	_, body = do(http.MethodGet, "/api/messages?q=welcome")
+	var list []Message
+	require.NoError(t, json.Unmarshal([]byte(body), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, msg.ID, list[0].ID)
+
+	_, body = do(http.MethodGet, "/api/messages/"+msg.ID)
+	var d details
+	require.NoError(t, json.Unmarshal([]byte(body), &d))
+	assert.Equal(t, "Welcome", d.Subject)
+	assert.Equal(t, "Hello text", strings.TrimSpace(d.Text))
+	assert.Equal(t, "<p>Hello html</p>", strings.TrimSpace(d.HTML))
+	assert.Equal(t, []attachment{{Filename: "report.csv", ContentType: "text/csv", Size: 3}}, d.Attachments)
+
+	resp, body = do(http.MethodGet, "/api/messages/"+msg.ID+"/html")
+	assert.Contains(t, resp.Header.Get("Content-Security-Policy"), "sandbox")
+	assert.Contains(t, body, "<p>Hello html</p>")
+
+	_, body = do(http.MethodGet, "/api/messages/"+msg.ID+"/text")
+	assert.Contains(t, body, "Hello text")
+
+	_, body = do(http.MethodGet, "/api/messages/"+msg.ID+"/raw")
+	assert.Equal(t, multipart, body)
+
+	resp, body = do(http.MethodGet, "/api/messages/"+msg.ID+"/attachments/0")
+	assert.Equal(t, "attachment; filename=report.csv", resp.Header.Get("Content-Disposition"))
+	assert.Equal(t, "a,b", body)
+
+	resp, _ = do(http.MethodGet, "/api/messages/"+msg.ID+"/attachments/1")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = do(http.MethodDelete, "/api/messages/"+msg.ID)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	resp, _ = do(http.MethodGet, "/api/messages/"+msg.ID)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, _ = do(http.MethodDelete, "/api/messages")
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+	assert.Empty(t, store.List(""))
+}
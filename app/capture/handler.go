@@ -0,0 +1,193 @@
+package capture
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"mime"
+	"net/http"
+	"strconv"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+//go:embed ui.html
+var ui []byte
+
+var errNoAttachment = errors.New("attachment not found")
+
+type handler struct {
+	store  *Store
+	logger *slog.Logger
+}
+
+// NewHandler mail catcher web UI and JSON API. There is no authentication, bind to a loopback address.
+//
+//	GET    /                                    web UI
+//	GET    /api/messages?q=                     list, newest first, q filters by sender, recipient or subject
+//	GET    /api/messages/{id}                   headers, text and HTML parts, attachments
+//	GET    /api/messages/{id}/raw               message as received
+//	GET    /api/messages/{id}/html              HTML part
+//	GET    /api/messages/{id}/text              text part
+//	GET    /api/messages/{id}/attachments/{n}   download attachment, by index
+//	DELETE /api/messages/{id}                   delete message
+//	DELETE /api/messages                        delete all messages
+func NewHandler(logger *slog.Logger, store *Store) http.Handler {
+	h := &handler{store: store, logger: logger}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", h.ui)
+	mux.HandleFunc("GET /api/messages", h.list)
+	mux.HandleFunc("GET /api/messages/{id}", h.get)
+	mux.HandleFunc("GET /api/messages/{id}/raw", h.raw)
+	mux.HandleFunc("GET /api/messages/{id}/html", h.html)
+	mux.HandleFunc("GET /api/messages/{id}/text", h.text)
+	mux.HandleFunc("GET /api/messages/{id}/attachments/{n}", h.attachment)
+	mux.HandleFunc("DELETE /api/messages/{id}", h.delete)
+	mux.HandleFunc("DELETE /api/messages", h.deleteAll)
+	return mux
+}
+
+func (h *handler) ui(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(ui)
+}
+
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.store.List(r.URL.Query().Get("q")))
+}
+
+// details JSON representation of a parsed message.
+type details struct {
+	Message
+	Headers     map[string][]string `json:"headers"`
+	Text        string              `json:"text"`
+	HTML        string              `json:"html"`
+	Attachments []attachment        `json:"attachments"`
+}
+
+type attachment struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type"`
+	Size        int    `json:"size"`
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request) {
+	msg, mail, ok := h.parse(w, r)
+	if !ok {
+		return
+	}
+	d := details{
+		Message:     msg,
+		Headers:     mail.Headers,
+		Text:        string(mail.Text),
+		HTML:        string(mail.HTML),
+		Attachments: make([]attachment, 0, len(mail.Attachments)),
+	}
+	for _, a := range mail.Attachments {
+		d.Attachments = append(d.Attachments, attachment{Filename: a.Filename, ContentType: a.ContentType, Size: len(a.Content)})
+	}
+	writeJSON(w, http.StatusOK, &d)
+}
+
+func (h *handler) raw(w http.ResponseWriter, r *http.Request) {
+	_, raw, err := h.store.Get(r.PathValue("id"))
+	if err != nil {
+		h.writeStoreError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(raw)
+}
+
+func (h *handler) html(w http.ResponseWriter, r *http.Request) {
+	_, mail, ok := h.parse(w, r)
+	if !ok {
+		return
+	}
+	// captured HTML is untrusted, no scripts and no requests to the catcher.
+	w.Header().Set("Content-Security-Policy", "sandbox; default-src 'none'; img-src * data:; style-src 'unsafe-inline'")
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	_, _ = w.Write(mail.HTML)
+}
+
+func (h *handler) text(w http.ResponseWriter, r *http.Request) {
+	_, mail, ok := h.parse(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write(mail.Text)
+}
+
+func (h *handler) attachment(w http.ResponseWriter, r *http.Request) {
+	_, mail, ok := h.parse(w, r)
+	if !ok {
+		return
+	}
+	n, err := strconv.Atoi(r.PathValue("n"))
+	if err != nil || n < 0 || n >= len(mail.Attachments) {
+		writeError(w, http.StatusNotFound, errNoAttachment)
+		return
+	}
+	a := mail.Attachments[n]
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": a.Filename}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	_, _ = w.Write(a.Content)
+}
+
+func (h *handler) delete(w http.ResponseWriter, r *http.Request) {
+	if err := h.store.Delete(r.PathValue("id")); err != nil {
+		h.writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *handler) deleteAll(w http.ResponseWriter, r *http.Request) {
+	if err := h.store.DeleteAll(); err != nil {
+		h.writeStoreError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// parse reads and parses the message of the request, replies with the error otherwise.
+func (h *handler) parse(w http.ResponseWriter, r *http.Request) (Message, *upstream.Email, bool) {
+	msg, raw, err := h.store.Get(r.PathValue("id"))
+	if err != nil {
+		h.writeStoreError(w, r, err)
+		return Message{}, nil, false
+	}
+	mail, err := upstream.NewEmailFromReader(bytes.NewReader(raw))
+	if err != nil {
+		writeError(w, http.StatusUnprocessableEntity, err)
+		return Message{}, nil, false
+	}
+	return msg, mail, true
+}
+
+func (h *handler) writeStoreError(w http.ResponseWriter, r *http.Request, err error) {
+	if errors.Is(err, ErrNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	h.logger.ErrorContext(r.Context(), "capture request failed", "method", r.Method, "path", r.URL.Path, "err", err)
+	writeError(w, http.StatusInternalServerError, err)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
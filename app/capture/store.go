@@ -0,0 +1,228 @@
+package capture
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultMaxMessages messages kept when the limit is not set, older ones are evicted.
+const DefaultMaxMessages = 1000
+
+// ErrNotFound no captured message with the ID.
+var ErrNotFound = errors.New("message not found")
+
+// Message captured message summary.
+type Message struct {
+	ID         string    `json:"id"`
+	ReceivedAt time.Time `json:"received_at"`
+	// From and To envelope sender and recipients.
+	From    string   `json:"from"`
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	Size    int      `json:"size"`
+}
+
+// matches reports whether the sender, a recipient or the subject contains query, case insensitive.
+func (m *Message) matches(query string) bool {
+	if query == "" {
+		return true
+	}
+	query = strings.ToLower(query)
+	for _, field := range append([]string{m.From, m.Subject}, m.To...) {
+		if strings.Contains(strings.ToLower(field), query) {
+			return true
+		}
+	}
+	return false
+}
+
+// Store captured messages, in memory or in a directory: <id>.eml raw message and <id>.json summary.
+// The oldest messages are evicted beyond the limit.
+type Store struct {
+	dir string
+	max int
+
+	mu sync.RWMutex
+	// messages oldest first, raw messages by ID unless kept in dir.
+	messages []*Message
+	raw      map[string][]byte
+}
+
+// Open creates store, in memory when dir is empty, otherwise loads the messages kept in dir.
+func Open(dir string, maxMessages int) (*Store, error) {
+	if maxMessages <= 0 {
+		maxMessages = DefaultMaxMessages
+	}
+	s := &Store{dir: dir, max: maxMessages, raw: map[string][]byte{}}
+	if dir == "" {
+		return s, nil
+	}
+
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		data, err := os.ReadFile(filepath.Clean(file))
+		if err != nil {
+			return nil, err
+		}
+		var msg Message
+		if err := json.Unmarshal(data, &msg); err != nil {
+			return nil, fmt.Errorf("%s: %w", file, err)
+		}
+		s.messages = append(s.messages, &msg)
+	}
+	slices.SortFunc(s.messages, func(a, b *Message) int {
+		return a.ReceivedAt.Compare(b.ReceivedAt)
+	})
+	return s, s.evict()
+}
+
+// Add stores the raw message, assigns its ID and receive time.
+func (s *Store) Add(msg Message, raw []byte) (Message, error) {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	msg.ID = hex.EncodeToString(id)
+	msg.ReceivedAt = time.Now().UTC()
+	msg.Size = len(raw)
+
+	if s.dir != "" {
+		summary, err := json.Marshal(&msg)
+		if err != nil {
+			return Message{}, err
+		}
+		if err := os.WriteFile(s.path(msg.ID, ".eml"), raw, 0o600); err != nil {
+			return Message{}, err
+		}
+		if err := os.WriteFile(s.path(msg.ID, ".json"), summary, 0o600); err != nil {
+			return Message{}, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages = append(s.messages, &msg)
+	if s.dir == "" {
+		s.raw[msg.ID] = raw
+	}
+	return msg, s.evict()
+}
+
+// List messages matching query, see Message.matches, newest first.
+func (s *Store) List(query string) []Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := make([]Message, 0, len(s.messages))
+	for i := len(s.messages) - 1; i >= 0; i-- {
+		if s.messages[i].matches(query) {
+			list = append(list, *s.messages[i])
+		}
+	}
+	return list
+}
+
+// Get message summary and raw message.
+func (s *Store) Get(id string) (Message, []byte, error) {
+	s.mu.RLock()
+	i := s.index(id)
+	if i < 0 {
+		s.mu.RUnlock()
+		return Message{}, nil, ErrNotFound
+	}
+	msg, raw := *s.messages[i], s.raw[id]
+	s.mu.RUnlock()
+
+	if s.dir == "" {
+		return msg, raw, nil
+	}
+	raw, err := os.ReadFile(s.path(id, ".eml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return Message{}, nil, ErrNotFound
+	}
+	return msg, raw, err
+}
+
+// Delete removes the message.
+func (s *Store) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(id)
+	if i < 0 {
+		return ErrNotFound
+	}
+	s.messages = slices.Delete(s.messages, i, i+1)
+	return s.remove(id)
+}
+
+// DeleteAll removes all messages.
+func (s *Store) DeleteAll() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var errs []error
+	for _, msg := range s.messages {
+		errs = append(errs, s.remove(msg.ID))
+	}
+	s.messages = nil
+	return errors.Join(errs...)
+}
+
+// evict removes the oldest messages beyond the limit, s.mu must be held.
+func (s *Store) evict() error {
+	var errs []error
+	for len(s.messages) > s.max {
+		errs = append(errs, s.remove(s.messages[0].ID))
+		s.messages = s.messages[1:]
+	}
+	return errors.Join(errs...)
+}
+
+// remove deletes the message content, s.mu must be held.
+func (s *Store) remove(id string) error {
+	delete(s.raw, id)
+	if s.dir == "" {
+		return nil
+	}
+	var errs []error
+	for _, ext := range []string{".eml", ".json"} {
+		if err := os.Remove(s.path(id, ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) index(id string) int {
+	return slices.IndexFunc(s.messages, func(m *Message) bool { return m.ID == id })
+}
+
+func (s *Store) path(id, ext string) string {
+	return filepath.Join(s.dir, id+ext)
+}
+
+// storeKey context.Context key for the store of capture upstreams.
+type storeKey struct{}
+
+// WithStore returns a copy of ctx carrying the store capture upstreams add messages to.
+func WithStore(ctx context.Context, store *Store) context.Context {
+	return context.WithValue(ctx, storeKey{}, store)
+}
+
+// StoreFromContext returns the Store value stored in ctx, if any.
+func StoreFromContext(ctx context.Context) (*Store, bool) {
+	store, ok := ctx.Value(storeKey{}).(*Store)
+	return store, ok && store != nil
+}
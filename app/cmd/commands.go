@@ -0,0 +1,172 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/leonardinius/smtpd-proxy/app/audit"
+	"github.com/leonardinius/smtpd-proxy/app/config"
+	"github.com/leonardinius/smtpd-proxy/app/metrics"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+var (
+	errUpstreamCheckFailed = errors.New("upstream check failed")
+	errNoAuditLog          = errors.New("no audit log, set audit.file in configuration or --file")
+)
+
+// ValidateCommand parses configuration, applies defaults, validates it and loads DKIM keys, exit code only.
+type ValidateCommand struct{}
+
+// CheckUpstreamsCommand connects and authenticates to every upstream without sending a message.
+type CheckUpstreamsCommand struct{}
+
+// SendTestCommand delivers a generated test message through a single upstream.
+type SendTestCommand struct {
+	To       []string `description:"recipient address, repeat for multiple"      long:"to"       required:"true"`
+	From     string   `description:"sender address, smtpd-proxy@<ehlo> by default" long:"from"`
+	Upstream string   `description:"upstream name or uid"                        long:"upstream" required:"true"`
+}
+
+// AuditCommand prints audit log records matching the criteria, as JSON lines.
+type AuditCommand struct {
+	Recipient string `description:"envelope recipient"                                   long:"recipient"`
+	MessageID string `description:"Message-Id header or proxy message ID"                 long:"message-id"`
+	File      string `description:"audit log path, audit.file from configuration by default" long:"file"`
+}
+
+func runCommand(ctx context.Context, name string, cfg *config.Config, opts *Opts) error {
+	switch name {
+	case "validate":
+		_, err := newDKIMSigner(cfg.ServerConfig.DKIM)
+		return err
+	case "check-upstreams":
+		return checkUpstreams(ctx, cfg)
+	case "send-test":
+		return sendTest(ctx, cfg, &opts.SendTest)
+	case "audit":
+		return queryAudit(cfg, &opts.Audit)
+	default:
+		return fmt.Errorf("unknown command: %s", name)
+	}
+}
+
+// checkUpstreams probes every upstream supporting health checks and prints the outcome.
+func checkUpstreams(ctx context.Context, cfg *config.Config) error {
+	ctx, _, err := withCaptureStore(ctx, &cfg.ServerConfig.Capture)
+	if err != nil {
+		return err
+	}
+	reg, err := createUpstreamServers(ctx, slog.Default(), cfg.ServerConfig.UpstreamServers)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	for _, entry := range reg.Entries() {
+		status, err := reg.HealthCheck(ctx, entry.UID)
+		if err != nil {
+			return err
+		}
+		health := status.Health
+		fmt.Printf("%-20s %-6s %-8s %-11s %8s %s\n",
+			displayName(&status.EntryMeta), status.Type, role(&status.EntryMeta), health.Status,
+			health.Latency.Round(time.Millisecond), health.Error)
+		if health.Status == upstream.HealthFailed {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%w: %d of %d", errUpstreamCheckFailed, failed, len(reg.Entries()))
+	}
+	return nil
+}
+
+// sendTest delivers a generated test message through the chosen upstream and prints the outcome and timing.
+func sendTest(ctx context.Context, cfg *config.Config, c *SendTestCommand) error {
+	ctx, _, err := withCaptureStore(ctx, &cfg.ServerConfig.Capture)
+	if err != nil {
+		return err
+	}
+	reg, err := createUpstreamServers(ctx, slog.Default(), cfg.ServerConfig.UpstreamServers)
+	if err != nil {
+		return err
+	}
+	entry, err := reg.Entry(c.Upstream)
+	if err != nil {
+		return err
+	}
+
+	from := c.From
+	if from == "" {
+		from = "smtpd-proxy@" + ehlo(&cfg.ServerConfig)
+	}
+	hostname, _ := os.Hostname()
+	mail := &upstream.Email{
+		From:    from,
+		To:      c.To,
+		Subject: "smtpd-proxy test message via " + displayName(&entry.EntryMeta),
+		Text: fmt.Appendf(nil, "Test message sent by smtpd-proxy %s-%s from %s at %s through upstream %s (%s).\n",
+			BRANCH, COMMIT, hostname, time.Now().Format(time.RFC3339), displayName(&entry.EntryMeta), entry.Type),
+		Headers: map[string][]string{},
+	}
+	ctx = upstream.WithEnvelope(ctx, &upstream.Envelope{From: upstream.AddressOf(from), To: c.To})
+
+	start := time.Now()
+	err = reg.ForwardTo(ctx, entry.UID, mail)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		fmt.Printf("%s (%s): failed after %s: %v\n", displayName(&entry.EntryMeta), entry.Type, elapsed, err)
+		return err
+	}
+	fmt.Printf("%s (%s): delivered to %d recipient(s) in %s\n",
+		displayName(&entry.EntryMeta), entry.Type, len(c.To), elapsed)
+	return nil
+}
+
+// queryAudit prints matching audit records.
+func queryAudit(cfg *config.Config, c *AuditCommand) error {
+	path := c.File
+	if path == "" {
+		path = cfg.ServerConfig.Audit.File
+	}
+	if path == "" {
+		return errNoAuditLog
+	}
+
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	enc := json.NewEncoder(os.Stdout)
+	return audit.Query(file, audit.Filter{Recipient: c.Recipient, MessageID: c.MessageID}, func(r *audit.Record) error {
+		return enc.Encode(r)
+	})
+}
+
+func displayName(meta *upstream.EntryMeta) string {
+	if meta.Name != "" {
+		return meta.Name
+	}
+	return meta.UID
+}
+
+func role(meta *upstream.EntryMeta) string {
+	switch {
+	case meta.Mirror:
+		return metrics.RoleMirror
+	case meta.Shadow:
+		return metrics.RoleShadow
+	default:
+		return metrics.RolePrimary
+	}
+}
@@ -0,0 +1,162 @@
+package cmd
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/leonardinius/smtpd-proxy/app/config"
+	"github.com/leonardinius/smtpd-proxy/app/server"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+// ConfigWatchInterval how often the configuration file is polled for changes with --watch-config.
+var ConfigWatchInterval = 2 * time.Second
+
+// configReloader re-reads the configuration file on SIGHUP and, optionally, when the file changes.
+type configReloader struct {
+	path   string
+	watch  bool
+	logger *slog.Logger
+}
+
+// triggers emits a value whenever configuration should be reloaded, until ctx is done.
+func (r *configReloader) triggers(ctx context.Context) <-chan struct{} {
+	ch := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case ch <- struct{}{}:
+		default: // reload already pending
+		}
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				r.logger.InfoContext(ctx, "SIGHUP received, reloading configuration", "path", r.path)
+				notify()
+			}
+		}
+	}()
+
+	if r.watch {
+		go r.poll(ctx, notify)
+	}
+	return ch
+}
+
+// poll notifies when configuration file modification time or size changes.
+func (r *configReloader) poll(ctx context.Context, notify func()) {
+	last, _ := os.Stat(r.path)
+	ticker := time.NewTicker(ConfigWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		info, err := os.Stat(r.path)
+		if err != nil {
+			r.logger.WarnContext(ctx, "configuration watch", "path", r.path, "err", err)
+			continue
+		}
+		if last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size() {
+			r.logger.InfoContext(ctx, "configuration file changed, reloading", "path", r.path)
+			notify()
+		}
+		last = info
+	}
+}
+
+// load parses the configuration file and applies defaults and validation.
+func (r *configReloader) load() (*config.Config, error) {
+	return loadConfig(r.path)
+}
+
+func loadConfig(path string) (*config.Config, error) {
+	cfg, err := config.ParseFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return cfg.LoadDefaults()
+}
+
+// restartRequired lists changed settings which are only applied on start.
+func restartRequired(current, next *config.ProxyServerConfig) []string {
+	var changed []string
+	for _, field := range []struct {
+		name    string
+		changed bool
+	}{
+		{"listen", current.Listen != next.Listen},
+		{"ehlo", current.Ehlo != next.Ehlo},
+		{"server-cert", current.ServerCertificatePath != next.ServerCertificatePath},
+		{"server-key", current.ServerKeyPath != next.ServerKeyPath},
+		{"metrics", current.Metrics != next.Metrics},
+		{"tracing", current.Tracing != next.Tracing},
+		{"admin", current.Admin != next.Admin},
+		{"logging", current.Logging != next.Logging},
+		{"audit", current.Audit != next.Audit},
+		{"capture", current.Capture != next.Capture},
+		{"dsn", current.DSN != next.DSN},
+		{"limits", current.Limits != next.Limits},
+		{"messages", !reflect.DeepEqual(current.Messages, next.Messages)},
+		{"policy.suppression.sqlite", current.Policy.Suppression.SQLite != next.Policy.Suppression.SQLite},
+		{"policy.suppression.sns", !reflect.DeepEqual(current.Policy.Suppression.SNS, next.Policy.Suppression.SNS)},
+	} {
+		if field.changed {
+			changed = append(changed, field.name)
+		}
+	}
+	return changed
+}
+
+// retiredRegistries registries replaced by reloads. Sessions in progress may still forward through them,
+// they are dropped once released by the sessions and their background forwards complete.
+type retiredRegistries struct {
+	mu   sync.Mutex
+	regs map[*upstream.RegistryMap]struct{}
+}
+
+// retire keeps reg until it is released, or for shutdown to wait for when ctx is done first.
+func (r *retiredRegistries) retire(ctx context.Context, srv *server.SrvBackend, reg *upstream.RegistryMap) {
+	r.mu.Lock()
+	if r.regs == nil {
+		r.regs = map[*upstream.RegistryMap]struct{}{}
+	}
+	r.regs[reg] = struct{}{}
+	r.mu.Unlock()
+
+	go func() {
+		if srv.WaitReleased(ctx, reg) != nil || reg.Wait(ctx) != nil {
+			return
+		}
+		r.mu.Lock()
+		delete(r.regs, reg)
+		r.mu.Unlock()
+	}()
+}
+
+// list registries not yet released.
+func (r *retiredRegistries) list() []*upstream.RegistryMap {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	regs := make([]*upstream.RegistryMap, 0, len(r.regs))
+	for reg := range r.regs {
+		regs = append(regs, reg)
+	}
+	return regs
+}
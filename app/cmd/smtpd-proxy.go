@@ -5,17 +5,37 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"hash/fnv"
+	"io"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/hashicorp/go-multierror"
 	"github.com/jessevdk/go-flags"
+	"github.com/leonardinius/smtpd-proxy/app/admin"
+	"github.com/leonardinius/smtpd-proxy/app/audit"
+	"github.com/leonardinius/smtpd-proxy/app/capture"
 	"github.com/leonardinius/smtpd-proxy/app/config"
+	"github.com/leonardinius/smtpd-proxy/app/dkim"
+	"github.com/leonardinius/smtpd-proxy/app/dsn"
+	"github.com/leonardinius/smtpd-proxy/app/limits"
+	"github.com/leonardinius/smtpd-proxy/app/logging"
+	"github.com/leonardinius/smtpd-proxy/app/metrics"
+	"github.com/leonardinius/smtpd-proxy/app/pipeline"
+	"github.com/leonardinius/smtpd-proxy/app/policy"
 	"github.com/leonardinius/smtpd-proxy/app/server"
+	"github.com/leonardinius/smtpd-proxy/app/sns"
+	"github.com/leonardinius/smtpd-proxy/app/staging"
+	"github.com/leonardinius/smtpd-proxy/app/tracing"
 	"github.com/leonardinius/smtpd-proxy/app/upstream"
 	"github.com/leonardinius/smtpd-proxy/app/upstream/forwarder"
+	"github.com/leonardinius/smtpd-proxy/app/verify"
 )
 
 var (
@@ -29,6 +49,12 @@ var (
 type Opts struct {
 	ConfigYamlFile string `default:"smtpd-proxy.yml"  description:"smtpd-proxy.yml configuration path" env:"SMTPD_CONFIG" long:"configuration" required:"true" short:"c"`
 	Verbose        bool   `description:"verbose mode" env:"VERBOSE"                                    long:"verbose"     short:"v"`
+	WatchConfig    bool   `description:"reload configuration when the file changes, in addition to SIGHUP" env:"SMTPD_WATCH_CONFIG" long:"watch-config"`
+
+	Validate       ValidateCommand       `command:"validate"        description:"validate configuration and exit"`
+	CheckUpstreams CheckUpstreamsCommand `command:"check-upstreams" description:"connect and authenticate to every upstream without sending"`
+	SendTest       SendTestCommand       `command:"send-test"       description:"deliver a test message through a single upstream"`
+	Audit          AuditCommand          `command:"audit"           description:"query the message audit log by recipient or Message-ID"`
 }
 
 var (
@@ -40,6 +66,7 @@ var (
 func Main(ctx context.Context, args ...string) error {
 	var opts Opts
 	p := flags.NewParser(&opts, flags.Default)
+	p.SubcommandsOptional = true
 
 	if _, err := p.ParseArgs(args); err != nil {
 		var flagsErr *flags.Error
@@ -51,28 +78,71 @@ func Main(ctx context.Context, args ...string) error {
 		}
 	}
 
-	logger := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	logger, _, err := logging.New(logging.Options{Level: verbosity(opts.Verbose, slog.LevelInfo)})
+	if err != nil {
+		return err
+	}
 	slog.SetDefault(logger)
 
-	fmt.Printf("smtpd-proxy revision %s-%s\n", BRANCH, COMMIT)
 	opts.ConfigYamlFile = filepath.Clean(opts.ConfigYamlFile)
-	logger.InfoContext(ctx, "parsing yaml", "path", opts.ConfigYamlFile)
-	cfg, err := config.ParseFile(opts.ConfigYamlFile)
+	if p.Active == nil {
+		fmt.Printf("smtpd-proxy revision %s-%s\n", BRANCH, COMMIT)
+		logger.InfoContext(ctx, "parsing yaml", "path", opts.ConfigYamlFile)
+	}
+	cfg, err := loadConfig(opts.ConfigYamlFile)
 	if err != nil {
-		logger.ErrorContext(ctx, "failed to parse configuration", "path", opts.ConfigYamlFile, "err", err)
+		if p.Active == nil {
+			logger.ErrorContext(ctx, "failed to load configuration", "path", opts.ConfigYamlFile, "err", err)
+		}
 		return err
 	}
-	cfg, err = cfg.LoadDefaults()
+
+	logger, closer, err := newLogger(&cfg.ServerConfig.Logging, opts.Verbose)
 	if err != nil {
-		logger.ErrorContext(ctx, "failed to load configuration", "path", opts.ConfigYamlFile, "err", err)
 		return err
 	}
+	defer closer.Close()
+	slog.SetDefault(logger)
+
+	if p.Active != nil {
+		return runCommand(ctx, p.Active.Name, cfg, &opts)
+	}
+
+	reloader := &configReloader{path: opts.ConfigYamlFile, watch: opts.WatchConfig, logger: logger}
+	return listenProxyAndServe(ctx, cfg, reloader)
+}
 
-	return ListenProxyAndServe(ctx, cfg)
+// newLogger configured logger, --verbose lowers the level to debug.
+func newLogger(c *config.LoggingConfig, verbose bool) (*slog.Logger, io.Closer, error) {
+	level, err := logging.ParseLevel(c.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	return logging.New(logging.Options{
+		Format:     c.Format,
+		Level:      verbosity(verbose, level),
+		File:       c.File,
+		MaxSizeMB:  c.MaxSizeMB,
+		MaxBackups: c.MaxBackups,
+		MaxAgeDays: c.MaxAgeDays,
+		Compress:   c.Compress,
+	})
+}
+
+func verbosity(verbose bool, level slog.Level) slog.Level {
+	if verbose {
+		return min(level, slog.LevelDebug)
+	}
+	return level
 }
 
 // ListenProxyAndServe run proxy cmd.
 func ListenProxyAndServe(ctx context.Context, c *config.Config) error {
+	return listenProxyAndServe(ctx, c, nil)
+}
+
+// listenProxyAndServe run proxy cmd, reloading upstreams and auth from reloader when it is set.
+func listenProxyAndServe(ctx context.Context, c *config.Config, reloader *configReloader) error {
 	srvConfig := c.ServerConfig
 	logger := slog.Default().With("server", srvConfig.Listen, "ehlo", srvConfig.Ehlo)
 	tlsConfig, err := loadTLSConfig(srvConfig.ServerCertificatePath, srvConfig.ServerKeyPath)
@@ -80,26 +150,121 @@ func ListenProxyAndServe(ctx context.Context, c *config.Config) error {
 		return err
 	}
 
+	// the store outlives upstreams replaced on reload, capture upstreams find it in ctx.
+	ctx, captureStore, err := withCaptureStore(ctx, &srvConfig.Capture)
+	if err != nil {
+		return err
+	}
 	upstreamServers, err := createUpstreamServers(ctx, logger, srvConfig.UpstreamServers)
 	if err != nil {
 		return err
 	}
+	signer, err := newDKIMSigner(srvConfig.DKIM)
+	if err != nil {
+		return err
+	}
+	transforms, err := newPipeline(srvConfig.Transforms)
+	if err != nil {
+		return err
+	}
+	stagingPolicy, err := newStagingPolicy(&srvConfig.Staging)
+	if err != nil {
+		return err
+	}
+	suppressionDB, err := openSuppressionDB(ctx, &srvConfig.Policy.Suppression)
+	if err != nil {
+		return err
+	}
+	if suppressionDB != nil {
+		defer suppressionDB.Close()
+	}
+	envelopePolicy, err := newPolicy(&srvConfig.Policy, suppressionDB)
+	if err != nil {
+		return err
+	}
+	var registry atomic.Pointer[upstream.RegistryMap]
+	registry.Store(upstreamServers)
+
+	srvConfig.Ehlo = ehlo(&srvConfig)
+
+	if m := srvConfig.Metrics; m.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle(m.Path, metrics.Handler())
+		if err := startHTTPServer(ctx, logger, m.Listen, mux); err != nil {
+			return err
+		}
+	}
+
+	if a := srvConfig.Admin; a.Listen != "" {
+		handler, err := admin.NewHandler(logger, a.Token, func() admin.Registry { return registry.Load() })
+		if err != nil {
+			return err
+		}
+		if err := startHTTPServer(ctx, logger, a.Listen, handler); err != nil {
+			return err
+		}
+	}
 
-	if srvConfig.Ehlo == "" {
-		srvConfig.Ehlo, _, _ = net.SplitHostPort(srvConfig.Listen)
+	if n := srvConfig.Policy.Suppression.SNS; n.Listen != "" {
+		mux := http.NewServeMux()
+		mux.Handle(n.Path, sns.NewHandler(logger, suppressionDB, sns.Options{TopicARNs: n.TopicARNs}))
+		if err := startHTTPServer(ctx, logger, n.Listen, mux); err != nil {
+			return err
+		}
 	}
 
+	if captureStore != nil {
+		if err := startHTTPServer(ctx, logger, srvConfig.Capture.Listen, capture.NewHandler(logger, captureStore)); err != nil {
+			return err
+		}
+	}
+
+	if t := srvConfig.Tracing; t.Endpoint != "" {
+		shutdown, err := tracing.Setup(ctx, tracing.Options{
+			Endpoint:    t.Endpoint,
+			Insecure:    t.Insecure,
+			ServiceName: t.ServiceName,
+			SampleRatio: t.SampleRatio,
+		})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := shutdown(context.WithoutCancel(ctx)); err != nil {
+				logger.ErrorContext(ctx, "tracing shutdown", "err", err)
+			}
+		}()
+	}
+
+	opts := append(reloadableOptions(&srvConfig, upstreamServers, signer, transforms, stagingPolicy, envelopePolicy), server.WithTLSConfig(tlsConfig))
+	if path := srvConfig.Audit.File; path != "" {
+		auditLog, err := audit.Open(path)
+		if err != nil {
+			return err
+		}
+		defer auditLog.Close()
+		opts = append(opts, server.WithAudit(auditLog))
+	}
+	if l := srvConfig.Limits; l != (config.LimitsConfig{}) {
+		opts = append(opts, server.WithLimits(limits.New(l.Options())))
+	}
+	if srvConfig.DSN.Enabled {
+		opts = append(opts, server.WithDSN(dsn.New(dsn.Options{ReportingMTA: srvConfig.Ehlo, From: srvConfig.DSN.From})))
+	}
+	opts = append(opts, server.WithMessages(srvConfig.Messages.Messages()))
+
 	srv := server.NewServer(
 		ctx,
 		logger,
 		srvConfig.Listen,
 		srvConfig.Ehlo,
-	).WithOptions(
-		server.WithAnnonAuthAllowed(srvConfig.IsAnonAuthAllowed),
-		server.WithAuth(server.NewHardcodedAuthFunc(srvConfig.Ehlo, srvConfig.Username, srvConfig.Password)),
-		server.WithTLSConfig(tlsConfig),
-		server.WithUpstreamServers(upstreamServers),
-	)
+	).WithOptions(opts...)
+
+	retired := &retiredRegistries{}
+	var reloads <-chan struct{}
+	if reloader != nil {
+		reloads = reloader.triggers(ctx)
+	}
 
 	errCh := make(chan error, 1)
 
@@ -113,17 +278,218 @@ func ListenProxyAndServe(ctx context.Context, c *config.Config) error {
 		errCh <- srv.ListenAndServe()
 	}()
 
-	select {
-	case <-ctx.Done():
-		logger.InfoContext(ctx, "shutting down")
-		if err := srv.Shutdown(); err != nil {
-			logger.ErrorContext(ctx, "failed to shutdown server", "err", err)
+	for {
+		select {
+		case <-ctx.Done():
+			return shutdown(ctx, logger, srv, append(retired.list(), registry.Load()), c.ServerConfig.ShutdownTimeout)
+		case err := <-errCh:
 			return err
+		case <-reloads:
+			next, reg, err := reload(ctx, logger, reloader, c, srv, suppressionDB)
+			if err != nil {
+				logger.ErrorContext(ctx, "configuration reload failed, keeping current configuration",
+					"path", reloader.path, "err", err)
+				continue
+			}
+			c = next
+			retired.retire(ctx, srv, registry.Swap(reg))
 		}
-		return nil
-	case err := <-errCh:
+	}
+}
+
+// shutdown drains SMTP transactions and background mirror forwards of the registries within timeout.
+func shutdown(ctx context.Context,
+	logger *slog.Logger,
+	srv *server.SrvBackend,
+	registries []*upstream.RegistryMap,
+	timeout time.Duration,
+) error {
+	logger.InfoContext(ctx, "shutting down", "timeout", timeout)
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), timeout)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.ErrorContext(ctx, "failed to shutdown server", "err", err)
 		return err
 	}
+	for _, reg := range registries {
+		if err := reg.Wait(ctx); err != nil {
+			logger.ErrorContext(ctx, "background forwards did not complete", "err", err)
+			return err
+		}
+	}
+	logger.InfoContext(ctx, "shutdown complete")
+	return nil
+}
+
+// reload builds upstreams and auth from the re-read configuration and swaps them into the server.
+// Sessions in progress finish with the previous upstreams and auth.
+func reload(ctx context.Context,
+	logger *slog.Logger,
+	reloader *configReloader,
+	current *config.Config,
+	srv *server.SrvBackend,
+	suppressionDB *policy.SQLite,
+) (*config.Config, *upstream.RegistryMap, error) {
+	next, err := reloader.load()
+	if err != nil {
+		return nil, nil, err
+	}
+	srvConfig := next.ServerConfig
+	reg, err := createUpstreamServers(ctx, logger, srvConfig.UpstreamServers)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer, err := newDKIMSigner(srvConfig.DKIM)
+	if err != nil {
+		return nil, nil, err
+	}
+	transforms, err := newPipeline(srvConfig.Transforms)
+	if err != nil {
+		return nil, nil, err
+	}
+	stagingPolicy, err := newStagingPolicy(&srvConfig.Staging)
+	if err != nil {
+		return nil, nil, err
+	}
+	envelopePolicy, err := newPolicy(&srvConfig.Policy, suppressionDB)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if changed := restartRequired(&current.ServerConfig, &srvConfig); len(changed) > 0 {
+		logger.WarnContext(ctx, "configuration changes require restart", "settings", changed)
+	}
+	srvConfig.Ehlo = ehlo(&current.ServerConfig)
+	srv.WithOptions(reloadableOptions(&srvConfig, reg, signer, transforms, stagingPolicy, envelopePolicy)...)
+	logger.InfoContext(ctx, "configuration reloaded", "path", reloader.path, "upstreams", reg.Len())
+	return next, reg, nil
+}
+
+// reloadableOptions server options which can be swapped in at runtime.
+func reloadableOptions(srvConfig *config.ProxyServerConfig,
+	reg upstream.Registry,
+	signer *dkim.Signer,
+	transforms *pipeline.Pipeline,
+	stagingPolicy *staging.Policy,
+	envelopePolicy *policy.Policy,
+) []server.Option {
+	return []server.Option{
+		server.WithAnnonAuthAllowed(srvConfig.IsAnonAuthAllowed),
+		server.WithAuth(server.NewHardcodedAuthFunc(srvConfig.Ehlo, srvConfig.Username, srvConfig.Password)),
+		server.WithUpstreamServers(reg),
+		server.WithDKIM(signer),
+		server.WithVerify(newVerifyPolicy(&srvConfig.Verify, srvConfig.Ehlo)),
+		server.WithPipeline(transforms),
+		server.WithStaging(stagingPolicy),
+		server.WithPolicy(envelopePolicy),
+	}
+}
+
+// openSuppressionDB opens the SQLite suppression list, nil when not configured.
+// The database stays open across configuration reloads.
+func openSuppressionDB(ctx context.Context, c *config.SuppressionConfig) (*policy.SQLite, error) {
+	if c.SQLite == "" {
+		return nil, nil //nolint:nilnil // no database
+	}
+	return policy.OpenSQLite(ctx, c.SQLite)
+}
+
+// newPolicy sender and recipient policy, nil when there are no rules and no suppression lists.
+func newPolicy(c *config.PolicyConfig, suppressionDB *policy.SQLite) (*policy.Policy, error) {
+	opts := policy.Options{}
+	for _, rule := range c.Senders {
+		opts.Senders = append(opts.Senders, policy.SenderRule{User: rule.User, Domains: rule.Domains})
+	}
+	if c.Suppression.File != "" {
+		list, err := policy.LoadFile(c.Suppression.File)
+		if err != nil {
+			return nil, err
+		}
+		opts.Suppression = append(opts.Suppression, list)
+	}
+	if suppressionDB != nil {
+		opts.Suppression = append(opts.Suppression, suppressionDB)
+	}
+	if len(opts.Senders) == 0 && len(opts.Suppression) == 0 {
+		return nil, nil //nolint:nilnil // policy disabled
+	}
+	return policy.New(opts), nil
+}
+
+// withCaptureStore opens the store of the capture upstreams into ctx, when the mail catcher is enabled.
+func withCaptureStore(ctx context.Context, c *config.CaptureConfig) (context.Context, *capture.Store, error) {
+	if c.Listen == "" {
+		return ctx, nil, nil
+	}
+	store, err := capture.Open(c.Dir, c.MaxMessages)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return capture.WithStore(ctx, store), store, nil
+}
+
+// newStagingPolicy staging recipient policy, nil when staging mode is disabled.
+func newStagingPolicy(c *config.StagingConfig) (*staging.Policy, error) {
+	if c.Mode == "" {
+		return nil, nil //nolint:nilnil // staging disabled
+	}
+	return staging.New(c.Options())
+}
+
+// newPipeline message transforms, nil when there are none.
+func newPipeline(transforms []config.TransformConfig) (*pipeline.Pipeline, error) {
+	if len(transforms) == 0 {
+		return nil, nil //nolint:nilnil // transforms disabled
+	}
+	specs := make([]pipeline.Spec, 0, len(transforms))
+	for _, t := range transforms {
+		specs = append(specs, t.Spec())
+	}
+	return pipeline.New(specs)
+}
+
+// newVerifyPolicy inbound verification, nil when disabled. authserv-id defaults to the EHLO domain.
+func newVerifyPolicy(c *config.VerifyConfig, ehlo string) *server.VerifyPolicy {
+	if !c.Enabled {
+		return nil
+	}
+	authServID := c.AuthServID
+	if authServID == "" {
+		authServID = ehlo
+	}
+	return &server.VerifyPolicy{
+		Verifier:   verify.New(verify.Options{AuthServID: authServID, SPF: c.SPF, DMARC: c.DMARC}),
+		OnFail:     c.OnFail,
+		Quarantine: c.Quarantine,
+	}
+}
+
+// newDKIMSigner loads the DKIM keys, nil when there are none.
+func newDKIMSigner(keys []config.DKIMConfig) (*dkim.Signer, error) {
+	if len(keys) == 0 {
+		return nil, nil //nolint:nilnil // signing disabled
+	}
+	dkimKeys := make([]dkim.Key, 0, len(keys))
+	for _, key := range keys {
+		dkimKeys = append(dkimKeys, dkim.Key{
+			Domain:           key.Domain,
+			Selector:         key.Selector,
+			KeyFile:          key.KeyFile,
+			Headers:          key.Headers,
+			Canonicalization: key.Canonicalization,
+		})
+	}
+	return dkim.New(dkimKeys)
+}
+
+// ehlo configured EHLO domain, listen host when not set.
+func ehlo(srvConfig *config.ProxyServerConfig) string {
+	if srvConfig.Ehlo != "" {
+		return srvConfig.Ehlo
+	}
+	host, _, _ := net.SplitHostPort(srvConfig.Listen)
+	return host
 }
 
 func loadTLSConfig(serverCertificatePath, serverKeyPath string) (*tls.Config, error) {
@@ -140,32 +506,31 @@ func loadTLSConfig(serverCertificatePath, serverKeyPath string) (*tls.Config, er
 func createUpstreamServers(ctx context.Context,
 	logger *slog.Logger,
 	upstreamServersConfig []config.UpstreamServer,
-) (reg upstream.Registry, err error) {
+) (reg *upstream.RegistryMap, err error) {
 	reg = upstream.NewEmptyRegistry(logger)
-	for _, serverConfig := range upstreamServersConfig {
-		var handler upstream.Forwarder
-		var _err error
-
-		switch serverConfig.Type {
-		case "smtp":
-			srv := forwarder.NewSMTPServer(logger)
-			handler, _err = srv.Configure(ctx, serverConfig.Settings)
-		case "ses":
-			srv := forwarder.NewSESServer(logger)
-			handler, _err = srv.Configure(ctx, serverConfig.Settings)
-		case "log":
-			srv := forwarder.NewLogServer(logger)
-			handler, err = srv.Configure(ctx, serverConfig.Settings)
-		default:
-			_err = fmt.Errorf("unrecognized server type: %s. allowed values: smtp, ses, log", serverConfig.Type)
+	uids := map[string]bool{}
+	for i, serverConfig := range upstreamServersConfig {
+		kind, ok := forwarder.LookupKind(serverConfig.Type)
+		if !ok {
+			err = multierror.Append(err, fmt.Errorf("unrecognized server type: %s. allowed values: %s",
+				serverConfig.Type, strings.Join(forwarder.KindNames(), ", ")))
+			continue
 		}
-
+		handler, _err := kind.NewServer(logger).Configure(ctx, serverConfig.Settings)
 		if _err != nil {
 			err = multierror.Append(err, _err)
 			continue
 		}
 
-		reg.AddForwarder(handler, serverConfig.Weight)
+		uid := upstreamUID(i, &serverConfig, uids)
+		opts := []upstream.EntryOption{upstream.WithUID(uid), upstream.WithName(serverConfig.Name), upstream.WithType(serverConfig.Type)}
+		if serverConfig.Mirror {
+			opts = append(opts, upstream.AsMirror())
+		}
+		if shadow := serverConfig.Shadow; shadow != nil {
+			opts = append(opts, upstream.AsShadow(shadow.Percent, shadow.RewriteTo))
+		}
+		reg.AddForwarder(handler, serverConfig.Weight, opts...)
 	}
 
 	if reg.Len() <= 0 {
@@ -174,3 +539,16 @@ func createUpstreamServers(ctx context.Context,
 
 	return reg, err
 }
+
+// upstreamUID UID of the configured upstream, the same across reloads so metric series carry on:
+// derived from type and name, or from the position when the name is not set or not unique.
+func upstreamUID(i int, serverConfig *config.UpstreamServer, uids map[string]bool) string {
+	key := serverConfig.Type + "/" + serverConfig.Name
+	if serverConfig.Name == "" || uids[key] {
+		key = fmt.Sprintf("%s/%s#%d", serverConfig.Type, serverConfig.Name, i)
+	}
+	uids[key] = true
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return fmt.Sprintf("uid:%016x", h.Sum64())
+}
@@ -7,16 +7,34 @@ import (
 	"os"
 	"path/filepath"
 	"reflect"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/creasty/defaults"
 	"github.com/hashicorp/go-multierror"
-	yaml "gopkg.in/yaml.v2"
+	"github.com/leonardinius/smtpd-proxy/app/dkim"
+	"github.com/leonardinius/smtpd-proxy/app/limits"
+	"github.com/leonardinius/smtpd-proxy/app/logging"
+	"github.com/leonardinius/smtpd-proxy/app/pipeline"
+	"github.com/leonardinius/smtpd-proxy/app/policy"
+	"github.com/leonardinius/smtpd-proxy/app/staging"
+	"github.com/leonardinius/smtpd-proxy/app/upstream/forwarder"
+	"github.com/leonardinius/smtpd-proxy/app/verify"
+	"gopkg.in/yaml.v3"
 )
 
 var (
 	_emptyConfig            = Config{}
 	errEmptyFile            = errors.New("empty yaml file contents")
-	errEmptyUpstreamServers = errors.New("no specified upstream servers, supported: smtp, ses, log")
+	errEmptyUpstreamServers = errors.New("no specified upstream servers")
+	errUnrecognizedType     = errors.New("unrecognized server type")
+	errShadowMirror         = errors.New("upstream can't be both shadow and mirror")
+	errShadowRewriteTo      = errors.New("shadow rewrite-to is required for delivering upstream type")
+	errAdminToken           = errors.New("admin token is required when admin listener is enabled")
+	errCaptureListen        = errors.New("capture upstream requires capture.listen")
+	errInvalidValue         = errors.New("invalid value")
+	errRequired             = errors.New("required")
 )
 
 // Config represents the structure of the yaml file.
@@ -26,21 +44,259 @@ type Config struct {
 
 // ProxyServerConfig the top level config.
 type ProxyServerConfig struct {
-	Listen                string           `default:"127.0.0.1:1025" yaml:"listen"`
-	Ehlo                  string           `default:"-"              yaml:"ehlo"`
-	Username              string           `default:"-"              yaml:"username"`
-	Password              string           `default:"-"              yaml:"password"`
-	IsAnonAuthAllowed     bool             `default:"-"              yaml:"is_anon_auth_allowed"`
-	ServerCertificatePath string           `default:"-"              yaml:"server-cert"`
-	ServerKeyPath         string           `default:"-"              yaml:"server-key"`
-	UpstreamServers       []UpstreamServer `yaml:"upstream-servers"`
+	Listen                string            `default:"127.0.0.1:1025" description:"SMTP listen address"           yaml:"listen"`
+	Ehlo                  string            `default:"-"              description:"EHLO domain"                   yaml:"ehlo"`
+	Username              string            `default:"-"              description:"SMTP auth username"            yaml:"username"`
+	Password              string            `default:"-"              description:"SMTP auth password"            yaml:"password"`
+	IsAnonAuthAllowed     bool              `default:"-"              description:"allow sessions without auth"   yaml:"is_anon_auth_allowed"`
+	ServerCertificatePath string            `default:"-"              description:"TLS certificate path"          yaml:"server-cert"`
+	ServerKeyPath         string            `default:"-"              description:"TLS key path"                  yaml:"server-key"`
+	ShutdownTimeout       time.Duration     `default:"30s"            description:"graceful shutdown timeout"     yaml:"shutdown-timeout"`
+	UpstreamServers       []UpstreamServer  `                         description:"upstreams to forward to"       yaml:"upstream-servers"`
+	Metrics               MetricsConfig     `                         description:"Prometheus metrics"            yaml:"metrics"`
+	Tracing               TracingConfig     `                         description:"OpenTelemetry tracing"         yaml:"tracing"`
+	Admin                 AdminConfig       `                         description:"admin HTTP API"                yaml:"admin"`
+	Logging               LoggingConfig     `                         description:"log format, level and output"  yaml:"logging"`
+	Audit                 AuditConfig       `                         description:"message audit log"             yaml:"audit"`
+	DKIM                  []DKIMConfig      `                         description:"DKIM signing keys"             yaml:"dkim"`
+	Verify                VerifyConfig      `                         description:"inbound message checks"        yaml:"verify"`
+	Transforms            []TransformConfig `                         description:"message transforms, in order"  yaml:"transforms"`
+	Staging               StagingConfig     `                         description:"staging recipient safety"      yaml:"staging"`
+	Capture               CaptureConfig     `                         description:"mail catcher web UI and API"   yaml:"capture"`
+	Policy                PolicyConfig      `                         description:"sender and recipient policy"   yaml:"policy"`
+	DSN                   DSNConfig         `                         description:"delivery status notifications" yaml:"dsn"`
+	Limits                LimitsConfig      `                         description:"session and rate limits"       yaml:"limits"`
+	Messages              MessagesConfig    `                         description:"message and attachment limits" yaml:"messages"`
+}
+
+// MetricsConfig Prometheus metrics HTTP listener, disabled when listen is empty.
+type MetricsConfig struct {
+	Listen string `default:"-"        description:"metrics listen address, disabled when empty" yaml:"listen"`
+	Path   string `default:"/metrics" description:"metrics URL path"                            yaml:"path"`
+}
+
+// TracingConfig OpenTelemetry OTLP/HTTP trace export, disabled when endpoint is empty.
+type TracingConfig struct {
+	Endpoint    string  `default:"-"           description:"OTLP/HTTP collector host:port, disabled when empty" yaml:"endpoint"`
+	Insecure    bool    `default:"-"           description:"plain HTTP export"                                  yaml:"insecure"`
+	ServiceName string  `default:"smtpd-proxy" description:"service.name resource attribute"                    yaml:"service-name"`
+	SampleRatio float64 `default:"1"           description:"share of traces sampled, 0-1"                       yaml:"sample-ratio"`
+}
+
+// AdminConfig admin HTTP API listener, disabled when listen is empty.
+// Requests must carry the bearer token; bind to a loopback address.
+type AdminConfig struct {
+	Listen string `default:"-" description:"admin API listen address, disabled when empty" yaml:"listen"`
+	Token  string `default:"-" description:"bearer token"                                  yaml:"token"`
+}
+
+// LoggingConfig log records format, level and output. Files are rotated by size.
+type LoggingConfig struct {
+	Format     string `default:"text" description:"record format"                       enum:"text,json"             yaml:"format"`
+	Level      string `default:"info" description:"minimum level"                       enum:"debug,info,warn,error" yaml:"level"`
+	File       string `default:"-"    description:"log file path, stdout when empty"                                 yaml:"file"`
+	MaxSizeMB  int    `default:"100"  description:"rotate file after size in megabytes"                              yaml:"max-size-mb"`
+	MaxBackups int    `default:"5"    description:"rotated files to keep"                                            yaml:"max-backups"`
+	MaxAgeDays int    `default:"28"   description:"days to keep rotated files"                                       yaml:"max-age-days"`
+	Compress   bool   `default:"-"    description:"gzip rotated files"                                               yaml:"compress"`
+}
+
+// CaptureConfig mail catcher of the capture upstreams, web UI and JSON API. Disabled when listen is empty.
+type CaptureConfig struct {
+	Listen      string `default:"-"    description:"web UI and API listen address, disabled when empty" yaml:"listen"`
+	Dir         string `default:"-"    description:"message store directory, in memory when empty"      yaml:"dir"`
+	MaxMessages int    `default:"1000" description:"messages kept, the oldest are evicted"              yaml:"max-messages"`
+}
+
+// LimitsConfig concurrent sessions and rates, per authenticated user or client IP of anonymous sessions.
+// Zero disables a limit.
+type LimitsConfig struct {
+	MaxSessions       int `default:"-" description:"concurrent sessions"                       yaml:"max-sessions"`
+	MaxSessionsPerIP  int `default:"-" description:"concurrent sessions per client IP"         yaml:"max-sessions-per-ip"`
+	MessagesPerMinute int `default:"-" description:"messages per minute per user or client IP" yaml:"messages-per-minute"`
+	RecipientsPerHour int `default:"-" description:"recipients per hour per user or client IP" yaml:"recipients-per-hour"`
+}
+
+// Options limiter options.
+func (l *LimitsConfig) Options() limits.Options {
+	return limits.Options{
+		MaxSessions:       l.MaxSessions,
+		MaxSessionsPerIP:  l.MaxSessionsPerIP,
+		MessagesPerMinute: l.MessagesPerMinute,
+		RecipientsPerHour: l.RecipientsPerHour,
+	}
+}
+
+// MessagesConfig message size, recipient count and attachment limits, overridable per authenticated user.
+// Zero disables a limit.
+type MessagesConfig struct {
+	MaxMessageBytes int                  `default:"10485760" description:"message size in bytes"        yaml:"max-message-bytes"`
+	MaxRecipients   int                  `default:"50"       description:"recipients per message"       yaml:"max-recipients"`
+	Attachments     AttachmentsConfig    `                   description:"attachment policy"            yaml:"attachments"`
+	Users           []UserMessagesConfig `                   description:"overrides per SMTP auth user" yaml:"users"`
+}
+
+// AttachmentsConfig attachment size, type and TLS requirements, checked at DATA.
+type AttachmentsConfig struct {
+	MaxBytes          int      `default:"-" description:"decoded size of an attachment in bytes"     yaml:"max-bytes"`
+	BlockedExtensions []string `            description:"blocked file extensions, e.g. .exe"         yaml:"blocked-extensions"`
+	BlockedTypes      []string `            description:"blocked MIME types, type/* for any subtype" yaml:"blocked-types"`
+	TLSOverBytes      int      `default:"-" description:"larger attachments require a TLS session"   yaml:"require-tls-over-bytes"`
+}
+
+// UserMessagesConfig limits of the user, unset fields inherit the messages defaults and zero disables a limit.
+type UserMessagesConfig struct {
+	User            string                `            description:"SMTP auth username"     yaml:"user"`
+	MaxMessageBytes *int                  `default:"-" description:"message size in bytes"  yaml:"max-message-bytes"`
+	MaxRecipients   *int                  `default:"-" description:"recipients per message" yaml:"max-recipients"`
+	Attachments     UserAttachmentsConfig `            description:"attachment policy"      yaml:"attachments"`
+}
+
+// UserAttachmentsConfig attachment policy of the user, unset fields inherit the messages defaults.
+type UserAttachmentsConfig struct {
+	MaxBytes          *int     `default:"-" description:"decoded size of an attachment in bytes"     yaml:"max-bytes"`
+	BlockedExtensions []string `            description:"blocked file extensions, e.g. .exe"         yaml:"blocked-extensions"`
+	BlockedTypes      []string `            description:"blocked MIME types, type/* for any subtype" yaml:"blocked-types"`
+	TLSOverBytes      *int     `default:"-" description:"larger attachments require a TLS session"   yaml:"require-tls-over-bytes"`
+}
+
+// Messages message rules of every user.
+func (m *MessagesConfig) Messages() *policy.Messages {
+	users := make(map[string]policy.MessageOverrides, len(m.Users))
+	for _, user := range m.Users {
+		users[user.User] = policy.MessageOverrides{
+			MaxMessageBytes:    user.MaxMessageBytes,
+			MaxRecipients:      user.MaxRecipients,
+			MaxAttachmentBytes: user.Attachments.MaxBytes,
+			BlockedExtensions:  user.Attachments.BlockedExtensions,
+			BlockedTypes:       user.Attachments.BlockedTypes,
+			TLSAttachmentBytes: user.Attachments.TLSOverBytes,
+		}
+	}
+	return policy.NewMessages(policy.MessageRules{
+		MaxMessageBytes:    m.MaxMessageBytes,
+		MaxRecipients:      m.MaxRecipients,
+		MaxAttachmentBytes: m.Attachments.MaxBytes,
+		BlockedExtensions:  m.Attachments.BlockedExtensions,
+		BlockedTypes:       m.Attachments.BlockedTypes,
+		TLSAttachmentBytes: m.Attachments.TLSOverBytes,
+	}, users)
+}
+
+// DSNConfig delivery status notifications (RFC 3464) to the envelope sender and the DSN SMTP extension.
+type DSNConfig struct {
+	Enabled bool   `default:"-" description:"advertise DSN, notify senders of failed deliveries"       yaml:"enabled"`
+	From    string `default:"-" description:"notification From address, MAILER-DAEMON@ehlo when empty" yaml:"from"`
+}
+
+// AuditConfig append-only JSON lines record of every message transaction, disabled when file is empty.
+type AuditConfig struct {
+	File string `default:"-" description:"audit log path, disabled when empty" yaml:"file"`
+}
+
+// DKIMConfig signing key of a sender domain, selected by the From header domain.
+type DKIMConfig struct {
+	Domain           string   `                          description:"signing domain, also signs subdomains"           yaml:"domain"`
+	Selector         string   `                          description:"key selector"                                    yaml:"selector"`
+	KeyFile          string   `                          description:"PEM private key path, RSA or Ed25519"            yaml:"key-file"`
+	Headers          []string `                          description:"header fields to sign, RFC 6376 list when empty" yaml:"headers"`
+	Canonicalization string   `default:"relaxed/relaxed" description:"header/body, simple or relaxed"                  yaml:"canonicalization"`
+}
+
+// VerifyConfig inbound message verification, stamps Authentication-Results. Disabled unless enabled.
+type VerifyConfig struct {
+	Enabled    bool   `default:"-"    description:"verify DKIM signatures"                                            yaml:"enabled"`
+	SPF        bool   `default:"-"    description:"check SPF of the client IP"                                        yaml:"spf"`
+	DMARC      bool   `default:"-"    description:"check DMARC of the From domain"                                    yaml:"dmarc"`
+	AuthServID string `default:"-"    description:"authserv-id, EHLO domain by default"                               yaml:"authserv-id"`
+	OnFail     string `default:"none" description:"action on failures"                  enum:"none,quarantine,reject" yaml:"on-fail"`
+	Quarantine string `default:"-"    description:"upstream name for quarantine"                                      yaml:"quarantine"`
+}
+
+// TransformConfig message transform applied before forwarding, type selects the keys in use.
+type TransformConfig struct { //nolint:lll // aligned struct tags
+	Type     string            `description:"transform type"                            enum:"add-header,remove-header,rewrite-header,rewrite-address,list-unsubscribe" yaml:"type"`
+	Name     string            `description:"header field name"                                                                                                         yaml:"name"`
+	Value    string            `description:"add-header value"                                                                                                          yaml:"value"`
+	Match    string            `description:"regexp on the header value"                                                                                                yaml:"match"`
+	Replace  string            `description:"rewrite-header replacement"                                                                                                yaml:"replace"`
+	Headers  []string          `description:"rewrite-address fields, From and Reply-To"                                                                                 yaml:"headers"`
+	Domains  map[string]string `description:"rewrite-address domain map"                                                                                                yaml:"domains"`
+	URL      string            `description:"list-unsubscribe URL template"                                                                                             yaml:"url"`
+	Mailto   string            `description:"list-unsubscribe address"                                                                                                  yaml:"mailto"`
+	OneClick bool              `description:"list-unsubscribe one-click POST"                                                                                           yaml:"one-click"`
+}
+
+// Spec pipeline spec of the transform.
+func (t *TransformConfig) Spec() pipeline.Spec {
+	return pipeline.Spec{
+		Type:     t.Type,
+		Name:     t.Name,
+		Value:    t.Value,
+		Match:    t.Match,
+		Replace:  t.Replace,
+		Headers:  t.Headers,
+		Domains:  t.Domains,
+		URL:      t.URL,
+		Mailto:   t.Mailto,
+		OneClick: t.OneClick,
+	}
+}
+
+// PolicyConfig envelope sender checks at MAIL and recipient checks at RCPT.
+type PolicyConfig struct {
+	Senders     []SenderPolicyConfig `description:"permitted sender domains per user" yaml:"senders"`
+	Suppression SuppressionConfig    `description:"recipients never delivered to"     yaml:"suppression"`
+}
+
+// SenderPolicyConfig sender domains the user may send as. Users without a rule are unrestricted, unless there is a "*" rule.
+type SenderPolicyConfig struct {
+	User    string   `description:"SMTP auth username, * for the others" yaml:"user"`
+	Domains []string `description:"sender domains, subdomains included"  yaml:"domains"`
+}
+
+// SuppressionConfig suppression lists, recipients are rejected at RCPT.
+type SuppressionConfig struct {
+	File   string    `default:"-" description:"addresses and domains, one per line"            yaml:"file"`
+	SQLite string    `default:"-" description:"SQLite database of the suppressions table"      yaml:"sqlite"`
+	SNS    SNSConfig `            description:"SES bounce and complaint notifications via SNS" yaml:"sns"`
+}
+
+// SNSConfig HTTP endpoint of SNS notifications adding hard bounces and complaints to the SQLite suppression list.
+// Disabled when listen is empty.
+type SNSConfig struct {
+	Listen    string   `default:"-"    description:"SNS endpoint listen address, disabled when empty" yaml:"listen"`
+	Path      string   `default:"/sns" description:"SNS endpoint URL path"                            yaml:"path"`
+	TopicARNs []string `               description:"accepted topic ARNs, any when empty"              yaml:"topic-arns"`
+}
+
+// StagingConfig keeps messages away from real recipients, disabled when mode is empty.
+type StagingConfig struct { //nolint:lll // aligned struct tags
+	Mode       string   `default:"-"      description:"redirect or allowlist, disabled when empty" enum:"redirect,allowlist" yaml:"mode"`
+	RedirectTo string   `default:"-"      description:"catch-all address of redirect mode"                                   yaml:"redirect-to"`
+	Allow      []string `                 description:"allowed domains, addresses or /regexp/"                               yaml:"allow"`
+	OnDenied   string   `default:"reject" description:"action on other recipients"                 enum:"reject,drop"        yaml:"on-denied"`
+}
+
+// Options staging policy options.
+func (s *StagingConfig) Options() staging.Options {
+	return staging.Options{Mode: s.Mode, RedirectTo: s.RedirectTo, Allow: s.Allow, OnDenied: s.OnDenied}
 }
 
 // UpstreamServer upstream server config.
 type UpstreamServer struct {
-	Type     string         `default:"smtp" yaml:"type"`
-	Weight   int            `default:"1"    yaml:"weight"`
-	Settings map[string]any `default:"{}"   yaml:"settings"`
+	Name     string         `default:"-"    description:"upstream name"                     yaml:"name"`
+	Type     string         `default:"smtp" description:"upstream type"                     yaml:"type"`
+	Weight   int            `default:"1"    description:"weighted pick share"               yaml:"weight"`
+	Mirror   bool           `default:"-"    description:"receive a copy of every message"   yaml:"mirror"`
+	Shadow   *ShadowConfig  `default:"-"    description:"evaluate with a sample of traffic" yaml:"shadow"`
+	Settings map[string]any `default:"{}"   description:"upstream type settings"            yaml:"settings"`
+}
+
+// ShadowConfig evaluates the upstream with a sample of real traffic, next to the weighted pick.
+type ShadowConfig struct {
+	Percent   float64 `description:"share of messages, 0-100" yaml:"percent"`
+	RewriteTo string  `description:"replaces all recipients"  yaml:"rewrite-to"`
 }
 
 // Parse takes a raw data and returns Config.
@@ -52,7 +308,14 @@ func Parse(reader io.Reader) (*Config, error) {
 		return nil, err
 	}
 
-	if err := yaml.Unmarshal(bytes, &c); err != nil {
+	var document yaml.Node
+	if err := yaml.Unmarshal(bytes, &document); err != nil {
+		return nil, err
+	}
+	if err := interpolate(&document); err != nil {
+		return nil, err
+	}
+	if err := document.Decode(&c); err != nil {
 		return nil, err
 	}
 
@@ -80,25 +343,81 @@ func (c *Config) LoadDefaults() (*Config, error) {
 	}
 
 	var err error
-	for _, server := range c.ServerConfig.UpstreamServers {
-		var _castErr error
-		if server.Weight <= 0 {
-			err = multierror.Append(err, fmt.Errorf("invalid non-positive weight: %v", server.Weight))
+	for i := range c.ServerConfig.UpstreamServers {
+		server := &c.ServerConfig.UpstreamServers[i]
+		path := fmt.Sprintf("smtpd-proxy.upstream-servers[%d]", i)
+		// the quarantine upstream receives messages failing verification only, weight is ignored.
+		quarantine := c.ServerConfig.Verify.isQuarantine(server)
+		if quarantine {
+			server.Weight = 0
+		}
+		if server.Weight <= 0 && !server.Mirror && server.Shadow == nil && !quarantine {
+			err = multierror.Append(err, fmt.Errorf("%s.weight: invalid non-positive weight: %v", path, server.Weight))
+		}
+		if server.Shadow != nil {
+			for _, shadowErr := range server.validateShadow() {
+				err = multierror.Append(err, fmt.Errorf("%s.shadow: %w", path, shadowErr))
+			}
 		}
-		switch server.Type {
-		case "smtp":
-		case "ses":
-		case "log":
-		default:
-			_castErr = fmt.Errorf("unrecognized server type: %s. allowed values: smtp, ses, log", server.Type)
+		kind, ok := forwarder.LookupKind(server.Type)
+		if !ok {
+			err = multierror.Append(err, fmt.Errorf("%s.type: %w: %s, allowed values [%s]",
+				path, errUnrecognizedType, server.Type, strings.Join(forwarder.KindNames(), ", ")))
+			continue
 		}
-		if _castErr != nil {
-			err = multierror.Append(err, _castErr)
+		for _, settingsErr := range kind.ValidateSettings(server.Settings) {
+			err = multierror.Append(err, settingsError(path+".settings", settingsErr))
+		}
+		if server.Type == "capture" && c.ServerConfig.Capture.Listen == "" {
+			err = multierror.Append(err, fmt.Errorf("%s.type: %w", path, errCaptureListen))
 		}
 	}
 
 	if len(c.ServerConfig.UpstreamServers) == 0 {
-		return nil, errEmptyUpstreamServers
+		return nil, fmt.Errorf("%w, supported: %s", errEmptyUpstreamServers, strings.Join(forwarder.KindNames(), ", "))
+	}
+
+	if admin := c.ServerConfig.Admin; admin.Listen != "" && admin.Token == "" {
+		err = multierror.Append(err, errAdminToken)
+	}
+
+	for _, loggingErr := range c.ServerConfig.Logging.validate() {
+		err = multierror.Append(err, fmt.Errorf("smtpd-proxy.logging.%w", loggingErr))
+	}
+
+	for _, verifyErr := range c.ServerConfig.Verify.validate(c.ServerConfig.UpstreamServers) {
+		err = multierror.Append(err, fmt.Errorf("smtpd-proxy.verify.%w", verifyErr))
+	}
+
+	for i, transform := range c.ServerConfig.Transforms {
+		spec := transform.Spec()
+		if _, transformErr := pipeline.NewTransformer(&spec); transformErr != nil {
+			err = multierror.Append(err, fmt.Errorf("smtpd-proxy.transforms[%d].%w", i, transformErr))
+		}
+	}
+
+	for _, limitsErr := range c.ServerConfig.Limits.validate() {
+		err = multierror.Append(err, fmt.Errorf("smtpd-proxy.limits.%w", limitsErr))
+	}
+
+	for _, messagesErr := range c.ServerConfig.Messages.validate() {
+		err = multierror.Append(err, fmt.Errorf("smtpd-proxy.messages.%w", messagesErr))
+	}
+
+	for _, policyErr := range c.ServerConfig.Policy.validate() {
+		err = multierror.Append(err, fmt.Errorf("smtpd-proxy.policy.%w", policyErr))
+	}
+
+	if c.ServerConfig.Staging.Mode != "" {
+		if _, stagingErr := staging.New(c.ServerConfig.Staging.Options()); stagingErr != nil {
+			err = multierror.Append(err, fmt.Errorf("smtpd-proxy.staging.%w", stagingErr))
+		}
+	}
+
+	for i, key := range c.ServerConfig.DKIM {
+		for _, dkimErr := range key.validate() {
+			err = multierror.Append(err, fmt.Errorf("smtpd-proxy.dkim[%d].%w", i, dkimErr))
+		}
 	}
 
 	if err != nil {
@@ -107,3 +426,148 @@ func (c *Config) LoadDefaults() (*Config, error) {
 
 	return c, nil
 }
+
+// settingsError qualifies upstream settings error with its key path.
+func settingsError(path string, err error) error {
+	var settingsErr *forwarder.SettingsError
+	if errors.As(err, &settingsErr) && settingsErr.Key != "" {
+		return fmt.Errorf("%s.%s: %w", path, settingsErr.Key, settingsErr.Err)
+	}
+	return fmt.Errorf("%s: %w", path, err)
+}
+
+func (l *LoggingConfig) validate() (errs []error) {
+	switch l.Format {
+	case logging.FormatText, logging.FormatJSON:
+	default:
+		errs = append(errs, fmt.Errorf("format: %w: %s, allowed values [text, json]", errInvalidValue, l.Format))
+	}
+	if _, err := logging.ParseLevel(l.Level); err != nil {
+		errs = append(errs, fmt.Errorf("level: %w: %s, allowed values [debug, info, warn, error]", errInvalidValue, l.Level))
+	}
+	return errs
+}
+
+func (l *LimitsConfig) validate() (errs []error) {
+	for _, field := range []struct {
+		key   string
+		value int
+	}{
+		{"max-sessions", l.MaxSessions},
+		{"max-sessions-per-ip", l.MaxSessionsPerIP},
+		{"messages-per-minute", l.MessagesPerMinute},
+		{"recipients-per-hour", l.RecipientsPerHour},
+	} {
+		if field.value < 0 {
+			errs = append(errs, fmt.Errorf("%s: %w: %d, must not be negative", field.key, errInvalidValue, field.value))
+		}
+	}
+	return errs
+}
+
+func (m *MessagesConfig) validate() (errs []error) {
+	attachments := &m.Attachments
+	errs = append(errs, validateMessageLimits("", &m.MaxMessageBytes, &m.MaxRecipients, &attachments.MaxBytes, &attachments.TLSOverBytes)...)
+	users := map[string]bool{}
+	for i, user := range m.Users {
+		path := fmt.Sprintf("users[%d].", i)
+		if user.User == "" {
+			errs = append(errs, fmt.Errorf("%suser: %w", path, errRequired))
+		} else if users[user.User] {
+			errs = append(errs, fmt.Errorf("%suser: %w: duplicate %s", path, errInvalidValue, user.User))
+		}
+		users[user.User] = true
+		overrides := &user.Attachments
+		errs = append(errs, validateMessageLimits(path, user.MaxMessageBytes, user.MaxRecipients, overrides.MaxBytes, overrides.TLSOverBytes)...)
+	}
+	return errs
+}
+
+// validateMessageLimits the set limits are not negative, nil limits are inherited.
+func validateMessageLimits(path string, maxMessageBytes, maxRecipients, maxAttachmentBytes, tlsOverBytes *int) (errs []error) {
+	for _, field := range []struct {
+		key   string
+		value *int
+	}{
+		{"max-message-bytes", maxMessageBytes},
+		{"max-recipients", maxRecipients},
+		{"attachments.max-bytes", maxAttachmentBytes},
+		{"attachments.require-tls-over-bytes", tlsOverBytes},
+	} {
+		if field.value != nil && *field.value < 0 {
+			errs = append(errs, fmt.Errorf("%s%s: %w: %d, must not be negative", path, field.key, errInvalidValue, *field.value))
+		}
+	}
+	return errs
+}
+
+// isQuarantine whether the upstream receives messages failing verification.
+func (v *VerifyConfig) isQuarantine(server *UpstreamServer) bool {
+	return v.Enabled && v.OnFail == verify.ActionQuarantine && server.Name != "" && server.Name == v.Quarantine
+}
+
+func (v *VerifyConfig) validate(upstreams []UpstreamServer) (errs []error) {
+	switch v.OnFail {
+	case verify.ActionNone, verify.ActionReject:
+	case verify.ActionQuarantine:
+		if v.Quarantine == "" {
+			errs = append(errs, fmt.Errorf("quarantine: %w: on-fail is quarantine", errRequired))
+		} else if !slices.ContainsFunc(upstreams, func(u UpstreamServer) bool { return u.Name == v.Quarantine }) {
+			errs = append(errs, fmt.Errorf("quarantine: %w: no upstream named %s", errInvalidValue, v.Quarantine))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("on-fail: %w: %s, allowed values [none, quarantine, reject]", errInvalidValue, v.OnFail))
+	}
+	return errs
+}
+
+func (p *PolicyConfig) validate() (errs []error) {
+	users := map[string]bool{}
+	for i, rule := range p.Senders {
+		if rule.User == "" {
+			errs = append(errs, fmt.Errorf("senders[%d].user: %w", i, errRequired))
+		} else if users[rule.User] {
+			errs = append(errs, fmt.Errorf("senders[%d].user: %w: duplicate %s", i, errInvalidValue, rule.User))
+		}
+		users[rule.User] = true
+		if len(rule.Domains) == 0 {
+			errs = append(errs, fmt.Errorf("senders[%d].domains: %w", i, errRequired))
+		}
+	}
+	if p.Suppression.SNS.Listen != "" && p.Suppression.SQLite == "" {
+		errs = append(errs, fmt.Errorf("suppression.sqlite: %w by suppression.sns", errRequired))
+	}
+	return errs
+}
+
+func (k *DKIMConfig) validate() (errs []error) {
+	for _, field := range []struct{ key, value string }{{"domain", k.Domain}, {"selector", k.Selector}, {"key-file", k.KeyFile}} {
+		if field.value == "" {
+			errs = append(errs, fmt.Errorf("%s: %w", field.key, errRequired))
+		}
+	}
+	if _, _, err := dkim.ParseCanonicalization(k.Canonicalization); err != nil {
+		errs = append(errs, fmt.Errorf("canonicalization: %w", err))
+	}
+	if len(k.Headers) > 0 && !slices.ContainsFunc(k.Headers, func(h string) bool { return strings.EqualFold(h, "From") }) {
+		errs = append(errs, fmt.Errorf("headers: %w: From is required", errInvalidValue))
+	}
+	return errs
+}
+
+func (s *UpstreamServer) validateShadow() (errs []error) {
+	if s.Mirror {
+		errs = append(errs, errShadowMirror)
+	}
+	if s.Shadow.Percent <= 0 || s.Shadow.Percent > 100 {
+		errs = append(errs, fmt.Errorf("invalid shadow percent: %v, expected (0, 100]", s.Shadow.Percent))
+	}
+	switch s.Type {
+	case "log", "s3", "capture":
+	default:
+		if s.Shadow.RewriteTo == "" {
+			errs = append(errs, fmt.Errorf("%w: %s", errShadowRewriteTo, s.Type))
+		}
+	}
+	return errs
+}
@@ -1,6 +1,9 @@
 package config
 
 import (
+	"flag"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -23,7 +26,7 @@ smtpd-proxy:
     - type: smtp
       weight: 25
       settings:
-        address: 127.0.0.1:1026
+        addr: 127.0.0.1:1026
         auth: plain
         username: user
         password: secret
@@ -53,7 +56,7 @@ smtpd-proxy:
 	assert.Equal(t, 25, srv.UpstreamServers[0].Weight)
 	assert.Equal(t,
 		map[string]any{
-			"address":  "127.0.0.1:1026",
+			"addr":     "127.0.0.1:1026",
 			"auth":     "plain",
 			"username": "user",
 			"password": "secret",
@@ -87,7 +90,8 @@ smtpd-proxy:
   upstream-servers:
     - type: smtp
       settings:
-        api_key: key
+        addr: 127.0.0.1:1026
+        auth: anon
 `
 	c, err := Parse(strings.NewReader(data))
 	require.Nil(t, err)
@@ -105,3 +109,456 @@ smtpd-proxy:
 	assert.Equal(t, "", srv.ServerCertificatePath)
 	assert.Equal(t, "", srv.ServerKeyPath)
 }
+
+func TestLoadConfigMirrorIgnoresWeight(t *testing.T) {
+	t.Parallel()
+	data := `
+smtpd-proxy:
+  upstream-servers:
+    - type: log
+    - type: log
+      name: archive
+      mirror: true
+      weight: 0
+`
+	c, err := Parse(strings.NewReader(data))
+	require.Nil(t, err)
+
+	c, err = c.LoadDefaults()
+	require.Nil(t, err)
+
+	srv := c.ServerConfig
+	assert.False(t, srv.UpstreamServers[0].Mirror)
+	assert.True(t, srv.UpstreamServers[1].Mirror)
+	assert.Equal(t, "archive", srv.UpstreamServers[1].Name)
+}
+
+func TestLoadConfigShadowValidation(t *testing.T) {
+	t.Parallel()
+	data := `
+smtpd-proxy:
+  upstream-servers:
+    - type: smtp
+    - type: ses
+      shadow:
+        percent: 10
+        rewrite-to: success@simulator.amazonses.com
+    - type: log
+      shadow:
+        percent: 100
+    - type: smtp
+      shadow:
+        percent: 120
+`
+	c, err := Parse(strings.NewReader(data))
+	require.Nil(t, err)
+
+	c, err = c.LoadDefaults()
+	require.Nil(t, c)
+	assert.ErrorContains(t, err, "invalid shadow percent: 120")
+	assert.ErrorContains(t, err, "shadow rewrite-to is required for delivering upstream type: smtp")
+	assert.NotContains(t, err.Error(), ": ses")
+	assert.NotContains(t, err.Error(), ": log")
+}
+
+func TestLoadConfigValidatesUpstreamSettings(t *testing.T) {
+	t.Parallel()
+	data := `
+smtpd-proxy:
+  upstream-servers:
+    - type: smtp
+      settings:
+        address: 127.0.0.1:1026
+        auth: xoauth2
+    - type: ses
+      settings:
+        region: 1
+    - type: sendmail
+    - type: smtp
+      settings:
+        addr: ""
+        auth: anon
+    - type: lmtp
+      settings:
+        addr: localhost
+    - type: mx
+      settings:
+        timeout: soon
+    - type: s3
+      settings:
+        bucket: ""
+`
+	c, err := Parse(strings.NewReader(data))
+	require.Nil(t, err)
+
+	c, err = c.LoadDefaults()
+	require.Nil(t, c)
+	assert.ErrorContains(t, err, "smtpd-proxy.upstream-servers[0].settings.address: unknown field")
+	assert.ErrorContains(t, err, "smtpd-proxy.upstream-servers[0].settings.addr: required field is missing")
+	assert.ErrorContains(t, err,
+		`smtpd-proxy.upstream-servers[0].settings.auth: invalid value: "xoauth2", allowed values [plain, login, cram-md5, anon]`)
+	assert.ErrorContains(t, err, "smtpd-proxy.upstream-servers[1].settings.region: invalid value: expected string, got number")
+	assert.ErrorContains(t, err, "smtpd-proxy.upstream-servers[2].type: unrecognized server type: sendmail")
+	assert.ErrorContains(t, err, "smtpd-proxy.upstream-servers[3].settings.addr: required field is missing", "empty is missing")
+	assert.ErrorContains(t, err, `smtpd-proxy.upstream-servers[4].settings.addr: invalid value: "localhost", expected host:port`)
+	assert.ErrorContains(t, err,
+		`smtpd-proxy.upstream-servers[5].settings.timeout: invalid value: "soon", expected a positive duration, e.g. 30s`)
+	assert.ErrorContains(t, err, "smtpd-proxy.upstream-servers[6].settings.bucket: required field is missing")
+}
+
+func TestLoadConfigLogging(t *testing.T) {
+	t.Parallel()
+	data := `
+smtpd-proxy:
+  logging:
+    format: yaml
+    level: verbose
+  upstream-servers:
+    - type: log
+`
+	c, err := Parse(strings.NewReader(data))
+	require.Nil(t, err)
+
+	_, err = c.LoadDefaults()
+	assert.ErrorContains(t, err, "smtpd-proxy.logging.format: invalid value: yaml")
+	assert.ErrorContains(t, err, "smtpd-proxy.logging.level: invalid value: verbose")
+
+	c, err = Parse(strings.NewReader("smtpd-proxy:\n  upstream-servers:\n    - type: log\n"))
+	require.Nil(t, err)
+	c, err = c.LoadDefaults()
+	require.Nil(t, err)
+	assert.Equal(t, LoggingConfig{Format: "text", Level: "info", MaxSizeMB: 100, MaxBackups: 5, MaxAgeDays: 28}, c.ServerConfig.Logging)
+}
+
+func TestLoadConfigDKIM(t *testing.T) {
+	t.Parallel()
+	data := `
+smtpd-proxy:
+  dkim:
+    - domain: example.com
+      selector: s1
+      key-file: /etc/dkim/example.com.pem
+    - domain: example.org
+      headers: [Subject, To]
+      canonicalization: relaxed/nowsp
+  upstream-servers:
+    - type: log
+`
+	c, err := Parse(strings.NewReader(data))
+	require.Nil(t, err)
+
+	_, err = c.LoadDefaults()
+	assert.ErrorContains(t, err, "smtpd-proxy.dkim[1].selector: required")
+	assert.ErrorContains(t, err, "smtpd-proxy.dkim[1].key-file: required")
+	assert.ErrorContains(t, err, "smtpd-proxy.dkim[1].canonicalization: invalid canonicalization")
+	assert.ErrorContains(t, err, "smtpd-proxy.dkim[1].headers: invalid value: From is required")
+	assert.NotContains(t, err.Error(), "dkim[0]")
+
+	c, err = Parse(strings.NewReader(data[:strings.Index(data, "    - domain: example.org")] + "  upstream-servers:\n    - type: log\n"))
+	require.Nil(t, err)
+	c, err = c.LoadDefaults()
+	require.Nil(t, err)
+	assert.Equal(t, []DKIMConfig{{
+		Domain: "example.com", Selector: "s1", KeyFile: "/etc/dkim/example.com.pem", Canonicalization: "relaxed/relaxed",
+	}}, c.ServerConfig.DKIM)
+}
+
+func TestLoadConfigVerify(t *testing.T) {
+	t.Parallel()
+	parse := func(verify string) (*Config, error) {
+		c, err := Parse(strings.NewReader("smtpd-proxy:\n  verify:\n" + verify + `
+  upstream-servers:
+    - type: log
+    - type: log
+      name: quarantine
+      weight: 5
+`))
+		require.Nil(t, err)
+		return c.LoadDefaults()
+	}
+
+	_, err := parse("    enabled: true\n    on-fail: drop\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.verify.on-fail: invalid value: drop")
+	_, err = parse("    enabled: true\n    on-fail: quarantine\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.verify.quarantine: required")
+	_, err = parse("    enabled: true\n    on-fail: quarantine\n    quarantine: archive\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.verify.quarantine: invalid value: no upstream named archive")
+
+	c, err := parse("    enabled: true\n    on-fail: quarantine\n    quarantine: quarantine\n")
+	require.Nil(t, err)
+	assert.Equal(t, 1, c.ServerConfig.UpstreamServers[0].Weight)
+	assert.Equal(t, 0, c.ServerConfig.UpstreamServers[1].Weight, "quarantine upstream is not routed to")
+
+	c, err = parse("    spf: true\n")
+	require.Nil(t, err)
+	assert.Equal(t, VerifyConfig{SPF: true, OnFail: "none"}, c.ServerConfig.Verify)
+	assert.Equal(t, 5, c.ServerConfig.UpstreamServers[1].Weight)
+}
+
+func TestLoadConfigTransforms(t *testing.T) {
+	t.Parallel()
+	parse := func(transforms string) (*Config, error) {
+		c, err := Parse(strings.NewReader("smtpd-proxy:\n  transforms:\n" + transforms + `
+  upstream-servers:
+    - type: log
+`))
+		require.Nil(t, err)
+		return c.LoadDefaults()
+	}
+
+	_, err := parse("    - type: add-header\n    - type: drop\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.transforms[0].name: required")
+	assert.ErrorContains(t, err, "smtpd-proxy.transforms[1].type: unknown transform type: drop")
+
+	c, err := parse("    - type: rewrite-address\n      domains:\n        internal.example.com: example.com\n")
+	require.Nil(t, err)
+	require.Len(t, c.ServerConfig.Transforms, 1)
+	assert.Equal(t, map[string]string{"internal.example.com": "example.com"}, c.ServerConfig.Transforms[0].Spec().Domains)
+}
+
+func TestLoadConfigStaging(t *testing.T) {
+	t.Parallel()
+	parse := func(staging string) (*Config, error) {
+		c, err := Parse(strings.NewReader("smtpd-proxy:\n  staging:\n" + staging + `
+  upstream-servers:
+    - type: log
+`))
+		require.Nil(t, err)
+		return c.LoadDefaults()
+	}
+
+	_, err := parse("    mode: redirect\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.staging.redirect-to: required")
+	_, err = parse("    mode: allowlist\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.staging.allow: required")
+
+	c, err := parse("    mode: allowlist\n    allow: [example.com]\n")
+	require.Nil(t, err)
+	assert.Equal(t, StagingConfig{Mode: "allowlist", Allow: []string{"example.com"}, OnDenied: "reject"}, c.ServerConfig.Staging)
+
+	c, err = parse("    on-denied: drop\n")
+	require.Nil(t, err, "disabled without mode")
+	assert.Empty(t, c.ServerConfig.Staging.Mode)
+}
+
+func TestLoadConfigPolicy(t *testing.T) {
+	t.Parallel()
+	parse := func(policy string) (*Config, error) {
+		c, err := Parse(strings.NewReader("smtpd-proxy:\n  policy:\n" + policy + `
+  upstream-servers:
+    - type: log
+`))
+		require.Nil(t, err)
+		return c.LoadDefaults()
+	}
+
+	_, err := parse("    senders:\n      - domains: [example.com]\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.policy.senders[0].user: required")
+	_, err = parse("    senders:\n      - user: app\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.policy.senders[0].domains: required")
+	_, err = parse("    senders:\n" +
+		"      - user: app\n        domains: [a.example]\n" +
+		"      - user: app\n        domains: [b.example]\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.policy.senders[1].user: invalid value: duplicate app")
+
+	c, err := parse("    senders:\n      - user: '*'\n        domains: [example.com]\n" +
+		"    suppression:\n      sqlite: /var/lib/smtpd-proxy/suppression.db\n")
+	require.Nil(t, err)
+	assert.Equal(t, PolicyConfig{
+		Senders:     []SenderPolicyConfig{{User: "*", Domains: []string{"example.com"}}},
+		Suppression: SuppressionConfig{SQLite: "/var/lib/smtpd-proxy/suppression.db", SNS: SNSConfig{Path: "/sns"}},
+	}, c.ServerConfig.Policy)
+
+	_, err = parse("    suppression:\n      sns:\n        listen: 127.0.0.1:8027\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.policy.suppression.sqlite: required by suppression.sns")
+}
+
+func TestLoadConfigDSN(t *testing.T) {
+	t.Parallel()
+	c, err := Parse(strings.NewReader(`smtpd-proxy:
+  dsn:
+    enabled: true
+    from: postmaster@example.com
+  upstream-servers:
+    - type: log
+`))
+	require.Nil(t, err)
+	c, err = c.LoadDefaults()
+	require.Nil(t, err)
+	assert.Equal(t, DSNConfig{Enabled: true, From: "postmaster@example.com"}, c.ServerConfig.DSN)
+}
+
+func TestLoadConfigLimits(t *testing.T) {
+	t.Parallel()
+	parse := func(limits string) (*Config, error) {
+		c, err := Parse(strings.NewReader("smtpd-proxy:\n  limits:\n" + limits + `
+  upstream-servers:
+    - type: log
+`))
+		require.Nil(t, err)
+		return c.LoadDefaults()
+	}
+
+	_, err := parse("    max-sessions-per-ip: -1\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.limits.max-sessions-per-ip: invalid value: -1, must not be negative")
+
+	c, err := parse("    max-sessions: 100\n    messages-per-minute: 60\n")
+	require.Nil(t, err)
+	assert.Equal(t, LimitsConfig{MaxSessions: 100, MessagesPerMinute: 60}, c.ServerConfig.Limits)
+}
+
+func TestLoadConfigMessages(t *testing.T) {
+	t.Parallel()
+	parse := func(messages string) (*Config, error) {
+		c, err := Parse(strings.NewReader("smtpd-proxy:\n  messages:\n" + messages + `
+  upstream-servers:
+    - type: log
+`))
+		require.Nil(t, err)
+		return c.LoadDefaults()
+	}
+
+	_, err := parse("    max-recipients: -1\n    users:\n      - max-message-bytes: -1\n      - user: app\n      - user: app\n")
+	assert.ErrorContains(t, err, "smtpd-proxy.messages.max-recipients: invalid value: -1, must not be negative")
+	assert.ErrorContains(t, err, "smtpd-proxy.messages.users[0].user: required")
+	assert.ErrorContains(t, err, "smtpd-proxy.messages.users[0].max-message-bytes: invalid value: -1, must not be negative")
+	assert.ErrorContains(t, err, "smtpd-proxy.messages.users[2].user: invalid value: duplicate app")
+
+	c, err := parse(`    attachments:
+      blocked-extensions: [.exe]
+      require-tls-over-bytes: 1048576
+    users:
+      - user: bulk
+        max-recipients: 500
+      - user: unlimited
+        max-message-bytes: 0
+        attachments:
+          require-tls-over-bytes: 0
+`)
+	require.Nil(t, err)
+	maxRecipients, zero := 500, 0
+	assert.Equal(t, MessagesConfig{
+		MaxMessageBytes: 10485760,
+		MaxRecipients:   50,
+		Attachments:     AttachmentsConfig{BlockedExtensions: []string{".exe"}, TLSOverBytes: 1048576},
+		Users: []UserMessagesConfig{
+			{User: "bulk", MaxRecipients: &maxRecipients},
+			{User: "unlimited", MaxMessageBytes: &zero, Attachments: UserAttachmentsConfig{TLSOverBytes: &zero}},
+		},
+	}, c.ServerConfig.Messages)
+	rules := c.ServerConfig.Messages.Messages().Rules("bulk")
+	assert.Equal(t, 10485760, rules.MaxMessageBytes)
+	assert.Equal(t, 500, rules.MaxRecipients)
+	assert.Equal(t, []string{".exe"}, rules.BlockedExtensions)
+	rules = c.ServerConfig.Messages.Messages().Rules("unlimited")
+	assert.Equal(t, 0, rules.MaxMessageBytes, "explicit zero overrides the default")
+	assert.Equal(t, 50, rules.MaxRecipients)
+	assert.Equal(t, 0, rules.TLSAttachmentBytes)
+}
+
+func TestLoadConfigCapture(t *testing.T) {
+	t.Parallel()
+	parse := func(capture string) (*Config, error) {
+		c, err := Parse(strings.NewReader("smtpd-proxy:\n" + capture + `
+  upstream-servers:
+    - type: capture
+`))
+		require.Nil(t, err)
+		return c.LoadDefaults()
+	}
+
+	_, err := parse("")
+	assert.ErrorContains(t, err, "smtpd-proxy.upstream-servers[0].type: capture upstream requires capture.listen")
+
+	c, err := parse("  capture:\n    listen: 127.0.0.1:8025\n")
+	require.Nil(t, err)
+	assert.Equal(t, CaptureConfig{Listen: "127.0.0.1:8025", MaxMessages: 1000}, c.ServerConfig.Capture)
+}
+
+func TestLoadConfigAdminRequiresToken(t *testing.T) {
+	t.Parallel()
+	data := `
+smtpd-proxy:
+  admin:
+    listen: 127.0.0.1:8025
+  upstream-servers:
+    - type: log
+`
+	c, err := Parse(strings.NewReader(data))
+	require.Nil(t, err)
+
+	_, err = c.LoadDefaults()
+	require.ErrorIs(t, err, errAdminToken)
+}
+
+func TestParseInterpolatesEnvironmentAndFiles(t *testing.T) {
+	t.Setenv("SMTPD_TEST_PASSWORD", "pa$$word")
+	t.Setenv("SMTPD_TEST_WEIGHT", "42")
+	t.Setenv("SMTPD_TEST_EMPTY", "")
+	secret := filepath.Join(t.TempDir(), "aws-secret")
+	require.NoError(t, os.WriteFile(secret, []byte("yyy\n"), 0o600))
+
+	data := `
+smtpd-proxy:
+  listen: ${SMTPD_TEST_LISTEN:-127.0.0.1:2525}
+  password: ${SMTPD_TEST_PASSWORD}
+  ehlo: "${SMTPD_TEST_EMPTY:-localhost}"
+  upstream-servers:
+    - type: ses
+      weight: ${SMTPD_TEST_WEIGHT}
+      settings:
+        aws_access_key_id: "${SMTPD_TEST_WEIGHT}"
+        aws_secret_access_key: ${file:` + secret + `}
+        region: price-$$5-${SMTPD_TEST_WEIGHT}
+`
+	c, err := Parse(strings.NewReader(data))
+	require.NoError(t, err)
+
+	srv := c.ServerConfig
+	assert.Equal(t, "127.0.0.1:2525", srv.Listen)
+	assert.Equal(t, "pa$$word", srv.Password)
+	assert.Equal(t, "localhost", srv.Ehlo)
+	assert.Equal(t, 42, srv.UpstreamServers[0].Weight)
+	assert.Equal(t,
+		map[string]any{
+			"aws_access_key_id":     "42",
+			"aws_secret_access_key": "yyy",
+			"region":                "price-$5-42",
+		},
+		srv.UpstreamServers[0].Settings)
+}
+
+func TestParseInterpolationErrorsArePathQualified(t *testing.T) {
+	data := `
+smtpd-proxy:
+  password: ${SMTPD_TEST_UNSET_PASSWORD}
+  upstream-servers:
+    - type: smtp
+      settings:
+        password: ${SMTPD_TEST_UNSET_UPSTREAM}
+        username: ${not a name}
+`
+	_, err := Parse(strings.NewReader(data))
+	require.ErrorIs(t, err, errMissingVariable)
+	require.ErrorIs(t, err, errInvalidReference)
+	assert.ErrorContains(t, err, "smtpd-proxy.password: environment variable is not set: SMTPD_TEST_UNSET_PASSWORD")
+	assert.ErrorContains(t, err,
+		"smtpd-proxy.upstream-servers[0].settings.password: environment variable is not set: SMTPD_TEST_UNSET_UPSTREAM")
+	assert.ErrorContains(t, err, "smtpd-proxy.upstream-servers[0].settings.username: invalid reference: ${not a name}")
+}
+
+var update = flag.Bool("update", false, "update golden files")
+
+func TestJSONSchemaUpToDate(t *testing.T) {
+	t.Parallel()
+	data, err := JSONSchema()
+	require.NoError(t, err)
+
+	path := filepath.Join("..", "..", "smtpd-proxy.schema.json")
+	if *update {
+		require.NoError(t, os.WriteFile(path, data, 0o600))
+	}
+	golden, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, string(golden), string(data), "run: go test ./app/config -run TestJSONSchemaUpToDate -update")
+}
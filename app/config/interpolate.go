@@ -0,0 +1,123 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errMissingVariable  = errors.New("environment variable is not set")
+	errInvalidReference = errors.New("invalid reference")
+
+	// referencePattern matches $$ escape and ${...} references.
+	referencePattern = regexp.MustCompile(`\$\$|\$\{([^}]*)\}`)
+	variableName     = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// interpolate expands references in every scalar value of the document:
+//
+//	${VAR}             environment variable, error when it is not set
+//	${VAR:-default}    environment variable, default when it is not set or empty
+//	${file:/run/x}     file contents, trailing newline trimmed
+//	$$                 literal $
+//
+// Unquoted values are re-resolved after expansion, e.g. `weight: ${WEIGHT}` decodes as int;
+// quote the reference to keep the value a string.
+func interpolate(node *yaml.Node) error {
+	var err error
+	walk(node, "", func(path string, n *yaml.Node) {
+		value, errs := expand(n.Value)
+		for _, expandErr := range errs {
+			err = multierror.Append(err, fmt.Errorf("%s: %w", path, expandErr))
+		}
+		if len(errs) > 0 {
+			return
+		}
+		if value == n.Value {
+			return
+		}
+		n.Value = value
+		if n.Style == 0 {
+			n.Tag = "" // resolve plain scalar type from the expanded value
+		}
+	})
+	return err
+}
+
+// walk calls fn for every scalar mapping value and sequence item, with its dotted path.
+func walk(node *yaml.Node, path string, fn func(path string, n *yaml.Node)) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, n := range node.Content {
+			walk(n, path, fn)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i].Value
+			if path != "" {
+				key = path + "." + key
+			}
+			walk(node.Content[i+1], key, fn)
+		}
+	case yaml.SequenceNode:
+		for i, n := range node.Content {
+			walk(n, path+"["+strconv.Itoa(i)+"]", fn)
+		}
+	case yaml.ScalarNode:
+		fn(path, node)
+	case yaml.AliasNode:
+		// expanded at its anchor.
+	}
+}
+
+// expand replaces all references within value.
+func expand(value string) (string, []error) {
+	if !strings.Contains(value, "$") {
+		return value, nil
+	}
+
+	var errs []error
+	expanded := referencePattern.ReplaceAllStringFunc(value, func(ref string) string {
+		if ref == "$$" {
+			return "$"
+		}
+		resolved, err := resolve(ref[2 : len(ref)-1])
+		if err != nil {
+			errs = append(errs, err)
+		}
+		return resolved
+	})
+	return expanded, errs
+}
+
+// resolve single reference expression, the part between ${ and }.
+func resolve(expr string) (string, error) {
+	if path, ok := strings.CutPrefix(expr, "file:"); ok {
+		data, err := os.ReadFile(filepath.Clean(path))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+
+	name, fallback, hasFallback := strings.Cut(expr, ":-")
+	if !variableName.MatchString(name) {
+		return "", fmt.Errorf("%w: ${%s}", errInvalidReference, expr)
+	}
+	value, ok := os.LookupEnv(name)
+	switch {
+	case hasFallback && value == "":
+		return fallback, nil
+	case !ok:
+		return "", fmt.Errorf("%w: %s", errMissingVariable, name)
+	}
+	return value, nil
+}
@@ -0,0 +1,172 @@
+package config
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream/forwarder"
+)
+
+const schemaDraft = "http://json-schema.org/draft-07/schema#"
+
+type schema = map[string]any
+
+// JSONSchema JSON Schema of the configuration file, for editor completion and validation.
+// Configuration fields are described by yaml, default, enum and description tags,
+// upstream settings by the upstream type typed settings, see forwarder.Kind.
+func JSONSchema() ([]byte, error) {
+	root := structSchema(reflect.TypeFor[Config]())
+	root["$schema"] = schemaDraft
+	root["title"] = "smtpd-proxy configuration"
+
+	servers := root["properties"].(schema)["smtpd-proxy"].(schema)["properties"].(schema)["upstream-servers"].(schema)
+	servers["items"] = upstreamServerSchema(servers["items"].(schema))
+
+	data, err := json.MarshalIndent(root, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// upstreamServerSchema restricts type to known upstream types and settings to the typed settings of the type.
+func upstreamServerSchema(s schema) schema {
+	properties := s["properties"].(schema)
+	properties["type"].(schema)["enum"] = forwarder.KindNames()
+
+	defaultType, _ := properties["type"].(schema)["default"].(string)
+	kinds := forwarder.Kinds()
+	conditions := make([]schema, 0, len(kinds))
+	for _, kind := range kinds {
+		condition := schema{
+			"properties": schema{"type": schema{"const": kind.Name}},
+		}
+		if kind.Name != defaultType {
+			condition["required"] = []string{"type"}
+		}
+		conditions = append(conditions, schema{
+			"if": condition,
+			"then": schema{
+				"properties": schema{"settings": settingsSchema(kind)},
+			},
+		})
+	}
+	s["allOf"] = conditions
+	return s
+}
+
+func settingsSchema(kind forwarder.Kind) schema {
+	properties := schema{}
+	var required []string
+	for _, f := range kind.Fields() {
+		p := typeSchema(f.Type)
+		if f.Description != "" {
+			p["description"] = f.Description
+		}
+		if len(f.Enum) > 0 {
+			p["enum"] = f.Enum
+		}
+		if f.Required {
+			required = append(required, f.Key)
+			// empty is as good as missing, see forwarder.Kind.ValidateSettings.
+			if f.Type.Kind() == reflect.String {
+				p["minLength"] = 1
+			}
+		}
+		properties[f.Key] = p
+	}
+
+	s := schema{
+		"type":                 "object",
+		"description":          kind.Description,
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+func structSchema(t reflect.Type) schema {
+	properties := schema{}
+	for _, f := range reflect.VisibleFields(t) {
+		key, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		p := typeSchema(f.Type)
+		if description := f.Tag.Get("description"); description != "" {
+			p["description"] = description
+		}
+		if value, ok := defaultValue(f); ok {
+			p["default"] = value
+		}
+		if enum := f.Tag.Get("enum"); enum != "" {
+			p["enum"] = strings.Split(enum, ",")
+		}
+		properties[key] = p
+	}
+	return schema{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+}
+
+func typeSchema(t reflect.Type) schema {
+	if t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == reflect.TypeFor[time.Duration]() {
+		return schema{"type": "string", "pattern": `^([0-9]+(\.[0-9]+)?(ns|us|µs|ms|s|m|h))+$`}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return schema{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return schema{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	default:
+		return schema{"type": "object"}
+	}
+}
+
+// defaultValue default tag value typed as the field, skipping "-" and container defaults.
+func defaultValue(f reflect.StructField) (any, bool) {
+	value := f.Tag.Get("default")
+	if value == "" || value == "-" {
+		return nil, false
+	}
+	if f.Type == reflect.TypeFor[time.Duration]() {
+		return value, true
+	}
+
+	switch f.Type.Kind() {
+	case reflect.String:
+		return value, true
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		return b, err == nil
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		return i, err == nil
+	case reflect.Float64:
+		n, err := strconv.ParseFloat(value, 64)
+		return n, err == nil
+	default:
+		return nil, false
+	}
+}
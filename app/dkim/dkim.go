@@ -0,0 +1,232 @@
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/emersion/go-msgauth/dkim"
+)
+
+var (
+	// ErrNoKey no signing key for the From domain, the message is forwarded unsigned.
+	ErrNoKey = errors.New("no DKIM key for sender domain")
+	// ErrNoFrom missing or unparsable From header, there is no domain to sign for.
+	ErrNoFrom = errors.New("no From address")
+
+	errNoPEM            = errors.New("no PEM block")
+	errKeyType          = errors.New("unsupported key type, expected RSA or Ed25519")
+	errCanonicalization = errors.New("invalid canonicalization, expected header/body of simple or relaxed")
+	errHeadersFrom      = errors.New("signed headers must include From")
+	errDuplicateDomain  = errors.New("duplicate domain")
+)
+
+// DefaultHeaders signed header fields recommended by RFC 6376 section 5.4.1.
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc",
+	"Resent-Date", "Resent-From", "Resent-To", "Resent-Cc",
+	"In-Reply-To", "References", "Message-Id",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding", "Content-ID", "Content-Description",
+	"List-Id", "List-Help", "List-Unsubscribe", "List-Subscribe", "List-Post", "List-Owner", "List-Archive",
+}
+
+// DefaultCanonicalization header/body canonicalization.
+const DefaultCanonicalization = "relaxed/relaxed"
+
+// Key signing key of a domain.
+type Key struct {
+	Domain   string
+	Selector string
+	// KeyFile PEM private key: RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8).
+	KeyFile string
+	// Headers to sign, DefaultHeaders when empty.
+	Headers []string
+	// Canonicalization header/body algorithms, e.g. relaxed/simple, DefaultCanonicalization when empty.
+	Canonicalization string
+}
+
+// Signer signs messages with the key of the From domain.
+type Signer struct {
+	domains map[string]*dkim.SignOptions
+}
+
+// New loads the keys. A key of a domain also signs for its subdomains without a key of their own.
+func New(keys []Key) (*Signer, error) {
+	s := &Signer{domains: make(map[string]*dkim.SignOptions, len(keys))}
+	for _, key := range keys {
+		domain := strings.ToLower(strings.TrimSuffix(key.Domain, "."))
+		if _, ok := s.domains[domain]; ok {
+			return nil, fmt.Errorf("%w: %s", errDuplicateDomain, domain)
+		}
+		opts, err := signOptions(domain, &key)
+		if err != nil {
+			return nil, fmt.Errorf("dkim %s: %w", domain, err)
+		}
+		s.domains[domain] = opts
+	}
+	return s, nil
+}
+
+func signOptions(domain string, key *Key) (*dkim.SignOptions, error) {
+	headerCanon, bodyCanon, err := ParseCanonicalization(key.Canonicalization)
+	if err != nil {
+		return nil, err
+	}
+	headers := key.Headers
+	if len(headers) == 0 {
+		headers = DefaultHeaders
+	}
+	if !slices.ContainsFunc(headers, func(h string) bool { return strings.EqualFold(h, "From") }) {
+		return nil, errHeadersFrom
+	}
+	signer, err := LoadKey(key.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &dkim.SignOptions{
+		Domain:                 domain,
+		Selector:               key.Selector,
+		Signer:                 signer,
+		HeaderCanonicalization: headerCanon,
+		BodyCanonicalization:   bodyCanon,
+		HeaderKeys:             headers,
+	}, nil
+}
+
+// ParseCanonicalization parses header/body canonicalization. The body defaults to simple
+// when only the header algorithm is given, as in the c= tag.
+func ParseCanonicalization(c string) (header, body dkim.Canonicalization, err error) {
+	if c == "" {
+		c = DefaultCanonicalization
+	}
+	h, b, ok := strings.Cut(c, "/")
+	if !ok {
+		b = string(dkim.CanonicalizationSimple)
+	}
+	header, okHeader := canonicalization(h)
+	body, okBody := canonicalization(b)
+	if !okHeader || !okBody {
+		return "", "", fmt.Errorf("%w: %s", errCanonicalization, c)
+	}
+	return header, body, nil
+}
+
+func canonicalization(c string) (dkim.Canonicalization, bool) {
+	switch dkim.Canonicalization(c) {
+	case dkim.CanonicalizationSimple:
+		return dkim.CanonicalizationSimple, true
+	case dkim.CanonicalizationRelaxed:
+		return dkim.CanonicalizationRelaxed, true
+	default:
+		return "", false
+	}
+}
+
+// LoadKey reads PEM private key file.
+func LoadKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	return ParseKey(data)
+}
+
+// ParseKey parses PEM RSA (PKCS #1 or PKCS #8) or Ed25519 (PKCS #8) private key.
+func ParseKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errNoPEM
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: %T", errKeyType, key)
+	}
+}
+
+// Domains signing domains.
+func (s *Signer) Domains() []string {
+	domains := make([]string, 0, len(s.domains))
+	for domain := range s.domains {
+		domains = append(domains, domain)
+	}
+	slices.Sort(domains)
+	return domains
+}
+
+// Sign prepends DKIM-Signature header to the raw message, signed with the key of its From domain,
+// or of the closest parent domain. Returns ErrNoKey when there is none, ErrNoFrom without a From domain.
+func (s *Signer) Sign(raw []byte) (signed []byte, domain string, err error) {
+	from, err := fromDomain(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	opts, ok := s.lookup(from)
+	if !ok {
+		return nil, "", fmt.Errorf("%w: %s", ErrNoKey, from)
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(raw) + 1024)
+	if err := dkim.Sign(&buf, bytes.NewReader(raw), opts); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), opts.Domain, nil
+}
+
+// lookup key of the domain, falling back to parent domains.
+func (s *Signer) lookup(domain string) (*dkim.SignOptions, bool) {
+	for {
+		if opts, ok := s.domains[domain]; ok {
+			return opts, true
+		}
+		_, parent, ok := strings.Cut(domain, ".")
+		if !ok || !strings.Contains(parent, ".") {
+			return nil, false
+		}
+		domain = parent
+	}
+}
+
+// fromDomain domain of the first From header address.
+func fromDomain(raw []byte) (string, error) {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return "", fmt.Errorf("%w: %w", ErrNoFrom, err)
+	}
+	from := header.Get("From")
+	if from == "" {
+		return "", ErrNoFrom
+	}
+	addrs, err := mail.ParseAddressList(from)
+	if err != nil {
+		return "", fmt.Errorf("%w: %s: %w", ErrNoFrom, from, err)
+	}
+	_, domain, ok := strings.Cut(addrs[0].Address, "@")
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrNoFrom, from)
+	}
+	return strings.ToLower(domain), nil
+}
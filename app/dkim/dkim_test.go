@@ -0,0 +1,153 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const message = "From: Sender <sender@mail.example.com>\r\n" +
+	"To: rcpt@example.net\r\n" +
+	"Subject: Hello\r\n" +
+	"X-Mailer: test\r\n" +
+	"\r\n" +
+	"Hello, world!\r\n"
+
+func writeKey(t *testing.T, pemType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dkim.pem")
+	require.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: pemType, Bytes: der}), 0o600))
+	return path
+}
+
+func dnsRecord(t *testing.T, pub crypto.PublicKey) string {
+	t.Helper()
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		require.NoError(t, err)
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	case ed25519.PublicKey:
+		return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)
+	}
+	t.Fatalf("unexpected key %T", pub)
+	return ""
+}
+
+func TestSignVerifies(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	edDER, err := x509.MarshalPKCS8PrivateKey(edKey)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		key      Key
+		pub      crypto.PublicKey
+		expected []string
+	}{
+		{
+			name: "rsa pkcs1 default headers",
+			key: Key{
+				Domain: "example.com", Selector: "s1", KeyFile: writeKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)),
+			},
+			pub:      rsaKey.Public(),
+			expected: []string{"a=rsa-sha256;", "c=relaxed/relaxed;", "s=s1;", "h=From:Reply-To:Subject:"},
+		},
+		{
+			name: "ed25519 pkcs8 custom headers",
+			key: Key{
+				Domain: "mail.example.com", Selector: "ed", KeyFile: writeKey(t, "PRIVATE KEY", edDER),
+				Headers: []string{"From", "Subject"}, Canonicalization: "simple",
+			},
+			pub:      edKey.Public(),
+			expected: []string{"a=ed25519-sha256;", "c=simple/simple;", "s=ed;", "h=From:Subject;"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signer, err := New([]Key{tt.key})
+			require.NoError(t, err)
+
+			signed, domain, err := signer.Sign([]byte(message))
+			require.NoError(t, err)
+			assert.Equal(t, tt.key.Domain, domain)
+			assert.True(t, bytes.HasPrefix(signed, []byte("DKIM-Signature:")))
+			for _, tag := range tt.expected {
+				assert.Contains(t, string(signed), tag)
+			}
+			assert.True(t, bytes.HasSuffix(signed, []byte(message)))
+
+			verifications, err := dkim.VerifyWithOptions(bytes.NewReader(signed), &dkim.VerifyOptions{
+				LookupTXT: func(domain string) ([]string, error) {
+					assert.Equal(t, tt.key.Selector+"._domainkey."+tt.key.Domain, domain)
+					return []string{dnsRecord(t, tt.pub)}, nil
+				},
+			})
+			require.NoError(t, err)
+			require.Len(t, verifications, 1)
+			require.NoError(t, verifications[0].Err)
+			assert.Equal(t, tt.key.Domain, verifications[0].Domain)
+		})
+	}
+}
+
+func TestSignSelectsDomain(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := writeKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+	signer, err := New([]Key{{Domain: "Example.com.", Selector: "s1", KeyFile: keyFile}})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"example.com"}, signer.Domains())
+
+	_, domain, err := signer.Sign([]byte("From: a@Sub.Example.COM\r\n\r\nbody\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, "example.com", domain)
+
+	_, _, err = signer.Sign([]byte("From: a@example.org\r\n\r\nbody\r\n"))
+	require.ErrorIs(t, err, ErrNoKey)
+
+	_, _, err = signer.Sign([]byte("Subject: no from\r\n\r\nbody\r\n"))
+	require.ErrorIs(t, err, ErrNoFrom)
+
+	_, _, err = signer.Sign([]byte("From: not an address\r\n\r\nbody\r\n"))
+	require.ErrorIs(t, err, ErrNoFrom)
+}
+
+func TestNewErrors(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := writeKey(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey))
+
+	tests := []struct {
+		name     string
+		keys     []Key
+		expected error
+	}{
+		{"duplicate", []Key{{Domain: "a.com", KeyFile: keyFile}, {Domain: "A.com", KeyFile: keyFile}}, errDuplicateDomain},
+		{"no from", []Key{{Domain: "a.com", KeyFile: keyFile, Headers: []string{"Subject"}}}, errHeadersFrom},
+		{"canonicalization", []Key{{Domain: "a.com", KeyFile: keyFile, Canonicalization: "relaxed/nowsp"}}, errCanonicalization},
+		{"not pem", []Key{{Domain: "a.com", KeyFile: os.DevNull}}, errNoPEM},
+		{"missing file", []Key{{Domain: "a.com", KeyFile: filepath.Join(t.TempDir(), "none.pem")}}, os.ErrNotExist},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.keys)
+			require.ErrorIs(t, err, tt.expected)
+		})
+	}
+}
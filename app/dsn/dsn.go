@@ -0,0 +1,250 @@
+package dsn
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+// Recipient actions, RFC 3464 section 2.3.3.
+const (
+	ActionFailed = "failed"
+	// ActionRelayed delivered to an upstream, which might not send notifications of its own.
+	ActionRelayed = "relayed"
+)
+
+var errNoRecipients = errors.New("no recipients to report")
+
+// Options notification sender.
+type Options struct {
+	// ReportingMTA host name of the proxy.
+	ReportingMTA string
+	// From notification From address, MAILER-DAEMON@ReportingMTA when empty.
+	From string
+}
+
+// Reporter composes RFC 3464 delivery status notifications.
+type Reporter struct {
+	mta  string
+	from string
+}
+
+// New creates reporter.
+func New(opts Options) *Reporter {
+	from := opts.From
+	if from == "" {
+		from = "MAILER-DAEMON@" + opts.ReportingMTA
+	}
+	return &Reporter{mta: opts.ReportingMTA, from: from}
+}
+
+// Message original message the notification is about.
+type Message struct {
+	// Sender envelope sender, the notification recipient.
+	Sender string
+	// EnvelopeID ENVID of MAIL.
+	EnvelopeID string
+	// Return RET of MAIL: headers only or the full message, full when empty.
+	Return  smtp.DSNReturn
+	Arrival time.Time
+	// Raw message as received.
+	Raw []byte
+}
+
+// Recipient per-recipient fields.
+type Recipient struct {
+	// Address envelope recipient.
+	Address string
+	// OriginalRecipient ORCPT of RCPT, "rfc822;address".
+	OriginalRecipient string
+	Action            string
+	Err               error
+}
+
+// Notifies reports whether the RCPT NOTIFY values ask for a notification of the action.
+// Recipients without NOTIFY get failure notifications only, RFC 3461 section 4.1.
+func Notifies(notify []smtp.DSNNotify, action string) bool {
+	want := smtp.DSNNotifySuccess
+	if action == ActionFailed {
+		want = smtp.DSNNotifyFailure
+		if len(notify) == 0 {
+			return true
+		}
+	}
+	return slices.Contains(notify, want)
+}
+
+// Report multipart/report notification of the message to its envelope sender.
+func (r *Reporter) Report(msg *Message, rcpts []Recipient) ([]byte, error) {
+	if len(rcpts) == 0 {
+		return nil, errNoRecipients
+	}
+
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	if err := r.writeText(w, rcpts); err != nil {
+		return nil, err
+	}
+	if err := r.writeStatus(w, msg, rcpts); err != nil {
+		return nil, err
+	}
+	if err := writeOriginal(w, msg); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	var b bytes.Buffer
+	header := []string{
+		"From: Mail Delivery System <" + r.from + ">",
+		"To: <" + msg.Sender + ">",
+		"Subject: " + subject(rcpts),
+		"Date: " + time.Now().Format(time.RFC1123Z),
+		"Message-Id: <" + messageID(r.mta) + ">",
+		"Auto-Submitted: auto-replied",
+		"MIME-Version: 1.0",
+		`Content-Type: multipart/report; report-type=delivery-status; boundary="` + w.Boundary() + `"`,
+	}
+	for _, line := range header {
+		b.WriteString(line + "\r\n")
+	}
+	b.WriteString("\r\n")
+	b.Write(body.Bytes())
+	return b.Bytes(), nil
+}
+
+// writeText human readable part, with the upstream error of every failed recipient.
+func (r *Reporter) writeText(w *multipart.Writer, rcpts []Recipient) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}})
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "This is the mail system at host %s.\r\n\r\n", r.mta)
+	for _, rcpt := range rcpts {
+		if rcpt.Action == ActionFailed {
+			fmt.Fprintf(&b, "Your message could not be delivered to <%s>:\r\n    %s\r\n\r\n", rcpt.Address, oneLine(rcpt.Err.Error()))
+		} else {
+			fmt.Fprintf(&b, "Your message was relayed to the upstream of <%s>.\r\n\r\n", rcpt.Address)
+		}
+	}
+	_, err = part.Write([]byte(b.String()))
+	return err
+}
+
+// writeStatus message/delivery-status part, RFC 3464 section 2.
+func (r *Reporter) writeStatus(w *multipart.Writer, msg *Message, rcpts []Recipient) error {
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {"message/delivery-status"}})
+	if err != nil {
+		return err
+	}
+	var b strings.Builder
+	b.WriteString("Reporting-MTA: dns; " + r.mta + "\r\n")
+	if msg.EnvelopeID != "" {
+		b.WriteString("Original-Envelope-Id: " + msg.EnvelopeID + "\r\n")
+	}
+	if !msg.Arrival.IsZero() {
+		b.WriteString("Arrival-Date: " + msg.Arrival.Format(time.RFC1123Z) + "\r\n")
+	}
+	for _, rcpt := range rcpts {
+		b.WriteString("\r\n")
+		if rcpt.OriginalRecipient != "" {
+			b.WriteString("Original-Recipient: " + rcpt.OriginalRecipient + "\r\n")
+		}
+		b.WriteString("Final-Recipient: rfc822; " + rcpt.Address + "\r\n")
+		b.WriteString("Action: " + rcpt.Action + "\r\n")
+		if rcpt.Action == ActionFailed {
+			status, diagnostic := statusOf(rcpt.Err)
+			b.WriteString("Status: " + status + "\r\n")
+			b.WriteString("Diagnostic-Code: " + diagnostic + "\r\n")
+		} else {
+			b.WriteString("Status: 2.0.0\r\n")
+		}
+	}
+	_, err = part.Write([]byte(b.String()))
+	return err
+}
+
+// writeOriginal returned message part: the full message, or its header for RET=HDRS.
+func writeOriginal(w *multipart.Writer, msg *Message) error {
+	contentType, content := "message/rfc822", msg.Raw
+	if msg.Return == smtp.DSNReturnHeaders {
+		contentType, content = "text/rfc822-headers", headerOf(msg.Raw)
+	}
+	part, err := w.CreatePart(textproto.MIMEHeader{"Content-Type": {contentType}})
+	if err != nil {
+		return err
+	}
+	_, err = part.Write(content)
+	return err
+}
+
+// statusOf Status and Diagnostic-Code fields of the delivery error.
+func statusOf(err error) (status, diagnostic string) {
+	class := 4
+	if upstream.IsPermanent(err) {
+		class = 5
+	}
+	status = fmt.Sprintf("%d.0.0", class)
+
+	var smtpErr *smtp.SMTPError
+	var protoErr *textproto.Error
+	switch {
+	case errors.As(err, &smtpErr):
+		if code := smtpErr.EnhancedCode; code[0] > 0 {
+			status = fmt.Sprintf("%d.%d.%d", code[0], code[1], code[2])
+			return status, fmt.Sprintf("smtp; %d %s %s", smtpErr.Code, status, oneLine(smtpErr.Message))
+		}
+		return status, fmt.Sprintf("smtp; %d %s", smtpErr.Code, oneLine(smtpErr.Message))
+	case errors.As(err, &protoErr):
+		return status, fmt.Sprintf("smtp; %d %s", protoErr.Code, oneLine(protoErr.Msg))
+	default:
+		return status, "X-smtpd-proxy; " + oneLine(err.Error())
+	}
+}
+
+// headerOf message header, up to the blank line.
+func headerOf(raw []byte) []byte {
+	var b bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(nil, len(raw)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		b.WriteString(line + "\r\n")
+	}
+	return b.Bytes()
+}
+
+func subject(rcpts []Recipient) string {
+	for _, rcpt := range rcpts {
+		if rcpt.Action == ActionFailed {
+			return "Undelivered Mail Returned to Sender"
+		}
+	}
+	return "Successful Mail Delivery Report"
+}
+
+func oneLine(s string) string {
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func messageID(host string) string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return fmt.Sprintf("%d.%s@%s", time.Now().UnixNano(), hex.EncodeToString(b), host)
+}
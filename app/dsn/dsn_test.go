@@ -0,0 +1,111 @@
+package dsn
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNotifies(t *testing.T) {
+	tests := []struct {
+		notify  []smtp.DSNNotify
+		failed  bool
+		relayed bool
+	}{
+		{nil, true, false},
+		{[]smtp.DSNNotify{smtp.DSNNotifyNever}, false, false},
+		{[]smtp.DSNNotify{smtp.DSNNotifySuccess}, false, true},
+		{[]smtp.DSNNotify{smtp.DSNNotifyFailure, smtp.DSNNotifyDelayed}, true, false},
+		{[]smtp.DSNNotify{smtp.DSNNotifySuccess, smtp.DSNNotifyFailure}, true, true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.failed, Notifies(tt.notify, ActionFailed), "%v failed", tt.notify)
+		assert.Equal(t, tt.relayed, Notifies(tt.notify, ActionRelayed), "%v relayed", tt.notify)
+	}
+}
+
+func TestStatusOf(t *testing.T) {
+	tests := []struct {
+		err                error
+		status, diagnostic string
+	}{
+		{
+			&smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 2, 2}, Message: "Mailbox\nfull"},
+			"5.2.2", "smtp; 552 5.2.2 Mailbox full",
+		},
+		{&smtp.SMTPError{Code: 554, EnhancedCode: smtp.NoEnhancedCode, Message: "Rejected"}, "5.0.0", "smtp; 554 Rejected"},
+		{fmt.Errorf("send: %w", &textproto.Error{Code: 451, Msg: "Try later"}), "4.0.0", "smtp; 451 Try later"},
+		{errors.New("connection refused"), "4.0.0", "X-smtpd-proxy; connection refused"},
+	}
+	for _, tt := range tests {
+		status, diagnostic := statusOf(tt.err)
+		assert.Equal(t, tt.status, status, tt.err.Error())
+		assert.Equal(t, tt.diagnostic, diagnostic, tt.err.Error())
+	}
+}
+
+func TestReport(t *testing.T) {
+	original := "From: app@example.com\r\nSubject: hello\r\n\r\nbody\r\n"
+	report, err := New(Options{ReportingMTA: "proxy.example.com"}).Report(&Message{
+		Sender:     "app@example.com",
+		EnvelopeID: "env-1",
+		Arrival:    time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC),
+		Raw:        []byte(original),
+	}, []Recipient{{
+		Address: "gone@example.net",
+		Action:  ActionFailed,
+		Err:     &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "User unknown"},
+	}})
+	require.NoError(t, err)
+
+	msg, err := mail.ReadMessage(bytes.NewReader(report))
+	require.NoError(t, err)
+	assert.Equal(t, "Mail Delivery System <MAILER-DAEMON@proxy.example.com>", msg.Header.Get("From"))
+	assert.Equal(t, "<app@example.com>", msg.Header.Get("To"))
+	assert.Equal(t, "auto-replied", msg.Header.Get("Auto-Submitted"))
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/report", mediaType)
+	assert.Equal(t, "delivery-status", params["report-type"])
+
+	reader := multipart.NewReader(msg.Body, params["boundary"])
+	var parts []string
+	var contents []string
+	for {
+		part, err := reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		content, err := io.ReadAll(part)
+		require.NoError(t, err)
+		parts = append(parts, part.Header.Get("Content-Type"))
+		contents = append(contents, string(content))
+	}
+	require.Equal(t, []string{"text/plain; charset=utf-8", "message/delivery-status", "message/rfc822"}, parts)
+	assert.Contains(t, contents[0], "gone@example.net")
+	assert.Contains(t, contents[0], "User unknown")
+	assert.Equal(t, "Reporting-MTA: dns; proxy.example.com\r\n"+
+		"Original-Envelope-Id: env-1\r\n"+
+		"Arrival-Date: Wed, 01 May 2024 10:00:00 +0000\r\n"+
+		"\r\n"+
+		"Final-Recipient: rfc822; gone@example.net\r\n"+
+		"Action: failed\r\n"+
+		"Status: 5.1.1\r\n"+
+		"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n", contents[1])
+	assert.Equal(t, original, contents[2])
+
+	_, err = New(Options{}).Report(&Message{}, nil)
+	require.ErrorIs(t, err, errNoRecipients)
+}
@@ -0,0 +1,151 @@
+package limits
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrSessions the concurrent sessions limit is reached.
+	ErrSessions = errors.New("too many concurrent sessions")
+	// ErrSessionsPerIP the concurrent sessions limit of the client IP is reached.
+	ErrSessionsPerIP = errors.New("too many concurrent sessions from the client IP")
+	// ErrMessageRate the messages per minute limit is reached.
+	ErrMessageRate = errors.New("message rate limit exceeded")
+	// ErrRecipientRate the recipients per hour limit is reached.
+	ErrRecipientRate = errors.New("recipient rate limit exceeded")
+)
+
+// Options limits, zero disables a limit.
+type Options struct {
+	MaxSessions      int
+	MaxSessionsPerIP int
+	// MessagesPerMinute and RecipientsPerHour per client, see Limiter.Message.
+	MessagesPerMinute int
+	RecipientsPerHour int
+}
+
+// Limiter concurrent sessions and message rates.
+// Rates are token buckets: a client may spend the whole limit at once, then tokens refill evenly over the period.
+type Limiter struct {
+	maxSessions      int
+	maxSessionsPerIP int
+
+	mu         sync.Mutex
+	sessions   int
+	perIP      map[string]int
+	messages   *rate
+	recipients *rate
+}
+
+// New creates limiter.
+func New(opts Options) *Limiter {
+	return &Limiter{
+		maxSessions:      opts.MaxSessions,
+		maxSessionsPerIP: opts.MaxSessionsPerIP,
+		perIP:            map[string]int{},
+		messages:         newRate(opts.MessagesPerMinute, time.Minute),
+		recipients:       newRate(opts.RecipientsPerHour, time.Hour),
+	}
+}
+
+// Open takes a session slot of the client IP. release frees it and may be called more than once.
+func (l *Limiter) Open(ip string) (release func(), err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxSessions > 0 && l.sessions >= l.maxSessions {
+		return nil, ErrSessions
+	}
+	if l.maxSessionsPerIP > 0 && l.perIP[ip] >= l.maxSessionsPerIP {
+		return nil, ErrSessionsPerIP
+	}
+	l.sessions++
+	l.perIP[ip]++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.sessions--
+			if l.perIP[ip]--; l.perIP[ip] <= 0 {
+				delete(l.perIP, ip)
+			}
+		})
+	}, nil
+}
+
+// Message spends a message of the client, the authenticated username or the IP of anonymous sessions.
+func (l *Limiter) Message(client string) error {
+	if !l.messages.allow(client, 1, time.Now()) {
+		return ErrMessageRate
+	}
+	return nil
+}
+
+// Recipient spends a recipient of the client, see Message.
+func (l *Limiter) Recipient(client string) error {
+	if !l.recipients.allow(client, 1, time.Now()) {
+		return ErrRecipientRate
+	}
+	return nil
+}
+
+// rate token buckets by client, nil when unlimited.
+type rate struct {
+	limit  float64
+	period time.Duration
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRate(limit int, period time.Duration) *rate {
+	if limit <= 0 {
+		return nil
+	}
+	return &rate{limit: float64(limit), period: period, buckets: map[string]*bucket{}}
+}
+
+// allow spends n tokens of the client bucket, unless there are not enough.
+func (r *rate) allow(client string, n float64, now time.Time) bool {
+	if r == nil {
+		return true
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sweep(now)
+	b, ok := r.buckets[client]
+	if !ok {
+		b = &bucket{tokens: r.limit, last: now}
+		r.buckets[client] = b
+	}
+	b.tokens = min(r.limit, b.tokens+now.Sub(b.last).Seconds()*r.limit/r.period.Seconds())
+	b.last = now
+	if b.tokens < n {
+		return false
+	}
+	b.tokens -= n
+	return true
+}
+
+// sweep forgets buckets refilled to the limit, at most once per period.
+func (r *rate) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < r.period {
+		return
+	}
+	r.lastSweep = now
+	for client, b := range r.buckets {
+		if now.Sub(b.last) >= r.period {
+			delete(r.buckets, client)
+		}
+	}
+}
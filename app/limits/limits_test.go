@@ -0,0 +1,70 @@
+package limits
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpen(t *testing.T) {
+	l := New(Options{MaxSessions: 3, MaxSessionsPerIP: 2})
+
+	release1, err := l.Open("192.0.2.1")
+	require.NoError(t, err)
+	_, err = l.Open("192.0.2.1")
+	require.NoError(t, err)
+	_, err = l.Open("192.0.2.1")
+	require.ErrorIs(t, err, ErrSessionsPerIP)
+
+	_, err = l.Open("192.0.2.2")
+	require.NoError(t, err)
+	_, err = l.Open("192.0.2.3")
+	require.ErrorIs(t, err, ErrSessions)
+
+	release1()
+	release1()
+	_, err = l.Open("192.0.2.3")
+	require.NoError(t, err, "released once")
+	_, err = l.Open("192.0.2.1")
+	require.ErrorIs(t, err, ErrSessions)
+
+	unlimited := New(Options{})
+	for range 100 {
+		_, err := unlimited.Open("192.0.2.1")
+		require.NoError(t, err)
+	}
+}
+
+func TestRate(t *testing.T) {
+	r := newRate(3, time.Minute)
+	start := time.Now()
+
+	for range 3 {
+		assert.True(t, r.allow("app", 1, start))
+	}
+	assert.False(t, r.allow("app", 1, start), "burst spent")
+	assert.True(t, r.allow("other", 1, start), "clients have own buckets")
+
+	assert.False(t, r.allow("app", 1, start.Add(10*time.Second)), "a third of a token")
+	assert.True(t, r.allow("app", 1, start.Add(20*time.Second)), "one token refilled")
+	assert.False(t, r.allow("app", 1, start.Add(20*time.Second)))
+
+	assert.True(t, r.allow("app", 3, start.Add(10*time.Minute)), "refill is capped at the limit")
+	assert.False(t, r.allow("app", 1, start.Add(10*time.Minute)))
+
+	assert.Len(t, r.buckets, 1, "idle buckets are swept")
+
+	var unlimited *rate
+	assert.True(t, unlimited.allow("app", 1000, start))
+}
+
+func TestMessageAndRecipient(t *testing.T) {
+	l := New(Options{MessagesPerMinute: 1, RecipientsPerHour: 2})
+	require.NoError(t, l.Message("app"))
+	require.ErrorIs(t, l.Message("app"), ErrMessageRate)
+	require.NoError(t, l.Recipient("app"))
+	require.NoError(t, l.Recipient("app"))
+	require.ErrorIs(t, l.Recipient("app"), ErrRecipientRate)
+}
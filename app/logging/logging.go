@@ -0,0 +1,148 @@
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+var errUnknownFormat = errors.New("unknown log format")
+
+const (
+	// FormatText logfmt-like key=value records.
+	FormatText = "text"
+	// FormatJSON one JSON object per record.
+	FormatJSON = "json"
+)
+
+// Options log handler options.
+type Options struct {
+	// Format text or json.
+	Format string
+	Level  slog.Level
+	// File path, stdout when empty. Rotated by size.
+	File       string
+	MaxSizeMB  int
+	MaxBackups int
+	MaxAgeDays int
+	Compress   bool
+}
+
+// New creates logger writing to stdout or rotated file, with session and message IDs
+// from context attached to every record. The returned closer releases the file.
+func New(opts Options) (*slog.Logger, io.Closer, error) {
+	var out io.WriteCloser = nopCloser{os.Stdout}
+	if opts.File != "" {
+		out = &lumberjack.Logger{
+			Filename:   opts.File,
+			MaxSize:    opts.MaxSizeMB,
+			MaxBackups: opts.MaxBackups,
+			MaxAge:     opts.MaxAgeDays,
+			Compress:   opts.Compress,
+		}
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: opts.Level}
+	var handler slog.Handler
+	switch opts.Format {
+	case FormatText, "":
+		handler = slog.NewTextHandler(out, handlerOpts)
+	case FormatJSON:
+		handler = slog.NewJSONHandler(out, handlerOpts)
+	default:
+		return nil, nil, fmt.Errorf("%w: %s, allowed values [text, json]", errUnknownFormat, opts.Format)
+	}
+	return slog.New(NewContextHandler(handler)), out, nil
+}
+
+// ParseLevel parses debug, info, warn or error, case insensitive.
+func ParseLevel(level string) (slog.Level, error) {
+	var l slog.Level
+	err := l.UnmarshalText([]byte(level))
+	return l, err
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// context.Context keys for correlation IDs.
+type (
+	sessionIDKey struct{}
+	messageIDKey struct{}
+)
+
+// NewSessionID random ID for an SMTP session.
+func NewSessionID() string {
+	b := make([]byte, 6)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// NewMessageID ID of the n-th message of the session, prefixed with the session ID
+// so a search for the session finds its messages as well.
+func NewMessageID(sessionID string, n int) string {
+	return sessionID + "-" + strconv.Itoa(n)
+}
+
+// WithSessionID returns a copy of ctx carrying the SMTP session ID.
+func WithSessionID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, sessionIDKey{}, id)
+}
+
+// WithMessageID returns a copy of ctx carrying the message ID.
+func WithMessageID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, messageIDKey{}, id)
+}
+
+// SessionIDFromContext returns the session ID stored in ctx, if any.
+func SessionIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(sessionIDKey{}).(string)
+	return id, ok
+}
+
+// MessageIDFromContext returns the message ID stored in ctx, if any.
+func MessageIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(messageIDKey{}).(string)
+	return id, ok
+}
+
+// ContextHandler adds session_id and message_id from the record context.
+type ContextHandler struct {
+	slog.Handler
+}
+
+// NewContextHandler wraps handler.
+func NewContextHandler(handler slog.Handler) *ContextHandler {
+	return &ContextHandler{Handler: handler}
+}
+
+func (h *ContextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id, ok := SessionIDFromContext(ctx); ok {
+		r.AddAttrs(slog.String("session_id", id))
+	}
+	if id, ok := MessageIDFromContext(ctx); ok {
+		r.AddAttrs(slog.String("message_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h *ContextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &ContextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *ContextHandler) WithGroup(name string) slog.Handler {
+	return &ContextHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,57 @@
+package logging
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestContextIDsAttachedToJSONRecords(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "smtpd-proxy.log")
+	logger, closer, err := New(Options{Format: FormatJSON, Level: slog.LevelDebug, File: path, MaxSizeMB: 1})
+	require.NoError(t, err)
+
+	sessionID := NewSessionID()
+	ctx := WithSessionID(context.Background(), sessionID)
+	logger.DebugContext(ctx, "mail", "from", "app@example.org")
+	ctx = WithMessageID(ctx, NewMessageID(sessionID, 1))
+	logger.With("uid", "uid:0001").InfoContext(ctx, "log-forwarder")
+	logger.InfoContext(context.Background(), "starting server")
+	require.NoError(t, closer.Close())
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	require.Len(t, lines, 3)
+
+	records := make([]map[string]any, 0, len(lines))
+	for _, line := range lines {
+		var record map[string]any
+		require.NoError(t, json.Unmarshal([]byte(line), &record))
+		records = append(records, record)
+	}
+	assert.Equal(t, sessionID, records[0]["session_id"])
+	assert.NotContains(t, records[0], "message_id")
+	assert.Equal(t, sessionID, records[1]["session_id"])
+	assert.Equal(t, sessionID+"-1", records[1]["message_id"])
+	assert.Equal(t, "uid:0001", records[1]["uid"])
+	assert.NotContains(t, records[2], "session_id")
+}
+
+func TestLevelAndFormat(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	require.NoError(t, err)
+	assert.Equal(t, slog.LevelWarn, level)
+	_, err = ParseLevel("verbose")
+	require.Error(t, err)
+
+	_, _, err = New(Options{Format: "xml"})
+	require.ErrorIs(t, err, errUnknownFormat)
+}
@@ -6,13 +6,16 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/smtp"
 	"os"
 	"strconv"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
 	"github.com/leonardinius/smtpd-proxy/app/cmd"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
 	"github.com/stretchr/testify/require"
 )
 
@@ -86,6 +89,93 @@ smtpd-proxy:
 	}
 }
 
+func Test_MainReloadsConfigurationOnSIGHUP(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	ctx, cancel := context.WithCancel(ctx)
+	t.Cleanup(cancel)
+
+	port := dynamicPort()
+	yamlConfig := func(anonAllowed string) string {
+		return fmt.Sprintf(`
+smtpd-proxy:
+  listen: %s:%d
+  ehlo: 127.0.0.1
+  username: user
+  password: secret
+  is_anon_auth_allowed: %s
+  upstream-servers:
+    - type: log
+`, bindHost, port, anonAllowed)
+	}
+
+	cfg, err := createConfigurationFle(t.TempDir(), yamlConfig("false"))
+	require.NoError(t, err)
+
+	go func() {
+		_ = cmd.Main(ctx, "-c", cfg.Name())
+		cancel()
+	}()
+	conn := waitForPortListenStart(ctx, t, port)
+	_ = conn.Close()
+
+	addr := net.JoinHostPort(bindHost, strconv.Itoa(port))
+	mailFrom := func() error {
+		c, err := smtp.Dial(addr)
+		require.NoError(t, err)
+		defer c.Close()
+		return c.Mail("from@example.com")
+	}
+	require.Error(t, mailFrom())
+
+	writeAndReload := func(content string) {
+		require.NoError(t, os.WriteFile(cfg.Name(), []byte(content), 0o600))
+		require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	}
+
+	writeAndReload(yamlConfig("true"))
+	require.Eventually(t, func() bool { return mailFrom() == nil }, 5*time.Second, 50*time.Millisecond)
+
+	// invalid configuration keeps the current one in place.
+	writeAndReload(yamlConfig("true") + "    - type: unknown\n")
+	time.Sleep(200 * time.Millisecond)
+	require.NoError(t, mailFrom())
+}
+
+func Test_MainSubcommands(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	cfg, err := createConfigurationFle(t.TempDir(), `
+smtpd-proxy:
+  upstream-servers:
+    - type: log
+      name: troubleshooting
+    - type: log
+      name: archive
+      mirror: true
+`)
+	require.NoError(t, err)
+
+	require.NoError(t, cmd.Main(ctx, "-c", cfg.Name(), "validate"))
+	require.NoError(t, cmd.Main(ctx, "-c", cfg.Name(), "check-upstreams"))
+	require.NoError(t, cmd.Main(ctx, "-c", cfg.Name(), "send-test", "--to", "to@example.com", "--upstream", "archive"))
+	require.ErrorIs(t, cmd.Main(ctx, "-c", cfg.Name(), "send-test", "--to", "to@example.com", "--upstream", "missing"),
+		upstream.ErrEntryNotFound)
+	require.ErrorContains(t, cmd.Main(ctx, "-c", cfg.Name(), "audit", "--recipient", "to@example.com"), "no audit log")
+
+	invalid, err := createConfigurationFle(t.TempDir(), `
+smtpd-proxy:
+  upstream-servers:
+    - type: smtp
+      settings:
+        address: 127.0.0.1:25
+`)
+	require.NoError(t, err)
+	require.ErrorContains(t, cmd.Main(ctx, "-c", invalid.Name(), "validate"), "settings.address: unknown field")
+}
+
 func waitForPortListenStart(ctx context.Context, t *testing.T, port int) (conn net.Conn) {
 	t.Helper()
 
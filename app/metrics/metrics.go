@@ -0,0 +1,221 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/textproto"
+	"time"
+
+	"github.com/aws/smithy-go"
+	gosmtp "github.com/emersion/go-smtp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "smtpd_proxy"
+
+// Upstream roles within the registry.
+const (
+	RolePrimary = "primary"
+	RoleMirror  = "mirror"
+	RoleShadow  = "shadow"
+)
+
+var (
+	registry = prometheus.NewRegistry()
+
+	connections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "connections_total",
+		Help:      "SMTP connections accepted.",
+	})
+	activeSessions = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "sessions_active",
+		Help:      "SMTP sessions currently open.",
+	})
+	authAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "auth_attempts_total",
+		Help:      "SMTP AUTH attempts by mechanism and result.",
+	}, []string{"mechanism", "result"})
+	limited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "limited_total",
+		Help:      "Sessions, messages and recipients refused by a limit.",
+	}, []string{"limit"})
+	messages = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_total",
+		Help:      "Messages submitted via DATA by status, accepted or rejected.",
+	}, []string{"status"})
+	messageSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "message_size_bytes",
+		Help:      "Size of messages submitted via DATA.",
+		Buckets:   prometheus.ExponentialBuckets(1024, 4, 8),
+	})
+	upstreamAttempts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_forward_attempts_total",
+		Help:      "Forward attempts per upstream.",
+	}, []string{"uid", "name", "type", "role"})
+	upstreamErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upstream_forward_errors_total",
+		Help:      "Failed forward attempts per upstream and error class.",
+	}, []string{"uid", "name", "type", "role", "class"})
+	upstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_forward_duration_seconds",
+		Help:      "Forward latency per upstream.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"uid", "name", "type", "role"})
+	upstreamStageDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upstream_stage_duration_seconds",
+		Help:      "Latency of individual forwarder stages, e.g. smtp dial or ses api call.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type", "stage", "result"})
+)
+
+func init() {
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		connections,
+		activeSessions,
+		authAttempts,
+		limited,
+		messages,
+		messageSize,
+		upstreamAttempts,
+		upstreamErrors,
+		upstreamDuration,
+		upstreamStageDuration,
+	)
+}
+
+// Handler serves metrics in Prometheus exposition format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{Registry: registry})
+}
+
+// Connection records accepted SMTP connection, including the ones refused by the limits.
+func Connection() {
+	connections.Inc()
+}
+
+// SessionOpened records new SMTP session, started by HELO/EHLO.
+func SessionOpened() {
+	activeSessions.Inc()
+}
+
+// SessionClosed records SMTP session end.
+func SessionClosed() {
+	activeSessions.Dec()
+}
+
+// Auth records SMTP AUTH outcome.
+func Auth(mechanism string, err error) {
+	authAttempts.WithLabelValues(mechanism, result(err)).Inc()
+}
+
+// Limited records a session, message or recipient refused by the limit.
+func Limited(limit string) {
+	limited.WithLabelValues(limit).Inc()
+}
+
+// Message records DATA outcome and message size.
+func Message(size int, err error) {
+	status := "accepted"
+	if err != nil {
+		status = "rejected"
+	}
+	messages.WithLabelValues(status).Inc()
+	messageSize.Observe(float64(size))
+}
+
+// Forward records upstream forward attempt.
+func Forward(uid, name, upstreamType, role string, elapsed time.Duration, err error) {
+	upstreamAttempts.WithLabelValues(uid, name, upstreamType, role).Inc()
+	upstreamDuration.WithLabelValues(uid, name, upstreamType, role).Observe(elapsed.Seconds())
+	if err != nil {
+		upstreamErrors.WithLabelValues(uid, name, upstreamType, role, ErrorClass(err)).Inc()
+	}
+}
+
+// Stage starts timing forwarder stage, the returned func records the outcome.
+func Stage(upstreamType, stage string) func(err error) {
+	start := time.Now()
+	return func(err error) {
+		upstreamStageDuration.WithLabelValues(upstreamType, stage, result(err)).Observe(time.Since(start).Seconds())
+	}
+}
+
+func result(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// ErrorClass coarse error category for metrics labels.
+func ErrorClass(err error) string {
+	var (
+		smtpErr  *gosmtp.SMTPError
+		protoErr *textproto.Error
+		apiErr   smithy.APIError
+		netErr   net.Error
+	)
+
+	code := 0
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &smtpErr):
+		code = smtpErr.Code
+	case errors.As(err, &protoErr):
+		code = protoErr.Code
+	case errors.As(err, &apiErr):
+		return apiErrorClass(apiErr)
+	case errors.As(err, &netErr):
+		if netErr.Timeout() {
+			return "timeout"
+		}
+		return "network"
+	default:
+		return "other"
+	}
+
+	switch {
+	case code == 530 || code == 534 || code == 535:
+		return "auth"
+	case code >= 500:
+		return "rejected"
+	case code >= 400:
+		return "temporary"
+	default:
+		return "other"
+	}
+}
+
+func apiErrorClass(err smithy.APIError) string {
+	switch err.ErrorCode() {
+	case "InvalidClientTokenId", "SignatureDoesNotMatch", "AccessDenied", "AccessDeniedException", "UnrecognizedClientException":
+		return "auth"
+	case "Throttling", "ThrottlingException", "SlowDown", "ServiceUnavailable":
+		return "temporary"
+	case "MessageRejected", "MailFromDomainNotVerifiedException", "AccountSendingPausedException":
+		return "rejected"
+	}
+	if err.ErrorFault() == smithy.FaultServer {
+		return "temporary"
+	}
+	return "api"
+}
@@ -0,0 +1,76 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"testing"
+	"time"
+
+	"github.com/aws/smithy-go"
+	gosmtp "github.com/emersion/go-smtp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorClass(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{context.DeadlineExceeded, "timeout"},
+		{fmt.Errorf("wrapped: %w", context.Canceled), "canceled"},
+		{&gosmtp.SMTPError{Code: 535}, "auth"},
+		{&gosmtp.SMTPError{Code: 550}, "rejected"},
+		{&textproto.Error{Code: 451}, "temporary"},
+		{&smithy.GenericAPIError{Code: "MessageRejected"}, "rejected"},
+		{&smithy.GenericAPIError{Code: "Throttling"}, "temporary"},
+		{&smithy.GenericAPIError{Code: "SignatureDoesNotMatch"}, "auth"},
+		{&smithy.GenericAPIError{Code: "Whatever", Fault: smithy.FaultServer}, "temporary"},
+		{&smithy.GenericAPIError{Code: "Whatever"}, "api"},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, "network"},
+		{errors.New("boom"), "other"},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.class, ErrorClass(test.err), "%v", test.err)
+	}
+}
+
+func TestHandlerExposesRecordedMetrics(t *testing.T) {
+	t.Parallel()
+	Connection()
+	SessionOpened()
+	Auth("PLAIN", nil)
+	Message(2048, nil)
+	Forward("uid:0001", "primary", "smtp", RolePrimary, 15*time.Millisecond, &gosmtp.SMTPError{Code: 554})
+	Stage("smtp", "dial")(nil)
+	SessionClosed()
+
+	srv := httptest.NewServer(Handler())
+	defer srv.Close()
+	res, err := http.Get(srv.URL)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+
+	for _, s := range []string{
+		"smtpd_proxy_connections_total",
+		"smtpd_proxy_sessions_active",
+		`smtpd_proxy_auth_attempts_total{mechanism="PLAIN",result="success"}`,
+		`smtpd_proxy_messages_total{status="accepted"}`,
+		"smtpd_proxy_message_size_bytes_bucket",
+		`smtpd_proxy_upstream_forward_attempts_total{name="primary",role="primary",type="smtp",uid="uid:0001"}`,
+		`smtpd_proxy_upstream_forward_errors_total{class="rejected",name="primary",role="primary",type="smtp",uid="uid:0001"}`,
+		"smtpd_proxy_upstream_forward_duration_seconds_bucket",
+		`smtpd_proxy_upstream_stage_duration_seconds_count{result="success",stage="dial",type="smtp"}`,
+	} {
+		assert.Contains(t, string(body), s)
+	}
+}
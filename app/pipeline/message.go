@@ -0,0 +1,127 @@
+package pipeline
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Field header field.
+type Field struct {
+	Name string
+	// raw whole field as in the message: name, folded value and line ending.
+	raw []byte
+}
+
+// NewField creates field, the value must be a valid single line header value.
+func NewField(name, value string) Field {
+	return Field{Name: name, raw: []byte(name + ": " + value + "\r\n")}
+}
+
+// Value unfolded value, leading and trailing white space removed.
+func (f Field) Value() string {
+	_, value, _ := bytes.Cut(f.raw, []byte(":"))
+	value = bytes.ReplaceAll(value, []byte("\r\n"), nil)
+	value = bytes.ReplaceAll(value, []byte("\n"), nil)
+	return strings.TrimSpace(string(value))
+}
+
+// Message header fields in order and the body, kept byte for byte unless modified,
+// so DKIM signatures of untouched fields stay valid.
+type Message struct {
+	Fields []Field
+	// Body blank line ending the header and the body.
+	Body []byte
+}
+
+// Parse splits raw message into header fields and body. Lines without colon are kept as fields.
+func Parse(raw []byte) *Message {
+	msg := &Message{}
+	rest := raw
+	for {
+		n := fieldLen(rest)
+		if n == 0 {
+			msg.Body = rest
+			return msg
+		}
+		name, _, _ := bytes.Cut(rest[:n], []byte(":"))
+		msg.Fields = append(msg.Fields, Field{Name: string(bytes.TrimSpace(name)), raw: rest[:n:n]})
+		rest = rest[n:]
+	}
+}
+
+// fieldLen length of the header field at the start of raw, continuation lines included,
+// 0 at the blank line ending the header.
+func fieldLen(raw []byte) int {
+	n := 0
+	for n < len(raw) {
+		line := raw[n:]
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line = line[:i+1]
+		}
+		blank := len(bytes.TrimRight(line, "\r\n")) == 0
+		if n == 0 && blank {
+			return 0
+		}
+		if n > 0 && (blank || (line[0] != ' ' && line[0] != '\t')) {
+			break
+		}
+		n += len(line)
+	}
+	return n
+}
+
+// Bytes renders the message.
+func (m *Message) Bytes() []byte {
+	size := len(m.Body)
+	for _, f := range m.Fields {
+		size += len(f.raw)
+	}
+	out := make([]byte, 0, size)
+	for _, f := range m.Fields {
+		out = append(out, f.raw...)
+	}
+	return append(out, m.Body...)
+}
+
+// Get value of the first field with the name, case insensitive.
+func (m *Message) Get(name string) string {
+	for _, f := range m.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return f.Value()
+		}
+	}
+	return ""
+}
+
+// Has whether there is a field with the name, case insensitive.
+func (m *Message) Has(name string) bool {
+	for _, f := range m.Fields {
+		if strings.EqualFold(f.Name, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add prepends field, as trace fields are.
+func (m *Message) Add(name, value string) {
+	m.Fields = append([]Field{NewField(name, value)}, m.Fields...)
+}
+
+// Del removes all fields with the name, case insensitive.
+func (m *Message) Del(name string) {
+	m.DelFunc(func(f Field) bool {
+		return strings.EqualFold(f.Name, name)
+	})
+}
+
+// DelFunc removes the fields for which del returns true.
+func (m *Message) DelFunc(del func(Field) bool) {
+	fields := m.Fields[:0]
+	for _, f := range m.Fields {
+		if !del(f) {
+			fields = append(fields, f)
+		}
+	}
+	m.Fields = fields
+}
@@ -0,0 +1,297 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+// Transform types.
+const (
+	TypeAddHeader       = "add-header"
+	TypeRemoveHeader    = "remove-header"
+	TypeRewriteHeader   = "rewrite-header"
+	TypeRewriteAddress  = "rewrite-address"
+	TypeListUnsubscribe = "list-unsubscribe"
+)
+
+var (
+	errUnknownType = errors.New("unknown transform type")
+	errRequired    = errors.New("required")
+)
+
+// Transformer modifies the message before it is forwarded.
+type Transformer interface {
+	Transform(ctx context.Context, msg *Message) error
+}
+
+// Spec transform configuration, Type selects the fields in use.
+type Spec struct {
+	Type string
+	// Name header field name, add-header, remove-header and rewrite-header.
+	Name string
+	// Value add-header value.
+	Value string
+	// Match regular expression on the field value, remove-header removes matching fields only,
+	// rewrite-header replaces the matches.
+	Match string
+	// Replace rewrite-header replacement, $1 expands to the first group.
+	Replace string
+	// Headers rewrite-address fields, From and Reply-To when empty.
+	Headers []string
+	// Domains rewrite-address sender domain to replacement domain.
+	Domains map[string]string
+	// URL and Mailto list-unsubscribe targets, URL is a template of .Recipient, .Sender and .MessageID.
+	URL    string
+	Mailto string
+	// OneClick adds List-Unsubscribe-Post for RFC 8058 one-click unsubscribe, needs URL.
+	OneClick bool
+}
+
+// Pipeline applies transformers in order.
+type Pipeline struct {
+	transformers []Transformer
+}
+
+var _ Transformer = (*Pipeline)(nil)
+
+// New creates the pipeline of specs.
+func New(specs []Spec) (*Pipeline, error) {
+	p := &Pipeline{transformers: make([]Transformer, 0, len(specs))}
+	for i, spec := range specs {
+		t, err := NewTransformer(&spec)
+		if err != nil {
+			return nil, fmt.Errorf("transform %d: %w", i, err)
+		}
+		p.transformers = append(p.transformers, t)
+	}
+	return p, nil
+}
+
+// Transform applies the transformers, stops at the first error.
+func (p *Pipeline) Transform(ctx context.Context, msg *Message) error {
+	for _, t := range p.transformers {
+		if err := t.Transform(ctx, msg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewTransformer creates transformer of the spec type.
+func NewTransformer(spec *Spec) (Transformer, error) {
+	var match *regexp.Regexp
+	if spec.Match != "" {
+		var err error
+		if match, err = regexp.Compile(spec.Match); err != nil {
+			return nil, fmt.Errorf("match: %w", err)
+		}
+	}
+
+	switch spec.Type {
+	case TypeAddHeader:
+		if spec.Name == "" {
+			return nil, fmt.Errorf("name: %w", errRequired)
+		}
+		return &addHeader{name: spec.Name, value: spec.Value}, nil
+	case TypeRemoveHeader:
+		if spec.Name == "" {
+			return nil, fmt.Errorf("name: %w", errRequired)
+		}
+		return &removeHeader{name: spec.Name, match: match}, nil
+	case TypeRewriteHeader:
+		if spec.Name == "" {
+			return nil, fmt.Errorf("name: %w", errRequired)
+		}
+		if match == nil {
+			return nil, fmt.Errorf("match: %w", errRequired)
+		}
+		return &rewriteHeader{name: spec.Name, match: match, replace: spec.Replace}, nil
+	case TypeRewriteAddress:
+		return newRewriteAddress(spec)
+	case TypeListUnsubscribe:
+		return newListUnsubscribe(spec)
+	default:
+		return nil, fmt.Errorf("type: %w: %s, allowed values [%s]", errUnknownType, spec.Type,
+			strings.Join([]string{TypeAddHeader, TypeRemoveHeader, TypeRewriteHeader, TypeRewriteAddress, TypeListUnsubscribe}, ", "))
+	}
+}
+
+// addHeader prepends field.
+type addHeader struct {
+	name, value string
+}
+
+func (t *addHeader) Transform(_ context.Context, msg *Message) error {
+	msg.Add(t.name, t.value)
+	return nil
+}
+
+// removeHeader removes the fields, only those with value matching when match is set.
+type removeHeader struct {
+	name  string
+	match *regexp.Regexp
+}
+
+func (t *removeHeader) Transform(_ context.Context, msg *Message) error {
+	msg.DelFunc(func(f Field) bool {
+		return strings.EqualFold(f.Name, t.name) && (t.match == nil || t.match.MatchString(f.Value()))
+	})
+	return nil
+}
+
+// rewriteHeader replaces the matches in the field values.
+type rewriteHeader struct {
+	name    string
+	match   *regexp.Regexp
+	replace string
+}
+
+func (t *rewriteHeader) Transform(_ context.Context, msg *Message) error {
+	for i, f := range msg.Fields {
+		if !strings.EqualFold(f.Name, t.name) {
+			continue
+		}
+		value := f.Value()
+		if rewritten := t.match.ReplaceAllString(value, t.replace); rewritten != value {
+			msg.Fields[i] = NewField(f.Name, rewritten)
+		}
+	}
+	return nil
+}
+
+// rewriteAddress replaces the domain of the addresses in the fields.
+type rewriteAddress struct {
+	headers []string
+	domains map[string]string
+}
+
+func newRewriteAddress(spec *Spec) (*rewriteAddress, error) {
+	if len(spec.Domains) == 0 {
+		return nil, fmt.Errorf("domains: %w", errRequired)
+	}
+	t := &rewriteAddress{headers: spec.Headers, domains: make(map[string]string, len(spec.Domains))}
+	if len(t.headers) == 0 {
+		t.headers = []string{"From", "Reply-To"}
+	}
+	for from, to := range spec.Domains {
+		t.domains[strings.ToLower(from)] = to
+	}
+	return t, nil
+}
+
+func (t *rewriteAddress) Transform(_ context.Context, msg *Message) error {
+	for i, f := range msg.Fields {
+		if !t.rewrites(f.Name) {
+			continue
+		}
+		// unparsable lists are left as is.
+		addrs, err := mail.ParseAddressList(f.Value())
+		if err != nil {
+			continue
+		}
+		changed := false
+		formatted := make([]string, 0, len(addrs))
+		for _, addr := range addrs {
+			if local, domain, ok := strings.Cut(addr.Address, "@"); ok {
+				if to, ok := t.domains[strings.ToLower(domain)]; ok {
+					addr.Address = local + "@" + to
+					changed = true
+				}
+			}
+			formatted = append(formatted, addr.String())
+		}
+		if changed {
+			msg.Fields[i] = NewField(f.Name, strings.Join(formatted, ", "))
+		}
+	}
+	return nil
+}
+
+func (t *rewriteAddress) rewrites(name string) bool {
+	for _, header := range t.headers {
+		if strings.EqualFold(header, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// listUnsubscribe adds List-Unsubscribe to messages without one.
+type listUnsubscribe struct {
+	url *template.Template
+	// perRecipient the URL is of the recipient, messages to several recipients get no URL.
+	perRecipient bool
+	mailto       string
+	oneClick     bool
+}
+
+// unsubscribeData list-unsubscribe URL template data, query escaped.
+type unsubscribeData struct {
+	// Recipient the envelope recipient of single recipient messages.
+	Recipient string
+	Sender    string
+	MessageID string
+}
+
+func newListUnsubscribe(spec *Spec) (*listUnsubscribe, error) {
+	if spec.URL == "" && spec.Mailto == "" {
+		return nil, fmt.Errorf("url or mailto: %w", errRequired)
+	}
+	if spec.OneClick && spec.URL == "" {
+		return nil, fmt.Errorf("url: %w: for one-click", errRequired)
+	}
+	t := &listUnsubscribe{mailto: spec.Mailto, oneClick: spec.OneClick}
+	if spec.URL != "" {
+		var err error
+		if t.url, err = template.New("url").Option("missingkey=error").Parse(spec.URL); err != nil {
+			return nil, fmt.Errorf("url: %w", err)
+		}
+		t.perRecipient = strings.Contains(spec.URL, ".Recipient")
+	}
+	return t, nil
+}
+
+func (t *listUnsubscribe) Transform(ctx context.Context, msg *Message) error {
+	if msg.Has("List-Unsubscribe") {
+		return nil
+	}
+
+	var targets []string
+	envelope, _ := upstream.EnvelopeFromContext(ctx)
+	// one message to several recipients must not unsubscribe them all with the link of one.
+	withURL := t.url != nil && (!t.perRecipient || envelope != nil && len(envelope.To) == 1)
+	if withURL {
+		data := unsubscribeData{MessageID: url.QueryEscape(strings.Trim(msg.Get("Message-Id"), "<>"))}
+		if envelope != nil {
+			data.Sender = url.QueryEscape(envelope.From)
+			if len(envelope.To) == 1 {
+				data.Recipient = url.QueryEscape(envelope.To[0])
+			}
+		}
+		var target strings.Builder
+		if err := t.url.Execute(&target, &data); err != nil {
+			return fmt.Errorf("list-unsubscribe url: %w", err)
+		}
+		targets = append(targets, "<"+target.String()+">")
+	}
+	if t.mailto != "" {
+		targets = append(targets, "<mailto:"+t.mailto+">")
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	if t.oneClick && withURL {
+		msg.Add("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+	msg.Add("List-Unsubscribe", strings.Join(targets, ", "))
+	return nil
+}
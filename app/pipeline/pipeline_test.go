@@ -0,0 +1,173 @@
+package pipeline
+
+import (
+	"context"
+	"testing"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const raw = "Received: from app.internal (10.0.0.1)\r\n" +
+	"\tby relay.internal; Mon, 1 Jan 2024 00:00:00 +0000\r\n" +
+	"Received: from edge.example.com by mx.example.com\r\n" +
+	"From: App <app@internal.example.com>\r\n" +
+	"Reply-To: support@internal.example.com, other@example.org\r\n" +
+	"X-Mailer: app 1.0\r\n" +
+	"Subject: hello\r\n" +
+	"Message-Id: <id-1@example.com>\r\n" +
+	"\r\n" +
+	"X-Mailer: not a header\r\n"
+
+func TestParseRoundTrip(t *testing.T) {
+	for _, in := range []string{
+		raw,
+		"Subject: bare newlines\n folded\n\nbody\n",
+		"Subject: no body\r\n",
+		"\r\nbody only\r\n",
+	} {
+		msg := Parse([]byte(in))
+		assert.Equal(t, in, string(msg.Bytes()))
+	}
+
+	msg := Parse([]byte(raw))
+	require.Len(t, msg.Fields, 7)
+	assert.Equal(t, "Received", msg.Fields[0].Name)
+	assert.Equal(t, "from app.internal (10.0.0.1)\tby relay.internal; Mon, 1 Jan 2024 00:00:00 +0000", msg.Fields[0].Value())
+	assert.Equal(t, "hello", msg.Get("subject"))
+	assert.Equal(t, "\r\nX-Mailer: not a header\r\n", string(msg.Body))
+}
+
+func TestTransform(t *testing.T) {
+	ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{
+		From: "bounce@example.com",
+		To:   []string{"to@example.net", "cc@example.net"},
+	})
+	tests := []struct {
+		name     string
+		specs    []Spec
+		contains []string
+		missing  []string
+	}{
+		{
+			name:     "add header",
+			specs:    []Spec{{Type: TypeAddHeader, Name: "X-Relayed-By", Value: "smtpd-proxy"}},
+			contains: []string{"X-Relayed-By: smtpd-proxy\r\nReceived: from app.internal"},
+		},
+		{
+			name:     "remove header",
+			specs:    []Spec{{Type: TypeRemoveHeader, Name: "x-mailer"}},
+			contains: []string{"Subject: hello\r\n", "\r\n\r\nX-Mailer: not a header\r\n"},
+			missing:  []string{"X-Mailer: app"},
+		},
+		{
+			name:     "remove matching header",
+			specs:    []Spec{{Type: TypeRemoveHeader, Name: "Received", Match: `\.internal\b`}},
+			contains: []string{"Received: from edge.example.com"},
+			missing:  []string{"app.internal", "relay.internal"},
+		},
+		{
+			name:     "rewrite header",
+			specs:    []Spec{{Type: TypeRewriteHeader, Name: "Subject", Match: `^(.*)$`, Replace: "[relay] $1"}},
+			contains: []string{"Subject: [relay] hello\r\n"},
+		},
+		{
+			name:     "rewrite address",
+			specs:    []Spec{{Type: TypeRewriteAddress, Domains: map[string]string{"Internal.Example.com": "example.com"}}},
+			contains: []string{"From: \"App\" <app@example.com>\r\n", "Reply-To: <support@example.com>, <other@example.org>\r\n"},
+			missing:  []string{"@internal.example.com"},
+		},
+		{
+			name: "list unsubscribe",
+			specs: []Spec{{
+				Type:     TypeListUnsubscribe,
+				URL:      "https://example.com/u?r={{.Recipient}}&id={{.MessageID}}",
+				Mailto:   "unsubscribe@example.com",
+				OneClick: true,
+			}},
+			contains: []string{"List-Unsubscribe: <mailto:unsubscribe@example.com>\r\n"},
+			missing:  []string{"https://example.com/u", "List-Unsubscribe-Post"},
+		},
+		{
+			name: "in order",
+			specs: []Spec{
+				{Type: TypeAddHeader, Name: "X-Stage", Value: "one"},
+				{Type: TypeRewriteHeader, Name: "X-Stage", Match: "one", Replace: "two"},
+			},
+			contains: []string{"X-Stage: two\r\n"},
+			missing:  []string{"X-Stage: one"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := New(tt.specs)
+			require.NoError(t, err)
+			msg := Parse([]byte(raw))
+			require.NoError(t, p.Transform(ctx, msg))
+			out := string(msg.Bytes())
+			for _, s := range tt.contains {
+				assert.Contains(t, out, s)
+			}
+			for _, s := range tt.missing {
+				assert.NotContains(t, out, s)
+			}
+		})
+	}
+}
+
+func TestListUnsubscribeKeepsExisting(t *testing.T) {
+	p, err := New([]Spec{{Type: TypeListUnsubscribe, Mailto: "unsubscribe@example.com"}})
+	require.NoError(t, err)
+	in := "List-Unsubscribe: <mailto:list@example.org>\r\nSubject: hello\r\n\r\nbody\r\n"
+	msg := Parse([]byte(in))
+	require.NoError(t, p.Transform(context.Background(), msg))
+	assert.Equal(t, in, string(msg.Bytes()))
+}
+
+func TestListUnsubscribeURL(t *testing.T) {
+	transform := func(t *testing.T, spec Spec, to ...string) string {
+		t.Helper()
+		p, err := New([]Spec{spec})
+		require.NoError(t, err)
+		ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{From: "bounce+id=1@example.com", To: to})
+		msg := Parse([]byte(raw))
+		require.NoError(t, p.Transform(ctx, msg))
+		return string(msg.Bytes())
+	}
+	recipientURL := Spec{
+		Type:     TypeListUnsubscribe,
+		URL:      "https://example.com/u?r={{.Recipient}}&id={{.MessageID}}",
+		OneClick: true,
+	}
+
+	out := transform(t, recipientURL, "to+tag&x=y@example.net")
+	assert.Contains(t, out, "List-Unsubscribe: <https://example.com/u?r=to%2Btag%26x%3Dy%40example.net&id=id-1%40example.com>\r\n")
+	assert.Contains(t, out, "List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+
+	out = transform(t, recipientURL, "to@example.net", "cc@example.net")
+	assert.NotContains(t, out, "List-Unsubscribe", "no link of one recipient for all")
+
+	out = transform(t, Spec{Type: TypeListUnsubscribe, URL: "https://example.com/u?s={{.Sender}}"}, "to@example.net", "cc@example.net")
+	assert.Contains(t, out, "List-Unsubscribe: <https://example.com/u?s=bounce%2Bid%3D1%40example.com>\r\n")
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		spec     Spec
+		expected string
+	}{
+		{Spec{Type: "drop-message"}, "transform 0: type: unknown transform type: drop-message"},
+		{Spec{Type: TypeAddHeader}, "transform 0: name: required"},
+		{Spec{Type: TypeRemoveHeader, Name: "Received", Match: "("}, "transform 0: match: error parsing regexp"},
+		{Spec{Type: TypeRewriteHeader, Name: "Subject"}, "transform 0: match: required"},
+		{Spec{Type: TypeRewriteAddress}, "transform 0: domains: required"},
+		{Spec{Type: TypeListUnsubscribe}, "transform 0: url or mailto: required"},
+		{Spec{Type: TypeListUnsubscribe, Mailto: "u@example.com", OneClick: true}, "transform 0: url: required: for one-click"},
+		{Spec{Type: TypeListUnsubscribe, URL: "https://example.com/{{.Recipient"}, "transform 0: url: template"},
+	}
+	for _, tt := range tests {
+		_, err := New([]Spec{tt.spec})
+		require.ErrorContains(t, err, tt.expected)
+	}
+}
@@ -0,0 +1,154 @@
+package policy
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"path"
+	"strings"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+var (
+	// ErrAttachmentSize an attachment is over the size limit.
+	ErrAttachmentSize = errors.New("attachment too big")
+	// ErrAttachmentType an attachment has a blocked file extension or MIME type.
+	ErrAttachmentType = errors.New("attachment type not allowed")
+	// ErrAttachmentTLS attachments over the size require a TLS session.
+	ErrAttachmentTLS = errors.New("attachment requires TLS")
+)
+
+// MessageRules message size, recipient count and attachment limits. Zero disables a limit.
+type MessageRules struct {
+	MaxMessageBytes int
+	MaxRecipients   int
+	// MaxAttachmentBytes decoded size of a single attachment.
+	MaxAttachmentBytes int
+	// BlockedExtensions file name extensions, e.g. ".exe".
+	BlockedExtensions []string
+	// BlockedTypes MIME types, type/* matches the subtypes.
+	BlockedTypes []string
+	// TLSAttachmentBytes attachments over the size are accepted in TLS sessions only.
+	TLSAttachmentBytes int
+}
+
+// MessageOverrides rules of a user, nil fields are inherited from the defaults. Zero disables a limit.
+type MessageOverrides struct {
+	MaxMessageBytes    *int
+	MaxRecipients      *int
+	MaxAttachmentBytes *int
+	BlockedExtensions  []string
+	BlockedTypes       []string
+	TLSAttachmentBytes *int
+}
+
+// merge overrides with the unset fields taken from defaults.
+func (o MessageOverrides) merge(defaults MessageRules) MessageRules {
+	r := defaults
+	override(&r.MaxMessageBytes, o.MaxMessageBytes)
+	override(&r.MaxRecipients, o.MaxRecipients)
+	override(&r.MaxAttachmentBytes, o.MaxAttachmentBytes)
+	override(&r.TLSAttachmentBytes, o.TLSAttachmentBytes)
+	if o.BlockedExtensions != nil {
+		r.BlockedExtensions = o.BlockedExtensions
+	}
+	if o.BlockedTypes != nil {
+		r.BlockedTypes = o.BlockedTypes
+	}
+	return r.normalize()
+}
+
+func override(limit, value *int) {
+	if value != nil {
+		*limit = *value
+	}
+}
+
+// Messages message rules of every user, with per-user overrides.
+type Messages struct {
+	defaults MessageRules
+	users    map[string]MessageRules
+}
+
+// NewMessages creates message rules, users override the set fields of defaults by SMTP auth username.
+func NewMessages(defaults MessageRules, users map[string]MessageOverrides) *Messages {
+	m := &Messages{defaults: defaults.normalize(), users: make(map[string]MessageRules, len(users))}
+	for user, overrides := range users {
+		m.users[user] = overrides.merge(m.defaults)
+	}
+	return m
+}
+
+// Rules of the user, the defaults when anonymous or without overrides.
+func (m *Messages) Rules(user string) MessageRules {
+	if rules, ok := m.users[user]; ok {
+		return rules
+	}
+	return m.defaults
+}
+
+// Max the largest message size and recipient count of any user, zero when one is unlimited.
+func (m *Messages) Max() (maxMessageBytes, maxRecipients int) {
+	maxMessageBytes, maxRecipients = m.defaults.MaxMessageBytes, m.defaults.MaxRecipients
+	for _, rules := range m.users {
+		maxMessageBytes = maxLimit(maxMessageBytes, rules.MaxMessageBytes)
+		maxRecipients = maxLimit(maxRecipients, rules.MaxRecipients)
+	}
+	return maxMessageBytes, maxRecipients
+}
+
+// CheckAttachments returns ErrAttachmentType, ErrAttachmentSize or ErrAttachmentTLS for the first attachment
+// breaking the rules.
+func (r *MessageRules) CheckAttachments(attachments []*upstream.Attachment, tls bool) error {
+	for _, a := range attachments {
+		name := strings.ToLower(a.Filename)
+		for _, ext := range r.BlockedExtensions {
+			if strings.HasSuffix(name, ext) {
+				return fmt.Errorf("%w: %s", ErrAttachmentType, a.Filename)
+			}
+		}
+		if mediaType, _, err := mime.ParseMediaType(a.ContentType); err == nil {
+			for _, blocked := range r.BlockedTypes {
+				if matched, _ := path.Match(blocked, mediaType); matched {
+					return fmt.Errorf("%w: %s %s", ErrAttachmentType, a.Filename, mediaType)
+				}
+			}
+		}
+		size := len(a.Content)
+		if r.MaxAttachmentBytes > 0 && size > r.MaxAttachmentBytes {
+			return fmt.Errorf("%w: %s %d bytes, limit %d", ErrAttachmentSize, a.Filename, size, r.MaxAttachmentBytes)
+		}
+		if r.TLSAttachmentBytes > 0 && size > r.TLSAttachmentBytes && !tls {
+			return fmt.Errorf("%w: %s %d bytes over %d", ErrAttachmentTLS, a.Filename, size, r.TLSAttachmentBytes)
+		}
+	}
+	return nil
+}
+
+// normalize lower case extensions with the leading dot and lower case MIME types.
+func (r MessageRules) normalize() MessageRules {
+	if r.BlockedExtensions != nil {
+		exts := make([]string, 0, len(r.BlockedExtensions))
+		for _, ext := range r.BlockedExtensions {
+			exts = append(exts, "."+strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), "."))
+		}
+		r.BlockedExtensions = exts
+	}
+	if r.BlockedTypes != nil {
+		types := make([]string, 0, len(r.BlockedTypes))
+		for _, t := range r.BlockedTypes {
+			types = append(types, strings.ToLower(strings.TrimSpace(t)))
+		}
+		r.BlockedTypes = types
+	}
+	return r
+}
+
+// maxLimit larger of the limits, where zero is unlimited.
+func maxLimit(a, b int) int {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return max(a, b)
+}
@@ -0,0 +1,106 @@
+package policy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+// AnyUser sender rule user matching sessions without a rule of their own, anonymous ones included.
+const AnyUser = "*"
+
+var (
+	// ErrSenderDomain the user may not send as the envelope sender domain.
+	ErrSenderDomain = errors.New("sender domain not permitted")
+	// ErrSuppressed the recipient is on the suppression list.
+	ErrSuppressed = errors.New("recipient suppressed")
+)
+
+// SenderRule domains the user may send as, subdomains included.
+type SenderRule struct {
+	// User SMTP auth username, AnyUser for the others.
+	User    string
+	Domains []string
+}
+
+// Suppression list of recipients never to deliver to.
+type Suppression interface {
+	// Suppressed reports whether the address, or its domain, is suppressed.
+	Suppressed(ctx context.Context, address string) (bool, error)
+}
+
+// Options policy rules. Zero value permits everything.
+type Options struct {
+	Senders []SenderRule
+	// Suppression lists checked in order.
+	Suppression []Suppression
+}
+
+// Policy checks envelope senders and recipients.
+type Policy struct {
+	senders     map[string][]string
+	suppression []Suppression
+}
+
+// New creates policy.
+func New(opts Options) *Policy {
+	p := &Policy{senders: make(map[string][]string, len(opts.Senders)), suppression: opts.Suppression}
+	for _, rule := range opts.Senders {
+		for _, domain := range rule.Domains {
+			p.senders[rule.User] = append(p.senders[rule.User], strings.ToLower(strings.TrimPrefix(domain, "@")))
+		}
+	}
+	return p
+}
+
+// CheckSender returns ErrSenderDomain when the user, empty when anonymous, may not send as from.
+// Users without a rule fall back to the AnyUser rule, and are unrestricted without one.
+// The null reverse-path of bounces is permitted.
+func (p *Policy) CheckSender(user, from string) error {
+	domains, ok := p.senders[user]
+	if !ok {
+		domains, ok = p.senders[AnyUser]
+	}
+	if !ok || from == "" {
+		return nil
+	}
+	if domain := domainOf(from); domain != "" {
+		for _, permitted := range domains {
+			if domain == permitted || strings.HasSuffix(domain, "."+permitted) {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrSenderDomain, from)
+}
+
+// CheckRecipient returns ErrSuppressed when the recipient is on a suppression list,
+// other errors are lookup failures.
+func (p *Policy) CheckRecipient(ctx context.Context, rcpt string) error {
+	for _, list := range p.suppression {
+		suppressed, err := list.Suppressed(ctx, rcpt)
+		if err != nil {
+			return err
+		}
+		if suppressed {
+			return fmt.Errorf("%w: %s", ErrSuppressed, rcpt)
+		}
+	}
+	return nil
+}
+
+// normalize lower case address without display name and angle brackets.
+func normalize(address string) string {
+	return strings.ToLower(upstream.AddressOf(address))
+}
+
+func domainOf(address string) string {
+	_, domain, ok := strings.Cut(normalize(address), "@")
+	if !ok {
+		return ""
+	}
+	return domain
+}
@@ -0,0 +1,145 @@
+package policy
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckSender(t *testing.T) {
+	p := New(Options{Senders: []SenderRule{
+		{User: "app", Domains: []string{"example.com", "@Example.org"}},
+		{User: AnyUser, Domains: []string{"shared.example"}},
+	}})
+
+	tests := []struct {
+		user, from string
+		err        bool
+	}{
+		{"app", "noreply@example.com", false},
+		{"app", "Billing <billing@mail.EXAMPLE.com>", false},
+		{"app", "info@example.org", false},
+		{"app", "info@notexample.com", true},
+		{"app", "info@shared.example", true},
+		{"app", "", false},
+		{"other", "info@shared.example", false},
+		{"", "info@example.com", true},
+		{"", "not-an-address", true},
+	}
+	for _, tt := range tests {
+		err := p.CheckSender(tt.user, tt.from)
+		if tt.err {
+			require.ErrorIs(t, err, ErrSenderDomain, "%s as %q", tt.user, tt.from)
+		} else {
+			require.NoError(t, err, "%s as %q", tt.user, tt.from)
+		}
+	}
+
+	require.NoError(t, New(Options{}).CheckSender("anyone", "x@anywhere.example"), "no rules")
+}
+
+func TestSuppressionList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "suppressed.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# bounced\nBounced@example.com\n\n@blocked.example\nspam.example\n"), 0o600))
+	list, err := LoadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, list.Len())
+
+	p := New(Options{Suppression: []Suppression{list}})
+	ctx := context.Background()
+	require.ErrorIs(t, p.CheckRecipient(ctx, "<bounced@EXAMPLE.com>"), ErrSuppressed)
+	require.ErrorIs(t, p.CheckRecipient(ctx, "anyone@blocked.example"), ErrSuppressed)
+	require.ErrorIs(t, p.CheckRecipient(ctx, "anyone@spam.example"), ErrSuppressed)
+	require.NoError(t, p.CheckRecipient(ctx, "delivered@example.com"))
+
+	_, err = LoadFile(filepath.Join(t.TempDir(), "missing.txt"))
+	require.Error(t, err)
+}
+
+func TestSuppressionSQLite(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "suppression.db")
+	db, err := OpenSQLite(ctx, path)
+	require.NoError(t, err)
+
+	require.NoError(t, db.Add(ctx, "Bounced@example.com", "hard bounce"))
+	require.NoError(t, db.Add(ctx, "bounced@example.com", "duplicate"))
+	require.NoError(t, db.Add(ctx, "blocked.example", "complaint"))
+
+	suppressed, err := db.Suppressed(ctx, "bounced@example.com")
+	require.NoError(t, err)
+	assert.True(t, suppressed)
+	suppressed, err = db.Suppressed(ctx, "someone@blocked.example")
+	require.NoError(t, err)
+	assert.True(t, suppressed)
+	suppressed, err = db.Suppressed(ctx, "delivered@example.com")
+	require.NoError(t, err)
+	assert.False(t, suppressed)
+	require.NoError(t, db.Close())
+
+	reopened, err := OpenSQLite(ctx, path)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = reopened.Close() })
+	p := New(Options{Suppression: []Suppression{reopened}})
+	require.ErrorIs(t, p.CheckRecipient(ctx, "bounced@example.com"), ErrSuppressed, "entries persist")
+}
+
+func TestMessages(t *testing.T) {
+	hundred, fifty, zero := 100, 50, 0
+	m := NewMessages(
+		MessageRules{MaxMessageBytes: 1000, MaxRecipients: 10, BlockedExtensions: []string{"EXE", ".bat"}},
+		map[string]MessageOverrides{
+			"bulk":      {MaxRecipients: &hundred, BlockedExtensions: []string{}},
+			"unlimited": {MaxMessageBytes: &zero, MaxAttachmentBytes: &fifty},
+		},
+	)
+
+	assert.Equal(t, MessageRules{MaxMessageBytes: 1000, MaxRecipients: 10, BlockedExtensions: []string{".exe", ".bat"}}, m.Rules(""))
+	assert.Equal(t, MessageRules{MaxMessageBytes: 1000, MaxRecipients: 100, BlockedExtensions: []string{}}, m.Rules("bulk"))
+	assert.Equal(t, m.Rules(""), m.Rules("other"))
+	assert.Equal(t, MessageRules{MaxRecipients: 10, MaxAttachmentBytes: 50, BlockedExtensions: []string{".exe", ".bat"}}, m.Rules("unlimited"))
+
+	maxMessageBytes, maxRecipients := m.Max()
+	assert.Equal(t, 0, maxMessageBytes, "unlimited for one user")
+	assert.Equal(t, 100, maxRecipients)
+}
+
+func TestCheckAttachments(t *testing.T) {
+	rules := NewMessages(MessageRules{
+		MaxAttachmentBytes: 100,
+		BlockedExtensions:  []string{"exe"},
+		BlockedTypes:       []string{"application/x-msdownload", "video/*"},
+		TLSAttachmentBytes: 10,
+	}, nil).Rules("")
+	attachment := func(name, contentType string, size int) []*upstream.Attachment {
+		return []*upstream.Attachment{{Filename: name, ContentType: contentType, Content: make([]byte, size)}}
+	}
+
+	tests := []struct {
+		attachments []*upstream.Attachment
+		tls         bool
+		err         error
+	}{
+		{nil, false, nil},
+		{attachment("report.pdf", "application/pdf", 10), false, nil},
+		{attachment("Setup.EXE", "application/octet-stream", 1), true, ErrAttachmentType},
+		{attachment("setup", "application/x-msdownload; name=setup", 1), true, ErrAttachmentType},
+		{attachment("clip.mp4", "video/mp4", 1), true, ErrAttachmentType},
+		{attachment("report.pdf", "application/pdf", 101), true, ErrAttachmentSize},
+		{attachment("report.pdf", "application/pdf", 11), false, ErrAttachmentTLS},
+		{attachment("report.pdf", "application/pdf", 11), true, nil},
+	}
+	for _, tt := range tests {
+		err := rules.CheckAttachments(tt.attachments, tt.tls)
+		if tt.err != nil {
+			require.ErrorIs(t, err, tt.err, "%v", tt.attachments)
+		} else {
+			require.NoError(t, err, "%v", tt.attachments)
+		}
+	}
+}
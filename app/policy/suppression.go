@@ -0,0 +1,136 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// registers the pure Go "sqlite" database/sql driver.
+	_ "modernc.org/sqlite"
+)
+
+// entries suppression list keys of the address: the address and @domain.
+func entries(address string) []string {
+	address = normalize(address)
+	keys := []string{address}
+	if _, domain, ok := strings.Cut(address, "@"); ok {
+		keys = append(keys, "@"+domain)
+	}
+	return keys
+}
+
+// normalizeEntry suppression list entry: lower case address, or @domain for domains.
+func normalizeEntry(entry string) string {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if !strings.Contains(entry, "@") {
+		return "@" + entry
+	}
+	return entry
+}
+
+// List suppression list read from a file: one address or domain per line, @domain is accepted too.
+// Blank lines and lines starting with # are skipped.
+type List struct {
+	entries map[string]struct{}
+}
+
+var _ Suppression = (*List)(nil)
+
+// LoadFile reads the list file.
+func LoadFile(path string) (*List, error) {
+	file, err := os.Open(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	l := &List{entries: map[string]struct{}{}}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		l.entries[normalizeEntry(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return l, nil
+}
+
+// Len number of entries.
+func (l *List) Len() int {
+	return len(l.entries)
+}
+
+// Suppressed reports whether the address, or its domain, is listed.
+func (l *List) Suppressed(_ context.Context, address string) (bool, error) {
+	for _, key := range entries(address) {
+		if _, ok := l.entries[key]; ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// SQLite suppression list kept in the suppressions table of a SQLite database, created when missing.
+// Entries are lower case addresses or @domain.
+type SQLite struct {
+	db *sql.DB
+}
+
+var _ Suppression = (*SQLite)(nil)
+
+const sqliteSchema = `CREATE TABLE IF NOT EXISTS suppressions (
+	address    TEXT PRIMARY KEY,
+	reason     TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL
+)`
+
+// OpenSQLite opens the database, creating the file and the table when missing.
+func OpenSQLite(ctx context.Context, path string) (*SQLite, error) {
+	db, err := sql.Open("sqlite", "file:"+filepath.Clean(path)+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.ExecContext(ctx, sqliteSchema); err != nil {
+		return nil, errors.Join(err, db.Close())
+	}
+	return &SQLite{db: db}, nil
+}
+
+// Suppressed reports whether the address, or its domain, is in the table.
+func (s *SQLite) Suppressed(ctx context.Context, address string) (bool, error) {
+	keys := entries(address)
+	args := make([]any, 0, len(keys))
+	for _, key := range keys {
+		args = append(args, key)
+	}
+	query := "SELECT 1 FROM suppressions WHERE address IN (?" + strings.Repeat(", ?", len(keys)-1) + ") LIMIT 1"
+	var found int
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&found)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Add suppresses the address, or the domain when entry has no @, keeping the first reason.
+func (s *SQLite) Add(ctx context.Context, entry, reason string) error {
+	_, err := s.db.ExecContext(ctx,
+		"INSERT INTO suppressions (address, reason, created_at) VALUES (?, ?, ?) ON CONFLICT (address) DO NOTHING",
+		normalizeEntry(entry), reason, time.Now().UTC())
+	return err
+}
+
+// Close closes the database.
+func (s *SQLite) Close() error {
+	return s.db.Close()
+}
@@ -1,14 +1,35 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
+	"github.com/leonardinius/smtpd-proxy/app/audit"
+	"github.com/leonardinius/smtpd-proxy/app/dkim"
+	"github.com/leonardinius/smtpd-proxy/app/dsn"
+	"github.com/leonardinius/smtpd-proxy/app/limits"
+	"github.com/leonardinius/smtpd-proxy/app/logging"
+	"github.com/leonardinius/smtpd-proxy/app/metrics"
+	"github.com/leonardinius/smtpd-proxy/app/pipeline"
+	"github.com/leonardinius/smtpd-proxy/app/policy"
+	"github.com/leonardinius/smtpd-proxy/app/staging"
+	"github.com/leonardinius/smtpd-proxy/app/tracing"
 	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/leonardinius/smtpd-proxy/app/verify"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
@@ -23,40 +44,268 @@ var (
 
 	// ErrUnsupportedMechanism error for unsupported mechanism.
 	ErrUnsupportedMechanism = errors.New("unsupported authentication mechanism")
+
+	// ErrShuttingDown reply to new commands while the server drains in-flight transactions.
+	ErrShuttingDown = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Service shutting down, closing transmission channel",
+	}
+
+	// ErrDKIMSign reply when the message of a signing domain can't be signed, signing again fails the same.
+	ErrDKIMSign = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+		Message:      "DKIM signing failed",
+	}
+
+	// ErrVerifyFailed reply to a message failing verification when the action is reject.
+	ErrVerifyFailed = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Message failed authentication checks",
+	}
+
+	// ErrTransform reply when the message can't be transformed.
+	ErrTransform = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Message transformation failed",
+	}
+
+	// ErrSenderNotAllowed reply to MAIL with a sender domain the user may not send as.
+	ErrSenderNotAllowed = &smtp.SMTPError{
+		Code:         553,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender address not allowed for this user",
+	}
+
+	// ErrRecipientSuppressed reply to RCPT of a suppressed recipient.
+	ErrRecipientSuppressed = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Recipient address is suppressed",
+	}
+
+	// ErrPolicyLookup reply when the recipient policy can't be checked.
+	ErrPolicyLookup = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+		Message:      "Recipient policy lookup failed, try again later",
+	}
+
+	// ErrTooManySessions reply to a session over the concurrent sessions limit.
+	ErrTooManySessions = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 3, 2},
+		Message:      "Too many concurrent sessions, try again later",
+	}
+
+	// ErrTooManySessionsPerIP reply to a session over the concurrent sessions limit of the client IP.
+	ErrTooManySessionsPerIP = &smtp.SMTPError{
+		Code:         421,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 0},
+		Message:      "Too many concurrent sessions from your address, try again later",
+	}
+
+	// ErrMessageRateLimit reply to MAIL over the messages per minute limit.
+	ErrMessageRateLimit = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Message rate limit exceeded, try again later",
+	}
+
+	// ErrRecipientRateLimit reply to RCPT over the recipients per hour limit.
+	ErrRecipientRateLimit = &smtp.SMTPError{
+		Code:         451,
+		EnhancedCode: smtp.EnhancedCode{4, 7, 1},
+		Message:      "Recipient rate limit exceeded, try again later",
+	}
+
+	// ErrMessageTooBig reply to a message over the size limit of the user.
+	ErrMessageTooBig = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Message size exceeds the limit for this user",
+	}
+
+	// ErrTooManyRecipients reply to RCPT over the recipient limit of the user.
+	ErrTooManyRecipients = &smtp.SMTPError{
+		Code:         452,
+		EnhancedCode: smtp.EnhancedCode{4, 5, 3},
+		Message:      "Too many recipients for this user",
+	}
+
+	// ErrAttachmentTooBig reply to a message with an attachment over the size limit.
+	ErrAttachmentTooBig = &smtp.SMTPError{
+		Code:         552,
+		EnhancedCode: smtp.EnhancedCode{5, 3, 4},
+		Message:      "Attachment size exceeds the limit",
+	}
+
+	// ErrAttachmentNotAllowed reply to a message with an attachment of a blocked extension or MIME type.
+	ErrAttachmentNotAllowed = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Attachment type not allowed",
+	}
+
+	// ErrAttachmentRequiresTLS reply to a message with a large attachment in a session without TLS.
+	ErrAttachmentRequiresTLS = &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 10},
+		Message:      "Large attachments require TLS, use STARTTLS",
+	}
+
+	// ErrStagingRecipient reply to a recipient outside the staging allowlist.
+	ErrStagingRecipient = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Recipient not allowed in staging",
+	}
+
+	errNoQuarantine = errors.New("registry can't forward to the quarantine upstream")
+)
+
+// session phases, see session.phase.
+const (
+	phaseIdle int32 = iota
+	phaseTransaction
+	phaseClosing
 )
 
 // The backend implements SMTP server methods.
 type backend struct {
-	logger        *slog.Logger
+	logger  *slog.Logger
+	state   atomic.Pointer[backendState]
+	ctx     context.Context
+	closing atomic.Bool
+	// limiter sessions and message rates, nil when unlimited.
+	limiter *limits.Limiter
+
+	mu       sync.Mutex
+	sessions map[*session]struct{}
+}
+
+// backendState reloadable part of the backend, replaced as a whole.
+// A session keeps the state it started with until logout.
+type backendState struct {
 	authLoginFunc AuthFunc
 	isAnonAllowed bool
 	forwarder     upstream.Registry
-	ctx           context.Context
+	audit         audit.Recorder
+	dkim          *dkim.Signer
+	verify        *VerifyPolicy
+	pipeline      *pipeline.Pipeline
+	staging       *staging.Policy
+	policy        *policy.Policy
+	dsn           *dsn.Reporter
+	messages      *policy.Messages
 }
 
 // The session implements SMTP session methods.
 type session struct {
 	bkd        *backend
+	state      *backendState
 	conn       *smtp.Conn
 	authorized bool
+	username   string
+	envelope   upstream.Envelope
+	// mailOpts and rcptOpts DSN parameters of MAIL and RCPT, by recipient.
+	mailOpts *smtp.MailOptions
+	rcptOpts map[string]*smtp.RcptOptions
+	// phase idle, in transaction (MAIL accepted until reset) or closing on shutdown.
+	phase atomic.Int32
+	// ctx carries the session span and session ID.
+	ctx     context.Context
+	span    trace.Span
+	txStart time.Time
+	// id session ID, messageID ID of the message in transaction, see logging.NewMessageID.
+	id        string
+	messages  int
+	messageID string
+	logout    sync.Once
 }
 
 // NewBackend Creates new backend.
 func newBackend(ctx context.Context, logger *slog.Logger, authLoginFunc AuthFunc) *backend {
-	return &backend{logger: logger, authLoginFunc: authLoginFunc, ctx: ctx}
+	bkd := &backend{logger: logger, ctx: ctx, sessions: map[*session]struct{}{}}
+	bkd.state.Store(&backendState{authLoginFunc: authLoginFunc})
+	return bkd
 }
 
 var _ smtp.Backend = (*backend)(nil)
 
 func (bkd *backend) NewSession(c *smtp.Conn) (smtp.Session, error) {
-	return &session{bkd: bkd, conn: c}, nil
+	if bkd.closing.Load() {
+		return nil, ErrShuttingDown
+	}
+	// a repeated EHLO starts over, go-smtp replaces the previous session without logout.
+	if prev, ok := c.Session().(*session); ok {
+		_ = prev.Logout()
+	}
+
+	metrics.SessionOpened()
+	id := logging.NewSessionID()
+	ctx, span := tracing.Start(logging.WithSessionID(bkd.ctx, id), "smtp.session",
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(
+			attribute.String("net.peer.addr", c.Conn().RemoteAddr().String()),
+			attribute.String("smtp.session_id", id),
+		),
+	)
+	s := &session{bkd: bkd, conn: c, ctx: ctx, span: span, id: id}
+	bkd.logger.DebugContext(ctx, "session", "remote_addr", c.Conn().RemoteAddr().String())
+
+	// the state is taken with the session registered, see inUse.
+	bkd.mu.Lock()
+	s.state = bkd.state.Load()
+	bkd.sessions[s] = struct{}{}
+	bkd.mu.Unlock()
+	return s, nil
+}
+
+// inUse reports whether a session still forwards with the registry.
+func (bkd *backend) inUse(forwarder upstream.Registry) bool {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	for s := range bkd.sessions {
+		if s.state.forwarder == forwarder {
+			return true
+		}
+	}
+	return false
+}
+
+// shutdown rejects new sessions and commands, idle sessions are told the service is closing.
+// Sessions in a transaction may finish it.
+func (bkd *backend) shutdown() {
+	bkd.closing.Store(true)
+
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	for s := range bkd.sessions {
+		if s.phase.CompareAndSwap(phaseIdle, phaseClosing) {
+			s.closeIdle()
+		}
+	}
+}
+
+// closeSessions closes connections of all remaining sessions.
+func (bkd *backend) closeSessions() {
+	bkd.mu.Lock()
+	defer bkd.mu.Unlock()
+	for s := range bkd.sessions {
+		bkd.logger.WarnContext(s.ctx, "closing session on shutdown deadline", "phase", s.phase.Load())
+		_ = s.conn.Conn().Close()
+	}
 }
 
 var _ smtp.AuthSession = (*session)(nil)
 
 // Check if user is authorized or anon login is allowed.
 func (s *session) isAuthOk() error {
-	if s.bkd.isAnonAllowed || s.authorized {
+	if s.state.isAnonAllowed || s.authorized {
 		return nil
 	}
 
@@ -66,43 +315,618 @@ func (s *session) isAuthOk() error {
 // Set return path for currently processed message.
 func (s *session) Mail(from string, opts *smtp.MailOptions) error {
 	err := s.isAuthOk()
-	s.bkd.logger.DebugContext(s.bkd.ctx, "mail", "from", from, "err", err)
+	if err == nil && s.state.policy != nil {
+		if policyErr := s.state.policy.CheckSender(s.username, from); policyErr != nil {
+			s.bkd.logger.WarnContext(s.ctx, "sender rejected", "from", from, "username", s.username, "err", policyErr)
+			err = ErrSenderNotAllowed
+		}
+	}
+	if err == nil && s.state.messages != nil && opts != nil {
+		if limit := s.state.messages.Rules(s.username).MaxMessageBytes; limit > 0 && opts.Size > int64(limit) {
+			err = ErrMessageTooBig
+		}
+	}
+	if err == nil && s.bkd.limiter != nil {
+		if limitErr := s.bkd.limiter.Message(s.client()); limitErr != nil {
+			s.bkd.logger.WarnContext(s.ctx, "message limited", "client", s.client(), "err", limitErr)
+			metrics.Limited(limitName(limitErr))
+			err = ErrMessageRateLimit
+		}
+	}
+	if err == nil && !s.beginTransaction() {
+		s.closeAfterReply()
+		err = ErrShuttingDown
+	}
+	if err == nil {
+		// bounces relayed by the client keep the null reverse-path.
+		s.envelope = upstream.Envelope{From: from, NullSender: from == ""}
+		s.mailOpts, s.rcptOpts = opts, nil
+		s.txStart = time.Now()
+		s.messages++
+		s.messageID = logging.NewMessageID(s.id, s.messages)
+	}
+	s.bkd.logger.DebugContext(s.txContext(), "mail", "from", from, "err", err)
 	return err
 }
 
+// beginTransaction moves the session into a transaction, refused once shutdown started.
+func (s *session) beginTransaction() bool {
+	if s.bkd.closing.Load() {
+		s.phase.Store(phaseClosing)
+		return false
+	}
+	return s.phase.CompareAndSwap(phaseIdle, phaseTransaction) || s.phase.Load() == phaseTransaction
+}
+
 // Add recipient for currently processed message.
 func (s *session) Rcpt(to string, opts *smtp.RcptOptions) error {
 	err := s.isAuthOk()
-	s.bkd.logger.DebugContext(s.bkd.ctx, "rcpt", "to", to, "err", err)
+	if err == nil && s.state.messages != nil {
+		if limit := s.state.messages.Rules(s.username).MaxRecipients; limit > 0 && len(s.envelope.To) >= limit {
+			err = ErrTooManyRecipients
+		}
+	}
+	if err == nil && s.state.policy != nil {
+		err = s.checkRecipient(to)
+	}
+	if err == nil && s.state.staging != nil && !s.state.staging.Allowed(to) {
+		if s.state.staging.Drops() {
+			s.bkd.logger.InfoContext(s.txContext(), "staging dropped recipient", "to", to)
+			return nil
+		}
+		err = ErrStagingRecipient
+	}
+	if err == nil && s.bkd.limiter != nil {
+		if limitErr := s.bkd.limiter.Recipient(s.client()); limitErr != nil {
+			s.bkd.logger.WarnContext(s.txContext(), "recipient limited", "client", s.client(), "to", to, "err", limitErr)
+			metrics.Limited(limitName(limitErr))
+			err = ErrRecipientRateLimit
+		}
+	}
+	if err == nil {
+		s.envelope.To = append(s.envelope.To, to)
+		if opts != nil {
+			if s.rcptOpts == nil {
+				s.rcptOpts = map[string]*smtp.RcptOptions{}
+			}
+			s.rcptOpts[to] = opts
+		}
+	}
+	s.bkd.logger.DebugContext(s.txContext(), "rcpt", "to", to, "err", err)
 	return err
 }
 
+// client rate limited party: the authenticated user, or the client IP of anonymous sessions.
+func (s *session) client() string {
+	if s.username != "" {
+		return "user:" + s.username
+	}
+	return "ip:" + remoteIP(s.conn)
+}
+
+func remoteIP(c *smtp.Conn) string {
+	host, _, _ := net.SplitHostPort(c.Conn().RemoteAddr().String())
+	return host
+}
+
+// limitName metrics label of the limit error.
+func limitName(err error) string {
+	switch {
+	case errors.Is(err, limits.ErrSessionsPerIP):
+		return "sessions_per_ip"
+	case errors.Is(err, limits.ErrMessageRate):
+		return "messages_per_minute"
+	case errors.Is(err, limits.ErrRecipientRate):
+		return "recipients_per_hour"
+	default:
+		return "sessions"
+	}
+}
+
+// checkMessage replies to a message over the size limit of the user or breaking the attachment rules.
+// The size is known once body, the rest of the message, is read.
+func (s *session) checkMessage(ctx context.Context, mail *upstream.Email, body io.Reader, counter *countingReader) error {
+	rules := s.state.messages.Rules(s.username)
+	if rules.MaxMessageBytes > 0 {
+		if _, err := io.Copy(io.Discard, body); err != nil {
+			return err
+		}
+		if counter.n > rules.MaxMessageBytes {
+			s.bkd.logger.WarnContext(ctx, "message too big", "size", counter.n, "limit", rules.MaxMessageBytes)
+			return ErrMessageTooBig
+		}
+	}
+
+	_, isTLS := s.conn.TLSConnectionState()
+	err := rules.CheckAttachments(mail.Attachments, isTLS)
+	if err != nil {
+		s.bkd.logger.WarnContext(ctx, "attachment rejected", "err", err)
+	}
+	switch {
+	case errors.Is(err, policy.ErrAttachmentType):
+		return ErrAttachmentNotAllowed
+	case errors.Is(err, policy.ErrAttachmentSize):
+		return ErrAttachmentTooBig
+	case errors.Is(err, policy.ErrAttachmentTLS):
+		return ErrAttachmentRequiresTLS
+	default:
+		return err
+	}
+}
+
+// checkRecipient replies to a recipient of the suppression list.
+func (s *session) checkRecipient(to string) error {
+	err := s.state.policy.CheckRecipient(s.txContext(), to)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, policy.ErrSuppressed):
+		s.bkd.logger.InfoContext(s.txContext(), "recipient rejected", "to", to, "err", err)
+		return ErrRecipientSuppressed
+	default:
+		s.bkd.logger.ErrorContext(s.txContext(), "recipient policy", "to", to, "err", err)
+		return ErrPolicyLookup
+	}
+}
+
 // Set currently processed message contents and send it.
 func (s *session) Data(r io.Reader) (err error) {
+	counter := &countingReader{r: r}
+	defer func() {
+		metrics.Message(counter.n, err)
+	}()
+
 	if err = s.isAuthOk(); err != nil {
 		return
 	}
 
-	var envelope *upstream.Email
-	if envelope, err = upstream.NewEmailFromReader(r); err != nil {
-		s.bkd.logger.ErrorContext(s.bkd.ctx, "data", "err", err)
+	// verification, transforms and signature work on the message as received, keep it to forward as is.
+	// Delivery status notifications return the message as received too.
+	var raw *bytes.Buffer
+	var body io.Reader = counter
+	redirect := s.stagingRedirectTo() != ""
+	rewrite := s.state.dkim != nil || s.state.verify != nil || s.state.pipeline != nil || redirect
+	if rewrite || s.state.dsn != nil {
+		raw = &bytes.Buffer{}
+		body = io.TeeReader(counter, raw)
+	}
+
+	parseStart := time.Now()
+	envelope, err := upstream.NewEmailFromReader(body)
+	parseEnd := time.Now()
+
+	ctx, span := s.startTransaction(envelope, parseStart)
+	defer func() {
+		tracing.End(span, err)
+	}()
+	_, parseSpan := tracing.Start(ctx, "smtp.data.parse", trace.WithTimestamp(parseStart))
+	tracing.End(parseSpan, err, trace.WithTimestamp(parseEnd))
+
+	if err != nil {
+		s.bkd.logger.ErrorContext(ctx, "data", "err", err)
+		s.audit(ctx, &auditOutcome{size: counter.n, status: audit.StatusRejected, err: err})
+		return err
+	}
+	s.bkd.logger.DebugContext(ctx, "data", "err", nil)
+
+	if s.state.messages != nil {
+		if err = s.checkMessage(ctx, envelope, body, counter); err != nil {
+			s.audit(ctx, &auditOutcome{mail: envelope, size: counter.n, status: audit.StatusRejected, err: err})
+			return err
+		}
+	}
+
+	// every recipient was dropped by the staging allowlist.
+	if len(s.envelope.To) == 0 && s.state.staging != nil {
+		_, err = io.Copy(io.Discard, counter)
+		s.bkd.logger.InfoContext(ctx, "staging dropped message", "err", err)
+		s.audit(ctx, &auditOutcome{mail: envelope, size: counter.n, status: audit.StatusDropped, err: err})
 		return err
+	}
+
+	smtpEnvelope := s.envelope
+	if redirect {
+		smtpEnvelope.To = []string{s.state.staging.RedirectTo()}
+	}
+	ctx = upstream.WithEnvelope(ctx, &smtpEnvelope)
+
+	var quarantine bool
+	if !rewrite && raw != nil {
+		if _, err = io.Copy(raw, counter); err != nil {
+			s.audit(ctx, &auditOutcome{mail: envelope, size: counter.n, status: audit.StatusFailed, err: err})
+			return err
+		}
+	}
+	if rewrite {
+		var message []byte
+		if message, quarantine, err = s.rawMessage(ctx, raw, counter); err != nil {
+			status := audit.StatusFailed
+			if errors.Is(err, ErrVerifyFailed) {
+				status = audit.StatusRejected
+			}
+			s.audit(ctx, &auditOutcome{mail: envelope, size: counter.n, status: status, err: err})
+			return err
+		}
+		ctx = upstream.WithRaw(ctx, message)
+		// forwarders read the parsed headers too, e.g. the rewritten From.
+		if s.state.pipeline != nil || redirect {
+			if envelope, err = upstream.NewEmailFromReader(bytes.NewReader(message)); err != nil {
+				s.bkd.logger.ErrorContext(ctx, "transform", "err", err)
+				s.audit(ctx, &auditOutcome{size: counter.n, status: audit.StatusFailed, err: err})
+				return ErrTransform
+			}
+		}
+	}
+
+	if s.state.staging != nil {
+		s.state.staging.Filter(envelope)
+	}
+
+	ctx, delivery := upstream.WithDelivery(ctx)
+	forwardStart := time.Now()
+	status := audit.StatusDelivered
+	if quarantine {
+		status = audit.StatusQuarantined
+		err = s.quarantine(ctx, envelope)
 	} else {
-		s.bkd.logger.DebugContext(s.bkd.ctx, "data", "err", nil)
+		err = s.state.forwarder.Forward(ctx, envelope)
+	}
+	outcome := &auditOutcome{
+		mail:     envelope,
+		size:     counter.n,
+		delivery: delivery,
+		forward:  time.Since(forwardStart),
+		status:   status,
+		err:      err,
+	}
+
+	// a message delivered to some recipients is accepted, a retry would duplicate it for the delivered ones.
+	// The failed recipients are in the log, the audit record and the notification.
+	var deliveryErr *upstream.DeliveryError
+	partial := errors.As(err, &deliveryErr) && deliveryErr.Partial()
+	if partial {
+		s.bkd.logger.WarnContext(ctx, "partial delivery", "delivered", deliveryErr.Delivered, "err", err)
+		outcome.status = audit.StatusPartial
+	}
+	// the sender learns of permanent failures from the notification, the client must not retry.
+	if s.state.dsn != nil && (err == nil || partial || upstream.IsPermanent(err)) {
+		if s.deliveryStatus(ctx, raw.Bytes(), err) && err != nil && !partial {
+			outcome.status = audit.StatusBounced
+			s.audit(ctx, outcome)
+			return nil
+		}
+	}
+	if partial {
+		s.audit(ctx, outcome)
+		return nil
+	}
+	if err != nil {
+		outcome.status = audit.StatusFailed
+	}
+	s.audit(ctx, outcome)
+	return err
+}
+
+// deliveryStatus sends the delivery status notification of the forward outcome to the envelope sender,
+// for the recipients whose NOTIFY asks for it. Returns whether a notification was sent of every failed recipient.
+// Notifications are never sent about bounces, the null reverse-path.
+func (s *session) deliveryStatus(ctx context.Context, original []byte, forwardErr error) bool {
+	sender := s.envelope.From
+	if sender == "" || (s.state.staging != nil && !s.state.staging.Allowed(sender)) {
+		return false
+	}
+
+	var rcpts []dsn.Recipient
+	failed, unreported := false, false
+	for _, to := range s.envelope.To {
+		rcpt := dsn.Recipient{Address: upstream.AddressOf(to), Action: dsn.ActionRelayed, Err: recipientError(to, forwardErr)}
+		if rcpt.Err != nil {
+			rcpt.Action = dsn.ActionFailed
+		}
+		opts := s.rcptOpts[to]
+		var notify []smtp.DSNNotify
+		if opts != nil {
+			notify = opts.Notify
+			if opts.OriginalRecipient != "" {
+				rcpt.OriginalRecipient = string(opts.OriginalRecipientType) + "; " + opts.OriginalRecipient
+			}
+		}
+		if dsn.Notifies(notify, rcpt.Action) {
+			rcpts = append(rcpts, rcpt)
+			failed = failed || rcpt.Err != nil
+		} else if rcpt.Err != nil {
+			unreported = true
+		}
+	}
+	if len(rcpts) == 0 {
+		return false
+	}
+
+	msg := &dsn.Message{Sender: upstream.AddressOf(sender), Arrival: s.txStart, Raw: original}
+	if s.mailOpts != nil {
+		msg.EnvelopeID, msg.Return = s.mailOpts.EnvelopeID, s.mailOpts.Return
+	}
+	report, err := s.state.dsn.Report(msg, rcpts)
+	if err == nil {
+		err = s.sendReport(ctx, msg.Sender, report)
+	}
+	if err != nil {
+		s.bkd.logger.ErrorContext(ctx, "delivery status notification", "to", msg.Sender, "err", err)
+		return false
+	}
+	s.bkd.logger.InfoContext(ctx, "delivery status notification", "to", msg.Sender, "recipients", len(rcpts), "failed", failed)
+	return failed && !unreported
+}
+
+// sendReport forwards the notification from the null reverse-path, see WithDSN.
+// In staging the notification is redirected and filtered as the messages are.
+func (s *session) sendReport(ctx context.Context, to string, report []byte) error {
+	envelope := &upstream.Envelope{To: []string{to}, NullSender: true}
+	if redirectTo := s.stagingRedirectTo(); redirectTo != "" {
+		msg := pipeline.Parse(report)
+		s.state.staging.Redirect(msg, envelope.To)
+		report, envelope.To = msg.Bytes(), []string{redirectTo}
+	}
+	mail, err := upstream.NewEmailFromReader(bytes.NewReader(report))
+	if err != nil {
+		return err
+	}
+	if s.state.staging != nil {
+		s.state.staging.Filter(mail)
+	}
+	// a fresh delivery report, the message's one is audited with the message.
+	ctx, _ = upstream.WithDelivery(upstream.WithRaw(upstream.WithEnvelope(ctx, envelope), report))
+	return s.state.forwarder.Forward(ctx, mail)
+}
+
+// stagingRedirectTo catch-all address of the staging redirect mode, empty otherwise.
+func (s *session) stagingRedirectTo() string {
+	if s.state.staging == nil {
+		return ""
+	}
+	return s.state.staging.RedirectTo()
+}
+
+// recipientError delivery error of the recipient, nil when delivered.
+func recipientError(rcpt string, forwardErr error) error {
+	var deliveryErr *upstream.DeliveryError
+	if !errors.As(forwardErr, &deliveryErr) {
+		return forwardErr
+	}
+	for _, failed := range deliveryErr.Failed {
+		if strings.EqualFold(upstream.AddressOf(failed.Recipient), upstream.AddressOf(rcpt)) {
+			return failed
+		}
+	}
+	// e.g. the staging catch-all replaced the recipient
+	if deliveryErr.Partial() {
+		return nil
+	}
+	return forwardErr
+}
+
+// rawMessage the message to forward as received: Bcc removed, verified, transformed, redirected
+// in staging and DKIM signed when enabled. quarantine is set when the message failed verification and must be quarantined.
+func (s *session) rawMessage(ctx context.Context, raw *bytes.Buffer, rest io.Reader) (message []byte, quarantine bool, err error) {
+	// the parser may stop short of the end, e.g. multipart epilogue, checks cover the whole body.
+	if _, err := io.Copy(raw, rest); err != nil {
+		return nil, false, err
+	}
+	msg := pipeline.Parse(raw.Bytes())
+	// rendering the parsed message drops Bcc, blind recipients stay hidden as received too.
+	msg.Del("Bcc")
+	if s.state.verify != nil {
+		if quarantine, err = s.verify(ctx, msg); err != nil {
+			return nil, false, err
+		}
+	}
+	if s.state.pipeline != nil {
+		if err := s.state.pipeline.Transform(ctx, msg); err != nil {
+			s.bkd.logger.ErrorContext(ctx, "transform", "err", err)
+			return nil, false, ErrTransform
+		}
+	}
+	if s.state.staging != nil {
+		s.state.staging.Redirect(msg, s.envelope.To)
+	}
+	message = msg.Bytes()
+	if s.state.dkim != nil {
+		if message, err = s.sign(ctx, message); err != nil {
+			return nil, false, err
+		}
+	}
+	return message, quarantine, nil
+}
+
+// verify checks the message and prepends Authentication-Results, see WithVerify.
+// Returns whether the message must be quarantined.
+func (s *session) verify(ctx context.Context, msg *pipeline.Message) (bool, error) {
+	policy := s.state.verify
+	host, _, _ := net.SplitHostPort(s.conn.Conn().RemoteAddr().String())
+	result := policy.Verifier.Verify(ctx, msg.Bytes(), &verify.Client{
+		IP:       net.ParseIP(host),
+		Helo:     s.conn.Hostname(),
+		MailFrom: s.envelope.From,
+	})
+	authServID := policy.Verifier.AuthServID()
+	value := result.Value(authServID)
+	// a sender must not be able to forge the results of the checks, RFC 8601 section 5.
+	msg.DelFunc(func(f pipeline.Field) bool {
+		id, _, _ := strings.Cut(f.Value(), ";")
+		return strings.EqualFold(f.Name, verify.HeaderName) && strings.EqualFold(strings.TrimSpace(id), authServID)
+	})
+	msg.Add(verify.HeaderName, value)
+	if !result.Failed() {
+		s.bkd.logger.DebugContext(ctx, "verify", "result", value)
+		return false, nil
 	}
 
-	return s.bkd.forwarder.Forward(s.bkd.ctx, envelope)
+	s.bkd.logger.WarnContext(ctx, "verify failed", "result", value, "action", policy.OnFail)
+	switch policy.OnFail {
+	case verify.ActionReject:
+		return false, ErrVerifyFailed
+	case verify.ActionQuarantine:
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// quarantine delivers the message through the quarantine upstream only.
+func (s *session) quarantine(ctx context.Context, mail *upstream.Email) error {
+	forwarder, ok := s.state.forwarder.(directForwarder)
+	if !ok {
+		return fmt.Errorf("%w: %T", errNoQuarantine, s.state.forwarder)
+	}
+	return forwarder.ForwardTo(ctx, s.state.verify.Quarantine, mail)
+}
+
+// directForwarder registry delivering through a single upstream, see upstream.RegistryMap.ForwardTo.
+type directForwarder interface {
+	ForwardTo(ctx context.Context, id string, mail *upstream.Email) error
+}
+
+// sign DKIM signs the message, when there is a key for its From domain.
+func (s *session) sign(ctx context.Context, message []byte) ([]byte, error) {
+	signed, domain, err := s.state.dkim.Sign(message)
+	if errors.Is(err, dkim.ErrNoKey) {
+		s.bkd.logger.DebugContext(ctx, "dkim", "err", err)
+		return message, nil
+	}
+	if errors.Is(err, dkim.ErrNoFrom) {
+		s.bkd.logger.WarnContext(ctx, "dkim unsigned", "err", err)
+		return message, nil
+	}
+	if err != nil {
+		s.bkd.logger.ErrorContext(ctx, "dkim", "err", err)
+		return nil, ErrDKIMSign
+	}
+	s.bkd.logger.DebugContext(ctx, "dkim", "domain", domain)
+	return signed, nil
+}
+
+// auditOutcome result of a message transaction, see session.audit.
+type auditOutcome struct {
+	mail     *upstream.Email
+	size     int
+	delivery *upstream.Delivery
+	forward  time.Duration
+	status   string
+	err      error
+}
+
+// audit appends the message transaction record to the audit log, if enabled.
+func (s *session) audit(ctx context.Context, o *auditOutcome) {
+	if s.state.audit == nil {
+		return
+	}
+
+	now := time.Now()
+	host, _, _ := net.SplitHostPort(s.conn.Conn().RemoteAddr().String())
+	record := &audit.Record{
+		Time:       now,
+		SessionID:  s.id,
+		MessageID:  s.messageID,
+		ClientIP:   host,
+		User:       s.username,
+		From:       s.envelope.From,
+		To:         s.envelope.To,
+		Size:       o.size,
+		Status:     o.status,
+		ReceivedAt: s.txStart,
+		DurationMS: now.Sub(s.txStart).Milliseconds(),
+		ForwardMS:  o.forward.Milliseconds(),
+	}
+	if o.mail != nil {
+		record.HeaderMessageID = o.mail.Headers.Get("Message-Id")
+		record.SubjectHash = audit.HashSubject(o.mail.Subject)
+	}
+	if o.delivery != nil {
+		if meta := o.delivery.Upstream(); meta.UID != "" {
+			record.Upstream = &audit.Upstream{UID: meta.UID, Name: meta.Name, Type: meta.Type}
+		}
+		record.ProviderMessageIDs = o.delivery.ProviderMessageIDs()
+	}
+	if o.err != nil {
+		record.Error = o.err.Error()
+	}
+	var deliveryErr *upstream.DeliveryError
+	if errors.As(o.err, &deliveryErr) {
+		for _, rcptErr := range deliveryErr.Failed {
+			record.Failed = append(record.Failed, upstream.AddressOf(rcptErr.Recipient))
+		}
+	}
+
+	if err := s.state.audit.Record(ctx, record); err != nil {
+		s.bkd.logger.ErrorContext(ctx, "audit record", "err", err)
+	}
+}
+
+// startTransaction starts the span covering MAIL FROM to the end of DATA.
+// A traceparent header in the message makes it a child of the submitting app's trace,
+// linked back to the session span.
+func (s *session) startTransaction(mail *upstream.Email, fallbackStart time.Time) (context.Context, trace.Span) {
+	start := s.txStart
+	if start.IsZero() {
+		start = fallbackStart
+	}
+	opts := []trace.SpanStartOption{
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("smtp.mail_from", s.envelope.From),
+			attribute.Int("smtp.rcpt_count", len(s.envelope.To)),
+			attribute.String("smtp.message_id", s.messageID),
+		),
+	}
+
+	parent := s.ctx
+	if mail != nil {
+		if remote := tracing.Extract(s.ctx, mail.Headers); trace.SpanContextFromContext(remote).IsRemote() {
+			parent = remote
+			opts = append(opts, trace.WithLinks(trace.LinkFromContext(s.ctx)))
+		}
+	}
+	if s.messageID != "" {
+		parent = logging.WithMessageID(parent, s.messageID)
+	}
+	return tracing.Start(parent, "smtp.transaction", opts...)
+}
+
+// txContext session context with the ID of the message in transaction, if any.
+func (s *session) txContext() context.Context {
+	if s.messageID == "" {
+		return s.ctx
+	}
+	return logging.WithMessageID(s.ctx, s.messageID)
 }
 
 // Discard currently processed message.
 func (s *session) Reset() {
-	s.bkd.logger.DebugContext(s.bkd.ctx, "reset")
+	s.bkd.logger.DebugContext(s.txContext(), "reset")
+	s.envelope = upstream.Envelope{}
+	s.mailOpts, s.rcptOpts = nil, nil
+	s.messageID = ""
+	// a transaction finished after shutdown started, e.g. right after the DATA reply: the session is closed,
+	// instead of waiting for the client to quit.
+	if s.phase.CompareAndSwap(phaseTransaction, phaseIdle) && s.bkd.closing.Load() &&
+		s.phase.CompareAndSwap(phaseIdle, phaseClosing) {
+		s.closeIdle()
+	}
 }
 
 // Free all resources associated with session.
+// Logout ends the session, once: on a repeated EHLO and again when the connection closes.
 func (s *session) Logout() error {
-	s.bkd.logger.DebugContext(s.bkd.ctx, "logout")
-	s.authorized = false
+	s.logout.Do(func() {
+		s.bkd.logger.DebugContext(s.ctx, "logout")
+		s.authorized = false
+		metrics.SessionClosed()
+		s.span.End()
+
+		s.bkd.mu.Lock()
+		delete(s.bkd.sessions, s)
+		s.bkd.mu.Unlock()
+	})
 	return nil
 }
 
@@ -111,19 +935,22 @@ func (s *session) AuthMechanisms() []string {
 }
 
 func (s *session) Auth(mech string) (sasl.Server, error) {
+	if s.bkd.closing.Load() {
+		s.closeAfterReply()
+		return nil, ErrShuttingDown
+	}
+
 	switch mech {
 	case sasl.Plain:
 		return sasl.NewPlainServer(func(identity, username, password string) error {
-			err := s.bkd.authLoginFunc.Authenticate(identity, username, password)
-			s.authorized = err == nil
-			s.bkd.logger.DebugContext(s.bkd.ctx, "auth plain", "username", username, "authorized", s.authorized)
+			err := s.authenticate(mech, identity, username, password)
+			s.bkd.logger.DebugContext(s.ctx, "auth plain", "username", username, "authorized", s.authorized)
 			return err
 		}), nil
 	case sasl.Login:
 		return sasl.NewLoginServer(func(username, password string) error {
-			err := s.bkd.authLoginFunc.Authenticate("", username, password)
-			s.authorized = err == nil
-			s.bkd.logger.DebugContext(s.bkd.ctx, "auth login", "username", username, "authorized", s.authorized)
+			err := s.authenticate(mech, "", username, password)
+			s.bkd.logger.DebugContext(s.ctx, "auth login", "username", username, "authorized", s.authorized)
 			return err
 		}), nil
 	default:
@@ -131,6 +958,56 @@ func (s *session) Auth(mech string) (sasl.Server, error) {
 	}
 }
 
+func (s *session) authenticate(mech, identity, username, password string) error {
+	_, span := tracing.Start(s.ctx, "smtp.auth", trace.WithAttributes(attribute.String("smtp.auth.mechanism", mech)))
+	err := s.state.authLoginFunc.Authenticate(identity, username, password)
+	tracing.End(span, err)
+	s.authorized = err == nil
+	if s.authorized {
+		s.username = username
+	}
+	metrics.Auth(mech, err)
+	return err
+}
+
+// closeIdle tells the idle client the service is closing and stops reading from it,
+// go-smtp closes the connection once the read fails.
+func (s *session) closeIdle() {
+	conn := s.conn.Conn()
+	_ = conn.SetWriteDeadline(time.Now().Add(time.Second))
+	reply := fmt.Sprintf("421 4.3.2 %s %s\r\n", s.conn.Server().Domain, ErrShuttingDown.Message)
+	if _, err := io.WriteString(conn, reply); err != nil {
+		s.bkd.logger.DebugContext(s.ctx, "shutdown reply", "err", err)
+	}
+	s.closeAfterReply()
+}
+
+// closeAfterReply stops reading from the client, so the connection is closed
+// right after the pending reply is written.
+func (s *session) closeAfterReply() {
+	conn := s.conn.Conn()
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if c, ok := conn.(interface{ CloseRead() error }); ok {
+		_ = c.CloseRead()
+		return
+	}
+	_ = conn.Close()
+}
+
+// countingReader counts bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
 // AuthFunc authentitate function type.
 type AuthFunc interface {
 	Authenticate(identity, username, password string) error
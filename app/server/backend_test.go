@@ -0,0 +1,850 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	msgdkim "github.com/emersion/go-msgauth/dkim"
+	gosmtp "github.com/emersion/go-smtp"
+	"github.com/leonardinius/smtpd-proxy/app/audit"
+	"github.com/leonardinius/smtpd-proxy/app/dkim"
+	"github.com/leonardinius/smtpd-proxy/app/dsn"
+	"github.com/leonardinius/smtpd-proxy/app/limits"
+	"github.com/leonardinius/smtpd-proxy/app/pipeline"
+	"github.com/leonardinius/smtpd-proxy/app/policy"
+	"github.com/leonardinius/smtpd-proxy/app/staging"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/leonardinius/smtpd-proxy/app/verify"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	remoteTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	remoteSpanID  = "00f067aa0ba902b7"
+)
+
+type noopForwarder struct{}
+
+func (noopForwarder) Forward(context.Context, *upstream.Email) error {
+	return nil
+}
+
+func TestTracingContinuesMessageTraceparent(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	_, addr := startTestServer(t, noopForwarder{})
+	msg := "Traceparent: 00-" + remoteTraceID + "-" + remoteSpanID + "-01\r\n" +
+		"From: from@example.com\r\n" +
+		"To: to@example.com\r\n" +
+		"Subject: traced\r\n" +
+		"\r\n" +
+		"body\r\n"
+	require.NoError(t, smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.com"}, []byte(msg)))
+
+	spans := map[string]tracetest.SpanStub{}
+	require.Eventually(t, func() bool {
+		for _, span := range exporter.GetSpans() {
+			spans[span.Name] = span
+		}
+		_, ok := spans["smtp.session"]
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	for _, name := range []string{"smtp.transaction", "smtp.data.parse", "upstream.route", "upstream.forward"} {
+		span, ok := spans[name]
+		require.True(t, ok, name)
+		assert.Equal(t, remoteTraceID, span.SpanContext.TraceID().String(), name)
+	}
+
+	transaction := spans["smtp.transaction"]
+	assert.Equal(t, remoteSpanID, transaction.Parent.SpanID().String())
+	require.Len(t, transaction.Links, 1)
+	assert.Equal(t, spans["smtp.session"].SpanContext.SpanID(), transaction.Links[0].SpanContext.SpanID())
+	assert.Equal(t, transaction.SpanContext.SpanID(), spans["smtp.data.parse"].Parent.SpanID())
+	assert.NotEqual(t, remoteTraceID, spans["smtp.session"].SpanContext.TraceID().String())
+}
+
+func TestTracingStartsTraceWithoutTraceparent(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	_, addr := startTestServer(t, noopForwarder{})
+	msg := "From: from@example.com\r\nTo: to@example.com\r\nSubject: untraced\r\n\r\nbody\r\n"
+	require.NoError(t, smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.com"}, []byte(msg)))
+
+	spans := map[string]tracetest.SpanStub{}
+	require.Eventually(t, func() bool {
+		for _, span := range exporter.GetSpans() {
+			spans[span.Name] = span
+		}
+		_, ok := spans["smtp.session"]
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	session := spans["smtp.session"]
+	transaction := spans["smtp.transaction"]
+	assert.Equal(t, session.SpanContext.TraceID(), transaction.SpanContext.TraceID())
+	assert.Equal(t, session.SpanContext.SpanID(), transaction.Parent.SpanID())
+	assert.Empty(t, transaction.Links)
+	assert.Equal(t, trace.SpanKindServer, session.SpanKind)
+}
+
+func TestShutdownDrainsTransactionInProgress(t *testing.T) {
+	forwarder := &blockingForwarder{started: make(chan struct{}), release: make(chan struct{})}
+	srv, addr := startTestServer(t, forwarder)
+
+	busyConn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer busyConn.Close()
+	busy := textproto.NewConn(busyConn)
+	_, _, err = busy.ReadResponse(220)
+	require.NoError(t, err)
+	idle, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer idle.Close()
+	idleReader := bufio.NewReader(idle)
+	greeting, err := idleReader.ReadString('\n')
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(greeting, "220 "), greeting)
+	_, err = io.WriteString(idle, "EHLO idle\r\n")
+	require.NoError(t, err)
+	for line := ""; !strings.HasPrefix(line, "250 "); {
+		line, err = idleReader.ReadString('\n')
+		require.NoError(t, err)
+	}
+
+	for _, cmd := range []struct {
+		line string
+		code int
+	}{{"EHLO busy", 250}, {"MAIL FROM:<from@example.com>", 250}, {"RCPT TO:<to@example.com>", 250}, {"DATA", 354}} {
+		require.NoError(t, busy.PrintfLine("%s", cmd.line))
+		_, _, err = busy.ReadResponse(cmd.code)
+		require.NoError(t, err, cmd.line)
+	}
+	w := busy.DotWriter()
+	_, err = io.WriteString(w, "Subject: drain\r\n\r\nbody\r\n")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	sent := make(chan error, 1)
+	go func() {
+		_, _, err := busy.ReadResponse(250)
+		sent <- err
+	}()
+	<-forwarder.started
+
+	shutdown := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		shutdown <- srv.Shutdown(ctx)
+	}()
+
+	// idle session is told the service is closing, then disconnected.
+	reply, err := idleReader.ReadString('\n')
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(reply, "421 4.3.2 "), reply)
+	_, err = idleReader.ReadString('\n')
+	require.ErrorIs(t, err, io.EOF)
+
+	select {
+	case err := <-shutdown:
+		t.Fatalf("shutdown returned before transaction completed: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(forwarder.release)
+	require.NoError(t, <-sent)
+
+	// the drained session is told the service is closing right after the DATA reply, then disconnected,
+	// well before the read timeout.
+	require.NoError(t, busyConn.SetReadDeadline(time.Now().Add(ReadTimeout/2)))
+	_, reply, err = busy.ReadResponse(421)
+	require.NoError(t, err)
+	assert.Contains(t, reply, ErrShuttingDown.Message)
+	_, err = busy.ReadLine()
+	require.ErrorIs(t, err, io.EOF)
+	require.NoError(t, <-shutdown)
+}
+
+func TestWaitReleased(t *testing.T) {
+	srv, addr := startTestServer(t, noopForwarder{})
+	previous := srv.backend.state.Load().forwarder
+	c, err := gosmtp.Dial(addr)
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.Hello("localhost"))
+
+	srv.WithOptions(WithUpstreamServers(upstream.NewEmptyRegistry(slog.Default())))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, srv.WaitReleased(ctx, previous), context.DeadlineExceeded, "the session keeps its registry")
+
+	other, err := gosmtp.Dial(addr)
+	require.NoError(t, err)
+	defer other.Close()
+	require.NoError(t, other.Hello("localhost"), "new sessions use the current registry")
+
+	require.NoError(t, c.Quit())
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, srv.WaitReleased(ctx, previous))
+}
+
+func TestShutdownClosesSessionsOnDeadline(t *testing.T) {
+	forwarder := &blockingForwarder{started: make(chan struct{}), release: make(chan struct{})}
+	defer close(forwarder.release)
+	srv, addr := startTestServer(t, forwarder)
+
+	busy, err := gosmtp.Dial(addr)
+	require.NoError(t, err)
+	defer busy.Close()
+	sent := make(chan error, 1)
+	go func() {
+		sent <- busy.SendMail("from@example.com", []string{"to@example.com"},
+			strings.NewReader("Subject: stuck\r\n\r\nbody\r\n"))
+	}()
+	<-forwarder.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, srv.Shutdown(ctx), context.DeadlineExceeded)
+	require.Error(t, <-sent)
+}
+
+func TestAuditRecordsMessageOutcome(t *testing.T) {
+	recorder := &auditRecorder{}
+	_, addr := startTestServer(t, reportingForwarder{}, WithAudit(recorder))
+	msg := func(subject string) []byte {
+		return []byte("Message-Id: <" + subject + "@example.com>\r\n" +
+			"Subject: " + subject + "\r\n" +
+			"\r\n" +
+			"body\r\n")
+	}
+	require.NoError(t, smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.com"}, msg("accepted")))
+	require.Error(t, smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.com"}, msg("refused")))
+
+	records := recorder.get()
+	require.Len(t, records, 2)
+	delivered := records[0]
+	assert.Equal(t, audit.StatusDelivered, delivered.Status)
+	assert.Equal(t, "<accepted@example.com>", delivered.HeaderMessageID)
+	assert.Equal(t, delivered.SessionID+"-1", delivered.MessageID)
+	assert.Equal(t, "127.0.0.1", delivered.ClientIP)
+	assert.Equal(t, "from@example.com", delivered.From)
+	assert.Equal(t, []string{"to@example.com"}, delivered.To)
+	assert.Equal(t, audit.HashSubject("accepted"), delivered.SubjectHash)
+	assert.Positive(t, delivered.Size)
+	require.NotNil(t, delivered.Upstream)
+	assert.NotEmpty(t, delivered.Upstream.UID)
+	assert.Equal(t, []string{"queue-accepted"}, delivered.ProviderMessageIDs)
+	assert.False(t, delivered.ReceivedAt.IsZero())
+
+	failed := records[1]
+	assert.Equal(t, audit.StatusFailed, failed.Status)
+	assert.Equal(t, "upstream refused", failed.Error)
+	assert.NotEqual(t, delivered.SessionID, failed.SessionID)
+}
+
+type reportingForwarder struct{}
+
+func (reportingForwarder) Forward(ctx context.Context, mail *upstream.Email) error {
+	if mail.Subject == "refused" {
+		return errors.New("upstream refused")
+	}
+	upstream.ReportProviderMessageID(ctx, "queue-"+mail.Subject)
+	return nil
+}
+
+type auditRecorder struct {
+	mu      sync.Mutex
+	records []audit.Record
+}
+
+func (r *auditRecorder) Record(_ context.Context, record *audit.Record) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records = append(r.records, *record)
+	return nil
+}
+
+func (r *auditRecorder) get() []audit.Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]audit.Record(nil), r.records...)
+}
+
+func TestDKIMSignsSenderDomain(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "dkim.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	signer, err := dkim.New([]dkim.Key{{Domain: "example.com", Selector: "s1", KeyFile: keyFile}})
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+
+	forwarder := &rawForwarder{}
+	_, addr := startTestServer(t, forwarder, WithDKIM(signer))
+	msg := func(from string) []byte {
+		return []byte("From: " + from + "\r\n" +
+			"Bcc: hidden@example.net,\r\n other@example.net\r\n" +
+			"Subject: signed\r\n" +
+			"\r\n" +
+			"body\r\n")
+	}
+	require.NoError(t, smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.net"}, msg("from@example.com")))
+	require.NoError(t, smtp.SendMail(addr, nil, "from@example.org", []string{"to@example.net"}, msg("from@example.org")))
+	require.NoError(t, smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.net"}, msg("undisclosed")))
+
+	raws := forwarder.get()
+	require.Len(t, raws, 3)
+	verifications, err := msgdkim.VerifyWithOptions(bytes.NewReader(raws[0]), &msgdkim.VerifyOptions{
+		LookupTXT: func(string) ([]string, error) {
+			return []string{"v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)}, nil
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, verifications, 1)
+	require.NoError(t, verifications[0].Err)
+	assert.Equal(t, "example.com", verifications[0].Domain)
+	assert.NotContains(t, string(raws[0]), "example.net")
+	assert.Contains(t, string(raws[0]), "Subject: signed\r\n\r\nbody\r\n")
+
+	assert.NotContains(t, string(raws[1]), "DKIM-Signature")
+	assert.NotContains(t, string(raws[2]), "DKIM-Signature", "invalid From is forwarded unsigned")
+}
+
+func TestVerifyStampsAuthenticationResults(t *testing.T) {
+	// SPF of example.com authorizes no hosts, the message fails verification.
+	verifier := verify.New(verify.Options{AuthServID: "mx.test", SPF: true, Resolver: spfResolver("v=spf1 -all")})
+	msg := []byte("Authentication-Results: mx.test; spf=pass smtp.mailfrom=from@example.com\r\n" +
+		"Authentication-Results: other.example;\r\n dkim=pass header.d=example.com\r\n" +
+		"From: from@example.com\r\n" +
+		"Subject: verify\r\n" +
+		"\r\n" +
+		"body\r\n")
+	send := func(t *testing.T, policy *VerifyPolicy) (*rawForwarder, *rawForwarder, error) {
+		t.Helper()
+		logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+		primary, quarantine := &rawForwarder{}, &rawForwarder{}
+		reg := upstream.NewEmptyRegistry(logger)
+		reg.AddForwarder(primary, 1)
+		reg.AddForwarder(quarantine, 0, upstream.WithName("quarantine"))
+		_, addr := startTestServer(t, noopForwarder{}, WithUpstreamServers(reg), WithVerify(policy))
+		return primary, quarantine, smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.net"}, msg)
+	}
+
+	t.Run("none", func(t *testing.T) {
+		primary, quarantine, err := send(t, &VerifyPolicy{Verifier: verifier, OnFail: verify.ActionNone})
+		require.NoError(t, err)
+		require.Len(t, primary.get(), 1)
+		assert.Empty(t, quarantine.get())
+
+		raw := string(primary.get()[0])
+		assert.True(t, strings.HasPrefix(raw, "Authentication-Results: mx.test; dkim=none"), raw)
+		assert.Contains(t, raw, "spf=fail")
+		assert.NotContains(t, raw, "spf=pass", "forged results of the proxy are removed")
+		assert.Contains(t, raw, "Authentication-Results: other.example;\r\n dkim=pass header.d=example.com\r\n")
+	})
+
+	t.Run("reject", func(t *testing.T) {
+		primary, quarantine, err := send(t, &VerifyPolicy{Verifier: verifier, OnFail: verify.ActionReject})
+		require.ErrorContains(t, err, "550")
+		assert.Empty(t, primary.get())
+		assert.Empty(t, quarantine.get())
+	})
+
+	t.Run("quarantine", func(t *testing.T) {
+		primary, quarantine, err := send(t, &VerifyPolicy{Verifier: verifier, OnFail: verify.ActionQuarantine, Quarantine: "quarantine"})
+		require.NoError(t, err)
+		assert.Empty(t, primary.get())
+		require.Len(t, quarantine.get(), 1)
+		assert.Contains(t, string(quarantine.get()[0]), "spf=fail")
+	})
+}
+
+func TestPipelineTransformsForwardedMessage(t *testing.T) {
+	transforms, err := pipeline.New([]pipeline.Spec{
+		{Type: pipeline.TypeRemoveHeader, Name: "X-Mailer"},
+		{Type: pipeline.TypeAddHeader, Name: "X-Relayed-By", Value: "smtpd-proxy"},
+		{Type: pipeline.TypeRewriteAddress, Domains: map[string]string{"internal.example.com": "example.com"}},
+	})
+	require.NoError(t, err)
+
+	forwarder := &rawForwarder{}
+	_, addr := startTestServer(t, forwarder, WithPipeline(transforms))
+	msg := []byte("From: app@internal.example.com\r\n" +
+		"X-Mailer: app 1.0\r\n" +
+		"Subject: transformed\r\n" +
+		"\r\n" +
+		"body\r\n")
+	require.NoError(t, smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.net"}, msg))
+
+	raws := forwarder.get()
+	require.Len(t, raws, 1)
+	assert.Equal(t, "X-Relayed-By: smtpd-proxy\r\nFrom: <app@example.com>\r\nSubject: transformed\r\n\r\nbody\r\n", string(raws[0]))
+	forwarder.mu.Lock()
+	defer forwarder.mu.Unlock()
+	assert.Equal(t, []string{"<app@example.com>"}, forwarder.froms, "email is parsed from the transformed message")
+}
+
+func TestStagingRecipients(t *testing.T) {
+	msg := []byte("From: app@example.com\r\n" +
+		"To: customer@gmail.com, qa@example.com\r\n" +
+		"Subject: staging\r\n" +
+		"\r\n" +
+		"body\r\n")
+	send := func(t *testing.T, opts staging.Options, to ...string) (*rawForwarder, error) {
+		t.Helper()
+		stagingPolicy, err := staging.New(opts)
+		require.NoError(t, err)
+		forwarder := &rawForwarder{}
+		_, addr := startTestServer(t, forwarder, WithStaging(stagingPolicy))
+		return forwarder, smtp.SendMail(addr, nil, "from@example.com", to, msg)
+	}
+	allowlist := func(action string) staging.Options {
+		return staging.Options{Mode: staging.ModeAllowlist, Allow: []string{"example.com"}, OnDenied: action}
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		forwarder, err := send(t, allowlist(staging.ActionReject), "qa@example.com", "customer@gmail.com")
+		require.ErrorContains(t, err, "Recipient not allowed in staging")
+		assert.Empty(t, forwarder.get())
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		forwarder, err := send(t, allowlist(staging.ActionDrop), "qa@example.com", "customer@gmail.com")
+		require.NoError(t, err)
+		require.Len(t, forwarder.get(), 1)
+		forwarder.mu.Lock()
+		defer forwarder.mu.Unlock()
+		assert.Equal(t, [][]string{{"qa@example.com"}}, forwarder.rcpts)
+		assert.Equal(t, []string{"qa@example.com"}, forwarder.mails[0].To, "header recipients are filtered too")
+	})
+
+	t.Run("drop all", func(t *testing.T) {
+		forwarder, err := send(t, allowlist(staging.ActionDrop), "customer@gmail.com")
+		require.NoError(t, err)
+		assert.Empty(t, forwarder.get())
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		forwarder, err := send(t, staging.Options{Mode: staging.ModeRedirect, RedirectTo: "catch-all@example.com"},
+			"customer@gmail.com", "hidden@gmail.com")
+		require.NoError(t, err)
+		raws := forwarder.get()
+		require.Len(t, raws, 1)
+		assert.Equal(t, "X-Original-To: customer@gmail.com, hidden@gmail.com\r\n"+
+			"To: catch-all@example.com\r\n"+
+			"From: app@example.com\r\n"+
+			"Subject: staging\r\n"+
+			"\r\n"+
+			"body\r\n", string(raws[0]))
+		forwarder.mu.Lock()
+		defer forwarder.mu.Unlock()
+		assert.Equal(t, [][]string{{"catch-all@example.com"}}, forwarder.rcpts)
+		assert.Equal(t, []string{"catch-all@example.com"}, forwarder.mails[0].To)
+	})
+}
+
+func TestPolicyChecks(t *testing.T) {
+	p := policy.New(policy.Options{
+		Senders:     []policy.SenderRule{{User: policy.AnyUser, Domains: []string{"example.com"}}},
+		Suppression: []policy.Suppression{suppressed{"bounced@example.net": true}},
+	})
+	forwarder := &rawForwarder{}
+	_, addr := startTestServer(t, forwarder, WithPolicy(p))
+	msg := []byte("Subject: policy\r\n\r\nbody\r\n")
+
+	err := smtp.SendMail(addr, nil, "from@other.example", []string{"to@example.net"}, msg)
+	require.ErrorContains(t, err, "Sender address not allowed for this user")
+
+	err = smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.net", "bounced@example.net"}, msg)
+	require.ErrorContains(t, err, "Recipient address is suppressed")
+	assert.Empty(t, forwarder.get())
+
+	require.NoError(t, smtp.SendMail(addr, nil, "from@mail.example.com", []string{"to@example.net"}, msg))
+	assert.Len(t, forwarder.get(), 1)
+}
+
+func TestPartialDeliveryIsAccepted(t *testing.T) {
+	forwarder := &rejectingForwarder{reject: map[string]bool{"gone@example.net": true}}
+	recorder := &auditRecorder{}
+	_, addr := startTestServer(t, forwarder, WithAudit(recorder))
+	msg := []byte("Subject: partial\r\n\r\nbody\r\n")
+
+	err := smtp.SendMail(addr, nil, "from@example.com", []string{"ok@example.net", "gone@example.net"}, msg)
+	require.NoError(t, err, "a retry would duplicate the message for ok@example.net")
+	forwarder.mu.Lock()
+	assert.Equal(t, [][]string{{"ok@example.net"}}, forwarder.rcpts)
+	forwarder.mu.Unlock()
+
+	records := recorder.get()
+	require.Len(t, records, 1)
+	assert.Equal(t, audit.StatusPartial, records[0].Status)
+	assert.Equal(t, []string{"gone@example.net"}, records[0].Failed)
+	assert.Contains(t, records[0].Error, "gone@example.net")
+}
+
+func TestDeliveryStatusNotifications(t *testing.T) {
+	reporter := dsn.New(dsn.Options{ReportingMTA: "proxy.example.com"})
+	msg := "From: app@example.com\r\nSubject: dsn\r\n\r\nsecret body\r\n"
+	send := func(t *testing.T, from string, mailOpts *gosmtp.MailOptions, rcpts map[string]*gosmtp.RcptOptions) (*rejectingForwarder, error) {
+		t.Helper()
+		forwarder := &rejectingForwarder{reject: map[string]bool{"gone@example.net": true}}
+		_, addr := startTestServer(t, forwarder, WithDSN(reporter))
+		c, err := gosmtp.Dial(addr)
+		require.NoError(t, err)
+		defer c.Close()
+		require.NoError(t, c.Mail(from, mailOpts))
+		for to, opts := range rcpts {
+			require.NoError(t, c.Rcpt(to, opts))
+		}
+		w, err := c.Data()
+		require.NoError(t, err)
+		_, err = io.WriteString(w, msg)
+		require.NoError(t, err)
+		return forwarder, w.Close()
+	}
+
+	t.Run("partial", func(t *testing.T) {
+		forwarder, err := send(t, "app@example.com", &gosmtp.MailOptions{Return: gosmtp.DSNReturnHeaders, EnvelopeID: "env-1"},
+			map[string]*gosmtp.RcptOptions{
+				"gone@example.net": {
+					Notify:                []gosmtp.DSNNotify{gosmtp.DSNNotifyFailure},
+					OriginalRecipientType: gosmtp.DSNAddressTypeRFC822,
+					OriginalRecipient:     "Gone@example.net",
+				},
+				"ok@example.net": {Notify: []gosmtp.DSNNotify{gosmtp.DSNNotifySuccess}},
+			})
+		require.NoError(t, err)
+		forwarder.mu.Lock()
+		defer forwarder.mu.Unlock()
+		require.Equal(t, [][]string{{"ok@example.net"}, {"app@example.com"}}, forwarder.rcpts, "message, then notification")
+		assert.Equal(t, []string{"app@example.com", ""}, forwarder.senders, "notification from the null reverse-path")
+		report := string(forwarder.raws[1])
+		assert.Contains(t, report, "report-type=delivery-status")
+		assert.Contains(t, report, "Original-Envelope-Id: env-1\r\n")
+		assert.Contains(t, report, "Original-Recipient: RFC822; Gone@example.net\r\n"+
+			"Final-Recipient: rfc822; gone@example.net\r\n"+
+			"Action: failed\r\n"+
+			"Status: 5.1.1\r\n"+
+			"Diagnostic-Code: smtp; 550 5.1.1 User unknown\r\n")
+		assert.Contains(t, report, "Final-Recipient: rfc822; ok@example.net\r\nAction: relayed\r\nStatus: 2.0.0\r\n")
+		assert.Contains(t, report, "Content-Type: text/rfc822-headers")
+		assert.NotContains(t, report, "secret body", "RET=HDRS")
+	})
+
+	t.Run("permanent failure", func(t *testing.T) {
+		forwarder, err := send(t, "app@example.com", nil, map[string]*gosmtp.RcptOptions{"gone@example.net": nil})
+		require.NoError(t, err, "the sender is notified instead")
+		forwarder.mu.Lock()
+		defer forwarder.mu.Unlock()
+		require.Equal(t, [][]string{{"app@example.com"}}, forwarder.rcpts)
+		assert.Equal(t, []string{""}, forwarder.senders, "notification from the null reverse-path")
+		assert.Contains(t, string(forwarder.raws[0]), "Subject: Undelivered Mail Returned to Sender")
+		assert.Contains(t, string(forwarder.raws[0]), "secret body", "full message by default")
+	})
+
+	t.Run("never", func(t *testing.T) {
+		forwarder, err := send(t, "app@example.com", nil,
+			map[string]*gosmtp.RcptOptions{"gone@example.net": {Notify: []gosmtp.DSNNotify{gosmtp.DSNNotifyNever}}})
+		require.ErrorContains(t, err, "User unknown")
+		assert.Empty(t, forwarder.get())
+	})
+
+	t.Run("staging redirect", func(t *testing.T) {
+		stagingPolicy, err := staging.New(staging.Options{Mode: staging.ModeRedirect, RedirectTo: "catch-all@example.com"})
+		require.NoError(t, err)
+		forwarder := &rawForwarder{}
+		_, addr := startTestServer(t, forwarder, WithDSN(reporter), WithStaging(stagingPolicy))
+		c, err := gosmtp.Dial(addr)
+		require.NoError(t, err)
+		defer c.Close()
+		require.NoError(t, c.Mail("app@customer.example", nil))
+		require.NoError(t, c.Rcpt("to@customer.example", &gosmtp.RcptOptions{Notify: []gosmtp.DSNNotify{gosmtp.DSNNotifySuccess}}))
+		w, err := c.Data()
+		require.NoError(t, err)
+		_, err = io.WriteString(w, msg)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+
+		forwarder.mu.Lock()
+		defer forwarder.mu.Unlock()
+		require.Equal(t, [][]string{{"catch-all@example.com"}, {"catch-all@example.com"}}, forwarder.rcpts, "message, then notification")
+		assert.Equal(t, []string{"catch-all@example.com"}, forwarder.mails[1].To)
+		assert.Contains(t, string(forwarder.raws[1]), "X-Original-To: app@customer.example\r\nTo: catch-all@example.com\r\n")
+		assert.Empty(t, forwarder.senders[1], "null reverse-path")
+		assert.NotContains(t, string(forwarder.raws[1]), "To: <app@customer.example>")
+	})
+
+	t.Run("null sender", func(t *testing.T) {
+		forwarder, err := send(t, "", nil, map[string]*gosmtp.RcptOptions{"gone@example.net": nil})
+		require.ErrorContains(t, err, "User unknown")
+		assert.Empty(t, forwarder.get())
+
+		forwarder, err = send(t, "", nil, map[string]*gosmtp.RcptOptions{"ok@example.net": nil})
+		require.NoError(t, err)
+		forwarder.mu.Lock()
+		defer forwarder.mu.Unlock()
+		assert.Equal(t, []string{""}, forwarder.senders, "relayed bounces keep the null reverse-path")
+	})
+}
+
+func TestLimits(t *testing.T) {
+	msg := []byte("Subject: limits\r\n\r\nbody\r\n")
+
+	t.Run("sessions per ip", func(t *testing.T) {
+		_, addr := startTestServer(t, noopForwarder{}, WithLimits(limits.New(limits.Options{MaxSessionsPerIP: 1})))
+		first, err := gosmtp.Dial(addr)
+		require.NoError(t, err)
+		require.NoError(t, first.Hello("localhost"))
+
+		second, err := gosmtp.Dial(addr)
+		require.NoError(t, err)
+		defer second.Close()
+		require.ErrorContains(t, second.Hello("localhost"), "Too many concurrent sessions from your address")
+
+		require.NoError(t, first.Quit())
+		require.Eventually(t, func() bool {
+			c, err := gosmtp.Dial(addr)
+			if err != nil {
+				return false
+			}
+			defer c.Close()
+			return c.Hello("localhost") == nil
+		}, time.Second, 10*time.Millisecond, "slot released on logout")
+	})
+
+	t.Run("repeated ehlo", func(t *testing.T) {
+		srv, addr := startTestServer(t, noopForwarder{}, WithLimits(limits.New(limits.Options{MaxSessionsPerIP: 1})))
+		conn, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer conn.Close()
+		text := textproto.NewConn(conn)
+		_, _, err = text.ReadResponse(220)
+		require.NoError(t, err)
+		for range 3 {
+			require.NoError(t, text.PrintfLine("EHLO localhost"))
+			_, _, err = text.ReadResponse(250)
+			require.NoError(t, err, "the connection holds its slot")
+		}
+		srv.backend.mu.Lock()
+		assert.Len(t, srv.backend.sessions, 1, "replaced sessions are logged out")
+		srv.backend.mu.Unlock()
+
+		other, err := net.Dial("tcp", addr)
+		require.NoError(t, err)
+		defer other.Close()
+		_, _, err = textproto.NewConn(other).ReadResponse(220)
+		require.ErrorContains(t, err, "4.7.0 Too many concurrent sessions from your address", "rejected at accept")
+	})
+
+	t.Run("messages per minute", func(t *testing.T) {
+		_, addr := startTestServer(t, noopForwarder{}, WithLimits(limits.New(limits.Options{MessagesPerMinute: 1})))
+		require.NoError(t, smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.net"}, msg))
+		err := smtp.SendMail(addr, nil, "from@example.com", []string{"to@example.net"}, msg)
+		require.ErrorContains(t, err, "Message rate limit exceeded")
+	})
+
+	t.Run("recipients per hour", func(t *testing.T) {
+		forwarder := &rawForwarder{}
+		_, addr := startTestServer(t, forwarder, WithLimits(limits.New(limits.Options{RecipientsPerHour: 2})))
+		err := smtp.SendMail(addr, nil, "from@example.com", []string{"a@example.net", "b@example.net", "c@example.net"}, msg)
+		require.ErrorContains(t, err, "Recipient rate limit exceeded")
+		assert.Empty(t, forwarder.get())
+	})
+}
+
+func TestMessageLimits(t *testing.T) {
+	maxMessageBytes, maxRecipients := 4000, 3
+	messages := policy.NewMessages(
+		policy.MessageRules{MaxMessageBytes: 1000, MaxRecipients: 2, BlockedExtensions: []string{"exe"}, TLSAttachmentBytes: 100},
+		map[string]policy.MessageOverrides{"app": {MaxMessageBytes: &maxMessageBytes, MaxRecipients: &maxRecipients}},
+	)
+	forwarder := &rawForwarder{}
+	_, addr := startTestServer(t, forwarder, WithMessages(messages), WithAuth(NewHardcodedAuthFunc("", "app", "secret")))
+	auth := smtp.PlainAuth("", "app", "secret", "127.0.0.1")
+	big := []byte("Subject: big\r\n\r\n" + strings.Repeat(strings.Repeat("x", 78)+"\r\n", 25))
+	attachment := func(name string, size int) []byte {
+		return []byte("Subject: attachment\r\n" +
+			"MIME-Version: 1.0\r\n" +
+			"Content-Type: multipart/mixed; boundary=b\r\n\r\n" +
+			"--b\r\nContent-Type: text/plain\r\n\r\nsee attached\r\n" +
+			"--b\r\nContent-Type: application/octet-stream\r\n" +
+			"Content-Disposition: attachment; filename=\"" + name + "\"\r\n\r\n" +
+			strings.Repeat("a", size) + "\r\n--b--\r\n")
+	}
+	rcpts := []string{"a@example.net", "b@example.net", "c@example.net"}
+
+	err := smtp.SendMail(addr, nil, "from@example.com", rcpts, []byte("Subject: rcpts\r\n\r\nbody\r\n"))
+	require.ErrorContains(t, err, "Too many recipients for this user")
+	err = smtp.SendMail(addr, nil, "from@example.com", rcpts[:1], big)
+	require.ErrorContains(t, err, "Message size exceeds the limit for this user")
+	err = smtp.SendMail(addr, auth, "from@example.com", rcpts[:1], attachment("setup.EXE", 10))
+	require.ErrorContains(t, err, "Attachment type not allowed")
+	err = smtp.SendMail(addr, auth, "from@example.com", rcpts[:1], attachment("report.pdf", 200))
+	require.ErrorContains(t, err, "Large attachments require TLS")
+	assert.Empty(t, forwarder.get())
+
+	require.NoError(t, smtp.SendMail(addr, auth, "from@example.com", rcpts, big), "the user limits are larger")
+	require.NoError(t, smtp.SendMail(addr, auth, "from@example.com", rcpts[:1], attachment("report.pdf", 10)))
+	assert.Len(t, forwarder.get(), 2)
+}
+
+// suppressed static suppression list.
+type suppressed map[string]bool
+
+func (s suppressed) Suppressed(_ context.Context, address string) (bool, error) {
+	return s[address], nil
+}
+
+// spfResolver answers the example.com TXT query with the SPF record, everything else is not found.
+type spfResolver string
+
+func (r spfResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if strings.TrimSuffix(name, ".") == "example.com" {
+		return []string{string(r)}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (spfResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (spfResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (spfResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+type rawForwarder struct {
+	mu    sync.Mutex
+	raws  [][]byte
+	froms []string
+	// senders envelope reverse-paths.
+	senders []string
+	rcpts   [][]string
+	mails   []*upstream.Email
+}
+
+func (f *rawForwarder) Forward(ctx context.Context, mail *upstream.Email) error {
+	raw, err := upstream.Bytes(ctx, mail)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.raws = append(f.raws, raw)
+	f.froms = append(f.froms, mail.From)
+	f.senders = append(f.senders, upstream.Sender(ctx, mail))
+	f.rcpts = append(f.rcpts, upstream.Recipients(ctx, mail))
+	f.mails = append(f.mails, mail)
+	return nil
+}
+
+func (f *rawForwarder) get() [][]byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([][]byte(nil), f.raws...)
+}
+
+// rejectingForwarder rejects the listed recipients with 550 5.1.1, the others are recorded, see rawForwarder.
+type rejectingForwarder struct {
+	rawForwarder
+	reject map[string]bool
+}
+
+func (f *rejectingForwarder) Forward(ctx context.Context, mail *upstream.Email) error {
+	result := &upstream.DeliveryError{}
+	for _, rcpt := range upstream.Recipients(ctx, mail) {
+		if f.reject[rcpt] {
+			err := &gosmtp.SMTPError{Code: 550, EnhancedCode: gosmtp.EnhancedCode{5, 1, 1}, Message: "User unknown"}
+			result.Failed = append(result.Failed, &upstream.RecipientError{Recipient: rcpt, Err: err})
+		} else {
+			result.Delivered = append(result.Delivered, rcpt)
+		}
+	}
+	if len(result.Delivered) > 0 {
+		envelope := upstream.Envelope{}
+		if e, ok := upstream.EnvelopeFromContext(ctx); ok {
+			envelope = *e
+		}
+		envelope.To = result.Delivered
+		ctx = upstream.WithEnvelope(ctx, &envelope)
+		if err := f.rawForwarder.Forward(ctx, mail); err != nil {
+			return err
+		}
+	}
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+type blockingForwarder struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (f *blockingForwarder) Forward(context.Context, *upstream.Email) error {
+	close(f.started)
+	<-f.release
+	return nil
+}
+
+func startTestServer(t *testing.T, forwarder upstream.Forwarder, opts ...Option) (*SrvBackend, string) {
+	t.Helper()
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	reg := upstream.NewEmptyRegistry(logger)
+	reg.AddForwarder(forwarder, 1)
+
+	srv := NewServer(context.Background(), logger, "127.0.0.1:0", "localhost").WithOptions(
+		append([]Option{WithAnnonAuthAllowed(true), WithUpstreamServers(reg)}, opts...)...,
+	)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = srv.Serve(l)
+	}()
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_ = srv.Shutdown(ctx)
+	})
+	return srv, l.Addr().String()
+}
@@ -3,45 +3,138 @@ package server
 import (
 	"crypto/tls"
 
+	"github.com/leonardinius/smtpd-proxy/app/audit"
+	"github.com/leonardinius/smtpd-proxy/app/dkim"
+	"github.com/leonardinius/smtpd-proxy/app/dsn"
+	"github.com/leonardinius/smtpd-proxy/app/limits"
+	"github.com/leonardinius/smtpd-proxy/app/pipeline"
+	"github.com/leonardinius/smtpd-proxy/app/policy"
+	"github.com/leonardinius/smtpd-proxy/app/staging"
 	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/leonardinius/smtpd-proxy/app/verify"
 )
 
 // An Option configures a server.
 type Option interface {
-	apply(srv *SrvBackend)
+	apply(srv *SrvBackend, state *backendState)
 }
 
 // optionFunc wraps a func so it satisfies the Option interface.
-type optionFunc func(srv *SrvBackend)
+type optionFunc func(srv *SrvBackend, state *backendState)
 
-func (f optionFunc) apply(srv *SrvBackend) {
-	f(srv)
+func (f optionFunc) apply(srv *SrvBackend, state *backendState) {
+	f(srv, state)
 }
 
-// WithAuth sets auth.
+// WithAuth sets auth. Reloadable.
 func WithAuth(auth AuthFunc) Option {
-	return optionFunc(func(srv *SrvBackend) {
-		srv.backend.authLoginFunc = auth
+	return optionFunc(func(_ *SrvBackend, state *backendState) {
+		state.authLoginFunc = auth
 	})
 }
 
-// WithAnnonAuthAllowed whether to allow anon login or not, added for perf tests.
+// WithAnnonAuthAllowed whether to allow anon login or not, added for perf tests. Reloadable.
 func WithAnnonAuthAllowed(isAnonAllowed bool) Option {
-	return optionFunc(func(srv *SrvBackend) {
-		srv.backend.isAnonAllowed = isAnonAllowed
+	return optionFunc(func(_ *SrvBackend, state *backendState) {
+		state.isAnonAllowed = isAnonAllowed
 	})
 }
 
-// WithTLSConfig sets tls.
+// WithTLSConfig sets tls. Must be applied before the server starts listening.
 func WithTLSConfig(tlsConfig *tls.Config) Option {
-	return optionFunc(func(srv *SrvBackend) {
+	return optionFunc(func(srv *SrvBackend, _ *backendState) {
 		srv.smtp.TLSConfig = tlsConfig
 	})
 }
 
-// WithUpstreamServers sets the upstream server handler.
+// WithUpstreamServers sets the upstream server handler. Reloadable.
 func WithUpstreamServers(reg upstream.Registry) Option {
-	return optionFunc(func(srv *SrvBackend) {
-		srv.backend.forwarder = reg
+	return optionFunc(func(_ *SrvBackend, state *backendState) {
+		state.forwarder = reg
+	})
+}
+
+// WithAudit appends a record of every message transaction to the audit log. Reloadable.
+func WithAudit(recorder audit.Recorder) Option {
+	return optionFunc(func(_ *SrvBackend, state *backendState) {
+		state.audit = recorder
+	})
+}
+
+// WithDKIM signs messages of the sender domains with a key, nil disables signing. Reloadable.
+func WithDKIM(signer *dkim.Signer) Option {
+	return optionFunc(func(_ *SrvBackend, state *backendState) {
+		state.dkim = signer
+	})
+}
+
+// VerifyPolicy inbound message verification and the action on failures.
+type VerifyPolicy struct {
+	Verifier *verify.Verifier
+	// OnFail verify.ActionNone, verify.ActionQuarantine or verify.ActionReject.
+	OnFail string
+	// Quarantine UID or name of the upstream receiving messages failing verification.
+	Quarantine string
+}
+
+// WithVerify verifies DKIM signatures, SPF and DMARC of received messages and stamps
+// Authentication-Results, nil disables verification. Reloadable.
+func WithVerify(policy *VerifyPolicy) Option {
+	return optionFunc(func(_ *SrvBackend, state *backendState) {
+		state.verify = policy
+	})
+}
+
+// WithPipeline transforms messages before they are forwarded, nil disables transforms. Reloadable.
+func WithPipeline(p *pipeline.Pipeline) Option {
+	return optionFunc(func(_ *SrvBackend, state *backendState) {
+		state.pipeline = p
+	})
+}
+
+// WithStaging redirects messages to a catch-all address or restricts recipients to an allowlist,
+// before any upstream is reached. nil disables staging mode. Reloadable.
+func WithStaging(policy *staging.Policy) Option {
+	return optionFunc(func(_ *SrvBackend, state *backendState) {
+		state.staging = policy
+	})
+}
+
+// WithPolicy checks envelope senders at MAIL and recipients at RCPT, nil disables the checks. Reloadable.
+func WithPolicy(p *policy.Policy) Option {
+	return optionFunc(func(_ *SrvBackend, state *backendState) {
+		state.policy = p
+	})
+}
+
+// WithDSN advertises the DSN extension (RFC 3461) and sends delivery status notifications to the envelope
+// sender, nil disables both. Permanent upstream failures are reported to the sender instead of the client.
+// Must be applied before the server starts listening.
+func WithDSN(reporter *dsn.Reporter) Option {
+	return optionFunc(func(srv *SrvBackend, state *backendState) {
+		srv.smtp.EnableDSN = reporter != nil
+		state.dsn = reporter
+	})
+}
+
+// WithLimits limits concurrent sessions, in total and per client IP, and message and recipient rates
+// per authenticated user or client IP. nil disables the limits. Must be applied before the server starts listening.
+func WithLimits(limiter *limits.Limiter) Option {
+	return optionFunc(func(srv *SrvBackend, _ *backendState) {
+		srv.backend.limiter = limiter
+	})
+}
+
+// WithMessages limits message size, recipient count and attachments per authenticated user, nil removes
+// the per-user limits. The listener limits become the largest of any user, see MaxMessageBytes and MaxRecipients.
+// Must be applied before the server starts listening.
+func WithMessages(messages *policy.Messages) Option {
+	return optionFunc(func(srv *SrvBackend, state *backendState) {
+		state.messages = messages
+		srv.smtp.MaxMessageBytes, srv.smtp.MaxRecipients = int64(MaxMessageBytes), MaxRecipients
+		if messages != nil {
+			maxMessageBytes, maxRecipients := messages.Max()
+			srv.smtp.MaxMessageBytes, srv.smtp.MaxRecipients = int64(maxMessageBytes), maxRecipients
+		}
 	})
 }
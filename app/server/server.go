@@ -2,10 +2,17 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"log/slog"
+	"net"
 	"time"
 
 	"github.com/emersion/go-smtp"
+	"github.com/leonardinius/smtpd-proxy/app/limits"
+	"github.com/leonardinius/smtpd-proxy/app/metrics"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
 )
 
 var (
@@ -18,9 +25,12 @@ var (
 	EnableSMTPUTF8    = true     // EnableSMTPUTF8 default true.
 )
 
+// releasePollInterval how often WaitReleased checks the sessions.
+const releasePollInterval = 500 * time.Millisecond
+
 // SMTPServer abstration.
 type SMTPServer interface {
-	Shutdown() error
+	Shutdown(ctx context.Context) error
 	ListenAndServe() error
 }
 
@@ -31,15 +41,106 @@ type SrvBackend struct {
 
 var _ SMTPServer = (*SrvBackend)(nil)
 
-func (srv *SrvBackend) Shutdown() error {
-	return srv.smtp.Close()
+// Shutdown stops accepting connections, replies 421 to idle sessions and new commands,
+// and waits for transactions in progress to complete. Once ctx is done,
+// remaining connections are closed and ctx error is returned.
+func (srv *SrvBackend) Shutdown(ctx context.Context) error {
+	srv.backend.shutdown()
+	err := srv.smtp.Shutdown(ctx)
+	if ctx.Err() != nil {
+		srv.backend.closeSessions()
+	}
+	return err
 }
 
+// ListenAndServe listens on the address, with implicit TLS when configured, see Serve.
 func (srv *SrvBackend) ListenAndServe() error {
+	network, addr := srv.smtp.Network, srv.smtp.Addr
+	if network == "" {
+		network = "tcp"
+	}
+	if addr == "" {
+		addr = ":smtp"
+		if srv.smtp.TLSConfig != nil {
+			addr = ":smtps"
+		}
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	l = srv.listener(l)
 	if srv.smtp.TLSConfig != nil {
-		return srv.smtp.ListenAndServeTLS()
+		l = tls.NewListener(l, srv.smtp.TLSConfig)
 	}
-	return srv.smtp.ListenAndServe()
+	return srv.smtp.Serve(l)
+}
+
+// Serve accepts connections of the plain listener.
+// Connections over the concurrent sessions limits are rejected with 421 at accept, see WithLimits.
+func (srv *SrvBackend) Serve(l net.Listener) error {
+	return srv.smtp.Serve(srv.listener(l))
+}
+
+func (srv *SrvBackend) listener(l net.Listener) net.Listener {
+	return &limitListener{Listener: l, bkd: srv.backend, tlsConfig: srv.smtp.TLSConfig, writeTimeout: srv.smtp.WriteTimeout}
+}
+
+// limitListener counts accepted connections and, with limits, takes a session slot of the client IP
+// for every accepted connection until it is closed.
+type limitListener struct {
+	net.Listener
+	bkd *backend
+	// tlsConfig of implicit TLS listeners, the rejection is sent over TLS.
+	tlsConfig    *tls.Config
+	writeTimeout time.Duration
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		metrics.Connection()
+		if l.bkd.limiter == nil {
+			return conn, nil
+		}
+		host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+		release, err := l.bkd.limiter.Open(host)
+		if err == nil {
+			return &limitedConn{Conn: conn, release: release}, nil
+		}
+		l.bkd.logger.WarnContext(l.bkd.ctx, "session limited", "remote_addr", conn.RemoteAddr().String(), "err", err)
+		metrics.Limited(limitName(err))
+		go l.reject(conn, err)
+	}
+}
+
+// reject replies 421 instead of the greeting and closes the connection.
+func (l *limitListener) reject(conn net.Conn, err error) {
+	reply := ErrTooManySessions
+	if errors.Is(err, limits.ErrSessionsPerIP) {
+		reply = ErrTooManySessionsPerIP
+	}
+	if l.tlsConfig != nil {
+		conn = tls.Server(conn, l.tlsConfig)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(l.writeTimeout))
+	code := reply.EnhancedCode
+	_, _ = fmt.Fprintf(conn, "%d %d.%d.%d %s\r\n", reply.Code, code[0], code[1], code[2], reply.Message)
+}
+
+// limitedConn frees the session slot on close.
+type limitedConn struct {
+	net.Conn
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.release()
+	return c.Conn.Close()
 }
 
 // NewServer prepares SMTP server.
@@ -58,9 +159,27 @@ func NewServer(ctx context.Context, logger *slog.Logger, addr, domain string) *S
 	return &SrvBackend{smtp: s, backend: bkd}
 }
 
+// WaitReleased blocks until no session uses the registry replaced by WithOptions, or ctx is done.
+func (srv *SrvBackend) WaitReleased(ctx context.Context, forwarder upstream.Registry) error {
+	ticker := time.NewTicker(releasePollInterval)
+	defer ticker.Stop()
+	for srv.backend.inUse(forwarder) {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// WithOptions applies options to a copy of the backend state and swaps it in atomically.
+// Sessions already in progress keep using the state they started with.
 func (srv *SrvBackend) WithOptions(opts ...Option) *SrvBackend {
+	state := *srv.backend.state.Load()
 	for _, opt := range opts {
-		opt.apply(srv)
+		opt.apply(srv, &state)
 	}
+	srv.backend.state.Store(&state)
 	return srv
 }
@@ -0,0 +1,159 @@
+package sns
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+)
+
+var errTopic = errors.New("topic not accepted")
+
+// Recorder keeps suppressed addresses.
+type Recorder interface {
+	Add(ctx context.Context, address, reason string) error
+}
+
+// Options SNS endpoint settings.
+type Options struct {
+	// TopicARNs accepted topics, any when empty.
+	TopicARNs []string
+	// Client fetches signing certificates and confirms subscriptions, http.DefaultClient when nil.
+	Client *http.Client
+}
+
+type handler struct {
+	logger   *slog.Logger
+	recorder Recorder
+	topics   []string
+	verifier *Verifier
+}
+
+// NewHandler SNS HTTP/S subscription endpoint of SES bounce and complaint notifications.
+// Messages are signature verified, subscriptions to accepted topics are confirmed,
+// hard-bounced and complaining recipients are recorded.
+func NewHandler(logger *slog.Logger, recorder Recorder, opts Options) http.Handler {
+	return &handler{logger: logger, recorder: recorder, topics: opts.TopicARNs, verifier: NewVerifier(opts.Client)}
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	var m Message
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 256<<10)).Decode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	logger := h.logger.With("sns_type", m.Type, "sns_message_id", m.MessageID, "topic_arn", m.TopicArn)
+	if len(h.topics) > 0 && !slices.Contains(h.topics, m.TopicArn) {
+		logger.WarnContext(ctx, "sns topic rejected")
+		http.Error(w, errTopic.Error(), http.StatusForbidden)
+		return
+	}
+	if err := h.verifier.Verify(ctx, &m); err != nil {
+		logger.WarnContext(ctx, "sns message rejected", "err", err)
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	var err error
+	switch m.Type {
+	case TypeSubscriptionConfirmation:
+		if err = h.verifier.ConfirmSubscription(ctx, &m); err == nil {
+			logger.InfoContext(ctx, "sns subscription confirmed")
+		}
+	case TypeUnsubscribeConfirmation:
+		logger.InfoContext(ctx, "sns subscription removed")
+	case TypeNotification:
+		err = h.notification(ctx, logger, m.Message)
+	}
+	if err != nil {
+		logger.ErrorContext(ctx, "sns message failed", "err", err)
+		// SNS retries delivery on server errors
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// notification records the suppressed recipients of the SES notification.
+func (h *handler) notification(ctx context.Context, logger *slog.Logger, body string) error {
+	var n notification
+	if err := json.Unmarshal([]byte(body), &n); err != nil {
+		// not an SES notification, there is nothing to record
+		logger.WarnContext(ctx, "sns notification skipped", "err", err)
+		return nil
+	}
+
+	for _, s := range n.suppressions() {
+		if s.address == "" {
+			continue
+		}
+		if err := h.recorder.Add(ctx, s.address, s.reason); err != nil {
+			return err
+		}
+		logger.InfoContext(ctx, "recipient suppressed", "to", s.address, "reason", s.reason, "ses_message_id", n.Mail.MessageID)
+	}
+	return nil
+}
+
+// notification SES bounce or complaint, as sent by notifications (notificationType) or event publishing (eventType).
+type notification struct {
+	NotificationType string `json:"notificationType"`
+	EventType        string `json:"eventType"`
+	Bounce           struct {
+		BounceType        string      `json:"bounceType"`
+		BounceSubType     string      `json:"bounceSubType"`
+		BouncedRecipients []recipient `json:"bouncedRecipients"`
+	} `json:"bounce"`
+	Complaint struct {
+		ComplaintFeedbackType string      `json:"complaintFeedbackType"`
+		ComplainedRecipients  []recipient `json:"complainedRecipients"`
+	} `json:"complaint"`
+	Mail struct {
+		MessageID string `json:"messageId"`
+	} `json:"mail"`
+}
+
+type recipient struct {
+	EmailAddress string `json:"emailAddress"`
+}
+
+type suppression struct {
+	address, reason string
+}
+
+// suppressions recipients of permanent bounces and complaints, transient bounces are retried later.
+func (n *notification) suppressions() []suppression {
+	kind := n.NotificationType
+	if kind == "" {
+		kind = n.EventType
+	}
+
+	var out []suppression
+	switch kind {
+	case "Bounce":
+		if n.Bounce.BounceType != "Permanent" {
+			return nil
+		}
+		for _, r := range n.Bounce.BouncedRecipients {
+			out = append(out, suppression{r.EmailAddress, "bounce: " + n.Bounce.BounceType + "/" + n.Bounce.BounceSubType})
+		}
+	case "Complaint":
+		reason := "complaint"
+		if n.Complaint.ComplaintFeedbackType != "" {
+			reason += ": " + n.Complaint.ComplaintFeedbackType
+		}
+		for _, r := range n.Complaint.ComplainedRecipients {
+			out = append(out, suppression{r.EmailAddress, reason})
+		}
+	}
+	return out
+}
@@ -0,0 +1,191 @@
+package sns
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const topic = "arn:aws:sns:eu-west-1:123456789012:ses-feedback"
+
+type recorded struct {
+	mu      sync.Mutex
+	entries map[string]string
+}
+
+func (r *recorded) Add(_ context.Context, address, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.entries[address] = reason
+	return nil
+}
+
+// fakeSNS serves the signing certificate and the subscribe URL.
+type fakeSNS struct {
+	srv        *httptest.Server
+	key        *rsa.PrivateKey
+	subscribed atomic.Int32
+}
+
+func newFakeSNS(t *testing.T) *fakeSNS {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "sns.amazonaws.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+
+	f := &fakeSNS{key: key}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /SimpleNotificationService-test.pem", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(certPEM)
+	})
+	mux.HandleFunc("GET /subscribe", func(w http.ResponseWriter, _ *http.Request) {
+		f.subscribed.Add(1)
+	})
+	f.srv = httptest.NewTLSServer(mux)
+	t.Cleanup(f.srv.Close)
+	return f
+}
+
+// sign sets the signing certificate URL and the SignatureVersion 2 signature.
+func (f *fakeSNS) sign(t *testing.T, m *Message) {
+	t.Helper()
+	m.SignatureVersion = "2"
+	m.SigningCertURL = f.srv.URL + "/SimpleNotificationService-test.pem"
+	payload, err := m.stringToSign()
+	require.NoError(t, err)
+	digest := sha256.Sum256([]byte(payload))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, f.key, crypto.SHA256, digest[:])
+	require.NoError(t, err)
+	m.Signature = base64.StdEncoding.EncodeToString(signature)
+}
+
+func newTestHandler(f *fakeSNS, recorder Recorder, topics ...string) *handler {
+	h := NewHandler(slog.New(slog.NewTextHandler(io.Discard, nil)), recorder, Options{TopicARNs: topics, Client: f.srv.Client()}).(*handler)
+	h.verifier.trusted = func(string) bool { return true }
+	return h
+}
+
+func post(t *testing.T, h http.Handler, m *Message) int {
+	t.Helper()
+	body, err := json.Marshal(m)
+	require.NoError(t, err)
+	req := httptest.NewRequest(http.MethodPost, "/sns", bytes.NewReader(body))
+	req.Header.Set("X-Amz-Sns-Message-Type", m.Type)
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w.Code
+}
+
+func notificationMessage(body string) *Message {
+	return &Message{
+		Type:      TypeNotification,
+		MessageID: "b0e2c5a4-1",
+		TopicArn:  topic,
+		Message:   body,
+		Timestamp: "2024-05-01T10:00:00.000Z",
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	f := newFakeSNS(t)
+	recorder := &recorded{entries: map[string]string{}}
+	h := newTestHandler(f, recorder, topic)
+
+	for _, body := range []string{
+		`{"notificationType":"Bounce","bounce":{"bounceType":"Permanent","bounceSubType":"General",` +
+			`"bouncedRecipients":[{"emailAddress":"gone@example.com"}]},"mail":{"messageId":"ses-1"}}`,
+		`{"notificationType":"Bounce","bounce":{"bounceType":"Transient","bounceSubType":"MailboxFull",` +
+			`"bouncedRecipients":[{"emailAddress":"full@example.com"}]}}`,
+		`{"eventType":"Complaint","complaint":{"complaintFeedbackType":"abuse",` +
+			`"complainedRecipients":[{"emailAddress":"angry@example.com"}]}}`,
+		`not json`,
+	} {
+		m := notificationMessage(body)
+		f.sign(t, m)
+		assert.Equal(t, http.StatusOK, post(t, h, m), body)
+	}
+	assert.Equal(t, map[string]string{
+		"gone@example.com":  "bounce: Permanent/General",
+		"angry@example.com": "complaint: abuse",
+	}, recorder.entries)
+}
+
+func TestRejectsUnverified(t *testing.T) {
+	f := newFakeSNS(t)
+	recorder := &recorded{entries: map[string]string{}}
+	body := `{"notificationType":"Complaint","complaint":{"complainedRecipients":[{"emailAddress":"x@example.com"}]}}`
+
+	tampered := notificationMessage(body)
+	f.sign(t, tampered)
+	tampered.Message = `{"notificationType":"Complaint","complaint":{"complainedRecipients":[{"emailAddress":"y@example.com"}]}}`
+	assert.Equal(t, http.StatusForbidden, post(t, newTestHandler(f, recorder), tampered))
+
+	other := notificationMessage(body)
+	other.TopicArn = "arn:aws:sns:eu-west-1:123456789012:other"
+	f.sign(t, other)
+	assert.Equal(t, http.StatusForbidden, post(t, newTestHandler(f, recorder, topic), other))
+
+	untrusted := notificationMessage(body)
+	f.sign(t, untrusted)
+	h := NewHandler(slog.New(slog.NewTextHandler(io.Discard, nil)), recorder, Options{Client: f.srv.Client()})
+	assert.Equal(t, http.StatusForbidden, post(t, h, untrusted), "certificate host is not SNS")
+
+	assert.Empty(t, recorder.entries)
+}
+
+func TestSubscriptionConfirmation(t *testing.T) {
+	f := newFakeSNS(t)
+	h := newTestHandler(f, &recorded{entries: map[string]string{}}, topic)
+	m := &Message{
+		Type:         TypeSubscriptionConfirmation,
+		MessageID:    "c0e2c5a4-1",
+		Token:        "token",
+		TopicArn:     topic,
+		Message:      "You have chosen to subscribe to the topic",
+		SubscribeURL: f.srv.URL + "/subscribe",
+		Timestamp:    "2024-05-01T10:00:00.000Z",
+	}
+	f.sign(t, m)
+	assert.Equal(t, http.StatusOK, post(t, h, m))
+	assert.Equal(t, int32(1), f.subscribed.Load())
+}
+
+func TestTrustedHost(t *testing.T) {
+	for host, trusted := range map[string]bool{
+		"sns.us-east-1.amazonaws.com":      true,
+		"sns.cn-north-1.amazonaws.com.cn":  true,
+		"sns.us-east-1.amazonaws.com.evil": false,
+		"evil.example/sns.amazonaws.com":   false,
+		"sqs.us-east-1.amazonaws.com":      false,
+	} {
+		assert.Equal(t, trusted, snsHost.MatchString(host), host)
+	}
+}
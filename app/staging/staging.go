@@ -0,0 +1,173 @@
+package staging
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/leonardinius/smtpd-proxy/app/pipeline"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+// Modes.
+const (
+	// ModeRedirect delivers every message to the catch-all address only.
+	ModeRedirect = "redirect"
+	// ModeAllowlist delivers to the allowed recipients only.
+	ModeAllowlist = "allowlist"
+)
+
+// Actions on recipients outside the allowlist.
+const (
+	// ActionReject replies 550 to RCPT.
+	ActionReject = "reject"
+	// ActionDrop accepts the recipient and never delivers to it.
+	ActionDrop = "drop"
+)
+
+// HeaderName header field listing the original envelope recipients of redirected messages.
+const HeaderName = "X-Original-To"
+
+var (
+	errUnknownMode   = errors.New("unknown mode")
+	errUnknownAction = errors.New("unknown action")
+	errRequired      = errors.New("required")
+)
+
+// Options staging mode settings.
+type Options struct {
+	// Mode ModeRedirect or ModeAllowlist.
+	Mode string
+	// RedirectTo catch-all address of ModeRedirect.
+	RedirectTo string
+	// Allow ModeAllowlist entries: domain, matching its subdomains too, address, or /regexp/ on the address.
+	Allow []string
+	// OnDenied ActionReject or ActionDrop.
+	OnDenied string
+}
+
+// Policy keeps messages away from real recipients in staging environments.
+type Policy struct {
+	opts      Options
+	domains   []string
+	addresses []string
+	patterns  []*regexp.Regexp
+}
+
+// New creates policy.
+func New(opts Options) (*Policy, error) {
+	p := &Policy{opts: opts}
+	switch opts.Mode {
+	case ModeRedirect:
+		if opts.RedirectTo == "" {
+			return nil, fmt.Errorf("redirect-to: %w", errRequired)
+		}
+		return p, nil
+	case ModeAllowlist:
+	default:
+		return nil, fmt.Errorf("mode: %w: %s, allowed values [%s, %s]", errUnknownMode, opts.Mode, ModeRedirect, ModeAllowlist)
+	}
+
+	switch opts.OnDenied {
+	case ActionReject, ActionDrop:
+	default:
+		return nil, fmt.Errorf("on-denied: %w: %s, allowed values [%s, %s]", errUnknownAction, opts.OnDenied, ActionReject, ActionDrop)
+	}
+	if len(opts.Allow) == 0 {
+		return nil, fmt.Errorf("allow: %w", errRequired)
+	}
+	for _, entry := range opts.Allow {
+		switch {
+		case len(entry) > 1 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/"):
+			pattern, err := regexp.Compile("(?i)" + entry[1:len(entry)-1])
+			if err != nil {
+				return nil, fmt.Errorf("allow: %w", err)
+			}
+			p.patterns = append(p.patterns, pattern)
+		case strings.Contains(entry, "@"):
+			p.addresses = append(p.addresses, strings.ToLower(entry))
+		default:
+			p.domains = append(p.domains, strings.ToLower(strings.TrimPrefix(entry, ".")))
+		}
+	}
+	return p, nil
+}
+
+// RedirectTo catch-all address, empty unless in ModeRedirect.
+func (p *Policy) RedirectTo() string {
+	if p.opts.Mode != ModeRedirect {
+		return ""
+	}
+	return p.opts.RedirectTo
+}
+
+// Drops reports whether recipients outside the allowlist are accepted and dropped, rather than rejected.
+func (p *Policy) Drops() bool {
+	return p.opts.OnDenied == ActionDrop
+}
+
+// Allowed reports whether the message may be delivered to the recipient.
+// All recipients are allowed in ModeRedirect, the message goes to the catch-all address instead.
+func (p *Policy) Allowed(rcpt string) bool {
+	if p.opts.Mode == ModeRedirect {
+		return true
+	}
+	address := strings.ToLower(upstream.AddressOf(rcpt))
+	for _, allowed := range p.addresses {
+		if address == allowed {
+			return true
+		}
+	}
+	if _, domain, ok := strings.Cut(address, "@"); ok {
+		for _, allowed := range p.domains {
+			if domain == allowed || strings.HasSuffix(domain, "."+allowed) {
+				return true
+			}
+		}
+	}
+	for _, pattern := range p.patterns {
+		if pattern.MatchString(address) {
+			return true
+		}
+	}
+	return false
+}
+
+// Redirect replaces To and Cc of the message with the catch-all address, the original envelope
+// recipients are kept in X-Original-To. No-op unless in ModeRedirect.
+func (p *Policy) Redirect(msg *pipeline.Message, rcpts []string) {
+	if p.opts.Mode != ModeRedirect {
+		return
+	}
+	msg.DelFunc(func(f pipeline.Field) bool {
+		return strings.EqualFold(f.Name, "To") || strings.EqualFold(f.Name, "Cc") || strings.EqualFold(f.Name, HeaderName)
+	})
+	msg.Add("To", p.opts.RedirectTo)
+	msg.Add(HeaderName, strings.Join(rcpts, ", "))
+}
+
+// Filter header recipients of the parsed message, forwarders building the destinations from them
+// must not reach anyone else: the catch-all address in ModeRedirect, allowed ones in ModeAllowlist.
+func (p *Policy) Filter(mail *upstream.Email) {
+	if p.opts.Mode == ModeRedirect {
+		mail.To, mail.Cc, mail.Bcc = []string{p.opts.RedirectTo}, nil, nil
+		return
+	}
+	mail.To = p.filter(mail.To)
+	mail.Cc = p.filter(mail.Cc)
+	mail.Bcc = p.filter(mail.Bcc)
+}
+
+func (p *Policy) filter(rcpts []string) []string {
+	allowed := rcpts[:0]
+	for _, rcpt := range rcpts {
+		if p.Allowed(rcpt) {
+			allowed = append(allowed, rcpt)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil
+	}
+	return allowed
+}
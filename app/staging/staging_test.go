@@ -0,0 +1,97 @@
+package staging
+
+import (
+	"testing"
+
+	"github.com/leonardinius/smtpd-proxy/app/pipeline"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllowed(t *testing.T) {
+	p, err := New(Options{
+		Mode:     ModeAllowlist,
+		Allow:    []string{"example.com", "qa@example.org", `/^dev\+.*@example\.net$/`},
+		OnDenied: ActionReject,
+	})
+	require.NoError(t, err)
+
+	for rcpt, allowed := range map[string]bool{
+		"user@example.com":          true,
+		"user@Mail.Example.COM":     true,
+		"user@notexample.com":       false,
+		"QA@example.org":            true,
+		"other@example.org":         false,
+		"dev+alice@example.net":     true,
+		"alice@example.net":         false,
+		"Dev <dev+b@example.net>":   true,
+		"customer@gmail.com":        false,
+		"customer@example.com.evil": false,
+	} {
+		assert.Equal(t, allowed, p.Allowed(rcpt), rcpt)
+	}
+	assert.False(t, p.Drops())
+	assert.Empty(t, p.RedirectTo())
+}
+
+func TestFilter(t *testing.T) {
+	p, err := New(Options{Mode: ModeAllowlist, Allow: []string{"example.com"}, OnDenied: ActionDrop})
+	require.NoError(t, err)
+	assert.True(t, p.Drops())
+
+	mail := &upstream.Email{
+		To:  []string{"a@example.com", "customer@gmail.com"},
+		Cc:  []string{"customer@yahoo.com"},
+		Bcc: []string{"b@example.com"},
+	}
+	p.Filter(mail)
+	assert.Equal(t, []string{"a@example.com"}, mail.To)
+	assert.Nil(t, mail.Cc)
+	assert.Equal(t, []string{"b@example.com"}, mail.Bcc)
+}
+
+func TestRedirect(t *testing.T) {
+	p, err := New(Options{Mode: ModeRedirect, RedirectTo: "catch-all@example.com"})
+	require.NoError(t, err)
+	assert.True(t, p.Allowed("customer@gmail.com"))
+	assert.Equal(t, "catch-all@example.com", p.RedirectTo())
+
+	msg := pipeline.Parse([]byte("From: app@example.com\r\n" +
+		"To: Customer <customer@gmail.com>,\r\n other@gmail.com\r\n" +
+		"Cc: cc@gmail.com\r\n" +
+		"X-Original-To: forged@example.com\r\n" +
+		"Subject: hello\r\n" +
+		"\r\n" +
+		"To: not a header\r\n"))
+	p.Redirect(msg, []string{"customer@gmail.com", "other@gmail.com", "bcc@gmail.com"})
+	assert.Equal(t, "X-Original-To: customer@gmail.com, other@gmail.com, bcc@gmail.com\r\n"+
+		"To: catch-all@example.com\r\n"+
+		"From: app@example.com\r\n"+
+		"Subject: hello\r\n"+
+		"\r\n"+
+		"To: not a header\r\n", string(msg.Bytes()))
+
+	mail := &upstream.Email{To: []string{"customer@gmail.com"}, Cc: []string{"cc@gmail.com"}, Bcc: []string{"bcc@gmail.com"}}
+	p.Filter(mail)
+	assert.Equal(t, []string{"catch-all@example.com"}, mail.To)
+	assert.Nil(t, mail.Cc)
+	assert.Nil(t, mail.Bcc)
+}
+
+func TestNewErrors(t *testing.T) {
+	tests := []struct {
+		opts     Options
+		expected string
+	}{
+		{Options{Mode: "off"}, "mode: unknown mode: off"},
+		{Options{Mode: ModeRedirect}, "redirect-to: required"},
+		{Options{Mode: ModeAllowlist, OnDenied: ActionReject}, "allow: required"},
+		{Options{Mode: ModeAllowlist, Allow: []string{"example.com"}, OnDenied: "bounce"}, "on-denied: unknown action: bounce"},
+		{Options{Mode: ModeAllowlist, Allow: []string{"/(/"}, OnDenied: ActionDrop}, "allow: error parsing regexp"},
+	}
+	for _, tt := range tests {
+		_, err := New(tt.opts)
+		require.ErrorContains(t, err, tt.expected)
+	}
+}
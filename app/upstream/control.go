@@ -0,0 +1,233 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/leonardinius/smtpd-proxy/app/metrics"
+)
+
+var (
+	// ErrEntryNotFound no registry entry with given UID or name.
+	ErrEntryNotFound = errors.New("upstream entry not found")
+
+	// ErrNotWeighted mirror and shadow entries are not part of the weighted pick.
+	ErrNotWeighted = errors.New("mirror and shadow upstreams have no weight")
+
+	// ErrInvalidWeight negative weight.
+	ErrInvalidWeight = errors.New("invalid negative weight")
+
+	// ErrInvalidState unknown target entry state.
+	ErrInvalidState = errors.New("invalid upstream state")
+)
+
+// State of a registry entry.
+type State string
+
+const (
+	// StateActive entry receives traffic.
+	StateActive State = "active"
+	// StateDraining entry receives no new messages, in-flight forwards are still running.
+	StateDraining State = "draining"
+	// StateDrained draining entry with no in-flight forwards left. Reported only.
+	StateDrained State = "drained"
+	// StateDisabled entry receives no new messages.
+	StateDisabled State = "disabled"
+)
+
+// HealthStatus outcome of the last health check.
+type HealthStatus string
+
+const (
+	HealthUnknown     HealthStatus = "unknown"
+	HealthOK          HealthStatus = "ok"
+	HealthFailed      HealthStatus = "failed"
+	HealthUnsupported HealthStatus = "unsupported"
+)
+
+// HealthChecker is implemented by forwarders able to probe the upstream without sending a message.
+type HealthChecker interface {
+	HealthCheck(ctx context.Context) error
+}
+
+// Health last health check result.
+type Health struct {
+	Status    HealthStatus
+	Error     string
+	CheckedAt time.Time
+	Latency   time.Duration
+}
+
+// EntryStatus snapshot of a registry entry.
+type EntryStatus struct {
+	EntryMeta
+	State            State
+	Weight           int
+	ConfiguredWeight int
+	InFlight         int64
+	Forwarded        int64
+	Failed           int64
+	Health           Health
+}
+
+// Entries returns a snapshot of all registry entries: weighted, then mirrors, then shadows.
+func (r *RegistryMap) Entries() []EntryStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entries := make([]EntryStatus, 0, len(r.entriesSorted)+len(r.mirrors)+len(r.shadows))
+	for _, group := range [][]*registryEntry{r.entriesSorted, r.mirrors, r.shadows} {
+		for _, entry := range group {
+			entries = append(entries, entry.status())
+		}
+	}
+	return entries
+}
+
+// Entry returns a snapshot of the entry with given UID or name.
+func (r *RegistryMap) Entry(id string) (EntryStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, err := r.lookup(id)
+	if err != nil {
+		return EntryStatus{}, err
+	}
+	return entry.status(), nil
+}
+
+// SetState activates, drains or disables the entry with given UID or name.
+func (r *RegistryMap) SetState(ctx context.Context, id string, state State) (EntryStatus, error) {
+	switch state {
+	case StateActive, StateDraining, StateDisabled:
+	default:
+		return EntryStatus{}, fmt.Errorf("%w: %s", ErrInvalidState, state)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, err := r.lookup(id)
+	if err != nil {
+		return EntryStatus{}, err
+	}
+	previous := entry.state
+	entry.state = state
+	r.rebalance()
+	r.logger.InfoContext(ctx, "upstream state changed", "uid", entry.meta.UID, "name", entry.meta.Name,
+		"from", previous, "to", state)
+	return entry.status(), nil
+}
+
+// SetWeight changes the weight of the entry with given UID or name.
+// Zero weight keeps the entry active but out of the weighted pick.
+func (r *RegistryMap) SetWeight(ctx context.Context, id string, weight int) (EntryStatus, error) {
+	if weight < 0 {
+		return EntryStatus{}, fmt.Errorf("%w: %d", ErrInvalidWeight, weight)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, err := r.lookup(id)
+	if err != nil {
+		return EntryStatus{}, err
+	}
+	if entry.meta.Mirror || entry.meta.Shadow {
+		return EntryStatus{}, ErrNotWeighted
+	}
+	previous := entry.weight
+	entry.weight = weight
+	r.rebalance()
+	r.logger.InfoContext(ctx, "upstream weight changed", "uid", entry.meta.UID, "name", entry.meta.Name,
+		"from", previous, "to", weight)
+	return entry.status(), nil
+}
+
+// HealthCheck probes the entry with given UID or name, if its forwarder supports it.
+// The registry mutex is not held while the check runs.
+func (r *RegistryMap) HealthCheck(ctx context.Context, id string) (EntryStatus, error) {
+	r.mu.Lock()
+	entry, err := r.lookup(id)
+	r.mu.Unlock()
+	if err != nil {
+		return EntryStatus{}, err
+	}
+
+	health := Health{Status: HealthUnsupported, CheckedAt: time.Now()}
+	if checker, ok := entry.sender.(HealthChecker); ok {
+		err = checker.HealthCheck(context.WithValue(ctx, entryContextKey, &entry.meta))
+		health.Latency = time.Since(health.CheckedAt)
+		health.Status = HealthOK
+		if err != nil {
+			health.Status = HealthFailed
+			health.Error = err.Error()
+			r.logger.WarnContext(ctx, "upstream health check failed", "uid", entry.meta.UID, "name", entry.meta.Name,
+				"err", err)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry.health = health
+	return entry.status(), nil
+}
+
+// ForwardTo delivers mail through the entry with given UID or name, regardless of its state and role.
+// Used to test a single upstream, not part of the regular routing.
+func (r *RegistryMap) ForwardTo(ctx context.Context, id string, mail *Email) error {
+	r.mu.Lock()
+	entry, err := r.lookup(id)
+	if err == nil {
+		entry.counters.inFlight.Add(1)
+	}
+	r.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	reportUpstream(ctx, &entry.meta)
+	start := time.Now()
+	err = entry.forward(ctx, metrics.RolePrimary, entry.sender, mail)
+	entry.record(metrics.RolePrimary, time.Since(start), err)
+	return err
+}
+
+// lookup finds entry by UID, then by name, must be called with mutex held.
+func (r *RegistryMap) lookup(id string) (*registryEntry, error) {
+	var byName *registryEntry
+	for _, group := range [][]*registryEntry{r.entriesSorted, r.mirrors, r.shadows} {
+		for _, entry := range group {
+			if entry.meta.UID == id {
+				return entry, nil
+			}
+			if byName == nil && entry.meta.Name != "" && entry.meta.Name == id {
+				byName = entry
+			}
+		}
+	}
+	if byName == nil {
+		return nil, fmt.Errorf("%w: %s", ErrEntryNotFound, id)
+	}
+	return byName, nil
+}
+
+// status snapshot of the entry, must be called with mutex held.
+func (e *registryEntry) status() EntryStatus {
+	s := EntryStatus{
+		EntryMeta:        e.meta,
+		State:            e.state,
+		Weight:           e.weight,
+		ConfiguredWeight: e.originalWeight,
+		InFlight:         e.counters.inFlight.Load(),
+		Forwarded:        e.counters.forwarded.Load(),
+		Failed:           e.counters.failed.Load(),
+		Health:           e.health,
+	}
+	if s.State == StateDraining && s.InFlight == 0 {
+		s.State = StateDrained
+	}
+	return s
+}
@@ -0,0 +1,62 @@
+package upstream
+
+import (
+	"context"
+	"sync"
+)
+
+// deliveryKey context.Context key for the delivery report.
+type deliveryKey struct{}
+
+// Delivery details of the primary forward of a message, filled in by the registry and forwarders.
+// Mirror and shadow forwards don't report.
+type Delivery struct {
+	mu                 sync.Mutex
+	upstream           EntryMeta
+	providerMessageIDs []string
+}
+
+// WithDelivery returns a copy of ctx collecting the delivery report of the message.
+func WithDelivery(ctx context.Context) (context.Context, *Delivery) {
+	d := &Delivery{}
+	return context.WithValue(ctx, deliveryKey{}, d), d
+}
+
+// Upstream entry chosen for the message.
+func (d *Delivery) Upstream() EntryMeta {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.upstream
+}
+
+// ProviderMessageIDs IDs the upstream assigned to the message, e.g. SES MessageId or SMTP queue ID.
+func (d *Delivery) ProviderMessageIDs() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]string(nil), d.providerMessageIDs...)
+}
+
+// ReportProviderMessageID records the ID the upstream assigned to the message being forwarded.
+// Ignored for mirror and shadow forwards and when no delivery report is collected.
+func ReportProviderMessageID(ctx context.Context, id string) {
+	if id == "" {
+		return
+	}
+	if meta, ok := FromContext(ctx); ok && (meta.Mirror || meta.Shadow) {
+		return
+	}
+	if d, ok := ctx.Value(deliveryKey{}).(*Delivery); ok {
+		d.mu.Lock()
+		d.providerMessageIDs = append(d.providerMessageIDs, id)
+		d.mu.Unlock()
+	}
+}
+
+// reportUpstream records the entry chosen for the message.
+func reportUpstream(ctx context.Context, meta *EntryMeta) {
+	if d, ok := ctx.Value(deliveryKey{}).(*Delivery); ok {
+		d.mu.Lock()
+		d.upstream = *meta
+		d.mu.Unlock()
+	}
+}
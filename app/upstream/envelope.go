@@ -0,0 +1,127 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"github.com/emersion/go-smtp"
+)
+
+// envelopeKey context.Context key for the SMTP envelope.
+type envelopeKey struct{}
+
+var envelopeContextKey envelopeKey
+
+// Envelope SMTP envelope (MAIL FROM / RCPT TO) of the message being forwarded.
+type Envelope struct {
+	From string
+	To   []string
+	// NullSender the message is sent from the null reverse-path, MAIL FROM:<>, e.g. a delivery status notification.
+	NullSender bool
+}
+
+// WithEnvelope returns a copy of ctx carrying the SMTP envelope.
+func WithEnvelope(ctx context.Context, envelope *Envelope) context.Context {
+	return context.WithValue(ctx, envelopeContextKey, envelope)
+}
+
+// EnvelopeFromContext returns the Envelope value stored in ctx, if any.
+func EnvelopeFromContext(ctx context.Context) (envelope *Envelope, ok bool) {
+	e, ok := ctx.Value(envelopeContextKey).(*Envelope)
+	return e, ok
+}
+
+// Sender returns the envelope sender for the mail, empty for the null reverse-path.
+// Falls back to the mail Sender and From headers when no envelope is known.
+func Sender(ctx context.Context, mail *Email) string {
+	if envelope, ok := EnvelopeFromContext(ctx); ok && (envelope.From != "" || envelope.NullSender) {
+		return envelope.From
+	}
+	if mail.Sender != "" {
+		return AddressOf(mail.Sender)
+	}
+	return AddressOf(mail.From)
+}
+
+// Recipients returns the envelope recipients for the mail.
+// Falls back to To, Cc and Bcc headers when no envelope is known.
+func Recipients(ctx context.Context, mail *Email) []string {
+	if envelope, ok := EnvelopeFromContext(ctx); ok && len(envelope.To) > 0 {
+		return envelope.To
+	}
+
+	rcpts := make([]string, 0, len(mail.To)+len(mail.Cc)+len(mail.Bcc))
+	for _, list := range [][]string{mail.To, mail.Cc, mail.Bcc} {
+		for _, rcpt := range list {
+			rcpts = append(rcpts, AddressOf(rcpt))
+		}
+	}
+	return rcpts
+}
+
+// AddressOf strips display name and angle brackets from an address.
+func AddressOf(address string) string {
+	if addr, err := mail.ParseAddress(address); err == nil {
+		return addr.Address
+	}
+	return strings.Trim(strings.TrimSpace(address), "<>")
+}
+
+// RecipientError failed delivery of a single recipient.
+type RecipientError struct {
+	Recipient string
+	Err       error
+}
+
+func (e *RecipientError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Recipient, e.Err)
+}
+
+func (e *RecipientError) Unwrap() error {
+	return e.Err
+}
+
+// DeliveryError per-recipient outcome of a forward where some recipients failed.
+type DeliveryError struct {
+	Delivered []string
+	Failed    []*RecipientError
+}
+
+func (e *DeliveryError) Error() string {
+	failed := make([]string, 0, len(e.Failed))
+	for _, f := range e.Failed {
+		failed = append(failed, f.Error())
+	}
+	return fmt.Sprintf("delivery failed for %d of %d recipients: %s",
+		len(e.Failed), len(e.Failed)+len(e.Delivered), strings.Join(failed, "; "))
+}
+
+func (e *DeliveryError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, f := range e.Failed {
+		errs = append(errs, f)
+	}
+	return errs
+}
+
+// Partial reports whether at least one recipient was delivered.
+func (e *DeliveryError) Partial() bool {
+	return len(e.Delivered) > 0
+}
+
+// IsPermanent reports whether err is a permanent (5xx) SMTP reply.
+func IsPermanent(err error) bool {
+	var smtpErr *smtp.SMTPError
+	if errors.As(err, &smtpErr) {
+		return smtpErr.Code >= 500
+	}
+	var protoErr *textproto.Error
+	if errors.As(err, &protoErr) {
+		return protoErr.Code >= 500
+	}
+	return false
+}
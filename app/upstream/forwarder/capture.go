@@ -0,0 +1,66 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	"github.com/leonardinius/smtpd-proxy/app/capture"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+var errNoCaptureStore = errors.New("capture upstream requires capture.listen in configuration")
+
+type captureUpstreamSettings struct{}
+
+type captureServer struct {
+	settings captureUpstreamSettings
+	logger   *slog.Logger
+	store    *capture.Store
+}
+
+var (
+	_ upstream.Server        = (*captureServer)(nil)
+	_ upstream.Forwarder     = (*captureServer)(nil)
+	_ upstream.HealthChecker = (*captureServer)(nil)
+)
+
+// NewCaptureServer new capture upstream, keeps messages in the store of the configure context, see capture.WithStore.
+func NewCaptureServer(logger *slog.Logger) upstream.Server {
+	return &captureServer{logger: logger}
+}
+
+func (u *captureServer) Configure(ctx context.Context, settings map[string]any) (upstream.Forwarder, error) {
+	if err := decodeSettings(settings, &u.settings); err != nil {
+		return nil, err
+	}
+	store, ok := capture.StoreFromContext(ctx)
+	if !ok {
+		return nil, errNoCaptureStore
+	}
+	u.store = store
+	return u, nil
+}
+
+// HealthCheck capture upstream is always healthy.
+func (u *captureServer) HealthCheck(context.Context) error {
+	return nil
+}
+
+func (u *captureServer) Forward(ctx context.Context, mail *upstream.Email) error {
+	raw, err := upstream.Bytes(ctx, mail)
+	if err != nil {
+		return err
+	}
+	msg, err := u.store.Add(capture.Message{
+		From:    upstream.Sender(ctx, mail),
+		To:      upstream.Recipients(ctx, mail),
+		Subject: mail.Subject,
+	}, raw)
+	if err != nil {
+		return err
+	}
+	upstream.ReportProviderMessageID(ctx, msg.ID)
+	u.logger.DebugContext(ctx, "captured", "id", msg.ID, "size", msg.Size)
+	return nil
+}
@@ -0,0 +1,41 @@
+package forwarder
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	"github.com/leonardinius/smtpd-proxy/app/capture"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCaptureForward(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	_, err := NewCaptureServer(logger).Configure(context.Background(), nil)
+	require.ErrorIs(t, err, errNoCaptureStore)
+
+	store, err := capture.Open("", 0)
+	require.NoError(t, err)
+	fwd, err := NewCaptureServer(logger).Configure(capture.WithStore(context.Background(), store), nil)
+	require.NoError(t, err)
+
+	raw := []byte("From: app@example.com\r\nTo: user@example.net\r\nSubject: hello\r\n\r\nbody\r\n")
+	ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{From: "bounce@example.com", To: []string{"user@example.net"}})
+	ctx = upstream.WithRaw(ctx, raw)
+	ctx, delivery := upstream.WithDelivery(ctx)
+	require.NoError(t, fwd.Forward(ctx, &upstream.Email{Subject: "hello"}))
+
+	list := store.List("")
+	require.Len(t, list, 1)
+	assert.Equal(t, "bounce@example.com", list[0].From)
+	assert.Equal(t, []string{"user@example.net"}, list[0].To)
+	assert.Equal(t, "hello", list[0].Subject)
+	assert.Equal(t, []string{list[0].ID}, delivery.ProviderMessageIDs())
+
+	_, stored, err := store.Get(list[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, raw, stored)
+}
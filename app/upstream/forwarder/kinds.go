@@ -0,0 +1,266 @@
+package forwarder
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+var (
+	errUnknownField = errors.New("unknown field")
+	errRequired     = errors.New("required field is missing")
+	errInvalidValue = errors.New("invalid value")
+)
+
+// Kind upstream type: its typed settings and server constructor.
+//
+// Settings struct fields are described with tags:
+//
+//	json:"name"             settings key
+//	required:"true"         key must be set to a non-zero value
+//	enum:"a,b"              allowed string values
+//	description:"..."       documentation, used in JSON schema
+type Kind struct {
+	Name        string
+	Description string
+	// Settings returns pointer to zero value typed settings.
+	Settings  func() any
+	NewServer func(logger *slog.Logger) upstream.Server
+}
+
+var kinds = []Kind{
+	{
+		Name:        "smtp",
+		Description: "Forward to SMTP server, STARTTLS when advertised.",
+		Settings:    func() any { return &smtpUpstreamSettings{} },
+		NewServer:   NewSMTPServer,
+	},
+	{
+		Name:        "ses",
+		Description: "Send via AWS SES API.",
+		Settings:    func() any { return &sesUpstreamSettings{} },
+		NewServer:   NewSESServer,
+	},
+	{
+		Name:        "log",
+		Description: "Log message excerpt, for troubleshooting.",
+		Settings:    func() any { return &logUpstreamSettings{} },
+		NewServer:   NewLogServer,
+	},
+	{
+		Name:        "lmtp",
+		Description: "Deliver to local mail store via LMTP, tcp or unix socket.",
+		Settings:    func() any { return &lmtpUpstreamSettings{} },
+		NewServer:   NewLMTPServer,
+	},
+	{
+		Name:        "mx",
+		Description: "Deliver directly to recipient domains MX hosts.",
+		Settings:    func() any { return &mxUpstreamSettings{} },
+		NewServer:   NewMXServer,
+	},
+	{
+		Name:        "s3",
+		Description: "Archive raw message and JSON metadata to S3-compatible storage.",
+		Settings:    func() any { return &s3UpstreamSettings{} },
+		NewServer:   NewS3Server,
+	},
+	{
+		Name:        "capture",
+		Description: "Keep messages for the mail catcher web UI and API, see capture.listen.",
+		Settings:    func() any { return &captureUpstreamSettings{} },
+		NewServer:   NewCaptureServer,
+	},
+}
+
+// Kinds all supported upstream types.
+func Kinds() []Kind {
+	return slices.Clone(kinds)
+}
+
+// KindNames supported upstream type names.
+func KindNames() []string {
+	names := make([]string, 0, len(kinds))
+	for _, k := range kinds {
+		names = append(names, k.Name)
+	}
+	return names
+}
+
+// LookupKind finds upstream type by name.
+func LookupKind(name string) (Kind, bool) {
+	i := slices.IndexFunc(kinds, func(k Kind) bool { return k.Name == name })
+	if i < 0 {
+		return Kind{}, false
+	}
+	return kinds[i], true
+}
+
+// settingsValidator typed settings checked beyond the tags, e.g. address and duration formats.
+// Unset values are not checked.
+type settingsValidator interface {
+	validate() []error
+}
+
+// SettingsError invalid upstream settings key.
+type SettingsError struct {
+	// Key settings key, empty when the error is not specific to a key.
+	Key string
+	Err error
+}
+
+func (e *SettingsError) Error() string {
+	if e.Key == "" {
+		return e.Err.Error()
+	}
+	return e.Key + ": " + e.Err.Error()
+}
+
+func (e *SettingsError) Unwrap() error {
+	return e.Err
+}
+
+// ValidateSettings checks settings against the typed settings of the kind: unknown keys, value types,
+// required keys, allowed values and the value formats of the kind. Returns *SettingsError values.
+func (k Kind) ValidateSettings(settings map[string]any) []error {
+	target := k.Settings()
+	errs := decodeStrict(settings, target)
+
+	v := reflect.ValueOf(target).Elem()
+	for _, f := range settingsFields(v.Type()) {
+		value := v.FieldByIndex(f.index)
+		// an empty value, e.g. of an unset ${VAR}, is as good as missing.
+		if f.required && value.IsZero() {
+			errs = append(errs, &SettingsError{Key: f.key, Err: errRequired})
+			continue
+		}
+		if len(f.enum) > 0 && value.Kind() == reflect.String && value.String() != "" &&
+			!slices.Contains(f.enum, value.String()) {
+			errs = append(errs, &SettingsError{Key: f.key, Err: fmt.Errorf("%w: %q, allowed values [%s]",
+				errInvalidValue, value.String(), strings.Join(f.enum, ", "))})
+		}
+	}
+	if validator, ok := target.(settingsValidator); ok {
+		errs = append(errs, validator.validate()...)
+	}
+	return errs
+}
+
+// decodeSettings strictly decodes settings into target and checks the value formats, see decodeStrict.
+func decodeSettings(settings map[string]any, target any) error {
+	errs := decodeStrict(settings, target)
+	if validator, ok := target.(settingsValidator); ok && len(errs) == 0 {
+		errs = validator.validate()
+	}
+	return errors.Join(errs...)
+}
+
+// validateHostPort checks an address setting is host:port.
+func validateHostPort(key, addr string) error {
+	if addr == "" {
+		return nil
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil || port == "" {
+		return &SettingsError{Key: key, Err: fmt.Errorf("%w: %q, expected host:port", errInvalidValue, addr)}
+	}
+	return nil
+}
+
+// decodeStrict decodes settings into target, reporting unknown keys and mistyped values.
+func decodeStrict(settings map[string]any, target any) []error {
+	known := map[string]bool{}
+	for _, f := range settingsFields(reflect.TypeOf(target).Elem()) {
+		known[f.key] = true
+	}
+
+	var errs []error
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		if !known[key] {
+			errs = append(errs, &SettingsError{Key: key, Err: errUnknownField})
+		}
+	}
+
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return append(errs, &SettingsError{Err: err})
+	}
+	if err = json.Unmarshal(data, target); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			err = &SettingsError{Key: typeErr.Field, Err: fmt.Errorf("%w: expected %s, got %s",
+				errInvalidValue, typeErr.Type, typeErr.Value)}
+		} else {
+			err = &SettingsError{Err: err}
+		}
+		errs = append(errs, err)
+	}
+	return errs
+}
+
+// SettingsField typed settings key description.
+type SettingsField struct {
+	Key         string
+	Type        reflect.Type
+	Required    bool
+	Enum        []string
+	Description string
+}
+
+// Fields typed settings keys of the kind.
+func (k Kind) Fields() []SettingsField {
+	fields := settingsFields(reflect.TypeOf(k.Settings()).Elem())
+	out := make([]SettingsField, 0, len(fields))
+	for _, f := range fields {
+		out = append(out, SettingsField{
+			Key:         f.key,
+			Type:        f.typ,
+			Required:    f.required,
+			Enum:        f.enum,
+			Description: f.description,
+		})
+	}
+	return out
+}
+
+type settingsField struct {
+	key         string
+	index       []int
+	typ         reflect.Type
+	required    bool
+	enum        []string
+	description string
+}
+
+func settingsFields(t reflect.Type) []settingsField {
+	fields := make([]settingsField, 0, t.NumField())
+	for _, f := range reflect.VisibleFields(t) {
+		key, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if key == "" || key == "-" {
+			continue
+		}
+		field := settingsField{
+			key:         key,
+			index:       f.Index,
+			typ:         f.Type,
+			required:    f.Tag.Get("required") == "true",
+			description: f.Tag.Get("description"),
+		}
+		if enum := f.Tag.Get("enum"); enum != "" {
+			field.enum = strings.Split(enum, ",")
+		}
+		fields = append(fields, field)
+	}
+	return fields
+}
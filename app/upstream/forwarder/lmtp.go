@@ -0,0 +1,169 @@
+package forwarder
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"path/filepath"
+
+	"github.com/emersion/go-smtp"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+const defaultLocalName = "localhost"
+
+var (
+	errNoAddr       = errors.New("addr is required")
+	errNoRecipients = errors.New("no recipients")
+)
+
+// lmtpUpstreamSettings LMTP (RFC 2033) delivery details.
+type lmtpUpstreamSettings struct {
+	Addr    string `description:"LMTP server host:port or unix socket path"                      json:"addr"    required:"true"`
+	Network string `description:"tcp or unix, unix for absolute addr by default" enum:"tcp,unix" json:"network"`
+	LHLO    string `description:"LHLO name"                                                      json:"lhlo"`
+}
+
+func (c *lmtpUpstreamSettings) validate() []error {
+	if c.Network == "tcp" || (c.Network == "" && !filepath.IsAbs(c.Addr)) {
+		if err := validateHostPort("addr", c.Addr); err != nil {
+			return []error{err}
+		}
+	}
+	return nil
+}
+
+type lmtpUpstream struct {
+	settings lmtpUpstreamSettings
+	logger   *slog.Logger
+}
+
+var (
+	_ upstream.Server        = (*lmtpUpstream)(nil)
+	_ upstream.Forwarder     = (*lmtpUpstream)(nil)
+	_ upstream.HealthChecker = (*lmtpUpstream)(nil)
+)
+
+// NewLMTPServer new lmtp upstream.
+func NewLMTPServer(logger *slog.Logger) upstream.Server {
+	return &lmtpUpstream{logger: logger}
+}
+
+func (u *lmtpUpstream) Configure(ctx context.Context, settings map[string]any) (upstream.Forwarder, error) {
+	err := decodeSettings(settings, &u.settings)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &u.settings
+	if c.Addr == "" {
+		return nil, errNoAddr
+	}
+	if c.Network == "" {
+		c.Network = "tcp"
+		if filepath.IsAbs(c.Addr) {
+			c.Network = "unix"
+		}
+	}
+	if c.LHLO == "" {
+		c.LHLO = defaultLocalName
+	}
+
+	return u, nil
+}
+
+func (u *lmtpUpstream) Forward(ctx context.Context, mail *upstream.Email) error {
+	rcpts := upstream.Recipients(ctx, mail)
+	if len(rcpts) == 0 {
+		return errNoRecipients
+	}
+
+	bytes, err := upstream.Bytes(ctx, mail)
+	if err != nil {
+		return err
+	}
+
+	dialCtx, done := stage(ctx, "lmtp", "dial")
+	client, err := u.dial(dialCtx)
+	done(err)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sendCtx, done := stage(ctx, "lmtp", "send")
+	err = u.send(sendCtx, client, upstream.Sender(ctx, mail), rcpts, bytes)
+	done(err)
+	return err
+}
+
+// HealthCheck connects and greets the LMTP server without sending.
+func (u *lmtpUpstream) HealthCheck(ctx context.Context) error {
+	client, err := u.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return client.Quit()
+}
+
+func (u *lmtpUpstream) dial(ctx context.Context) (*smtp.Client, error) {
+	c := &u.settings
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, c.Network, c.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	client := smtp.NewClientLMTP(conn)
+	if err = client.Hello(c.LHLO); err != nil {
+		_ = client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+func (u *lmtpUpstream) send(ctx context.Context, client *smtp.Client, from string, rcpts []string, bytes []byte) error {
+	if err := client.Mail(from, nil); err != nil {
+		return err
+	}
+
+	result := &upstream.DeliveryError{}
+	accepted := 0
+	for _, rcpt := range rcpts {
+		if err := client.Rcpt(rcpt, nil); err != nil {
+			result.Failed = append(result.Failed, &upstream.RecipientError{Recipient: rcpt, Err: err})
+			continue
+		}
+		accepted++
+	}
+
+	if accepted > 0 {
+		w, err := client.LMTPData(func(rcpt string, status *smtp.SMTPError) {
+			if status != nil {
+				result.Failed = append(result.Failed, &upstream.RecipientError{Recipient: rcpt, Err: status})
+				return
+			}
+			result.Delivered = append(result.Delivered, rcpt)
+		})
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(bytes); err != nil {
+			return err
+		}
+		if err = w.Close(); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Quit(); err != nil {
+		u.logger.DebugContext(ctx, "lmtp quit", "err", err)
+	}
+
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
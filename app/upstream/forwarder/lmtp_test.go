@@ -0,0 +1,175 @@
+package forwarder
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var errMailboxFull = &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 2, 2}, Message: "mailbox full"}
+
+type lmtpBackend struct {
+	mu        sync.Mutex
+	delivered map[string]string
+}
+
+func (be *lmtpBackend) NewSession(_ *smtp.Conn) (smtp.Session, error) {
+	return &lmtpSession{be: be}, nil
+}
+
+type lmtpSession struct {
+	be    *lmtpBackend
+	rcpts []string
+}
+
+var _ smtp.LMTPSession = (*lmtpSession)(nil)
+
+func (s *lmtpSession) Reset()        { s.rcpts = nil }
+func (s *lmtpSession) Logout() error { return nil }
+
+func (s *lmtpSession) Mail(_ string, _ *smtp.MailOptions) error { return nil }
+
+func (s *lmtpSession) Rcpt(to string, _ *smtp.RcptOptions) error {
+	if strings.HasPrefix(to, "unknown@") {
+		return &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 1, 1}, Message: "no such user"}
+	}
+	s.rcpts = append(s.rcpts, to)
+	return nil
+}
+
+func (s *lmtpSession) Data(r io.Reader) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.be.mu.Lock()
+	defer s.be.mu.Unlock()
+	for _, rcpt := range s.rcpts {
+		s.be.delivered[rcpt] = string(body)
+	}
+	return nil
+}
+
+func (s *lmtpSession) LMTPData(r io.Reader, status smtp.StatusCollector) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.be.mu.Lock()
+	defer s.be.mu.Unlock()
+	for _, rcpt := range s.rcpts {
+		if strings.HasPrefix(rcpt, "full@") {
+			status.SetStatus(rcpt, errMailboxFull)
+			continue
+		}
+		s.be.delivered[rcpt] = string(body)
+		status.SetStatus(rcpt, nil)
+	}
+	return nil
+}
+
+func startLMTPServer(t *testing.T, network, addr string) (*lmtpBackend, string) {
+	t.Helper()
+	return startTestServer(t, true, network, addr)
+}
+
+func startTestServer(t *testing.T, lmtp bool, network, addr string) (*lmtpBackend, string) {
+	t.Helper()
+	be := &lmtpBackend{delivered: make(map[string]string)}
+	srv := smtp.NewServer(be)
+	srv.LMTP = lmtp
+	srv.AllowInsecureAuth = true
+	srv.Domain = "localhost"
+
+	l, err := net.Listen(network, addr)
+	require.NoError(t, err)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return be, l.Addr().String()
+}
+
+func newTestMail() *upstream.Email {
+	mail, _ := upstream.NewEmailFromReader(strings.NewReader(strings.Join([]string{
+		"To: <user@example.net>",
+		"From: <sender@example.org>",
+		"Subject: LMTP test",
+		"Content-Type: text/plain",
+		"",
+		"LMTP body",
+		"",
+	}, "\r\n")))
+	return mail
+}
+
+func configureLMTP(t *testing.T, settings map[string]any) upstream.Forwarder {
+	t.Helper()
+	f, err := NewLMTPServer(slog.Default()).Configure(context.Background(), settings)
+	require.NoError(t, err)
+	return f
+}
+
+func TestLMTPForwardTCP(t *testing.T) {
+	t.Parallel()
+	be, addr := startLMTPServer(t, "tcp", "127.0.0.1:0")
+
+	f := configureLMTP(t, map[string]any{"addr": addr})
+	ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{
+		From: "sender@example.org",
+		To:   []string{"a@example.net", "b@example.net"},
+	})
+	require.NoError(t, f.Forward(ctx, newTestMail()))
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	assert.Len(t, be.delivered, 2)
+	assert.Contains(t, be.delivered["a@example.net"], "LMTP body")
+}
+
+func TestLMTPForwardUnixPerRecipientStatus(t *testing.T) {
+	t.Parallel()
+	dir, err := os.MkdirTemp("", "lmtp")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	socket := filepath.Join(dir, "lmtp.sock")
+	be, _ := startLMTPServer(t, "unix", socket)
+
+	f := configureLMTP(t, map[string]any{"addr": socket})
+	ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{
+		From: "sender@example.org",
+		To:   []string{"ok@example.net", "unknown@example.net", "full@example.net"},
+	})
+	err = f.Forward(ctx, newTestMail())
+
+	var deliveryErr *upstream.DeliveryError
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.True(t, deliveryErr.Partial())
+	assert.Equal(t, []string{"ok@example.net"}, deliveryErr.Delivered)
+	require.Len(t, deliveryErr.Failed, 2)
+	assert.Equal(t, "unknown@example.net", deliveryErr.Failed[0].Recipient)
+	assert.Equal(t, "full@example.net", deliveryErr.Failed[1].Recipient)
+
+	var smtpErr *smtp.SMTPError
+	require.ErrorAs(t, deliveryErr.Failed[1], &smtpErr)
+	assert.Equal(t, 552, smtpErr.Code)
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	assert.Len(t, be.delivered, 1)
+}
+
+func TestLMTPConfigureRequiresAddr(t *testing.T) {
+	t.Parallel()
+	_, err := NewLMTPServer(slog.Default()).Configure(context.Background(), map[string]any{})
+	assert.ErrorIs(t, err, errNoAddr)
+}
@@ -2,7 +2,6 @@ package forwarder
 
 import (
 	"context"
-	"encoding/json"
 	"log/slog"
 
 	"github.com/leonardinius/smtpd-proxy/app/upstream"
@@ -16,8 +15,9 @@ type logServer struct {
 }
 
 var (
-	_ upstream.Server    = (*logServer)(nil)
-	_ upstream.Forwarder = (*logServer)(nil)
+	_ upstream.Server        = (*logServer)(nil)
+	_ upstream.Forwarder     = (*logServer)(nil)
+	_ upstream.HealthChecker = (*logServer)(nil)
 )
 
 // NewLogServer new ses upstream.
@@ -26,12 +26,7 @@ func NewLogServer(logger *slog.Logger) upstream.Server {
 }
 
 func (u *logServer) Configure(ctx context.Context, settings map[string]any) (upstream.Forwarder, error) {
-	bytes, err := json.Marshal(settings)
-	if err != nil {
-		return nil, err
-	}
-
-	err = json.Unmarshal(bytes, &u.settings)
+	err := decodeSettings(settings, &u.settings)
 	if err != nil {
 		return nil, err
 	}
@@ -39,6 +34,11 @@ func (u *logServer) Configure(ctx context.Context, settings map[string]any) (ups
 	return u, nil
 }
 
+// HealthCheck log upstream is always healthy.
+func (u *logServer) HealthCheck(context.Context) error {
+	return nil
+}
+
 func (u *logServer) Forward(ctx context.Context, mail *upstream.Email) error {
 	var uid string
 	if meta, ok := upstream.FromContext(ctx); ok {
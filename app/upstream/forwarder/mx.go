@@ -0,0 +1,328 @@
+package forwarder
+
+import (
+	"cmp"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+const (
+	defaultMXPort    = 25
+	defaultMXTimeout = 30 * time.Second
+)
+
+var (
+	errNullMX          = errors.New("domain does not accept mail (null MX)")
+	errNoMXHosts       = errors.New("no reachable mail exchanger")
+	errTLSRequired     = errors.New("mail exchanger does not support STARTTLS")
+	errUnrecognizedTLS = errors.New("unrecognized starttls mode")
+)
+
+// Resolver DNS lookups used for direct MX delivery, satisfied by *net.Resolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// mxUpstreamSettings direct MX delivery details.
+type mxUpstreamSettings struct {
+	Helo      string `description:"EHLO name, hostname by default"                                                   json:"helo"`
+	Port      int    `description:"SMTP port, 25 by default"                                                         json:"port"`
+	StartTLS  string `description:"STARTTLS policy, opportunistic by default" enum:"opportunistic,required,disabled" json:"starttls"`
+	TLSVerify bool   `description:"verify MX host certificates"                                                      json:"tls_verify"`
+	Resolver  string `description:"DNS server host:port, system by default"                                          json:"resolver"`
+	Timeout   string `description:"per MX host delivery timeout, e.g. 30s"                                           json:"timeout"`
+}
+
+func (c *mxUpstreamSettings) validate() (errs []error) {
+	if err := validateHostPort("resolver", c.Resolver); err != nil {
+		errs = append(errs, err)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		errs = append(errs, &SettingsError{Key: "port", Err: fmt.Errorf("%w: %d, expected 1-65535", errInvalidValue, c.Port)})
+	}
+	if c.Timeout != "" {
+		if timeout, err := time.ParseDuration(c.Timeout); err != nil || timeout <= 0 {
+			errs = append(errs, &SettingsError{Key: "timeout", Err: fmt.Errorf("%w: %q, expected a positive duration, e.g. 30s",
+				errInvalidValue, c.Timeout)})
+		}
+	}
+	return errs
+}
+
+type mxUpstream struct {
+	settings mxUpstreamSettings
+	resolver Resolver
+	timeout  time.Duration
+	logger   *slog.Logger
+}
+
+var (
+	_ upstream.Server    = (*mxUpstream)(nil)
+	_ upstream.Forwarder = (*mxUpstream)(nil)
+)
+
+// NewMXServer new direct MX delivery upstream.
+func NewMXServer(logger *slog.Logger) upstream.Server {
+	return &mxUpstream{logger: logger}
+}
+
+// NewMXServerWithResolver new direct MX delivery upstream with custom DNS resolver.
+func NewMXServerWithResolver(logger *slog.Logger, resolver Resolver) upstream.Server {
+	return &mxUpstream{logger: logger, resolver: resolver}
+}
+
+func (u *mxUpstream) Configure(ctx context.Context, settings map[string]any) (upstream.Forwarder, error) {
+	err := decodeSettings(settings, &u.settings)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &u.settings
+	if c.Port == 0 {
+		c.Port = defaultMXPort
+	}
+	if c.Helo == "" {
+		if c.Helo, err = os.Hostname(); err != nil {
+			c.Helo = defaultLocalName
+		}
+	}
+	switch c.StartTLS {
+	case "":
+		c.StartTLS = "opportunistic"
+	case "opportunistic", "required", "disabled":
+	default:
+		return nil, fmt.Errorf("%w: %s, supported values [opportunistic, required, disabled]", errUnrecognizedTLS, c.StartTLS)
+	}
+
+	u.timeout = defaultMXTimeout
+	if c.Timeout != "" {
+		if u.timeout, err = time.ParseDuration(c.Timeout); err != nil {
+			return nil, err
+		}
+	}
+
+	if u.resolver == nil {
+		u.resolver = newResolver(c.Resolver)
+	}
+
+	return u, nil
+}
+
+// newResolver system resolver, or the one querying the given DNS server.
+func newResolver(server string) *net.Resolver {
+	if server == "" {
+		return net.DefaultResolver
+	}
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, server)
+		},
+	}
+}
+
+func (u *mxUpstream) Forward(ctx context.Context, mail *upstream.Email) error {
+	rcpts := upstream.Recipients(ctx, mail)
+	if len(rcpts) == 0 {
+		return errNoRecipients
+	}
+
+	bytes, err := upstream.Bytes(ctx, mail)
+	if err != nil {
+		return err
+	}
+
+	from := upstream.Sender(ctx, mail)
+	result := &upstream.DeliveryError{}
+	for _, group := range groupByDomain(rcpts) {
+		delivered, failed := u.deliverDomain(ctx, group.domain, from, group.rcpts, bytes)
+		result.Delivered = append(result.Delivered, delivered...)
+		result.Failed = append(result.Failed, failed...)
+	}
+
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+type domainRecipients struct {
+	domain string
+	rcpts  []string
+}
+
+// groupByDomain groups recipients by domain, preserving the order of appearance.
+func groupByDomain(rcpts []string) []domainRecipients {
+	groups := make([]domainRecipients, 0, len(rcpts))
+	index := make(map[string]int, len(rcpts))
+	for _, rcpt := range rcpts {
+		domain := ""
+		if at := strings.LastIndexByte(rcpt, '@'); at >= 0 {
+			domain = strings.ToLower(rcpt[at+1:])
+		}
+		i, ok := index[domain]
+		if !ok {
+			i = len(groups)
+			index[domain] = i
+			groups = append(groups, domainRecipients{domain: domain})
+		}
+		groups[i].rcpts = append(groups[i].rcpts, rcpt)
+	}
+	return groups
+}
+
+func failAll(rcpts []string, err error) []*upstream.RecipientError {
+	failed := make([]*upstream.RecipientError, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		failed = append(failed, &upstream.RecipientError{Recipient: rcpt, Err: err})
+	}
+	return failed
+}
+
+// deliverDomain tries mail exchangers in preference order until one accepts the transaction.
+func (u *mxUpstream) deliverDomain(ctx context.Context, domain, from string, rcpts []string, body []byte,
+) (delivered []string, failed []*upstream.RecipientError) {
+	lookupCtx, done := stage(ctx, "mx", "lookup")
+	hosts, err := u.lookupMX(lookupCtx, domain)
+	done(err)
+	if err != nil {
+		return nil, failAll(rcpts, err)
+	}
+
+	lastErr := errNoMXHosts
+	for _, host := range hosts {
+		addrs, err := u.resolver.LookupHost(ctx, host)
+		if err != nil {
+			u.logger.DebugContext(ctx, "mx host lookup", "host", host, "err", err)
+			lastErr = err
+			continue
+		}
+		for _, addr := range addrs {
+			deliverCtx, done := stage(ctx, "mx", "deliver")
+			delivered, failed, err = u.deliverHost(deliverCtx, host, addr, from, rcpts, body)
+			done(err)
+			if err == nil {
+				return delivered, failed
+			}
+			u.logger.DebugContext(ctx, "mx delivery attempt", "host", host, "addr", addr, "err", err)
+			lastErr = err
+			if upstream.IsPermanent(err) {
+				return nil, failAll(rcpts, err)
+			}
+		}
+	}
+	return nil, failAll(rcpts, lastErr)
+}
+
+// lookupMX mail exchanger hosts in preference order, falls back to the domain A/AAAA (RFC 5321 5.1).
+func (u *mxUpstream) lookupMX(ctx context.Context, domain string) ([]string, error) {
+	records, err := u.resolver.LookupMX(ctx, domain)
+	var dnsErr *net.DNSError
+	if err != nil && !(errors.As(err, &dnsErr) && dnsErr.IsNotFound) {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return []string{domain}, nil
+	}
+
+	slices.SortStableFunc(records, func(a, b *net.MX) int { return cmp.Compare(a.Pref, b.Pref) })
+	hosts := make([]string, 0, len(records))
+	for _, mx := range records {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			return nil, fmt.Errorf("%w: %s", errNullMX, domain)
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+// deliverHost runs a single SMTP transaction against addr.
+// Non-nil error means the transaction failed as a whole and the next host may be tried.
+func (u *mxUpstream) deliverHost(ctx context.Context, host, addr, from string, rcpts []string, body []byte,
+) (delivered []string, failed []*upstream.RecipientError, err error) {
+	ctx, cancel := context.WithTimeout(ctx, u.timeout)
+	defer cancel()
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(addr, strconv.Itoa(u.settings.Port)))
+	if err != nil {
+		return nil, nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, nil, err
+	}
+	defer client.Close()
+
+	if err = client.Hello(u.settings.Helo); err != nil {
+		return nil, nil, err
+	}
+	if err = u.startTLS(client, host); err != nil {
+		return nil, nil, err
+	}
+	if err = client.Mail(from); err != nil {
+		return nil, nil, err
+	}
+
+	accepted := make([]string, 0, len(rcpts))
+	for _, rcpt := range rcpts {
+		if err = client.Rcpt(rcpt); err != nil {
+			failed = append(failed, &upstream.RecipientError{Recipient: rcpt, Err: err})
+			continue
+		}
+		accepted = append(accepted, rcpt)
+	}
+	if len(accepted) == 0 {
+		return nil, failed, nil
+	}
+
+	reply, err := data(client, body)
+	if err != nil {
+		return nil, nil, err
+	}
+	upstream.ReportProviderMessageID(ctx, queueID(reply))
+	if err = client.Quit(); err != nil {
+		u.logger.DebugContext(ctx, "mx quit", "host", host, "err", err)
+	}
+
+	return accepted, failed, nil
+}
+
+func (u *mxUpstream) startTLS(client *smtp.Client, host string) error {
+	mode := u.settings.StartTLS
+	if mode == "disabled" {
+		return nil
+	}
+	if ok, _ := client.Extension("STARTTLS"); !ok {
+		if mode == "required" {
+			return errTLSRequired
+		}
+		return nil
+	}
+	//nolint:gosec // opportunistic TLS (RFC 7435) accepts unauthenticated encryption unless verification is asked for
+	return client.StartTLS(&tls.Config{
+		ServerName:         host,
+		InsecureSkipVerify: !u.settings.TLSVerify,
+		MinVersion:         tls.VersionTLS12,
+	})
+}
@@ -0,0 +1,129 @@
+package forwarder
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver local DNS stand-in.
+type fakeResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+}
+
+var _ Resolver = (*fakeResolver)(nil)
+
+func (r *fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	if records, ok := r.mx[name]; ok {
+		return records, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(_ context.Context, host string) ([]string, error) {
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestMXForwardPreferenceFallbackAndGrouping(t *testing.T) {
+	t.Parallel()
+	be, addr := startTestServer(t, false, "tcp", "127.0.0.1:0")
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	portNum, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	resolver := &fakeResolver{
+		mx: map[string][]*net.MX{
+			// deliberately unsorted, the lower preference host is down.
+			"example.net": {{Host: "mx-backup.example.net.", Pref: 20}, {Host: "mx-down.example.net.", Pref: 10}},
+			"null.test":   {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"mx-down.example.net":   {"127.0.0.2"},
+			"mx-backup.example.net": {"127.0.0.1"},
+			"example.org":           {"127.0.0.1"},
+		},
+	}
+
+	f, err := NewMXServerWithResolver(slog.Default(), resolver).Configure(context.Background(), map[string]any{
+		"port": portNum,
+		"helo": "proxy.test",
+	})
+	require.NoError(t, err)
+
+	ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{
+		From: "sender@example.org",
+		To:   []string{"a@example.net", "b@example.org", "c@Example.NET", "d@null.test", "unknown@example.org"},
+	})
+	ctx, delivery := upstream.WithDelivery(ctx)
+	err = f.Forward(ctx, newTestMail())
+
+	var deliveryErr *upstream.DeliveryError
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.Equal(t, []string{"a@example.net", "c@Example.NET", "b@example.org"}, deliveryErr.Delivered)
+	assert.Len(t, delivery.ProviderMessageIDs(), 2, "one 250 reply per domain")
+	require.Len(t, deliveryErr.Failed, 2)
+	assert.Equal(t, "unknown@example.org", deliveryErr.Failed[0].Recipient)
+	assert.True(t, upstream.IsPermanent(deliveryErr.Failed[0]))
+	assert.Equal(t, "d@null.test", deliveryErr.Failed[1].Recipient)
+	assert.ErrorIs(t, deliveryErr.Failed[1], errNullMX)
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	assert.Len(t, be.delivered, 3)
+	assert.Contains(t, be.delivered["b@example.org"], "LMTP body")
+}
+
+func TestMXForwardStartTLSRequired(t *testing.T) {
+	t.Parallel()
+	_, addr := startTestServer(t, false, "tcp", "127.0.0.1:0")
+	_, port, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+	portNum, err := strconv.Atoi(port)
+	require.NoError(t, err)
+
+	resolver := &fakeResolver{hosts: map[string][]string{"example.net": {"127.0.0.1"}}}
+	f, err := NewMXServerWithResolver(slog.Default(), resolver).Configure(context.Background(), map[string]any{
+		"port":     portNum,
+		"starttls": "required",
+	})
+	require.NoError(t, err)
+
+	ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{
+		From: "sender@example.org",
+		To:   []string{"a@example.net"},
+	})
+	err = f.Forward(ctx, newTestMail())
+	assert.ErrorIs(t, err, errTLSRequired)
+}
+
+func TestQueueID(t *testing.T) {
+	t.Parallel()
+	for reply, want := range map[string]string{
+		"2.0.0 Ok: queued as 4F2b1x0Zz9z1":                   "4F2b1x0Zz9z1",
+		"OK id=1rX4Ab-000AbC-2x":                             "1rX4Ab-000AbC-2x",
+		"2.0.0 4AB1cdEf012345 Message accepted for delivery": "4AB1cdEf012345",
+		"Ok 0100018e6a8bd4ea-2c1d-000000":                    "Ok 0100018e6a8bd4ea-2c1d-000000",
+	} {
+		assert.Equal(t, want, queueID(reply), reply)
+	}
+}
+
+func TestGroupByDomain(t *testing.T) {
+	t.Parallel()
+	groups := groupByDomain([]string{"a@x.test", "b@y.test", "c@X.test"})
+	assert.Equal(t, []domainRecipients{
+		{domain: "x.test", rcpts: []string{"a@x.test", "c@X.test"}},
+		{domain: "y.test", rcpts: []string{"b@y.test"}},
+	}, groups)
+}
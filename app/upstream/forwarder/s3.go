@@ -0,0 +1,251 @@
+package forwarder
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+)
+
+const defaultKeyTemplate = "{{.Date}}/{{.Sender}}/{{.Time}}-{{.Unique}}-{{.MessageID}}"
+
+var (
+	errNoBucket        = errors.New("bucket is required")
+	errUnrecognizedSSE = errors.New("unrecognized server side encryption")
+	unsafeKeyChars     = regexp.MustCompile(`[^A-Za-z0-9._@+=-]+`)
+)
+
+// s3UpstreamSettings S3-compatible archive details.
+type s3UpstreamSettings struct { //nolint:lll // aligned struct tags
+	AwsAccessKeyID     string `description:"AWS access key ID"                                        json:"aws_access_key_id"`
+	AwsSecretAccessKey string `description:"AWS secret access key"                                    json:"aws_secret_access_key"`
+	Region             string `description:"AWS region"                                               json:"region"`
+	Endpoint           string `description:"S3 API endpoint URL"                                      json:"endpoint"`
+	Bucket             string `description:"bucket name"                                              json:"bucket"                required:"true"`
+	KeyTemplate        string `description:"object key template"                                      json:"key_template"`
+	PathStyle          bool   `description:"path-style addressing"                                    json:"path_style"`
+	SSE                string `description:"encryption"            enum:"AES256,aws:kms,aws:kms:dsse" json:"sse"`
+	SSEKMSKeyID        string `description:"KMS key ID"                                               json:"sse_kms_key_id"`
+}
+
+type s3Upstream struct {
+	settings s3UpstreamSettings
+	client   *awss3.Client
+	key      *template.Template
+	logger   *slog.Logger
+}
+
+var (
+	_ upstream.Server        = (*s3Upstream)(nil)
+	_ upstream.Forwarder     = (*s3Upstream)(nil)
+	_ upstream.HealthChecker = (*s3Upstream)(nil)
+)
+
+// NewS3Server new S3 archive upstream.
+func NewS3Server(logger *slog.Logger) upstream.Server {
+	return &s3Upstream{logger: logger}
+}
+
+func (u *s3Upstream) Configure(ctx context.Context, settings map[string]any) (upstream.Forwarder, error) {
+	err := decodeSettings(settings, &u.settings)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &u.settings
+	if c.Bucket == "" {
+		return nil, errNoBucket
+	}
+	switch types.ServerSideEncryption(c.SSE) {
+	case "", types.ServerSideEncryptionAes256, types.ServerSideEncryptionAwsKms, types.ServerSideEncryptionAwsKmsDsse:
+	default:
+		return nil, fmt.Errorf("%w: %s, supported values [AES256, aws:kms, aws:kms:dsse]", errUnrecognizedSSE, c.SSE)
+	}
+	if c.KeyTemplate == "" {
+		c.KeyTemplate = defaultKeyTemplate
+	}
+	if u.key, err = template.New("key").Option("missingkey=error").Parse(c.KeyTemplate); err != nil {
+		return nil, err
+	}
+
+	opts := make([]func(*awss3.Options), 0)
+	if c.Endpoint != "" {
+		opts = append(opts, func(o *awss3.Options) {
+			o.BaseEndpoint = aws.String(c.Endpoint)
+		})
+	}
+	opts = append(opts, func(o *awss3.Options) {
+		o.UsePathStyle = c.PathStyle
+	})
+
+	cfgOpts := []func(*config.LoadOptions) error{config.WithRegion(c.Region)}
+	if c.AwsAccessKeyID != "" {
+		credentialsProvider := credentials.NewStaticCredentialsProvider(c.AwsAccessKeyID, c.AwsSecretAccessKey, "")
+		cfgOpts = append(cfgOpts, config.WithCredentialsProvider(credentialsProvider))
+	}
+	cfg, err := config.LoadDefaultConfig(ctx, cfgOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	u.client = awss3.NewFromConfig(cfg, opts...)
+	return u, nil
+}
+
+// archiveKey values available to the key template.
+type archiveKey struct {
+	Year      string
+	Month     string
+	Day       string
+	Date      string
+	Time      string
+	Sender    string
+	MessageID string
+	UID       string
+	Unique    string
+}
+
+// archiveMetadata JSON sidecar stored next to the raw message.
+type archiveMetadata struct {
+	MessageID    string    `json:"message_id"`
+	UID          string    `json:"uid,omitempty"`
+	EnvelopeFrom string    `json:"envelope_from"`
+	EnvelopeTo   []string  `json:"envelope_to"`
+	From         string    `json:"from"`
+	To           []string  `json:"to,omitempty"`
+	Cc           []string  `json:"cc,omitempty"`
+	ReplyTo      []string  `json:"reply_to,omitempty"`
+	Subject      string    `json:"subject"`
+	Attachments  []string  `json:"attachments,omitempty"`
+	Size         int       `json:"size"`
+	ArchivedAt   time.Time `json:"archived_at"`
+}
+
+func (u *s3Upstream) Forward(ctx context.Context, mail *upstream.Email) error {
+	raw, err := upstream.Bytes(ctx, mail)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	meta := archiveMetadata{
+		MessageID:    messageID(mail),
+		EnvelopeFrom: upstream.Sender(ctx, mail),
+		EnvelopeTo:   upstream.Recipients(ctx, mail),
+		From:         mail.From,
+		To:           mail.To,
+		Cc:           mail.Cc,
+		ReplyTo:      mail.ReplyTo,
+		Subject:      mail.Subject,
+		Size:         len(raw),
+		ArchivedAt:   now,
+	}
+	if entry, ok := upstream.FromContext(ctx); ok {
+		meta.UID = entry.UID
+	}
+	for _, a := range mail.Attachments {
+		meta.Attachments = append(meta.Attachments, a.Filename)
+	}
+
+	key, err := u.objectKey(now, meta)
+	if err != nil {
+		return err
+	}
+	sidecar, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+
+	if err = u.put(ctx, key+".eml", "message/rfc822", raw); err != nil {
+		return err
+	}
+	if err = u.put(ctx, key+".json", "application/json", sidecar); err != nil {
+		return err
+	}
+	upstream.ReportProviderMessageID(ctx, key)
+	return nil
+}
+
+func (u *s3Upstream) objectKey(now time.Time, meta archiveMetadata) (string, error) {
+	var key bytes.Buffer
+	err := u.key.Execute(&key, archiveKey{
+		Year:      now.Format("2006"),
+		Month:     now.Format("01"),
+		Day:       now.Format("02"),
+		Date:      now.Format("2006-01-02"),
+		Time:      now.Format("150405"),
+		Sender:    sanitizeKey(meta.EnvelopeFrom),
+		MessageID: sanitizeKey(strings.Trim(meta.MessageID, "<>")),
+		UID:       sanitizeKey(meta.UID),
+		Unique:    randomHex(8),
+	})
+	return key.String(), err
+}
+
+// HealthCheck verifies the bucket exists and is accessible.
+func (u *s3Upstream) HealthCheck(ctx context.Context) error {
+	ctx, done := stage(ctx, "s3", "HeadBucket")
+	_, err := u.client.HeadBucket(ctx, &awss3.HeadBucketInput{Bucket: aws.String(u.settings.Bucket)})
+	done(err)
+	return err
+}
+
+func (u *s3Upstream) put(ctx context.Context, key, contentType string, body []byte) error {
+	c := &u.settings
+	input := &awss3.PutObjectInput{
+		Bucket:        aws.String(c.Bucket),
+		Key:           aws.String(key),
+		Body:          bytes.NewReader(body),
+		ContentLength: aws.Int64(int64(len(body))),
+		ContentType:   aws.String(contentType),
+	}
+	if c.SSE != "" {
+		input.ServerSideEncryption = types.ServerSideEncryption(c.SSE)
+	}
+	if c.SSEKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(c.SSEKMSKeyID)
+	}
+
+	ctx, done := stage(ctx, "s3", "PutObject")
+	_, err := u.client.PutObject(ctx, input)
+	done(err)
+	return err
+}
+
+// messageID Message-Id header, or a generated one for messages without it.
+func messageID(mail *upstream.Email) string {
+	if id := mail.Headers.Get("Message-Id"); id != "" {
+		return id
+	}
+	return fmt.Sprintf("%d.%s@smtpd-proxy", time.Now().UnixNano(), randomHex(8))
+}
+
+// randomHex n random bytes, hex encoded.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// sanitizeKey keeps object key path components free of separators and special characters.
+func sanitizeKey(s string) string {
+	if s == "" {
+		return "_"
+	}
+	return unsafeKeyChars.ReplaceAllString(s, "_")
+}
@@ -0,0 +1,69 @@
+package forwarder
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestS3ObjectKeyTemplate(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2024, 3, 9, 14, 5, 7, 0, time.UTC)
+	meta := archiveMetadata{
+		MessageID:    "<abc/123@mail.example.org>",
+		EnvelopeFrom: "Sender Name+tag@example.org",
+		UID:          "uid:0001",
+	}
+
+	tests := []struct {
+		template string
+		key      string
+	}{
+		{"archive/{{.Year}}/{{.Month}}/{{.Day}}/{{.Time}}-{{.UID}}", "archive/2024/03/09/140507-uid_0001"},
+	}
+	for _, test := range tests {
+		f, err := NewS3Server(slog.Default()).Configure(context.Background(), map[string]any{
+			"bucket":       "archive",
+			"region":       "us-east-1",
+			"key_template": test.template,
+		})
+		require.NoError(t, err)
+		key, err := f.(*s3Upstream).objectKey(now, meta)
+		require.NoError(t, err)
+		assert.Equal(t, test.key, key)
+	}
+}
+
+func TestS3DefaultObjectKeyIsUnique(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2024, 3, 9, 14, 5, 7, 0, time.UTC)
+	meta := archiveMetadata{
+		MessageID:    "<abc/123@mail.example.org>",
+		EnvelopeFrom: "Sender Name+tag@example.org",
+	}
+	f, err := NewS3Server(slog.Default()).Configure(context.Background(), map[string]any{"bucket": "archive", "region": "us-east-1"})
+	require.NoError(t, err)
+
+	first, err := f.(*s3Upstream).objectKey(now, meta)
+	require.NoError(t, err)
+	second, err := f.(*s3Upstream).objectKey(now, meta)
+	require.NoError(t, err)
+	assert.Regexp(t, `^2024-03-09/Sender_Name\+tag@example\.org/140507-[0-9a-f]{16}-abc_123@mail\.example\.org$`, first)
+	assert.NotEqual(t, first, second, "same Message-ID in the same second must not overwrite the archived message")
+}
+
+func TestS3ConfigureValidation(t *testing.T) {
+	t.Parallel()
+	_, err := NewS3Server(slog.Default()).Configure(context.Background(), map[string]any{})
+	assert.ErrorIs(t, err, errNoBucket)
+
+	_, err = NewS3Server(slog.Default()).Configure(context.Background(), map[string]any{"bucket": "b", "sse": "rot13"})
+	assert.ErrorIs(t, err, errUnrecognizedSSE)
+
+	_, err = NewS3Server(slog.Default()).Configure(context.Background(), map[string]any{"bucket": "b", "key_template": "{{.Nope"})
+	assert.Error(t, err)
+}
@@ -2,10 +2,10 @@ package forwarder
 
 import (
 	"context"
-	"encoding/json"
 	"log/slog"
 	gohttp "net/http"
 	"net/url"
+	"strings"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/aws/transport/http"
@@ -24,10 +24,10 @@ const (
 
 // sesUpstreamSettings AWS SES upstream details.
 type sesUpstreamSettings struct {
-	AwsAccessKeyID     string `json:"aws_access_key_id"`
-	AwsSecretAccessKey string `json:"aws_secret_access_key"`
-	Region             string `json:"region"`
-	Endpoint           string `json:"endpoint"`
+	AwsAccessKeyID     string `description:"AWS access key ID"                      json:"aws_access_key_id"`
+	AwsSecretAccessKey string `description:"AWS secret access key"                  json:"aws_secret_access_key"`
+	Region             string `description:"AWS region, default chain when omitted" json:"region"`
+	Endpoint           string `description:"SES API endpoint URL, e.g. localstack"  json:"endpoint"`
 }
 
 type sesUpstream struct {
@@ -37,8 +37,9 @@ type sesUpstream struct {
 }
 
 var (
-	_ upstream.Server    = (*sesUpstream)(nil)
-	_ upstream.Forwarder = (*sesUpstream)(nil)
+	_ upstream.Server        = (*sesUpstream)(nil)
+	_ upstream.Forwarder     = (*sesUpstream)(nil)
+	_ upstream.HealthChecker = (*sesUpstream)(nil)
 )
 
 // NewSESServer new ses upstream.
@@ -47,12 +48,7 @@ func NewSESServer(logger *slog.Logger) upstream.Server {
 }
 
 func (u *sesUpstream) Configure(ctx context.Context, settings map[string]any) (upstream.Forwarder, error) {
-	bytes, err := json.Marshal(settings)
-	if err != nil {
-		return nil, err
-	}
-
-	err = json.Unmarshal(bytes, &u.settings)
+	err := decodeSettings(settings, &u.settings)
 	if err != nil {
 		return nil, err
 	}
@@ -91,43 +87,49 @@ func (u *sesUpstream) Configure(ctx context.Context, settings map[string]any) (u
 }
 
 func (u *sesUpstream) Forward(ctx context.Context, mail *upstream.Email) (err error) {
-	if len(mail.Attachments) == 0 {
+	if len(mail.Attachments) == 0 && !upstream.HasRaw(ctx) {
 		return u.sesForwardSimple(ctx, mail)
 	}
 
 	return u.sesForwardRaw(ctx, mail)
 }
 
+// HealthCheck verifies credentials and account access by reading the sending quota.
+func (u *sesUpstream) HealthCheck(ctx context.Context) error {
+	ctx, done := stage(ctx, "ses", "GetSendQuota")
+	_, err := u.client.GetSendQuota(ctx, &awsses.GetSendQuotaInput{})
+	done(err)
+	return err
+}
+
 func (u *sesUpstream) sesForwardRaw(ctx context.Context, mail *upstream.Email) error {
-	bytes, err := mail.Bytes()
+	bytes, err := upstream.Bytes(ctx, mail)
 	if err != nil {
 		return err
 	}
 
-	destinations := make([]string, 0, 3)
-	destinations = append(destinations, mail.To...)
-	destinations = append(destinations, mail.Bcc...)
-	destinations = append(destinations, mail.Cc...)
-
 	inputRaw := &awsses.SendRawEmailInput{
-		Source:       aws.String(mail.From),
-		Destinations: destinations,
+		Source: aws.String(mail.From),
+		// envelope recipients, the raw message headers may list others, e.g. redirected in staging.
+		Destinations: upstream.Recipients(ctx, mail),
 		RawMessage:   &types.RawMessage{Data: bytes},
 	}
 
 	// Attempt to send the email.
-	_, err = u.client.SendRawEmail(ctx, inputRaw)
-	return err
+	ctx, done := stage(ctx, "ses", "SendRawEmail")
+	out, err := u.client.SendRawEmail(ctx, inputRaw)
+	done(err)
+	if err != nil {
+		return err
+	}
+	upstream.ReportProviderMessageID(ctx, aws.ToString(out.MessageId))
+	return nil
 }
 
 func (u *sesUpstream) sesForwardSimple(ctx context.Context, mail *upstream.Email) error {
 	input := &awsses.SendEmailInput{
-		Source: aws.String(mail.From),
-		Destination: &types.Destination{
-			ToAddresses:  mail.To,
-			BccAddresses: mail.Bcc,
-			CcAddresses:  mail.Cc,
-		},
+		Source:           aws.String(mail.From),
+		Destination:      destination(ctx, mail),
 		ReplyToAddresses: mail.ReplyTo,
 		Message: &types.Message{
 			Body: &types.Body{
@@ -148,8 +150,42 @@ func (u *sesUpstream) sesForwardSimple(ctx context.Context, mail *upstream.Email
 	}
 
 	// Attempt to send the email.
-	_, err := u.client.SendEmail(ctx, input)
-	return err
+	ctx, done := stage(ctx, "ses", "SendEmail")
+	out, err := u.client.SendEmail(ctx, input)
+	done(err)
+	if err != nil {
+		return err
+	}
+	upstream.ReportProviderMessageID(ctx, aws.ToString(out.MessageId))
+	return nil
+}
+
+// destination the envelope recipients, recipients removed from the envelope (e.g. suppressed) are not sent to.
+// SES renders To and Cc headers of the destination, recipients missing from the header fields go to Bcc.
+func destination(ctx context.Context, mail *upstream.Email) *types.Destination {
+	pending := map[string]bool{}
+	rcpts := upstream.Recipients(ctx, mail)
+	for _, rcpt := range rcpts {
+		pending[strings.ToLower(upstream.AddressOf(rcpt))] = true
+	}
+	take := func(list []string) (taken []string) {
+		for _, rcpt := range list {
+			if address := strings.ToLower(upstream.AddressOf(rcpt)); pending[address] {
+				delete(pending, address)
+				taken = append(taken, rcpt)
+			}
+		}
+		return taken
+	}
+
+	d := &types.Destination{ToAddresses: take(mail.To), CcAddresses: take(mail.Cc)}
+	for _, rcpt := range rcpts {
+		if address := strings.ToLower(upstream.AddressOf(rcpt)); pending[address] {
+			delete(pending, address)
+			d.BccAddresses = append(d.BccAddresses, rcpt)
+		}
+	}
+	return d
 }
 
 type v2EndpointResolver struct {
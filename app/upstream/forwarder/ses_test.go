@@ -0,0 +1,64 @@
+package forwarder
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSESSendEmailDestinationIsEnvelope(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var form url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.NoError(t, r.ParseForm())
+		form = r.PostForm
+		w.Header().Set("Content-Type", "text/xml")
+		_, _ = w.Write([]byte(`<SendEmailResponse><SendEmailResult><MessageId>ses-1</MessageId></SendEmailResult>` +
+			`<ResponseMetadata><RequestId>req-1</RequestId></ResponseMetadata></SendEmailResponse>`))
+	}))
+	defer srv.Close()
+
+	f, err := NewSESServer(slog.Default()).Configure(context.Background(), map[string]any{
+		"aws_access_key_id":     "key",
+		"aws_secret_access_key": "secret",
+		"region":                "us-east-1",
+		"endpoint":              srv.URL,
+	})
+	require.NoError(t, err)
+
+	mail := &upstream.Email{
+		From:    "app@example.org",
+		To:      []string{"Customer <customer@example.com>"},
+		Cc:      []string{"suppressed@example.com", "boss@example.com"},
+		Subject: "hello",
+		Text:    []byte("body"),
+	}
+	// suppressed@example.com was rejected at RCPT, hidden@example.com is a blind recipient.
+	ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{
+		From: "app@example.org",
+		To:   []string{"customer@example.com", "boss@example.com", "hidden@example.com"},
+	})
+	require.NoError(t, f.Forward(ctx, mail))
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, "SendEmail", form.Get("Action"))
+	assert.Equal(t, "Customer <customer@example.com>", form.Get("Destination.ToAddresses.member.1"))
+	assert.Equal(t, "boss@example.com", form.Get("Destination.CcAddresses.member.1"))
+	assert.Empty(t, form.Get("Destination.CcAddresses.member.2"))
+	assert.Equal(t, "hidden@example.com", form.Get("Destination.BccAddresses.member.1"))
+	for key, values := range form {
+		assert.NotContains(t, values, "suppressed@example.com", key)
+	}
+}
@@ -2,17 +2,23 @@ package forwarder
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"log/slog"
 	"net"
 	"net/smtp"
+	"regexp"
+	"strings"
 
 	"github.com/leonardinius/smtpd-proxy/app/upstream"
 )
 
-var errUnrecognizedAuthType = errors.New("unrecognized auth type")
+var (
+	errUnrecognizedAuthType = errors.New("unrecognized auth type")
+	errAuthNotSupported     = errors.New("smtp: server doesn't support AUTH")
+)
 
 func unrecognizedAuthTypeError(authType string) error {
 	return fmt.Errorf("%w: %s, supported values [login, plain, cram-md5, anon]", errUnrecognizedAuthType, authType)
@@ -20,22 +26,32 @@ func unrecognizedAuthTypeError(authType string) error {
 
 // smtpUpstreamSettings smtp details.
 type smtpUpstreamSettings struct {
-	Addr     string `json:"addr"`
-	Auth     string `json:"auth"`
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Host     string `json:"host"`
+	Addr     string `description:"SMTP server host:port"                                     json:"addr"     required:"true"`
+	Auth     string `description:"authentication mechanism" enum:"plain,login,cram-md5,anon" json:"auth"     required:"true"`
+	Username string `description:"authentication username"                                   json:"username"`
+	Password string `description:"authentication password"                                   json:"password"`
+	Host     string `description:"TLS and auth server name, host of addr when empty"         json:"host"`
+}
+
+func (c *smtpUpstreamSettings) validate() []error {
+	if err := validateHostPort("addr", c.Addr); err != nil {
+		return []error{err}
+	}
+	return nil
 }
 
 type smptUpstream struct {
 	settings smtpUpstreamSettings
 	auth     smtp.Auth
 	logger   *slog.Logger
+	// rootCAs verifying STARTTLS certificates, the host's roots when nil.
+	rootCAs *x509.CertPool
 }
 
 var (
-	_ upstream.Server    = (*smptUpstream)(nil)
-	_ upstream.Forwarder = (*smptUpstream)(nil)
+	_ upstream.Server        = (*smptUpstream)(nil)
+	_ upstream.Forwarder     = (*smptUpstream)(nil)
+	_ upstream.HealthChecker = (*smptUpstream)(nil)
 )
 
 // NewSMTPServer new smtp upstream.
@@ -44,12 +60,7 @@ func NewSMTPServer(logger *slog.Logger) upstream.Server {
 }
 
 func (u *smptUpstream) Configure(ctx context.Context, settings map[string]any) (upstream.Forwarder, error) {
-	bytes, err := json.Marshal(settings)
-	if err != nil {
-		return nil, err
-	}
-
-	err = json.Unmarshal(bytes, &u.settings)
+	err := decodeSettings(settings, &u.settings)
 	if err != nil {
 		return nil, err
 	}
@@ -61,13 +72,20 @@ func (u *smptUpstream) Configure(ctx context.Context, settings map[string]any) (
 	return u, nil
 }
 
+// serverName TLS and auth server name.
+func (u *smptUpstream) serverName() (string, error) {
+	if u.settings.Host != "" {
+		return u.settings.Host, nil
+	}
+	host, _, err := net.SplitHostPort(u.settings.Addr)
+	return host, err
+}
+
 func (u *smptUpstream) initAuth() (auth smtp.Auth, err error) {
 	c := &u.settings
-	host := c.Host
-	if host == "" {
-		if host, _, err = net.SplitHostPort(c.Addr); err != nil {
-			return nil, err
-		}
+	host, err := u.serverName()
+	if err != nil {
+		return nil, err
 	}
 
 	switch authType := c.Auth; authType {
@@ -85,6 +103,161 @@ func (u *smptUpstream) initAuth() (auth smtp.Auth, err error) {
 	return
 }
 
-func (u *smptUpstream) Forward(_ context.Context, mail *upstream.Email) error {
-	return mail.Send(u.settings.Addr, u.auth)
+func (u *smptUpstream) Forward(ctx context.Context, mail *upstream.Email) error {
+	rcpts := upstream.Recipients(ctx, mail)
+	if len(rcpts) == 0 {
+		return errNoRecipients
+	}
+
+	bytes, err := upstream.Bytes(ctx, mail)
+	if err != nil {
+		return err
+	}
+
+	dialCtx, done := stage(ctx, "smtp", "dial")
+	client, err := u.dial(dialCtx)
+	done(err)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	_, done = stage(ctx, "smtp", "auth")
+	err = u.authenticate(client)
+	done(err)
+	if err != nil {
+		return err
+	}
+
+	sendCtx, done := stage(ctx, "smtp", "send")
+	err = u.send(sendCtx, client, upstream.Sender(ctx, mail), rcpts, bytes)
+	done(err)
+	return err
+}
+
+// HealthCheck connects and authenticates to the upstream without sending.
+func (u *smptUpstream) HealthCheck(ctx context.Context) error {
+	client, err := u.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if err = u.authenticate(client); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// dial connects and greets the upstream, upgrading to TLS when it is advertised.
+func (u *smptUpstream) dial(ctx context.Context) (*smtp.Client, error) {
+	host, err := u.serverName()
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", u.settings.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, host)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(&tls.Config{ServerName: host, RootCAs: u.rootCAs, MinVersion: tls.VersionTLS12}); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+func (u *smptUpstream) authenticate(client *smtp.Client) error {
+	if u.auth == nil {
+		return nil
+	}
+	if ok, _ := client.Extension("AUTH"); !ok {
+		return errAuthNotSupported
+	}
+	return client.Auth(u.auth)
+}
+
+func (u *smptUpstream) send(ctx context.Context, client *smtp.Client, from string, rcpts []string, body []byte) error {
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+
+	result := &upstream.DeliveryError{}
+	for _, rcpt := range rcpts {
+		if err := client.Rcpt(rcpt); err != nil {
+			result.Failed = append(result.Failed, &upstream.RecipientError{Recipient: rcpt, Err: err})
+			continue
+		}
+		result.Delivered = append(result.Delivered, rcpt)
+	}
+	if len(result.Delivered) == 0 {
+		return result
+	}
+
+	reply, err := data(client, body)
+	if err != nil {
+		return err
+	}
+	upstream.ReportProviderMessageID(ctx, queueID(reply))
+	if err = client.Quit(); err != nil {
+		u.logger.DebugContext(ctx, "smtp quit", "err", err)
+	}
+
+	if len(result.Failed) > 0 {
+		return result
+	}
+	return nil
+}
+
+// data sends the message body, returns the text of the 250 reply.
+// Same as smtp.Client.Data, which discards the reply.
+func data(client *smtp.Client, body []byte) (string, error) {
+	id, err := client.Text.Cmd("DATA")
+	if err != nil {
+		return "", err
+	}
+	client.Text.StartResponse(id)
+	_, _, err = client.Text.ReadResponse(354)
+	client.Text.EndResponse(id)
+	if err != nil {
+		return "", err
+	}
+
+	w := client.Text.DotWriter()
+	if _, err = w.Write(body); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+	_, reply, err := client.Text.ReadResponse(250)
+	return reply, err
+}
+
+// queueIDPattern queue ID in the 250 reply to DATA:
+// Postfix "queued as 4F2b1x", Exim "OK id=1rX4-000Ab", Sendmail "4AB1cd Message accepted for delivery".
+var queueIDPattern = regexp.MustCompile(`(?i)queued as ([\w.-]+)|\bid=([\w.-]+)|^(?:[\d.]+ )?([\w.-]+) Message accepted`)
+
+// queueID extracts the queue ID from the 250 reply text, the whole reply when the format is unknown.
+func queueID(reply string) string {
+	if m := queueIDPattern.FindStringSubmatch(reply); m != nil {
+		for _, id := range m[1:] {
+			if id != "" {
+				return id
+			}
+		}
+	}
+	return strings.TrimSpace(reply)
 }
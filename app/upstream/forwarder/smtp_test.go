@@ -0,0 +1,119 @@
+package forwarder
+
+import (
+	"context"
+	"crypto/x509"
+	"log/slog"
+	"maps"
+	"net"
+	"net/http/httptest"
+	"slices"
+	"sync/atomic"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+	"github.com/leonardinius/smtpd-proxy/app/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// tlsBackend records whether the sessions upgraded with STARTTLS.
+type tlsBackend struct {
+	*lmtpBackend
+	tls atomic.Bool
+}
+
+func (be *tlsBackend) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	if _, ok := c.TLSConnectionState(); ok {
+		be.tls.Store(true)
+	}
+	return be.lmtpBackend.NewSession(c)
+}
+
+// startSMTPServer SMTP server offering STARTTLS with the httptest certificate of example.com and 127.0.0.1.
+func startSMTPServer(t *testing.T) (*tlsBackend, string, *x509.CertPool) {
+	t.Helper()
+	certs := httptest.NewTLSServer(nil)
+	t.Cleanup(certs.Close)
+	roots := x509.NewCertPool()
+	roots.AddCert(certs.Certificate())
+
+	be := &tlsBackend{lmtpBackend: &lmtpBackend{delivered: make(map[string]string)}}
+	srv := smtp.NewServer(be)
+	srv.Domain = "localhost"
+	srv.TLSConfig = certs.TLS
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() { _ = srv.Serve(l) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return be, l.Addr().String(), roots
+}
+
+func configureSMTP(t *testing.T, addr string, roots *x509.CertPool) upstream.Forwarder {
+	t.Helper()
+	return configureSMTPSettings(t, map[string]any{"addr": addr, "auth": "anon"}, roots)
+}
+
+func configureSMTPSettings(t *testing.T, settings map[string]any, roots *x509.CertPool) upstream.Forwarder {
+	t.Helper()
+	f, err := NewSMTPServer(slog.Default()).Configure(context.Background(), settings)
+	require.NoError(t, err)
+	f.(*smptUpstream).rootCAs = roots
+	return f
+}
+
+func TestSMTPForwardUpgradesToTLS(t *testing.T) {
+	t.Parallel()
+	be, addr, roots := startSMTPServer(t)
+
+	ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{From: "sender@example.org", To: []string{"a@example.net"}})
+	require.NoError(t, configureSMTP(t, addr, roots).Forward(ctx, newTestMail()))
+	assert.True(t, be.tls.Load(), "STARTTLS advertised")
+	be.mu.Lock()
+	assert.Contains(t, be.delivered["a@example.net"], "LMTP body")
+	assert.NotContains(t, be.delivered, "user@example.net", "envelope recipients, not the To header")
+	be.mu.Unlock()
+
+	err := configureSMTP(t, addr, nil).Forward(ctx, newTestMail())
+	require.ErrorContains(t, err, "certificate", "untrusted certificate")
+}
+
+func TestSMTPForwardVerifiesHost(t *testing.T) {
+	t.Parallel()
+	_, addr, roots := startSMTPServer(t)
+	ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{From: "sender@example.org", To: []string{"a@example.net"}})
+
+	f := configureSMTPSettings(t, map[string]any{"addr": addr, "auth": "anon", "host": "example.com"}, roots)
+	require.NoError(t, f.Forward(ctx, newTestMail()), "the certificate is issued to example.com")
+
+	f = configureSMTPSettings(t, map[string]any{"addr": addr, "auth": "anon", "host": "mail.example.org"}, roots)
+	require.ErrorContains(t, f.Forward(ctx, newTestMail()), "mail.example.org", "verified against host, not the addr IP")
+}
+
+func TestSMTPForwardPartialRecipientFailure(t *testing.T) {
+	t.Parallel()
+	be, addr, roots := startSMTPServer(t)
+
+	ctx := upstream.WithEnvelope(context.Background(), &upstream.Envelope{
+		From: "sender@example.org",
+		To:   []string{"a@example.net", "unknown@example.net"},
+	})
+	err := configureSMTP(t, addr, roots).Forward(ctx, newTestMail())
+
+	var deliveryErr *upstream.DeliveryError
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.Equal(t, []string{"a@example.net"}, deliveryErr.Delivered)
+	require.Len(t, deliveryErr.Failed, 1)
+	assert.Equal(t, "unknown@example.net", deliveryErr.Failed[0].Recipient)
+	assert.True(t, upstream.IsPermanent(deliveryErr.Failed[0]))
+
+	be.mu.Lock()
+	defer be.mu.Unlock()
+	assert.Equal(t, []string{"a@example.net"}, slices.Collect(maps.Keys(be.delivered)))
+
+	ctx = upstream.WithEnvelope(context.Background(), &upstream.Envelope{From: "sender@example.org", To: []string{"unknown@example.net"}})
+	err = configureSMTP(t, addr, roots).Forward(ctx, newTestMail())
+	require.ErrorAs(t, err, &deliveryErr)
+	assert.False(t, deliveryErr.Partial(), "no recipient accepted, DATA is not sent")
+}
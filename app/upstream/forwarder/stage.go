@@ -0,0 +1,18 @@
+package forwarder
+
+import (
+	"context"
+
+	"github.com/leonardinius/smtpd-proxy/app/metrics"
+	"github.com/leonardinius/smtpd-proxy/app/tracing"
+)
+
+// stage instruments a forwarder step with a trace span and a latency metric.
+func stage(ctx context.Context, upstreamType, name string) (context.Context, func(err error)) {
+	ctx, span := tracing.Start(ctx, upstreamType+"."+name)
+	observe := metrics.Stage(upstreamType, name)
+	return ctx, func(err error) {
+		observe(err)
+		tracing.End(span, err)
+	}
+}
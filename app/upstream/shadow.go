@@ -0,0 +1,191 @@
+package upstream
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/leonardinius/smtpd-proxy/app/metrics"
+)
+
+// shadowSettings candidate upstream evaluated with a sample of real traffic.
+type shadowSettings struct {
+	// percent of messages submitted to the shadow, 0-100.
+	percent float64
+	// rewriteTo replaces all recipients, e.g. SES mailbox simulator address.
+	rewriteTo string
+	counters  shadowCounters
+}
+
+// shadowCounters shadow vs primary outcomes of sampled messages.
+type shadowCounters struct {
+	samples          atomic.Int64
+	failed           atomic.Int64
+	primaryFailed    atomic.Int64
+	mismatched       atomic.Int64
+	latencyNs        atomic.Int64
+	primaryLatencyNs atomic.Int64
+}
+
+// ShadowStats snapshot of shadow upstream performance compared to the primary.
+type ShadowStats struct {
+	EntryMeta
+	Percent               float64
+	Samples               int64
+	Errors                int64
+	PrimaryErrors         int64
+	OutcomeMismatches     int64
+	AverageLatency        time.Duration
+	AveragePrimaryLatency time.Duration
+}
+
+// AsShadow marks the entry as a shadow: a percentage of messages is also submitted to it,
+// with recipients rewritten to rewriteTo, and outcomes are compared to the primary.
+func AsShadow(percent float64, rewriteTo string) EntryOption {
+	return entryOptionFunc(func(entry *registryEntry) {
+		entry.meta.Shadow = true
+		entry.shadow = &shadowSettings{percent: percent, rewriteTo: rewriteTo}
+	})
+}
+
+// forwardOutcome result of a single forward attempt.
+type forwardOutcome struct {
+	err     error
+	latency time.Duration
+}
+
+// primaryOutcome outcome of the primary forward, published once it is known.
+type primaryOutcome struct {
+	done chan struct{}
+	forwardOutcome
+}
+
+func newPrimaryOutcome() *primaryOutcome {
+	return &primaryOutcome{done: make(chan struct{})}
+}
+
+func (p *primaryOutcome) publish(err error, latency time.Duration) {
+	p.err = err
+	p.latency = latency
+	close(p.done)
+}
+
+// shadow submits sampled messages to shadow entries in background.
+func (r *RegistryMap) shadow(ctx context.Context, mail *Email, primary *primaryOutcome) {
+	r.mu.Lock()
+	shadows := make([]*registryEntry, 0, len(r.shadows))
+	for _, entry := range r.shadows {
+		if entry.state == StateActive && float64(r.rnd.Intn(10000)) < entry.shadow.percent*100 {
+			entry.counters.inFlight.Add(1)
+			shadows = append(shadows, entry)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, entry := range shadows {
+		r.background.Add(1)
+		// the copy is taken before the primary forward renders the mail, see cloneEmail.
+		shadowMail := cloneEmail(mail)
+		go func() {
+			defer r.background.Done()
+			r.forwardShadow(context.WithoutCancel(ctx), entry, shadowMail, primary)
+		}()
+	}
+}
+
+func (r *RegistryMap) forwardShadow(ctx context.Context, entry *registryEntry, mail *Email, primary *primaryOutcome) {
+	ctx, cancel := context.WithTimeout(ctx, MirrorTimeout)
+	defer cancel()
+
+	logger := r.logger.With("uid", entry.meta.UID, "name", entry.meta.Name, "type", entry.meta.Type, "shadow", true)
+	var outcome forwardOutcome
+	func() {
+		defer func() {
+			if x := recover(); x != nil {
+				outcome.err = fmt.Errorf("panic: %v", x)
+			}
+		}()
+
+		shadowMail, shadowCtx := mail, ctx
+		if rewriteTo := entry.shadow.rewriteTo; rewriteTo != "" {
+			shadowMail = rewriteRecipients(mail, rewriteTo)
+			sender := Sender(ctx, mail)
+			shadowCtx = WithEnvelope(ctx, &Envelope{From: sender, To: []string{rewriteTo}, NullSender: sender == ""})
+		}
+
+		start := time.Now()
+		outcome.err = entry.forward(shadowCtx, metrics.RoleShadow, entry.sender, shadowMail)
+		outcome.latency = time.Since(start)
+	}()
+	entry.record(metrics.RoleShadow, outcome.latency, outcome.err)
+
+	select {
+	case <-primary.done:
+	case <-ctx.Done():
+		logger.WarnContext(ctx, "shadow compare timeout", "err", ctx.Err())
+		return
+	}
+
+	entry.shadow.counters.record(outcome, primary.forwardOutcome)
+	logger.InfoContext(ctx, "shadow compare",
+		"latency", outcome.latency,
+		"primary_latency", primary.latency,
+		"err", outcome.err,
+		"primary_err", primary.err,
+	)
+}
+
+func (c *shadowCounters) record(shadow, primary forwardOutcome) {
+	c.samples.Add(1)
+	c.latencyNs.Add(int64(shadow.latency))
+	c.primaryLatencyNs.Add(int64(primary.latency))
+	if shadow.err != nil {
+		c.failed.Add(1)
+	}
+	if primary.err != nil {
+		c.primaryFailed.Add(1)
+	}
+	if (shadow.err == nil) != (primary.err == nil) {
+		c.mismatched.Add(1)
+	}
+}
+
+// ShadowStats returns shadow upstreams performance compared to primaries.
+func (r *RegistryMap) ShadowStats() []ShadowStats {
+	r.mu.Lock()
+	shadows := slices.Clone(r.shadows)
+	r.mu.Unlock()
+
+	stats := make([]ShadowStats, 0, len(shadows))
+	for _, entry := range shadows {
+		c := &entry.shadow.counters
+		s := ShadowStats{
+			EntryMeta:         entry.meta,
+			Percent:           entry.shadow.percent,
+			Samples:           c.samples.Load(),
+			Errors:            c.failed.Load(),
+			PrimaryErrors:     c.primaryFailed.Load(),
+			OutcomeMismatches: c.mismatched.Load(),
+		}
+		if s.Samples > 0 {
+			s.AverageLatency = time.Duration(c.latencyNs.Load() / s.Samples)
+			s.AveragePrimaryLatency = time.Duration(c.primaryLatencyNs.Load() / s.Samples)
+		}
+		stats = append(stats, s)
+	}
+	return stats
+}
+
+// rewriteRecipients copy of the mail addressed to a single recipient only.
+func rewriteRecipients(mail *Email, to string) *Email {
+	rewritten := cloneEmail(mail)
+	rewritten.To = []string{to}
+	rewritten.Cc = nil
+	rewritten.Bcc = nil
+	for _, h := range []string{"To", "Cc", "Bcc"} {
+		delete(rewritten.Headers, h)
+	}
+	return rewritten
+}
@@ -9,16 +9,33 @@ import (
 	"log/slog"
 	"math"
 	"math/big"
+	"net/textproto"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/jordan-wright/email"
+	"github.com/leonardinius/smtpd-proxy/app/metrics"
+	"github.com/leonardinius/smtpd-proxy/app/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-var errEmptyRegistry = errors.New("empty sender registry")
+var (
+	errEmptyRegistry   = errors.New("empty sender registry")
+	errNoActiveEntries = errors.New("no active upstream in sender registry")
+)
+
+// MirrorTimeout upper bound for delivering a mirror copy.
+var MirrorTimeout = 5 * time.Minute
 
 // Email wrapper for package specific (github.com/jordan-wright/email) email.
 type Email = email.Email
 
+// Attachment wrapper for package specific email attachment, see Email.Attachments.
+type Attachment = email.Attachment
+
 // NewEmailFromReader reads email from DATA stream.
 func NewEmailFromReader(r io.Reader) (*Email, error) {
 	var envelope *email.Email
@@ -30,6 +47,57 @@ func NewEmailFromReader(r io.Reader) (*Email, error) {
 	return envelope, nil
 }
 
+// cloneEmail copy of the mail safe to render concurrently with the original:
+// Email.Bytes sets default headers of the attachments in place.
+func cloneEmail(mail *Email) *Email {
+	if mail == nil {
+		return nil
+	}
+	c := *mail
+	c.Headers = cloneHeader(mail.Headers)
+	c.Attachments = make([]*Attachment, 0, len(mail.Attachments))
+	for _, a := range mail.Attachments {
+		attachment := *a
+		attachment.Header = cloneHeader(a.Header)
+		c.Attachments = append(c.Attachments, &attachment)
+	}
+	return &c
+}
+
+func cloneHeader(h textproto.MIMEHeader) textproto.MIMEHeader {
+	if h == nil {
+		return nil
+	}
+	c := make(textproto.MIMEHeader, len(h))
+	for k, v := range h {
+		c[k] = slices.Clone(v)
+	}
+	return c
+}
+
+// rawKey context.Context key for the message bytes to forward as is.
+type rawKey struct{}
+
+// WithRaw returns a copy of ctx carrying the message bytes to forward as is,
+// e.g. DKIM signed message which must not be re-rendered.
+func WithRaw(ctx context.Context, raw []byte) context.Context {
+	return context.WithValue(ctx, rawKey{}, raw)
+}
+
+// HasRaw reports whether ctx carries the message bytes to forward as is.
+func HasRaw(ctx context.Context) bool {
+	_, ok := ctx.Value(rawKey{}).([]byte)
+	return ok
+}
+
+// Bytes returns the message to forward: the bytes carried by ctx, see WithRaw, or the rendered mail.
+func Bytes(ctx context.Context, mail *Email) ([]byte, error) {
+	if raw, ok := ctx.Value(rawKey{}).([]byte); ok {
+		return raw, nil
+	}
+	return mail.Bytes()
+}
+
 // Server inits the connecion pool to the server.
 type Server interface {
 	Configure(ctx context.Context, config map[string]any) (Forwarder, error)
@@ -43,7 +111,7 @@ type Forwarder interface {
 // Registry envelope holde of multiple upstream servers.
 type Registry interface {
 	Forwarder
-	AddForwarder(forwarder Forwarder, weight int)
+	AddForwarder(forwarder Forwarder, weight int, opts ...EntryOption)
 	Len() int
 }
 
@@ -58,23 +126,86 @@ type entryKey string
 var entryContextKey entryKey
 
 type EntryMeta struct {
-	UID string
+	UID    string
+	Name   string
+	Type   string
+	Mirror bool
+	Shadow bool
+}
+
+// An EntryOption configures a registry entry.
+type EntryOption interface {
+	apply(entry *registryEntry)
+}
+
+// entryOptionFunc wraps a func so it satisfies the EntryOption interface.
+type entryOptionFunc func(entry *registryEntry)
+
+func (f entryOptionFunc) apply(entry *registryEntry) {
+	f(entry)
+}
+
+// WithName sets human readable entry name.
+func WithName(name string) EntryOption {
+	return entryOptionFunc(func(entry *registryEntry) {
+		entry.meta.Name = name
+	})
+}
+
+// WithUID sets the entry UID, random when empty. Metrics and the admin API identify entries by UID.
+func WithUID(uid string) EntryOption {
+	return entryOptionFunc(func(entry *registryEntry) {
+		if uid != "" {
+			entry.meta.UID = uid
+		}
+	})
+}
+
+// WithType sets entry upstream type, e.g. smtp or ses.
+func WithType(upstreamType string) EntryOption {
+	return entryOptionFunc(func(entry *registryEntry) {
+		entry.meta.Type = upstreamType
+	})
+}
+
+// AsMirror marks the entry to receive a copy of every message, regardless of weights.
+func AsMirror() EntryOption {
+	return entryOptionFunc(func(entry *registryEntry) {
+		entry.meta.Mirror = true
+	})
+}
+
+// entryCounters forward outcomes of a single entry.
+type entryCounters struct {
+	forwarded atomic.Int64
+	failed    atomic.Int64
+	inFlight  atomic.Int64
 }
 
 // registryEntry entry witin registry.
+// state, weight, threshold and health are guarded by the registry mutex.
 type registryEntry struct {
 	originalWeight int
+	weight         int
 	threshold      int
+	state          State
+	health         Health
 	sender         Forwarder
 	meta           EntryMeta
+	counters       *entryCounters
+	shadow         *shadowSettings
 }
 
 type RegistryMap struct {
 	mu            sync.Mutex
-	entriesSorted []registryEntry
+	entriesSorted []*registryEntry
+	mirrors       []*registryEntry
+	shadows       []*registryEntry
 	totalWeight   int
 	rnd           randInt
 	logger        *slog.Logger
+	// background mirror and shadow forwards.
+	background sync.WaitGroup
 }
 
 // randInt interface for random values.
@@ -120,14 +251,51 @@ func NewEmptyRegistry(logger *slog.Logger) *RegistryMap {
 	}
 }
 
-func (r *RegistryMap) AddForwarder(forwarder Forwarder, weight int) {
+func (r *RegistryMap) AddForwarder(forwarder Forwarder, weight int, opts ...EntryOption) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	newTotal := r.totalWeight + weight
 	uid := fmt.Sprintf("uid:%04x", r.rnd.Int())
-	newEntry := registryEntry{originalWeight: weight, threshold: newTotal, sender: forwarder, meta: EntryMeta{UID: uid}}
+	newEntry := &registryEntry{
+		originalWeight: weight,
+		weight:         weight,
+		state:          StateActive,
+		health:         Health{Status: HealthUnknown},
+		sender:         forwarder,
+		meta:           EntryMeta{UID: uid},
+		counters:       &entryCounters{},
+	}
+	for _, opt := range opts {
+		opt.apply(newEntry)
+	}
+
+	switch {
+	case newEntry.meta.Mirror:
+		r.mirrors = append(r.mirrors, newEntry)
+		return
+	case newEntry.meta.Shadow:
+		r.shadows = append(r.shadows, newEntry)
+		return
+	}
+
 	r.entriesSorted = append(r.entriesSorted, newEntry)
-	r.totalWeight = newTotal
+	r.rebalance()
+}
+
+// rebalance recomputes pick thresholds over routable entries, must be called with mutex held.
+func (r *RegistryMap) rebalance() {
+	total := 0
+	for _, entry := range r.entriesSorted {
+		if entry.routable() {
+			total += entry.weight
+		}
+		entry.threshold = total
+	}
+	r.totalWeight = total
+}
+
+// routable whether the entry takes part in the weighted pick.
+func (e *registryEntry) routable() bool {
+	return e.state == StateActive && e.weight > 0
 }
 
 func (r *RegistryMap) pick() (Forwarder, *registryEntry, error) {
@@ -136,12 +304,19 @@ func (r *RegistryMap) pick() (Forwarder, *registryEntry, error) {
 	if len(r.entriesSorted) == 0 {
 		return nil, nil, errEmptyRegistry
 	}
+	if r.totalWeight == 0 {
+		return nil, nil, errNoActiveEntries
+	}
 
 	chance := r.rnd.Intn(r.totalWeight + 1)
 	acc := 0
 	for _, entry := range r.entriesSorted {
+		if !entry.routable() {
+			continue
+		}
 		if chance >= acc && chance <= entry.threshold {
-			return entry.sender, &entry, nil
+			entry.counters.inFlight.Add(1)
+			return entry.sender, entry, nil
 		}
 		acc = entry.threshold
 	}
@@ -155,19 +330,124 @@ func (r *RegistryMap) Len() int {
 }
 
 func (r *RegistryMap) Forward(ctx context.Context, mail *Email) error {
+	_, routeSpan := tracing.Start(ctx, "upstream.route")
 	sender, entry, err := r.pick()
+	if err == nil {
+		routeSpan.SetAttributes(entry.meta.attributes(metrics.RolePrimary)...)
+	}
+	tracing.End(routeSpan, err)
 	if err != nil {
 		return err
 	}
+	reportUpstream(ctx, &entry.meta)
+
+	r.mirror(ctx, mail)
+	primary := newPrimaryOutcome()
+	r.shadow(ctx, mail, primary)
 
 	uid := entry.meta.UID
-	err = sender.Forward(context.WithValue(ctx, entryContextKey, &entry.meta), mail)
+	start := time.Now()
+	err = entry.forward(ctx, metrics.RolePrimary, sender, mail)
+	elapsed := time.Since(start)
+	primary.publish(err, elapsed)
+	entry.record(metrics.RolePrimary, elapsed, err)
 	if err != nil {
 		r.logger.WarnContext(ctx, "forward error", "uid", uid, "err", err)
 	}
 	return err
 }
 
+// mirror sends a copy of the mail to every mirror entry in background.
+// Mirror outcomes never affect the primary forward result.
+func (r *RegistryMap) mirror(ctx context.Context, mail *Email) {
+	r.mu.Lock()
+	mirrors := make([]*registryEntry, 0, len(r.mirrors))
+	for _, entry := range r.mirrors {
+		if entry.state == StateActive {
+			entry.counters.inFlight.Add(1)
+			mirrors = append(mirrors, entry)
+		}
+	}
+	r.mu.Unlock()
+
+	for _, entry := range mirrors {
+		r.background.Add(1)
+		// the copy is taken before the primary forward renders the mail.
+		mirrorMail := cloneEmail(mail)
+		go func() {
+			defer r.background.Done()
+			r.forwardMirror(context.WithoutCancel(ctx), entry, mirrorMail)
+		}()
+	}
+}
+
+// Wait blocks until background mirror and shadow forwards complete or ctx is done.
+func (r *RegistryMap) Wait(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.background.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+func (r *RegistryMap) forwardMirror(ctx context.Context, entry *registryEntry, mail *Email) {
+	ctx, cancel := context.WithTimeout(ctx, MirrorTimeout)
+	defer cancel()
+
+	logger := r.logger.With("uid", entry.meta.UID, "name", entry.meta.Name, "type", entry.meta.Type, "mirror", true)
+	start := time.Now()
+	defer func() {
+		if x := recover(); x != nil {
+			entry.record(metrics.RoleMirror, time.Since(start), fmt.Errorf("panic: %v", x))
+			logger.ErrorContext(ctx, "mirror forward panic", "panic", x)
+		}
+	}()
+
+	err := entry.forward(ctx, metrics.RoleMirror, entry.sender, mail)
+	entry.record(metrics.RoleMirror, time.Since(start), err)
+	if err != nil {
+		logger.WarnContext(ctx, "mirror forward error", "err", err)
+	}
+}
+
+// forward single attempt within upstream.forward trace span.
+func (e *registryEntry) forward(ctx context.Context, role string, sender Forwarder, mail *Email) (err error) {
+	ctx, span := tracing.Start(ctx, "upstream.forward", trace.WithAttributes(e.meta.attributes(role)...))
+	defer func() { tracing.End(span, err) }()
+	defer e.counters.inFlight.Add(-1) // acquired when the entry was selected, under registry mutex.
+	return sender.Forward(context.WithValue(ctx, entryContextKey, &e.meta), mail)
+}
+
+func (m *EntryMeta) attributes(role string) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		attribute.String("upstream.uid", m.UID),
+		attribute.String("upstream.name", m.Name),
+		attribute.String("upstream.type", m.Type),
+		attribute.String("upstream.role", role),
+	}
+}
+
+// record forward outcome in entry counters and metrics.
+func (e *registryEntry) record(role string, elapsed time.Duration, err error) {
+	e.counters.record(err)
+	metrics.Forward(e.meta.UID, e.meta.Name, e.meta.Type, role, elapsed, err)
+}
+
+func (c *entryCounters) record(err error) {
+	if err != nil {
+		c.failed.Add(1)
+		return
+	}
+	c.forwarded.Add(1)
+}
+
 // FromContext returns the entryMeta value stored in ctx, if any.
 func FromContext(ctx context.Context) (meta *EntryMeta, ok bool) {
 	u, ok := ctx.Value(entryContextKey).(*EntryMeta)
@@ -1,10 +1,16 @@
 package upstream
 
 import (
+	"context"
+	"errors"
 	"log/slog"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/jordan-wright/email"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestInitAddForward(t *testing.T) {
@@ -55,6 +61,231 @@ func TestRegistryRandomForwardPickRandomThresholds(t *testing.T) {
 	}
 }
 
+func TestMirrorReceivesCopyWithoutAffectingPrimary(t *testing.T) {
+	primary := newRecordingForwarder(nil)
+	mirror := newRecordingForwarder(errors.New("archive unavailable"))
+	r := newRegistry( /*uids*/ 1, 2 /*pic percentages*/, 5)
+	r.AddForwarder(primary, 10, WithType("smtp"))
+	r.AddForwarder(mirror, 0, WithName("archive"), WithType("s3"), AsMirror())
+
+	assert.Equal(t, 1, r.Len())
+	assert.Equal(t, 10, r.totalWeight)
+
+	err := r.Forward(context.Background(), nil)
+	require.NoError(t, err)
+
+	assert.Equal(t, "uid:0001", (<-primary.calls).UID)
+	select {
+	case meta := <-mirror.calls:
+		assert.Equal(t, EntryMeta{UID: "uid:0002", Name: "archive", Type: "s3", Mirror: true}, *meta)
+	case <-time.After(time.Second):
+		t.Fatal("mirror did not receive a copy")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, r.Wait(ctx))
+	assert.Equal(t, int64(1), r.mirrors[0].counters.failed.Load())
+	assert.Equal(t, int64(1), r.entriesSorted[0].counters.forwarded.Load())
+}
+
+func TestMirrorRendersCopyOfAttachments(t *testing.T) {
+	r := newRegistry( /*uids*/ 1, 2, 3 /*pic percentages*/, 5)
+	r.AddForwarder(renderingForwarder{}, 10)
+	r.AddForwarder(renderingForwarder{}, 0, AsMirror())
+	r.AddForwarder(renderingForwarder{}, 0, AsMirror())
+
+	mail := email.NewEmail()
+	mail.From, mail.To, mail.Text = "app@example.org", []string{"customer@example.com"}, []byte("see attached")
+	_, err := mail.Attach(strings.NewReader("report"), "report.txt", "text/plain")
+	require.NoError(t, err)
+	require.NoError(t, r.Forward(context.Background(), mail))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, r.Wait(ctx))
+	assert.Equal(t, int64(0), r.mirrors[0].counters.failed.Load()+r.mirrors[1].counters.failed.Load())
+}
+
+func TestShadowRendersCopyOfAttachments(t *testing.T) {
+	r := newRegistry( /*uids*/ 1, 2, 3 /*pic percentages*/, 5 /*shadow samples*/, 0, 0)
+	r.AddForwarder(renderingForwarder{}, 10)
+	r.AddForwarder(renderingForwarder{}, 0, AsShadow(100, ""))
+	r.AddForwarder(renderingForwarder{}, 0, AsShadow(100, "success@simulator.amazonses.com"))
+
+	mail := email.NewEmail()
+	mail.From, mail.To, mail.Text = "app@example.org", []string{"customer@example.com"}, []byte("see attached")
+	_, err := mail.Attach(strings.NewReader("report"), "report.txt", "text/plain")
+	require.NoError(t, err)
+	require.NoError(t, r.Forward(context.Background(), mail))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, r.Wait(ctx))
+	for _, stats := range r.ShadowStats() {
+		assert.Equal(t, int64(0), stats.Errors)
+	}
+}
+
+func TestShadowSampledWithRewrittenRecipients(t *testing.T) {
+	primary := newRecordingForwarder(errors.New("throttled"))
+	candidate := newMailRecordingForwarder()
+	r := newRegistry( /*uids*/ 1, 2 /*pic percentages*/, 5 /*shadow sample*/, 2499, 5 /*shadow sample*/, 2500)
+	r.AddForwarder(primary, 10)
+	r.AddForwarder(candidate, 0, WithName("candidate"), AsShadow(25, "success@simulator.amazonses.com"))
+	assert.Equal(t, 1, r.Len())
+
+	mail := &Email{To: []string{"customer@example.com"}, Cc: []string{"boss@example.com"}, Headers: map[string][]string{}}
+	ctx := WithEnvelope(context.Background(), &Envelope{From: "app@example.org", To: []string{"customer@example.com"}})
+	require.Error(t, r.Forward(ctx, mail))
+	require.Error(t, r.Forward(ctx, mail))
+
+	select {
+	case got := <-candidate.mails:
+		assert.Equal(t, []string{"success@simulator.amazonses.com"}, got.mail.To)
+		assert.Empty(t, got.mail.Cc)
+		assert.Equal(t, &Envelope{From: "app@example.org", To: []string{"success@simulator.amazonses.com"}}, got.envelope)
+	case <-time.After(time.Second):
+		t.Fatal("shadow did not receive a sample")
+	}
+	assert.Equal(t, []string{"customer@example.com"}, mail.To, "original mail must stay untouched")
+
+	assert.Eventually(t, func() bool { return r.ShadowStats()[0].Samples == 1 }, time.Second, 10*time.Millisecond)
+	stats := r.ShadowStats()[0]
+	assert.Equal(t, "candidate", stats.Name)
+	assert.Equal(t, int64(0), stats.Errors)
+	assert.Equal(t, int64(1), stats.PrimaryErrors)
+	assert.Equal(t, int64(1), stats.OutcomeMismatches)
+	assert.Empty(t, candidate.mails, "second message must not be sampled")
+}
+
+func TestWithUID(t *testing.T) {
+	r := newRegistry( /*uids*/ 1, 2)
+	r.AddForwarder(nil, 10, WithUID("uid:stable"), WithName("first"))
+	r.AddForwarder(nil, 10, WithUID(""), WithName("second"))
+
+	assert.Equal(t, "first", mustEntry(t, r, "uid:stable").Name)
+	assert.Equal(t, "second", mustEntry(t, r, "uid:0002").Name, "random when empty")
+}
+
+func TestDrainDisableAndWeightRebalance(t *testing.T) {
+	ctx := context.Background()
+	r := newRegistry( /*uids*/ 1, 2, 3 /*pic percentages*/, 0, 25)
+	r.AddForwarder(nil, 10, WithName("first"))
+	r.AddForwarder(nil, 20, WithName("second"))
+	r.AddForwarder(nil, 0, WithName("archive"), AsMirror())
+
+	status, err := r.SetState(ctx, "first", StateDraining)
+	require.NoError(t, err)
+	assert.Equal(t, StateDrained, status.State)
+	assert.Equal(t, 20, r.totalWeight)
+	_, entry, err := r.pick()
+	require.NoError(t, err)
+	assert.Equal(t, "uid:0002", entry.meta.UID)
+	assert.Equal(t, StateActive, mustEntry(t, r, "uid:0002").State)
+	assert.Equal(t, int64(1), mustEntry(t, r, "uid:0002").InFlight)
+
+	_, err = r.SetState(ctx, "uid:0002", StateDisabled)
+	require.NoError(t, err)
+	_, _, err = r.pick()
+	require.ErrorIs(t, err, errNoActiveEntries)
+
+	_, err = r.SetState(ctx, "first", StateActive)
+	require.NoError(t, err)
+	status, err = r.SetWeight(ctx, "first", 25)
+	require.NoError(t, err)
+	assert.Equal(t, 25, status.Weight)
+	assert.Equal(t, 10, status.ConfiguredWeight)
+	assert.Equal(t, 25, r.totalWeight)
+	_, entry, err = r.pick()
+	require.NoError(t, err)
+	assert.Equal(t, "uid:0001", entry.meta.UID)
+
+	_, err = r.SetWeight(ctx, "archive", 5)
+	require.ErrorIs(t, err, ErrNotWeighted)
+	_, err = r.SetWeight(ctx, "first", -1)
+	require.ErrorIs(t, err, ErrInvalidWeight)
+	_, err = r.SetState(ctx, "missing", StateDisabled)
+	require.ErrorIs(t, err, ErrEntryNotFound)
+	assert.Len(t, r.Entries(), 3)
+}
+
+func TestHealthCheck(t *testing.T) {
+	r := newRegistry( /*uids*/ 1, 2)
+	r.AddForwarder(healthForwarder{err: errors.New("connection refused")}, 10)
+	r.AddForwarder(nil, 10)
+
+	status, err := r.HealthCheck(context.Background(), "uid:0001")
+	require.NoError(t, err)
+	assert.Equal(t, HealthFailed, status.Health.Status)
+	assert.Equal(t, "connection refused", status.Health.Error)
+
+	status, err = r.HealthCheck(context.Background(), "uid:0002")
+	require.NoError(t, err)
+	assert.Equal(t, HealthUnsupported, status.Health.Status)
+}
+
+func mustEntry(t *testing.T, r *RegistryMap, id string) EntryStatus {
+	t.Helper()
+	status, err := r.Entry(id)
+	require.NoError(t, err)
+	return status
+}
+
+type healthForwarder struct {
+	err error
+}
+
+func (f healthForwarder) Forward(context.Context, *Email) error {
+	return nil
+}
+
+func (f healthForwarder) HealthCheck(context.Context) error {
+	return f.err
+}
+
+type recordedMail struct {
+	mail     *Email
+	envelope *Envelope
+}
+
+type mailRecordingForwarder struct {
+	mails chan recordedMail
+}
+
+func newMailRecordingForwarder() *mailRecordingForwarder {
+	return &mailRecordingForwarder{mails: make(chan recordedMail, 10)}
+}
+
+func (f *mailRecordingForwarder) Forward(ctx context.Context, mail *Email) error {
+	envelope, _ := EnvelopeFromContext(ctx)
+	f.mails <- recordedMail{mail: mail, envelope: envelope}
+	return nil
+}
+
+// renderingForwarder renders the mail as forwarders without the raw message do.
+type renderingForwarder struct{}
+
+func (renderingForwarder) Forward(ctx context.Context, mail *Email) error {
+	_, err := Bytes(ctx, mail)
+	return err
+}
+
+type recordingForwarder struct {
+	err   error
+	calls chan *EntryMeta
+}
+
+func newRecordingForwarder(err error) *recordingForwarder {
+	return &recordingForwarder{err: err, calls: make(chan *EntryMeta, 10)}
+}
+
+func (f *recordingForwarder) Forward(ctx context.Context, _ *Email) error {
+	meta, _ := FromContext(ctx)
+	f.calls <- meta
+	return f.err
+}
+
 type MockRandom struct {
 	Values []int
 }
@@ -78,3 +309,21 @@ func newRegistry(randomValues ...int) *RegistryMap {
 	r.rnd = &MockRandom{Values: randomValues}
 	return r
 }
+
+func TestForwardToDisabledMirror(t *testing.T) {
+	ctx := context.Background()
+	primary := newRecordingForwarder(nil)
+	archive := newRecordingForwarder(nil)
+	r := newRegistry( /*uids*/ 1, 2)
+	r.AddForwarder(primary, 10)
+	r.AddForwarder(archive, 0, WithName("archive"), AsMirror())
+	_, err := r.SetState(ctx, "archive", StateDisabled)
+	require.NoError(t, err)
+
+	require.NoError(t, r.ForwardTo(ctx, "archive", nil))
+	assert.Equal(t, "uid:0002", (<-archive.calls).UID)
+	assert.Empty(t, primary.calls)
+	assert.Equal(t, int64(1), mustEntry(t, r, "archive").Forwarded)
+	assert.Equal(t, int64(0), mustEntry(t, r, "archive").InFlight)
+	require.ErrorIs(t, r.ForwardTo(ctx, "missing", nil), ErrEntryNotFound)
+}
@@ -0,0 +1,251 @@
+package verify
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strings"
+
+	"blitiri.com.ar/go/spf"
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/emersion/go-msgauth/dkim"
+	"github.com/emersion/go-msgauth/dmarc"
+	"golang.org/x/net/publicsuffix"
+)
+
+// Actions on messages failing verification.
+const (
+	// ActionNone only stamps Authentication-Results.
+	ActionNone = "none"
+	// ActionQuarantine delivers through the quarantine upstream instead of the regular routing.
+	ActionQuarantine = "quarantine"
+	// ActionReject replies 550 to DATA.
+	ActionReject = "reject"
+)
+
+// HeaderName header field stamped with the results, RFC 8601.
+const HeaderName = "Authentication-Results"
+
+// Resolver DNS lookups of the checks, *net.Resolver satisfies it. Tests use a local fake.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Options checks to run. DKIM signatures are always verified.
+type Options struct {
+	// AuthServID authserv-id of the Authentication-Results header, e.g. the EHLO domain.
+	AuthServID string
+	SPF        bool
+	DMARC      bool
+	// Resolver net.DefaultResolver when nil.
+	Resolver Resolver
+}
+
+// Verifier checks DKIM signatures, SPF of the client and DMARC alignment of inbound messages.
+type Verifier struct {
+	opts Options
+}
+
+// New creates verifier.
+func New(opts Options) *Verifier {
+	if opts.Resolver == nil {
+		opts.Resolver = net.DefaultResolver
+	}
+	return &Verifier{opts: opts}
+}
+
+// AuthServID authserv-id of the stamped header.
+func (v *Verifier) AuthServID() string {
+	return v.opts.AuthServID
+}
+
+// Client SMTP client identities checked by SPF.
+type Client struct {
+	IP       net.IP
+	Helo     string
+	MailFrom string
+}
+
+// Result of the checks.
+type Result struct {
+	DKIM []*authres.DKIMResult
+	// SPF nil when disabled.
+	SPF *authres.SPFResult
+	// DMARC nil when disabled.
+	DMARC *authres.DMARCResult
+}
+
+// Failed reports whether the message failed verification: DMARC fail when DMARC is checked,
+// otherwise SPF fail or any failing DKIM signature.
+func (r *Result) Failed() bool {
+	if r.DMARC != nil {
+		return r.DMARC.Value == authres.ResultFail
+	}
+	if r.SPF != nil && r.SPF.Value == authres.ResultFail {
+		return true
+	}
+	for _, d := range r.DKIM {
+		if d.Value == authres.ResultFail || d.Value == authres.ResultPermError {
+			return true
+		}
+	}
+	return false
+}
+
+// Value Authentication-Results header field value.
+func (r *Result) Value(authServID string) string {
+	results := make([]authres.Result, 0, len(r.DKIM)+2)
+	for _, d := range r.DKIM {
+		results = append(results, d)
+	}
+	if r.SPF != nil {
+		results = append(results, r.SPF)
+	}
+	if r.DMARC != nil {
+		results = append(results, r.DMARC)
+	}
+	return authres.Format(authServID, results)
+}
+
+// Verify runs the checks on the raw message. DNS failures are reported as temperror results.
+func (v *Verifier) Verify(ctx context.Context, raw []byte, client *Client) *Result {
+	result := &Result{DKIM: v.verifyDKIM(ctx, raw)}
+	if v.opts.SPF {
+		result.SPF = v.checkSPF(ctx, client)
+	}
+	if v.opts.DMARC {
+		result.DMARC = v.checkDMARC(ctx, raw, result)
+	}
+	return result
+}
+
+func (v *Verifier) lookupTXT(ctx context.Context) func(string) ([]string, error) {
+	return func(name string) ([]string, error) {
+		return v.opts.Resolver.LookupTXT(ctx, name)
+	}
+}
+
+func (v *Verifier) verifyDKIM(ctx context.Context, raw []byte) []*authres.DKIMResult {
+	verifications, err := dkim.VerifyWithOptions(bytes.NewReader(raw), &dkim.VerifyOptions{LookupTXT: v.lookupTXT(ctx)})
+	if err != nil {
+		return []*authres.DKIMResult{{Value: authres.ResultPermError, Reason: err.Error()}}
+	}
+	if len(verifications) == 0 {
+		return []*authres.DKIMResult{{Value: authres.ResultNone}}
+	}
+	results := make([]*authres.DKIMResult, 0, len(verifications))
+	for _, verification := range verifications {
+		r := &authres.DKIMResult{Value: authres.ResultPass, Domain: verification.Domain, Identifier: verification.Identifier}
+		switch {
+		case verification.Err == nil:
+		case dkim.IsTempFail(verification.Err):
+			r.Value, r.Reason = authres.ResultTempError, verification.Err.Error()
+		default:
+			r.Value, r.Reason = authres.ResultFail, verification.Err.Error()
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func (v *Verifier) checkSPF(ctx context.Context, client *Client) *authres.SPFResult {
+	sender := client.MailFrom
+	if sender == "" {
+		// null reverse-path, RFC 7208 section 2.4.
+		sender = "postmaster@" + client.Helo
+	}
+	result, err := spf.CheckHostWithSender(client.IP, client.Helo, sender,
+		spf.WithContext(ctx), spf.WithResolver(v.opts.Resolver))
+	r := &authres.SPFResult{Value: authres.ResultValue(result), From: sender, Helo: client.Helo}
+	if err != nil && result != spf.Pass {
+		r.Reason = err.Error()
+	}
+	return r
+}
+
+func (v *Verifier) checkDMARC(ctx context.Context, raw []byte, result *Result) *authres.DMARCResult {
+	from, err := fromDomain(raw)
+	if err != nil {
+		return &authres.DMARCResult{Value: authres.ResultPermError, Reason: err.Error()}
+	}
+	r := &authres.DMARCResult{From: from}
+
+	opts := &dmarc.LookupOptions{LookupTXT: v.lookupTXT(ctx)}
+	record, err := dmarc.LookupWithOptions(from, opts)
+	if errors.Is(err, dmarc.ErrNoPolicy) {
+		if org := organizationalDomain(from); org != from {
+			record, err = dmarc.LookupWithOptions(org, opts)
+		}
+	}
+	switch {
+	case errors.Is(err, dmarc.ErrNoPolicy):
+		r.Value = authres.ResultNone
+		return r
+	case dmarc.IsTempFail(err):
+		r.Value, r.Reason = authres.ResultTempError, err.Error()
+		return r
+	case err != nil:
+		r.Value, r.Reason = authres.ResultPermError, err.Error()
+		return r
+	}
+
+	for _, d := range result.DKIM {
+		if d.Value == authres.ResultPass && aligned(d.Domain, from, record.DKIMAlignment) {
+			r.Value = authres.ResultPass
+			return r
+		}
+	}
+	if result.SPF != nil && result.SPF.Value == authres.ResultPass {
+		if _, domain, ok := strings.Cut(result.SPF.From, "@"); ok && aligned(domain, from, record.SPFAlignment) {
+			r.Value = authres.ResultPass
+			return r
+		}
+	}
+	r.Value, r.Reason = authres.ResultFail, "no aligned DKIM or SPF pass"
+	return r
+}
+
+// aligned identifier alignment, RFC 7489 section 3.1.
+func aligned(domain, from string, mode dmarc.AlignmentMode) bool {
+	if strings.EqualFold(domain, from) {
+		return true
+	}
+	if mode == dmarc.AlignmentStrict {
+		return false
+	}
+	return strings.EqualFold(organizationalDomain(domain), organizationalDomain(from))
+}
+
+func organizationalDomain(domain string) string {
+	org, err := publicsuffix.EffectiveTLDPlusOne(strings.ToLower(domain))
+	if err != nil {
+		return strings.ToLower(domain)
+	}
+	return org
+}
+
+var errNoFrom = errors.New("no From header")
+
+// fromDomain domain of the From header, which must hold a single address.
+func fromDomain(raw []byte) (string, error) {
+	header, err := textproto.NewReader(bufio.NewReader(bytes.NewReader(raw))).ReadMIMEHeader()
+	if err != nil && len(header) == 0 {
+		return "", err
+	}
+	addrs, err := mail.ParseAddressList(header.Get("From"))
+	if err != nil || len(addrs) != 1 {
+		return "", errNoFrom
+	}
+	_, domain, ok := strings.Cut(addrs[0].Address, "@")
+	if !ok {
+		return "", errNoFrom
+	}
+	return strings.ToLower(domain), nil
+}
@@ -0,0 +1,163 @@
+package verify
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-msgauth/authres"
+	"github.com/leonardinius/smtpd-proxy/app/dkim"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeResolver answers TXT queries from a map, everything else is not found.
+type fakeResolver map[string][]string
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r fakeResolver) LookupTXT(_ context.Context, name string) ([]string, error) {
+	if txt, ok := r[strings.TrimSuffix(name, ".")]; ok {
+		return txt, nil
+	}
+	return nil, notFound(name)
+}
+
+func (fakeResolver) LookupMX(_ context.Context, name string) ([]*net.MX, error) {
+	return nil, notFound(name)
+}
+
+func (fakeResolver) LookupIPAddr(_ context.Context, host string) ([]net.IPAddr, error) {
+	return nil, notFound(host)
+}
+
+func (fakeResolver) LookupAddr(_ context.Context, addr string) ([]string, error) {
+	return nil, notFound(addr)
+}
+
+func newSigner(t *testing.T, domain string) (*dkim.Signer, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "dkim.pem")
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0o600))
+	signer, err := dkim.New([]dkim.Key{{Domain: domain, Selector: "s1", KeyFile: keyFile}})
+	require.NoError(t, err)
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	require.NoError(t, err)
+	return signer, "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(pub)
+}
+
+func message(from, body string) []byte {
+	return []byte("From: " + from + "\r\nSubject: test\r\n\r\n" + body + "\r\n")
+}
+
+func TestVerify(t *testing.T) {
+	signer, record := newSigner(t, "example.com")
+	sign := func(raw []byte) []byte {
+		signed, _, err := signer.Sign(raw)
+		require.NoError(t, err)
+		return signed
+	}
+	resolver := fakeResolver{
+		"s1._domainkey.example.com": {record},
+		"example.com":               {"v=spf1 ip4:192.0.2.0/24 -all"},
+		"_dmarc.example.com":        {"v=DMARC1; p=reject"},
+		"_dmarc.strict.example.com": {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+	}
+	v := New(Options{AuthServID: "mx.example.net", SPF: true, DMARC: true, Resolver: resolver})
+	allowed := &Client{IP: net.ParseIP("192.0.2.10"), Helo: "app.example.com", MailFrom: "bounce@example.com"}
+	denied := &Client{IP: net.ParseIP("198.51.100.1"), Helo: "app.example.com", MailFrom: "bounce@example.com"}
+
+	tampered := sign(message("a@example.com", "hello"))
+	tampered = append(tampered[:len(tampered)-2], []byte(" tampered\r\n")...)
+
+	tests := []struct {
+		name     string
+		raw      []byte
+		client   *Client
+		failed   bool
+		expected []string
+	}{
+		{
+			name:     "dkim and spf pass",
+			raw:      sign(message("a@example.com", "hello")),
+			client:   allowed,
+			expected: []string{"dkim=pass header.d=example.com", "spf=pass", "dmarc=pass header.from=example.com"},
+		},
+		{
+			name:     "relaxed dkim alignment of subdomain",
+			raw:      sign(message("a@mail.example.com", "hello")),
+			client:   denied,
+			expected: []string{"dkim=pass", "spf=fail", "dmarc=pass header.from=mail.example.com"},
+		},
+		{
+			name:     "spf pass alone is aligned",
+			raw:      message("a@example.com", "hello"),
+			client:   allowed,
+			expected: []string{"dkim=none", "spf=pass", "dmarc=pass"},
+		},
+		{
+			name:     "tampered body",
+			raw:      tampered,
+			client:   denied,
+			failed:   true,
+			expected: []string{"dkim=fail", "spf=fail", "dmarc=fail"},
+		},
+		{
+			name:     "strict alignment",
+			raw:      sign(message("a@strict.example.com", "hello")),
+			client:   allowed,
+			failed:   true,
+			expected: []string{"dkim=pass header.d=example.com", "dmarc=fail", "header.from=strict.example.com"},
+		},
+		{
+			name:     "no dmarc policy",
+			raw:      message("a@example.org", "hello"),
+			client:   &Client{IP: net.ParseIP("198.51.100.1"), Helo: "app.example.org"},
+			expected: []string{"dkim=none", "spf=none", "smtp.mailfrom=postmaster@app.example.org", "dmarc=none"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := v.Verify(context.Background(), tt.raw, tt.client)
+			assert.Equal(t, tt.failed, result.Failed())
+
+			value := result.Value(v.AuthServID())
+			for _, expected := range tt.expected {
+				assert.Contains(t, value, expected)
+			}
+			id, _, err := authres.Parse(value)
+			require.NoError(t, err)
+			assert.Equal(t, "mx.example.net", id)
+		})
+	}
+}
+
+func TestFailedWithoutDMARC(t *testing.T) {
+	signer, record := newSigner(t, "example.com")
+	signed, _, err := signer.Sign(message("a@example.com", "hello"))
+	require.NoError(t, err)
+	tampered := append(signed[:len(signed)-2:len(signed)-2], []byte(" tampered\r\n")...)
+
+	v := New(Options{Resolver: fakeResolver{"s1._domainkey.example.com": {record}}})
+	client := &Client{IP: net.ParseIP("192.0.2.10"), Helo: "app.example.com"}
+
+	assert.False(t, v.Verify(context.Background(), signed, client).Failed())
+	assert.False(t, v.Verify(context.Background(), message("a@example.com", "unsigned"), client).Failed())
+	result := v.Verify(context.Background(), tampered, client)
+	assert.True(t, result.Failed())
+	assert.Nil(t, result.SPF)
+	assert.Nil(t, result.DMARC)
+}
@@ -0,0 +1,174 @@
+package systemtest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	awscreds "github.com/aws/aws-sdk-go-v2/credentials"
+	awss3 "github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	tc "github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+)
+
+var (
+	_ suite.SetupAllSuite    = (*S3SystemTestSuite)(nil)
+	_ suite.TearDownAllSuite = (*S3SystemTestSuite)(nil)
+)
+
+// S3SystemTestSuite suite.
+type S3SystemTestSuite struct {
+	suite.Suite
+	ctx        context.Context
+	localstack tc.Container
+}
+
+// In order for 'go test' to run this suite, we need to create
+// a normal test function and pass our suite to suite.Run.
+func TestS3SystemTestSuite(t *testing.T) {
+	t.Parallel()
+	suite.Run(t, new(S3SystemTestSuite))
+}
+
+func (su *S3SystemTestSuite) SetupSuite() {
+	var err error
+	ctx, cancel := context.WithCancel(context.Background())
+	su.T().Cleanup(cancel)
+	su.ctx = ctx
+
+	su.localstack, err = initFakeS3Container(su.ctx)
+	if err != nil {
+		su.T().Fatalf("Errors: %v ", err)
+	}
+}
+
+func (su *S3SystemTestSuite) TearDownSuite() {
+	localstack := su.localstack
+	tc.CleanupContainer(su.T(), localstack)
+	su.localstack = nil
+}
+
+func (su *S3SystemTestSuite) TestSmokeS3ArchivesRawMessageAndMetadata() {
+	port := DynamicPort()
+	proxyEndpoint := fmt.Sprintf("%s:%d", BindHost, port)
+	s3Port, err := su.localstack.MappedPort(su.ctx, "4566/tcp")
+	require.NoError(su.T(), err)
+	s3Endpoint := "http://" + net.JoinHostPort(BindHost, s3Port.Port())
+	bucket := fmt.Sprintf("archive-%d", time.Now().UnixMilli())
+
+	s3 := newS3Client(su.ctx, su.T(), s3Endpoint)
+	_, err = s3.CreateBucket(su.ctx, &awss3.CreateBucketInput{Bucket: aws.String(bucket)})
+	require.NoError(su.T(), err)
+
+	config := fmt.Sprintf(`
+smtpd-proxy:
+  listen: %s
+  ehlo: 127.0.0.1
+  username: user-s3@example.com
+  password: password
+  is_anon_auth_allowed: false
+  upstream-servers:
+  - type: s3
+    settings:
+      endpoint: %s
+      path_style: true
+      bucket: %s
+      key_template: "{{.Sender}}/{{.MessageID}}"
+      sse: AES256
+      aws_access_key_id: amz-key-1
+      aws_secret_access_key: amz-**-secret
+      region: us-east-1
+`, proxyEndpoint, s3Endpoint, bucket)
+	RunMainWithConfig(su.ctx, su.T(), config, port, func(t *testing.T, conn net.Conn) {
+		auth := smtp.PlainAuth("", "user-s3@example.com", "password", BindHost)
+		msg := strings.Join([]string{
+			"To: <discard-s3@tld.invalid>",
+			"From: <gotest-s3@esmtp.email>",
+			"Message-Id: <archive-test@esmtp.email>",
+			"Subject: Test E-mail! (S3)",
+			"",
+			"This is the email body (S3).",
+			"",
+		}, "\r\n")
+		err := smtp.SendMail(proxyEndpoint, auth, "sender-s3@example.org", []string{"recipient-s3@example.net"}, []byte(msg))
+		require.NoError(t, err)
+
+		key := "sender-s3@example.org/archive-test@esmtp.email"
+		raw := getS3Object(su.ctx, t, s3, bucket, key+".eml")
+		assert.Contains(t, raw, "This is the email body (S3).")
+
+		var meta map[string]any
+		require.NoError(t, json.Unmarshal([]byte(getS3Object(su.ctx, t, s3, bucket, key+".json")), &meta))
+		assert.Equal(t, "<archive-test@esmtp.email>", meta["message_id"])
+		assert.Equal(t, "sender-s3@example.org", meta["envelope_from"])
+		assert.Equal(t, []any{"recipient-s3@example.net"}, meta["envelope_to"])
+		assert.Equal(t, "Test E-mail! (S3)", meta["subject"])
+	})
+}
+
+func initFakeS3Container(ctx context.Context) (tc.Container, error) {
+	localstackReq := tc.ContainerRequest{
+		Image:        "localstack/localstack:2.3.2",
+		ExposedPorts: []string{"4566/tcp"},
+		Env: map[string]string{
+			"EAGER_SERVICE_LOADING": "1",
+			"SERVICES":              "s3",
+		},
+		HostConfigModifier: func(hc *container.HostConfig) {
+			hc.AutoRemove = true
+		},
+		WaitingFor: wait.ForListeningPort("4566/tcp"),
+	}
+	return tc.GenericContainer(ctx, tc.GenericContainerRequest{
+		ContainerRequest: localstackReq,
+		Started:          true,
+	})
+}
+
+func newS3Client(ctx context.Context, t *testing.T, endpoint string) *awss3.Client {
+	credentialsProvider := awscreds.NewStaticCredentialsProvider("amz-key-1", "amz-**-secret", "")
+	cfg, err := awsconfig.LoadDefaultConfig(ctx,
+		awsconfig.WithRegion("us-east-1"),
+		awsconfig.WithCredentialsProvider(credentialsProvider),
+	)
+	require.NoError(t, err)
+	return awss3.NewFromConfig(cfg, func(o *awss3.Options) {
+		o.BaseEndpoint = aws.String(endpoint)
+		o.UsePathStyle = true
+	})
+}
+
+func getS3Object(ctx context.Context, t *testing.T, s3 *awss3.Client, bucket, key string) string {
+	var body string
+	assert.Eventuallyf(t,
+		func() bool {
+			out, err := s3.GetObject(ctx, &awss3.GetObjectInput{Bucket: aws.String(bucket), Key: aws.String(key)})
+			if err != nil {
+				return false
+			}
+			defer out.Body.Close()
+			bytes, err := io.ReadAll(out.Body)
+			if err != nil {
+				return false
+			}
+			body = string(bytes)
+			return true
+		},
+		10*time.Second,
+		300*time.Millisecond,
+		"Failed to obtain s3 object %s", key,
+	)
+	return body
+}